@@ -7,6 +7,7 @@ import (
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
 	"io"
 	"unsafe"
 )
@@ -20,9 +21,9 @@ var (
 	errMissingRSDP           = &kernel.Error{Module: "acpi", Message: "could not locate ACPI RSDP"}
 	errTableChecksumMismatch = &kernel.Error{Module: "acpi", Message: "detected checksum mismatch while parsing ACPI table header"}
 
-	mapFn         = vmm.Map
-	identityMapFn = vmm.IdentityMapRegion
-	unmapFn       = vmm.Unmap
+	directMapFn       = vmm.DirectMapRegion
+	virtToPhysFn      = vmm.VirtToPhys
+	visitMemRegionsFn = multiboot.VisitMemRegions
 
 	// RDSP must be located in the physical memory region 0xe0000 to 0xfffff
 	rsdpLocationLow uintptr = 0xe0000
@@ -31,6 +32,9 @@ var (
 
 	rsdpSignature = [8]byte{'R', 'S', 'D', ' ', 'P', 'T', 'R', ' '}
 	fadtSignature = "FACP"
+
+	// activeTables points to the table map of the initialized ACPI driver.
+	activeTables map[string]*table.SDTHeader
 )
 
 type acpiDriver struct {
@@ -52,11 +56,32 @@ func (drv *acpiDriver) DriverInit(w io.Writer) *kernel.Error {
 		return err
 	}
 
+	if err := drv.relocateReclaimableTables(); err != nil {
+		return err
+	}
+
 	drv.printTableInfo(w)
 
+	if err := drv.parseNUMATopology(w); err != nil {
+		return err
+	}
+
+	if err := drv.registerPMTimer(); err != nil {
+		return err
+	}
+
+	activeTables = drv.tableMap
 	return nil
 }
 
+// LookupTable returns the header of the ACPI table with the specified
+// signature or nil if the table is not available. Drivers with a detection
+// order after device.DetectOrderBeforeACPI can use LookupTable to access the
+// tables that were discovered by the ACPI driver.
+func LookupTable(signature string) *table.SDTHeader {
+	return activeTables[signature]
+}
+
 // DriverName returns the name of this driver.
 func (*acpiDriver) DriverName() string {
 	return "ACPI"
@@ -100,12 +125,12 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 	switch drv.useXSDT {
 	case true:
 		sdtAddresses = make([]uintptr, payloadLen>>3)
-		for curPtr, i := drv.rsdtAddr+sizeofHeader, 0; i < len(sdtAddresses); curPtr, i = curPtr+8, i+1 {
+		for curPtr, i := uintptr(unsafe.Pointer(header))+sizeofHeader, 0; i < len(sdtAddresses); curPtr, i = curPtr+8, i+1 {
 			sdtAddresses[i] = uintptr(*(*uint64)(unsafe.Pointer(curPtr)))
 		}
 	default:
 		sdtAddresses = make([]uintptr, payloadLen>>2)
-		for curPtr, i := drv.rsdtAddr+sizeofHeader, 0; i < len(sdtAddresses); curPtr, i = curPtr+4, i+1 {
+		for curPtr, i := uintptr(unsafe.Pointer(header))+sizeofHeader, 0; i < len(sdtAddresses); curPtr, i = curPtr+4, i+1 {
 			sdtAddresses[i] = uintptr(*(*uint32)(unsafe.Pointer(curPtr)))
 		}
 	}
@@ -159,23 +184,64 @@ func (drv *acpiDriver) enumerateTables(w io.Writer) *kernel.Error {
 	return nil
 }
 
+// relocateReclaimableTables copies any tables that reside in ACPI-reclaimable
+// memory regions to the Go heap and updates the table map to point to the
+// copies. This allows the kernel to hand these regions over to the frame
+// allocator once hardware detection completes.
+func (drv *acpiDriver) relocateReclaimableTables() *kernel.Error {
+	var reclaimable []multiboot.MemoryMapEntry
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type == multiboot.MemAcpiReclaimable {
+			reclaimable = append(reclaimable, *region)
+		}
+		return true
+	})
+
+	if len(reclaimable) == 0 {
+		return nil
+	}
+
+	for name, header := range drv.tableMap {
+		tableAddr, err := virtToPhysFn(uintptr(unsafe.Pointer(header)))
+		if err != nil {
+			return err
+		}
+
+		tableEnd := uint64(tableAddr) + uint64(header.Length)
+		for _, region := range reclaimable {
+			if uint64(tableAddr) >= region.PhysAddress+region.Length || tableEnd <= region.PhysAddress {
+				continue
+			}
+
+			tableCopy := make([]byte, header.Length)
+			kernel.Memcopy(uintptr(unsafe.Pointer(header)), uintptr(unsafe.Pointer(&tableCopy[0])), uintptr(header.Length))
+			drv.tableMap[name] = (*table.SDTHeader)(unsafe.Pointer(&tableCopy[0]))
+			break
+		}
+	}
+
+	return nil
+}
+
 // mapACPITable attempts to map and parse the header for the ACPI table starting
-// at the given address. It then uses the length field for the header to expand
-// the mapping to cover the table contents and verifies the checksum before
-// returning a pointer to the table header.
+// at the given physical address. It then uses the length field for the header
+// to expand the mapping to cover the table contents and verifies the checksum
+// before returning a pointer to the table header. Tables are accessed via the
+// direct physical memory map.
 func mapACPITable(tableAddr uintptr) (header *table.SDTHeader, sizeofHeader uintptr, err *kernel.Error) {
 	var headerPage mm.Page
 
-	// Identity-map the table header so we can access its length field
+	// Map the table header so we can access its length field
 	sizeofHeader = unsafe.Sizeof(table.SDTHeader{})
-	if headerPage, err = identityMapFn(mm.FrameFromAddress(tableAddr), sizeofHeader, vmm.FlagPresent); err != nil {
+	if headerPage, err = directMapFn(mm.FrameFromAddress(tableAddr), sizeofHeader, vmm.FlagPresent); err != nil {
 		return nil, sizeofHeader, err
 	}
 
 	// Expand mapping to cover the table contents
 	headerPageAddr := headerPage.Address() + vmm.PageOffset(tableAddr)
 	header = (*table.SDTHeader)(unsafe.Pointer(headerPageAddr))
-	if _, err = identityMapFn(mm.FrameFromAddress(tableAddr), uintptr(header.Length), vmm.FlagPresent); err != nil {
+	if _, err = directMapFn(mm.FrameFromAddress(tableAddr), uintptr(header.Length), vmm.FlagPresent); err != nil {
 		return nil, sizeofHeader, err
 	}
 
@@ -197,23 +263,20 @@ func locateRSDT() (uintptr, bool, *kernel.Error) {
 		rsdp2 *table.ExtRSDPDescriptor
 	)
 
-	// Cleanup temporary identity mappings when the function returns
-	defer func() {
-		for curPage := mm.PageFromAddress(rsdpLocationLow); curPage <= mm.PageFromAddress(rsdpLocationHi); curPage++ {
-			unmapFn(curPage)
-		}
-	}()
-
-	// Setup temporary identity mapping so we can scan for the header
-	for curPage := mm.PageFromAddress(rsdpLocationLow); curPage <= mm.PageFromAddress(rsdpLocationHi); curPage++ {
-		if err := mapFn(curPage, mm.Frame(curPage), vmm.FlagPresent); err != nil {
-			return 0, false, err
-		}
+	// Add the region to the direct map so we can scan for the header
+	regionPage, err := directMapFn(mm.FrameFromAddress(rsdpLocationLow), rsdpLocationHi-rsdpLocationLow+1, vmm.FlagPresent)
+	if err != nil {
+		return 0, false, err
 	}
 
+	var (
+		regionLow = regionPage.Address() + vmm.PageOffset(rsdpLocationLow)
+		regionHi  = regionLow + rsdpLocationHi - rsdpLocationLow
+	)
+
 	// The RSDP should be aligned on a 16-byte boundary
 checkNextBlock:
-	for curPtr := rsdpLocationLow; curPtr < rsdpLocationHi; curPtr += rsdpAlignment {
+	for curPtr := regionLow; curPtr < regionHi; curPtr += rsdpAlignment {
 		rsdp = (*table.RSDPDescriptor)(unsafe.Pointer(curPtr))
 		for i, b := range rsdpSignature {
 			if rsdp.Signature[i] != b {
@@ -5,6 +5,8 @@ import (
 	"gopheros/kernel"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
+	"gopheros/multiboot"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -19,16 +21,16 @@ var (
 
 func TestProbe(t *testing.T) {
 	defer func(rsdpLow, rsdpHi, rsdpAlign uintptr) {
-		mapFn = vmm.Map
-		unmapFn = vmm.Unmap
+		directMapFn = vmm.DirectMapRegion
 		rsdpLocationLow = rsdpLow
 		rsdpLocationHi = rsdpHi
 		rsdpAlignment = rsdpAlign
 	}(rsdpLocationLow, rsdpLocationHi, rsdpAlignment)
 
 	t.Run("ACPI1", func(t *testing.T) {
-		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
-		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.Page(frame), nil
+		}
 
 		// Allocate space for 2 descriptors; leave the first entry
 		// blank to test that locateRSDT will jump over it and populate
@@ -67,8 +69,9 @@ func TestProbe(t *testing.T) {
 	})
 
 	t.Run("ACPI2+", func(t *testing.T) {
-		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
-		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.Page(frame), nil
+		}
 
 		// Allocate space for 2 descriptors; leave the first entry
 		// blank to test that locateRSDT will jump over it and populate
@@ -108,8 +111,9 @@ func TestProbe(t *testing.T) {
 	})
 
 	t.Run("RSDP ACPI1 checksum mismatch", func(t *testing.T) {
-		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
-		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.Page(frame), nil
+		}
 
 		sizeofRSDP := unsafe.Sizeof(table.RSDPDescriptor{})
 		buf := make([]byte, sizeofRSDP)
@@ -133,8 +137,9 @@ func TestProbe(t *testing.T) {
 	})
 
 	t.Run("RSDP ACPI2+ checksum mismatch", func(t *testing.T) {
-		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
-		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.Page(frame), nil
+		}
 
 		sizeofExtRSDP := unsafe.Sizeof(table.ExtRSDPDescriptor{})
 		buf := make([]byte, sizeofExtRSDP)
@@ -159,8 +164,9 @@ func TestProbe(t *testing.T) {
 
 	t.Run("error mapping rsdp memory block", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "vmm.Map failed"}
-		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
-		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		directMapFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
 
 		drv := probeForACPI()
 		if drv != nil {
@@ -171,12 +177,17 @@ func TestProbe(t *testing.T) {
 
 func TestDriverInit(t *testing.T) {
 	defer func() {
-		identityMapFn = vmm.IdentityMapRegion
+		directMapFn = vmm.DirectMapRegion
+		visitMemRegionsFn = multiboot.VisitMemRegions
+		registerClockSourceFn = time.RegisterClockSource
 	}()
 
+	visitMemRegionsFn = func(_ multiboot.MemRegionVisitor) {}
+	registerClockSourceFn = func(_ time.ClockSource) *kernel.Error { return nil }
+
 	t.Run("success", func(t *testing.T) {
 		rsdtAddr, _ := genTestRDST(t, acpiRev2Plus)
-		identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
 			return mm.Page(frame), nil
 		}
 
@@ -188,6 +199,17 @@ func TestDriverInit(t *testing.T) {
 		if err := drv.DriverInit(os.Stderr); err != nil {
 			t.Fatal(err)
 		}
+
+		defer func() { activeTables = nil }()
+		for signature, header := range drv.tableMap {
+			if got := LookupTable(signature); got != header {
+				t.Errorf("expected LookupTable(%q) to return the header for the %s table", signature, signature)
+			}
+		}
+
+		if got := LookupTable("XXXX"); got != nil {
+			t.Error("expected LookupTable to return nil for a missing table")
+		}
 	})
 
 	t.Run("map errors in enumerateTables", func(t *testing.T) {
@@ -229,18 +251,115 @@ func TestDriverInit(t *testing.T) {
 
 		// Test map errors for all map calls in enumerateTables
 		for specIndex, spec := range specs {
-			identityMapFn = spec
+			directMapFn = spec
 			if err := drv.DriverInit(os.Stderr); err != expErr {
 				t.Errorf("[spec %d]; expected to get an error\n", specIndex)
 			}
 		}
 	})
 
+	t.Run("clock source registration error", func(t *testing.T) {
+		rsdtAddr, _ := genTestRDST(t, acpiRev2Plus)
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return mm.Page(frame), nil
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "too many clock sources"}
+		registerClockSourceFn = func(_ time.ClockSource) *kernel.Error { return expErr }
+
+		drv := &acpiDriver{
+			rsdtAddr: rsdtAddr,
+			useXSDT:  true,
+		}
+
+		if err := drv.DriverInit(os.Stderr); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestRelocateReclaimableTables(t *testing.T) {
+	defer func() {
+		virtToPhysFn = vmm.VirtToPhys
+		visitMemRegionsFn = multiboot.VisitMemRegions
+	}()
+
+	var (
+		reclaimableBuf = make([]byte, 2*mm.PageSize)
+		otherBuf       = make([]byte, mm.PageSize)
+		reclaimable    = (*table.SDTHeader)(unsafe.Pointer(&reclaimableBuf[0]))
+		other          = (*table.SDTHeader)(unsafe.Pointer(&otherBuf[0]))
+	)
+
+	reclaimable.Signature = [4]byte{'S', 'R', 'A', 'T'}
+	reclaimable.Length = uint32(len(reclaimableBuf))
+	reclaimableBuf[len(reclaimableBuf)-1] = 0xaa
+	other.Signature = [4]byte{'F', 'A', 'C', 'P'}
+	other.Length = uint32(len(otherBuf))
+
+	// In the tests, virtual and physical addresses are identical
+	virtToPhysFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		return virtAddr, nil
+	}
+
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for _, region := range []multiboot.MemoryMapEntry{
+			{PhysAddress: uint64(uintptr(unsafe.Pointer(other))), Length: uint64(other.Length), Type: multiboot.MemNvs},
+			// Only the tail of the table overlaps the reclaimable region
+			{PhysAddress: uint64(uintptr(unsafe.Pointer(reclaimable)) + mm.PageSize), Length: uint64(mm.PageSize), Type: multiboot.MemAcpiReclaimable},
+		} {
+			if !visitor(&region) {
+				return
+			}
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		drv := &acpiDriver{
+			tableMap: map[string]*table.SDTHeader{"SRAT": reclaimable, "FACP": other},
+		}
+
+		if err := drv.relocateReclaimableTables(); err != nil {
+			t.Fatal(err)
+		}
+
+		if drv.tableMap["FACP"] != other {
+			t.Error("expected table outside the ACPI-reclaimable regions not to be relocated")
+		}
+
+		relocated := drv.tableMap["SRAT"]
+		if relocated == reclaimable {
+			t.Fatal("expected table in ACPI-reclaimable region to be relocated")
+		}
+
+		if relocated.Signature != reclaimable.Signature || relocated.Length != reclaimable.Length {
+			t.Fatalf("expected relocated table header to match the original; got %+v", *relocated)
+		}
+
+		if got := *(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(relocated)) + uintptr(relocated.Length) - 1)); got != 0xaa {
+			t.Fatalf("expected relocated table contents to match the original; got last byte 0x%x", got)
+		}
+	})
+
+	t.Run("translation error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "invalid mapping"}
+		virtToPhysFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		drv := &acpiDriver{
+			tableMap: map[string]*table.SDTHeader{"SRAT": reclaimable},
+		}
+
+		if err := drv.relocateReclaimableTables(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
 }
 
 func TestEnumerateTables(t *testing.T) {
 	defer func() {
-		identityMapFn = vmm.IdentityMapRegion
+		directMapFn = vmm.DirectMapRegion
 	}()
 
 	var expTables = []string{"SSDT", "APIC", "FACP", "DSDT"}
@@ -248,7 +367,7 @@ func TestEnumerateTables(t *testing.T) {
 	t.Run("ACPI1", func(t *testing.T) {
 		rsdtAddr, tableList := genTestRDST(t, acpiRev1)
 
-		identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
 			// The frame encodes the table index we need to lookup (see genTestRDST)
 			nextTableIndex := int(frame)
 			if nextTableIndex >= len(tableList) {
@@ -284,7 +403,7 @@ func TestEnumerateTables(t *testing.T) {
 
 	t.Run("ACPI2+", func(t *testing.T) {
 		rsdtAddr, _ := genTestRDST(t, acpiRev2Plus)
-		identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
 			return mm.Page(frame), nil
 		}
 
@@ -310,7 +429,7 @@ func TestEnumerateTables(t *testing.T) {
 
 	t.Run("checksum mismatch", func(t *testing.T) {
 		rsdtAddr, tableList := genTestRDST(t, acpiRev2Plus)
-		identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
 			return mm.Page(frame), nil
 		}
 
@@ -347,16 +466,16 @@ func TestEnumerateTables(t *testing.T) {
 
 func TestMapACPITableErrors(t *testing.T) {
 	defer func() {
-		identityMapFn = vmm.IdentityMapRegion
+		directMapFn = vmm.DirectMapRegion
 	}()
 
 	var (
 		callCount int
-		expErr    = &kernel.Error{Module: "test", Message: "identityMapRegion failed"}
+		expErr    = &kernel.Error{Module: "test", Message: "DirectMapRegion failed"}
 		header    table.SDTHeader
 	)
 
-	identityMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+	directMapFn = func(frame mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
 		callCount++
 		if callCount >= 2 {
 			return 0, expErr
@@ -410,7 +529,7 @@ func genTestRDST(t *testing.T, acpiVersion uint8) (rsdtAddr uintptr, tableList [
 			// Since the tests run in 64-bit mode these 32-bit addresses
 			// will be invalid and cause a page fault. So we cheat and
 			// encode the table index and page offset as the pointer.
-			// The test code will hook identityMapFn to reconstruct the
+			// The test code will hook directMapFn to reconstruct the
 			// correct pointer to the table contents.
 			offset := vmm.PageOffset(uintptr(unsafe.Pointer(dsdt)))
 			encodedTableLoc := (uintptr(dsdtIndex) << mm.PageShift) + offset
@@ -438,7 +557,7 @@ func genTestRDST(t *testing.T, acpiVersion uint8) (rsdtAddr uintptr, tableList [
 		// Since the tests run in 64-bit mode these 32-bit addresses
 		// will be invalid and cause a page fault. So we cheat and
 		// encode the table index and page offset as the pointer.
-		// The test code will hook identityMapFn to reconstruct the
+		// The test code will hook directMapFn to reconstruct the
 		// correct pointer to the table contents.
 		for index, tableHeader := range tableList {
 			offset := vmm.PageOffset(uintptr(unsafe.Pointer(tableHeader)))
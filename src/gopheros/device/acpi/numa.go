@@ -0,0 +1,137 @@
+package acpi
+
+import (
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"io"
+	"unsafe"
+)
+
+var (
+	sratSignature = "SRAT"
+	slitSignature = "SLIT"
+
+	// setNUMATopologyFn is used by tests to mock calls to the mm package
+	// and is automatically inlined by the compiler.
+	setNUMATopologyFn = mm.SetNUMATopology
+)
+
+// parseNUMATopology parses the SRAT and SLIT tables (if present) and registers
+// the detected NUMA topology with the mm package.
+func (drv *acpiDriver) parseNUMATopology(w io.Writer) *kernel.Error {
+	sratHeader := drv.tableMap[sratSignature]
+	if sratHeader == nil {
+		return nil
+	}
+
+	topology := mm.NUMATopology{
+		CPUNodes:  parseSRATCPUAffinity(sratHeader),
+		MemRanges: parseSRATMemAffinity(sratHeader),
+	}
+
+	if slitHeader := drv.tableMap[slitSignature]; slitHeader != nil {
+		topology.Distances = parseSLIT(slitHeader)
+	}
+
+	if err := setNUMATopologyFn(topology); err != nil {
+		return err
+	}
+
+	kfmt.Fprintf(w, "NUMA: detected %d node(s), %d memory range(s), %d CPU(s)\n",
+		mm.NodeCount(), len(topology.MemRanges), len(topology.CPUNodes),
+	)
+
+	return nil
+}
+
+// visitSRATEntries invokes visitor for each entry in the SRAT table.
+func visitSRATEntries(sratHeader *table.SDTHeader, visitor func(*table.SRATEntry)) {
+	var (
+		curPtr = uintptr(unsafe.Pointer(sratHeader)) + unsafe.Sizeof(table.SRAT{})
+		endPtr = uintptr(unsafe.Pointer(sratHeader)) + uintptr(sratHeader.Length)
+	)
+
+	for curPtr+unsafe.Sizeof(table.SRATEntry{}) <= endPtr {
+		entry := (*table.SRATEntry)(unsafe.Pointer(curPtr))
+		if entry.Length == 0 {
+			return
+		}
+
+		visitor(entry)
+		curPtr += uintptr(entry.Length)
+	}
+}
+
+// parseSRATCPUAffinity returns a map of APIC IDs to the nodes that contain
+// them for all enabled processor affinity entries in the SRAT table.
+func parseSRATCPUAffinity(sratHeader *table.SDTHeader) map[uint32]mm.NodeID {
+	cpuNodes := make(map[uint32]mm.NodeID)
+
+	visitSRATEntries(sratHeader, func(entry *table.SRATEntry) {
+		switch entry.Type {
+		case table.SRATEntryTypeProcessorAffinity:
+			cpu := (*table.SRATEntryProcessorAffinity)(unsafe.Pointer(entry))
+			if cpu.Flags&table.SRATAffinityEnabled != 0 {
+				cpuNodes[uint32(cpu.APICID)] = mm.NodeID(cpu.ProximityDomain())
+			}
+		case table.SRATEntryTypeX2APICAffinity:
+			cpu := (*table.SRATEntryX2APICAffinity)(unsafe.Pointer(entry))
+			if cpu.Flags&table.SRATAffinityEnabled != 0 {
+				cpuNodes[cpu.X2APICID] = mm.NodeID(cpu.ProximityDomain)
+			}
+		}
+	})
+
+	return cpuNodes
+}
+
+// parseSRATMemAffinity returns the list of enabled memory ranges in the SRAT
+// table and the nodes they are attached to.
+func parseSRATMemAffinity(sratHeader *table.SDTHeader) []mm.NodeMemRange {
+	var memRanges []mm.NodeMemRange
+
+	visitSRATEntries(sratHeader, func(entry *table.SRATEntry) {
+		if entry.Type != table.SRATEntryTypeMemAffinity {
+			return
+		}
+
+		mem := (*table.SRATEntryMemAffinity)(unsafe.Pointer(entry))
+		if mem.Flags&table.SRATAffinityEnabled == 0 || mem.RangeLength() == 0 {
+			return
+		}
+
+		memRanges = append(memRanges, mm.NodeMemRange{
+			Node:       mm.NodeID(mem.ProximityDomain()),
+			StartFrame: mm.FrameFromAddress(uintptr(mem.RangeBase())),
+			EndFrame:   mm.FrameFromAddress(uintptr(mem.RangeBase() + mem.RangeLength() - 1)),
+		})
+	})
+
+	return memRanges
+}
+
+// parseSLIT returns the locality distance matrix defined by the SLIT table.
+func parseSLIT(slitHeader *table.SDTHeader) [][]uint8 {
+	var (
+		slit          = (*table.SLIT)(unsafe.Pointer(slitHeader))
+		localityCount = uintptr(slit.LocalityCountLo)
+		matrixPtr     = uintptr(unsafe.Pointer(slitHeader)) + unsafe.Sizeof(table.SLIT{})
+	)
+
+	// Ignore malformed tables that cannot fit the distance matrix
+	if slit.LocalityCountHi != 0 || unsafe.Sizeof(table.SLIT{})+localityCount*localityCount > uintptr(slitHeader.Length) {
+		return nil
+	}
+
+	distances := make([][]uint8, localityCount)
+	for from := uintptr(0); from < localityCount; from++ {
+		distances[from] = make([]uint8, localityCount)
+		for to := uintptr(0); to < localityCount; to++ {
+			distances[from][to] = *(*uint8)(unsafe.Pointer(matrixPtr + from*localityCount + to))
+		}
+	}
+
+	return distances
+}
@@ -0,0 +1,183 @@
+package acpi
+
+import (
+	"bytes"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestParseNUMATopology(t *testing.T) {
+	defer func() {
+		setNUMATopologyFn = mm.SetNUMATopology
+	}()
+
+	// Emulate the tables generated by qemu when invoked with:
+	// -smp 3 -numa node,mem=512M,cpus=0 -numa node,mem=512M,cpus=1-2
+	// -numa dist,src=0,dst=1,val=21
+	srat, slit := genTestNUMATables(t)
+
+	var (
+		drv = &acpiDriver{
+			tableMap: map[string]*table.SDTHeader{
+				sratSignature: srat,
+				slitSignature: slit,
+			},
+		}
+		buf bytes.Buffer
+		got mm.NUMATopology
+	)
+
+	setNUMATopologyFn = func(topology mm.NUMATopology) *kernel.Error {
+		got = topology
+		return nil
+	}
+
+	if err := drv.parseNUMATopology(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := mm.NUMATopology{
+		MemRanges: []mm.NodeMemRange{
+			{Node: 0, StartFrame: 0, EndFrame: 0x9f},
+			{Node: 0, StartFrame: 0x100, EndFrame: 0x1ffff},
+			{Node: 1, StartFrame: 0x20000, EndFrame: 0x3ffff},
+		},
+		CPUNodes: map[uint32]mm.NodeID{
+			0: 0,
+			1: 1,
+			// x2APIC entry
+			0x102: 1,
+		},
+		Distances: [][]uint8{
+			{10, 21},
+			{21, 10},
+		},
+	}
+
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected parsed topology to be:\n%+v\ngot:\n%+v", exp, got)
+	}
+
+	if !strings.Contains(buf.String(), "3 memory range(s), 3 CPU(s)") {
+		t.Errorf("unexpected NUMA summary output: %q", buf.String())
+	}
+
+	t.Run("without SLIT", func(t *testing.T) {
+		delete(drv.tableMap, slitSignature)
+		if err := drv.parseNUMATopology(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Distances != nil {
+			t.Fatalf("expected no distance information; got %v", got.Distances)
+		}
+	})
+
+	t.Run("without SRAT", func(t *testing.T) {
+		got = mm.NUMATopology{}
+		delete(drv.tableMap, sratSignature)
+		if err := drv.parseNUMATopology(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if got.MemRanges != nil {
+			t.Fatal("expected mm.SetNUMATopology not to be called")
+		}
+	})
+
+	t.Run("mm error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+		drv.tableMap[sratSignature] = srat
+		setNUMATopologyFn = func(_ mm.NUMATopology) *kernel.Error { return expErr }
+
+		if err := drv.parseNUMATopology(&buf); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestParseSLITMalformed(t *testing.T) {
+	buf := make([]byte, unsafe.Sizeof(table.SLIT{})+2)
+	slit := (*table.SLIT)(unsafe.Pointer(&buf[0]))
+	slit.Length = uint32(len(buf))
+	slit.LocalityCountLo = 2
+
+	if got := parseSLIT(&slit.SDTHeader); got != nil {
+		t.Fatalf("expected malformed SLIT to be ignored; got %v", got)
+	}
+}
+
+func genTestNUMATables(t *testing.T) (*table.SDTHeader, *table.SDTHeader) {
+	var (
+		sizeofSRAT            = unsafe.Sizeof(table.SRAT{})
+		sizeofCPUEntry        = unsafe.Sizeof(table.SRATEntryProcessorAffinity{})
+		sizeofX2Entry         = unsafe.Sizeof(table.SRATEntryX2APICAffinity{})
+		sizeofMemEntry        = unsafe.Sizeof(table.SRATEntryMemAffinity{})
+		sizeofSLIT            = unsafe.Sizeof(table.SLIT{})
+		sratBuf               = make([]byte, sizeofSRAT+3*sizeofCPUEntry+sizeofX2Entry+5*sizeofMemEntry)
+		slitBuf               = make([]byte, sizeofSLIT+4)
+		srat                  = (*table.SRAT)(unsafe.Pointer(&sratBuf[0]))
+		slit                  = (*table.SLIT)(unsafe.Pointer(&slitBuf[0]))
+		offset                = sizeofSRAT
+		enabled        uint32 = table.SRATAffinityEnabled
+	)
+
+	srat.Signature = [4]byte{'S', 'R', 'A', 'T'}
+	srat.Length = uint32(len(sratBuf))
+
+	addCPU := func(apicID uint8, domain uint32, flags uint32) {
+		entry := (*table.SRATEntryProcessorAffinity)(unsafe.Pointer(&sratBuf[offset]))
+		entry.Type = table.SRATEntryTypeProcessorAffinity
+		entry.Length = uint8(sizeofCPUEntry)
+		entry.APICID = apicID
+		entry.ProximityDomainLo = uint8(domain)
+		entry.ProximityDomainHi = [3]uint8{uint8(domain >> 8), uint8(domain >> 16), uint8(domain >> 24)}
+		entry.Flags = flags
+		offset += sizeofCPUEntry
+	}
+
+	addMem := func(base, length uint64, domain uint32, flags uint32) {
+		entry := (*table.SRATEntryMemAffinity)(unsafe.Pointer(&sratBuf[offset]))
+		entry.Type = table.SRATEntryTypeMemAffinity
+		entry.Length = uint8(sizeofMemEntry)
+		entry.ProximityDomainLo, entry.ProximityDomainHi = uint16(domain), uint16(domain>>16)
+		entry.BaseAddressLo, entry.BaseAddressHi = uint32(base), uint32(base>>32)
+		entry.LengthLo, entry.LengthHi = uint32(length), uint32(length>>32)
+		entry.Flags = flags
+		offset += sizeofMemEntry
+	}
+
+	addCPU(0, 0, enabled)
+	addCPU(1, 1, enabled)
+	addCPU(2, 1, 0) // disabled
+
+	x2 := (*table.SRATEntryX2APICAffinity)(unsafe.Pointer(&sratBuf[offset]))
+	x2.Type = table.SRATEntryTypeX2APICAffinity
+	x2.Length = uint8(sizeofX2Entry)
+	x2.X2APICID = 0x102
+	x2.ProximityDomain = 1
+	x2.Flags = enabled
+	offset += sizeofX2Entry
+
+	addMem(0, 0xa0000, 0, enabled)
+	addMem(0x100000, 0x1ff00000, 0, enabled)
+	addMem(0x20000000, 0x20000000, 1, enabled)
+	addMem(0x40000000, 0x20000000, 1, 0) // disabled
+	addMem(0x60000000, 0, 1, enabled)    // empty range
+
+	if offset != uintptr(len(sratBuf)) {
+		t.Fatalf("SRAT buffer size mismatch: %d != %d", offset, len(sratBuf))
+	}
+
+	slit.Signature = [4]byte{'S', 'L', 'I', 'T'}
+	slit.Length = uint32(len(slitBuf))
+	slit.LocalityCountLo = 2
+	copy(slitBuf[sizeofSLIT:], []byte{10, 21, 21, 10})
+
+	return &srat.SDTHeader, &slit.SDTHeader
+}
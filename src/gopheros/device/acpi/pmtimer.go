@@ -0,0 +1,65 @@
+package acpi
+
+import (
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/time"
+	"unsafe"
+)
+
+const (
+	// pmTimerFrequency is the frequency of the ACPI power management timer.
+	pmTimerFrequency = uint64(3579545)
+
+	// The PM timer counter is either 24 or 32 bits wide. As the width is
+	// reported via a FADT flag, the driver always uses the low 24 bits
+	// which are valid for both counter widths.
+	pmTimerMask = uint64(0xffffff)
+
+	pmTimerRating = 200
+)
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// and time packages and are automatically inlined by the compiler.
+	portReadDwordFn       = cpu.PortReadDword
+	registerClockSourceFn = time.RegisterClockSource
+)
+
+// pmTimer is a clock source backed by the free-running counter of the ACPI
+// power management timer.
+type pmTimer struct {
+	port uint16
+}
+
+// Name returns the name of the clock source.
+func (*pmTimer) Name() string { return "acpi_pm" }
+
+// Rating returns the rating of the clock source.
+func (*pmTimer) Rating() int { return pmTimerRating }
+
+// Read returns the current counter value.
+func (t *pmTimer) Read() uint64 { return uint64(portReadDwordFn(t.port)) & pmTimerMask }
+
+// Mask returns the bitmask for the valid counter bits.
+func (*pmTimer) Mask() uint64 { return pmTimerMask }
+
+// Frequency returns the counter frequency.
+func (*pmTimer) Frequency() uint64 { return pmTimerFrequency }
+
+// registerPMTimer registers the PM timer as a clock source if it is described
+// by the FADT.
+func (drv *acpiDriver) registerPMTimer() *kernel.Error {
+	header := drv.tableMap[fadtSignature]
+	if header == nil {
+		return nil
+	}
+
+	fadt := (*table.FADT)(unsafe.Pointer(header))
+	if fadt.PMTimerBlock == 0 || fadt.PMTimerLength != 4 {
+		return nil
+	}
+
+	return registerClockSourceFn(&pmTimer{port: uint16(fadt.PMTimerBlock)})
+}
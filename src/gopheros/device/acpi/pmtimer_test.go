@@ -0,0 +1,106 @@
+package acpi
+
+import (
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/time"
+	"testing"
+	"unsafe"
+)
+
+func TestPMTimer(t *testing.T) {
+	defer func() {
+		portReadDwordFn = cpu.PortReadDword
+	}()
+
+	var readPort uint16
+	portReadDwordFn = func(port uint16) uint32 {
+		readPort = port
+		return 0xaa123456
+	}
+
+	timer := &pmTimer{port: 0x4008}
+	if got, exp := timer.Name(), "acpi_pm"; got != exp {
+		t.Errorf("expected Name() to return %q; got %q", exp, got)
+	}
+
+	if got, exp := timer.Rating(), pmTimerRating; got != exp {
+		t.Errorf("expected Rating() to return %d; got %d", exp, got)
+	}
+
+	if got, exp := timer.Frequency(), pmTimerFrequency; got != exp {
+		t.Errorf("expected Frequency() to return %d; got %d", exp, got)
+	}
+
+	if got, exp := timer.Mask(), pmTimerMask; got != exp {
+		t.Errorf("expected Mask() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := timer.Read(), uint64(0x123456); got != exp {
+		t.Errorf("expected Read() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if exp := uint16(0x4008); readPort != exp {
+		t.Errorf("expected Read() to access port 0x%x; got 0x%x", exp, readPort)
+	}
+}
+
+func TestRegisterPMTimer(t *testing.T) {
+	defer func() {
+		registerClockSourceFn = time.RegisterClockSource
+	}()
+
+	var registered time.ClockSource
+	registerClockSourceFn = func(source time.ClockSource) *kernel.Error {
+		registered = source
+		return nil
+	}
+
+	fadtBuf := make([]byte, unsafe.Sizeof(table.FADT{}))
+	fadt := (*table.FADT)(unsafe.Pointer(&fadtBuf[0]))
+	drv := &acpiDriver{
+		tableMap: map[string]*table.SDTHeader{
+			fadtSignature: &fadt.SDTHeader,
+		},
+	}
+
+	specs := []struct {
+		block  uint32
+		length uint8
+		expReg bool
+	}{
+		{0, 4, false},
+		{0x4008, 0, false},
+		{0x4008, 4, true},
+	}
+
+	for specIndex, spec := range specs {
+		registered = nil
+		fadt.PMTimerBlock = spec.block
+		fadt.PMTimerLength = spec.length
+
+		if err := drv.registerPMTimer(); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if gotReg := registered != nil; gotReg != spec.expReg {
+			t.Errorf("[spec %d] expected clock source registration to be %t; got %t", specIndex, spec.expReg, gotReg)
+			continue
+		}
+
+		if spec.expReg {
+			if got := registered.(*pmTimer).port; got != uint16(spec.block) {
+				t.Errorf("[spec %d] expected timer port to be 0x%x; got 0x%x", specIndex, spec.block, got)
+			}
+		}
+	}
+
+	t.Run("missing FADT", func(t *testing.T) {
+		registered = nil
+		if err := (&acpiDriver{}).registerPMTimer(); err != nil || registered != nil {
+			t.Fatal("expected registerPMTimer to skip registration when the FADT is missing")
+		}
+	})
+}
@@ -201,6 +201,8 @@ type MADT struct {
 // MADTEntryLocalAPIC describes a single physical processor and its local
 // interrupt controller.
 type MADTEntryLocalAPIC struct {
+	MADTEntry
+
 	ProcessorID uint8
 	APICID      uint8
 	Flags       uint32
@@ -208,6 +210,8 @@ type MADTEntryLocalAPIC struct {
 
 // MADTEntryIOAPIC describes an I/O Advanced Programmable Interrupt Controller.
 type MADTEntryIOAPIC struct {
+	MADTEntry
+
 	APICID   uint8
 	reserved uint8
 
@@ -223,6 +227,8 @@ type MADTEntryIOAPIC struct {
 // Override.  This mechanism is used to map IRQ sources to global system
 // interrupts.
 type MADTEntryInterruptSrcOverride struct {
+	MADTEntry
+
 	BusSrc          uint8
 	IRQSrc          uint8
 	GlobalInterrupt uint32
@@ -232,33 +238,234 @@ type MADTEntryInterruptSrcOverride struct {
 // MADTEntryNMI describes a non-maskable interrupt that we need to set up for
 // a single processor or all processors.
 type MADTEntryNMI struct {
+	MADTEntry
+
 	// Processor specifies the local APIC that we need to configure for
 	// this NMI. If set to 0xff we need to configure all processor APICs.
 	Processor uint8
 
-	Flags uint16
+	// The flags are split into two fields as they are not aligned to a
+	// 2-byte boundary.
+	FlagsLo uint8
+	FlagsHi uint8
 
 	// This value will be either 0 or 1 and specifies which entry in the
 	// local vector table of the processor's local APIC we need to setup.
 	LINT uint8
 }
 
+// NMIFlags returns the polarity and trigger mode flags for the NMI.
+func (e *MADTEntryNMI) NMIFlags() uint16 {
+	return uint16(e.FlagsLo) | uint16(e.FlagsHi)<<8
+}
+
+// MADTEntryLocalX2APIC describes a single physical processor whose local
+// interrupt controller operates in x2APIC mode.
+type MADTEntryLocalX2APIC struct {
+	MADTEntry
+
+	reserved    uint16
+	X2APICID    uint32
+	Flags       uint32
+	ProcessorID uint32
+}
+
 // MADTEntryType describes the type of a MADT record.
 type MADTEntryType uint8
 
 // The list of supported MADT entry types.
 const (
-	MADTEntryTypeLocalAPIC MADTEntryType = iota
-	MADTEntryTypeIOAPIC
-	MADTEntryTypeIntSrcOverride
-	MADTEntryTypeNMI
+	MADTEntryTypeLocalAPIC      MADTEntryType = 0
+	MADTEntryTypeIOAPIC         MADTEntryType = 1
+	MADTEntryTypeIntSrcOverride MADTEntryType = 2
+	MADTEntryTypeNMI            MADTEntryType = 4
+	MADTEntryTypeLocalX2APIC    MADTEntryType = 9
 )
 
+// The MADT interrupt source override and NMI flags encode the polarity and
+// trigger mode of the interrupt. A zero value selects the defaults for the
+// bus that raises the interrupt.
+const (
+	MADTPolarityMask       = 0x3
+	MADTPolarityActiveHigh = 0x1
+	MADTPolarityActiveLow  = 0x3
+	MADTTriggerMask        = 0xc
+	MADTTriggerEdge        = 0x4
+	MADTTriggerLevel       = 0xc
+)
+
+// MADTLocalAPICEnabled is set in the flags of a local APIC entry if the
+// processor can be used.
+const MADTLocalAPICEnabled = 1 << 0
+
 // MADTEntry describes a MADT table entry that follows the MADT definition. As
 // MADT entries are variable sized records, this struct works as a union. The
-// consumer of this struct must check the type value before accessing the union
-// values.
+// consumer of this struct must check the type value before casting it to the
+// appropriate entry type.
 type MADTEntry struct {
 	Type   MADTEntryType
 	Length uint8
 }
+
+// SRAT (System Resource Affinity Table) is an ACPI table that associates
+// processors and memory ranges with proximity domains (NUMA nodes). Following
+// the table header are a series of variable sized records (SRATEntry).
+type SRAT struct {
+	SDTHeader
+
+	reserved1 uint32
+	reserved2 [8]byte
+}
+
+// SRATEntryType describes the type of a SRAT record.
+type SRATEntryType uint8
+
+// The list of supported SRAT entry types.
+const (
+	SRATEntryTypeProcessorAffinity SRATEntryType = iota
+	SRATEntryTypeMemAffinity
+	SRATEntryTypeX2APICAffinity
+)
+
+// SRATEntry describes a SRAT table entry. As SRAT entries are variable sized
+// records, this struct works as a union. The consumer of this struct must
+// check the type value before casting it to the appropriate entry type.
+type SRATEntry struct {
+	Type   SRATEntryType
+	Length uint8
+}
+
+// SRATAffinityEnabled is set in the flags of a SRAT entry if the entry is
+// enabled.
+const SRATAffinityEnabled = 1 << 0
+
+// SRATEntryProcessorAffinity associates a processor (identified by its local
+// APIC ID) with a proximity domain.
+type SRATEntryProcessorAffinity struct {
+	SRATEntry
+
+	// Bits 0-7 of the proximity domain.
+	ProximityDomainLo uint8
+
+	APICID uint8
+	Flags  uint32
+
+	LocalSAPICEID uint8
+
+	// Bits 8-31 of the proximity domain.
+	ProximityDomainHi [3]uint8
+
+	ClockDomain uint32
+}
+
+// ProximityDomain returns the proximity domain for the processor.
+func (e *SRATEntryProcessorAffinity) ProximityDomain() uint32 {
+	return uint32(e.ProximityDomainLo) |
+		uint32(e.ProximityDomainHi[0])<<8 |
+		uint32(e.ProximityDomainHi[1])<<16 |
+		uint32(e.ProximityDomainHi[2])<<24
+}
+
+// SRATEntryMemAffinity associates a physical memory range with a proximity
+// domain.
+type SRATEntryMemAffinity struct {
+	SRATEntry
+
+	// The proximity domain is split into two fields as it is not aligned
+	// to a 4-byte boundary.
+	ProximityDomainLo uint16
+	ProximityDomainHi uint16
+
+	reserved1 uint16
+
+	BaseAddressLo uint32
+	BaseAddressHi uint32
+	LengthLo      uint32
+	LengthHi      uint32
+
+	reserved2 uint32
+	Flags     uint32
+	reserved3 uint64
+}
+
+// ProximityDomain returns the proximity domain for the memory range.
+func (e *SRATEntryMemAffinity) ProximityDomain() uint32 {
+	return uint32(e.ProximityDomainLo) | uint32(e.ProximityDomainHi)<<16
+}
+
+// RangeBase returns the physical address where the memory range begins.
+func (e *SRATEntryMemAffinity) RangeBase() uint64 {
+	return uint64(e.BaseAddressLo) | uint64(e.BaseAddressHi)<<32
+}
+
+// RangeLength returns the length of the memory range.
+func (e *SRATEntryMemAffinity) RangeLength() uint64 {
+	return uint64(e.LengthLo) | uint64(e.LengthHi)<<32
+}
+
+// SRATEntryX2APICAffinity associates a processor (identified by its x2APIC
+// ID) with a proximity domain.
+type SRATEntryX2APICAffinity struct {
+	SRATEntry
+
+	reserved1 uint16
+
+	ProximityDomain uint32
+	X2APICID        uint32
+	Flags           uint32
+	ClockDomain     uint32
+
+	reserved2 uint32
+}
+
+// SLIT (System Locality Information Table) is an ACPI table that provides the
+// relative distance between proximity domains (localities). Following the
+// table header is a LocalityCount * LocalityCount matrix of byte-sized
+// distances where entry (i, j) contains the distance from locality i to
+// locality j.
+type SLIT struct {
+	SDTHeader
+
+	// The locality count is a 64-bit value that is not aligned to an
+	// 8-byte boundary.
+	LocalityCountLo uint32
+	LocalityCountHi uint32
+}
+
+// HPET (High Precision Event Timer) is an ACPI table that describes the
+// location of the memory-mapped registers of an HPET block.
+type HPET struct {
+	SDTHeader
+
+	EventTimerBlockID uint32
+
+	// The base address is encoded as a GenericAddress. As its 64-bit
+	// address field is not aligned to an 8-byte boundary, the address is
+	// split into two fields.
+	BaseAddressSpace     AddressSpace
+	BaseAddressBitWidth  uint8
+	BaseAddressBitOffset uint8
+	reserved             uint8
+	BaseAddressLo        uint32
+	BaseAddressHi        uint32
+
+	HPETNumber uint8
+
+	// The minimum clock tick is a 16-bit value that is not aligned to a
+	// 2-byte boundary.
+	MinClockTickLo uint8
+	MinClockTickHi uint8
+
+	PageProtection uint8
+}
+
+// BaseAddress returns the physical address of the HPET registers.
+func (t *HPET) BaseAddress() uint64 {
+	return uint64(t.BaseAddressLo) | uint64(t.BaseAddressHi)<<32
+}
+
+// MinClockTick returns the minimum number of main counter ticks that should be
+// used when programming a comparator in periodic mode.
+func (t *HPET) MinClockTick() uint16 {
+	return uint16(t.MinClockTickLo) | uint16(t.MinClockTickHi)<<8
+}
@@ -0,0 +1,450 @@
+// Package apic provides drivers for the local APIC and the IO APICs that are
+// described by the ACPI MADT table. Once initialized, the driver replaces the
+// legacy 8259 PIC as the interrupt controller used by the irq package.
+package apic
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
+	"io"
+	"unsafe"
+)
+
+const (
+	// spuriousVector is raised by the local APIC when an interrupt is
+	// withdrawn before it gets delivered. It must not be acknowledged.
+	spuriousVector = gate.InterruptNumber(0xff)
+
+	// tlbShootdownVector is used by the IPIs that request TLB shootdowns.
+	tlbShootdownVector = gate.InterruptNumber(0xfe)
+
+	// timerVector is raised by the local APIC timer.
+	timerVector = gate.InterruptNumber(0xfd)
+
+	// maxLines is the number of IRQ lines that can be routed without
+	// overlapping with the vectors reserved by this driver.
+	maxLines = int(timerVector - irq.VectorBase)
+
+	// isaLines is the number of legacy ISA IRQs which are identity-mapped
+	// to GSIs unless an interrupt source override says otherwise.
+	isaLines = 16
+
+	// noGSI marks IRQ lines that are not connected to a GSI.
+	noGSI = ^uint32(0)
+
+	madtSignature = "APIC"
+)
+
+var (
+	errNoIOAPIC                  = &kernel.Error{Module: "apic", Message: "no IO APIC found in the MADT"}
+	errDestinationNotAddressable = &kernel.Error{Module: "apic", Message: "the local APIC ID of the bootstrap CPU cannot be used as an IO APIC destination"}
+	errNotInitialized            = &kernel.Error{Module: "apic", Message: "APIC driver has not been initialized"}
+	errUnknownCPU                = &kernel.Error{Module: "apic", Message: "local APIC ID of the current CPU is not listed in the MADT"}
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// vmm, gate, irq, time and acpi packages and are automatically inlined
+	// by the compiler.
+	hasFeatureFn              = features.Has
+	readMSRFn                 = cpu.ReadMSR
+	writeMSRFn                = cpu.WriteMSR
+	readTSCFn                 = cpu.ReadTSC
+	nanotimeFn                = time.Nanotime
+	registerEventDeviceFn     = time.RegisterEventDevice
+	mapMMIOFn                 = vmm.MapMMIO
+	handleInterruptFn         = gate.HandleInterrupt
+	setControllerFn           = irq.SetController
+	setTLBShootdownHandlersFn = vmm.SetTLBShootdownHandlers
+	lookupTableFn             = acpi.LookupTable
+
+	// activeDriver points to the initialized driver and is used by the
+	// interrupt handlers installed by the driver.
+	activeDriver *Driver
+)
+
+// lineRoute describes how an IRQ line is connected to an IO APIC.
+type lineRoute struct {
+	gsi uint32
+
+	// flags contains the MADT polarity and trigger mode flags for the
+	// line.
+	flags uint16
+}
+
+// Driver implements a device driver and an irq.Controller for the local APICs
+// and the system IO APICs. All IRQs are delivered to the bootstrap CPU.
+type Driver struct {
+	madt *table.MADT
+
+	lapic   localAPIC
+	ioapics []*ioAPIC
+
+	// timers contains the local APIC timer of each CPU indexed by its CPU
+	// index.
+	timers []lapicTimer
+
+	// nmis contains the MADT entries that describe how NMIs are connected
+	// to the local APICs.
+	nmis []*table.MADTEntryNMI
+
+	// bspIndex is the CPU index of the bootstrap CPU.
+	bspIndex uint32
+
+	// routes maps each IRQ line to the GSI it is connected to.
+	routes []lineRoute
+
+	// cpuAPICIDs contains the local APIC IDs of the enabled CPUs indexed
+	// by their CPU index.
+	cpuAPICIDs []uint32
+}
+
+// DriverName returns the name of this driver.
+func (drv *Driver) DriverName() string {
+	return "APIC"
+}
+
+// DriverVersion returns the version of this driver.
+func (drv *Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit enables the local APIC, programs the IO APIC redirection tables
+// and installs the driver as the active interrupt controller. All IRQ lines
+// are initially masked. The local APIC timer of the bootstrap CPU is
+// registered as a timer event device and gets calibrated once the monotonic
+// clock is started; the other CPUs set up their timers via InitCPU.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	var overrides []*table.MADTEntryInterruptSrcOverride
+
+	for _, entry := range drv.entries() {
+		switch entry.Type {
+		case table.MADTEntryTypeLocalAPIC:
+			if lapic := (*table.MADTEntryLocalAPIC)(unsafe.Pointer(entry)); lapic.Flags&table.MADTLocalAPICEnabled != 0 {
+				drv.cpuAPICIDs = append(drv.cpuAPICIDs, uint32(lapic.APICID))
+			}
+		case table.MADTEntryTypeLocalX2APIC:
+			if lapic := (*table.MADTEntryLocalX2APIC)(unsafe.Pointer(entry)); lapic.Flags&table.MADTLocalAPICEnabled != 0 {
+				drv.cpuAPICIDs = append(drv.cpuAPICIDs, lapic.X2APICID)
+			}
+		case table.MADTEntryTypeIOAPIC:
+			ioapicEntry := (*table.MADTEntryIOAPIC)(unsafe.Pointer(entry))
+			ioapic := new(ioAPIC)
+			if err := ioapic.init(uintptr(ioapicEntry.Address), ioapicEntry.SysInterruptBase); err != nil {
+				return err
+			}
+			drv.ioapics = append(drv.ioapics, ioapic)
+		case table.MADTEntryTypeIntSrcOverride:
+			overrides = append(overrides, (*table.MADTEntryInterruptSrcOverride)(unsafe.Pointer(entry)))
+		case table.MADTEntryTypeNMI:
+			drv.nmis = append(drv.nmis, (*table.MADTEntryNMI)(unsafe.Pointer(entry)))
+		}
+	}
+
+	if len(drv.ioapics) == 0 {
+		return errNoIOAPIC
+	}
+
+	if err := drv.lapic.init(uintptr(drv.madt.LocalControllerAddress)); err != nil {
+		return err
+	}
+
+	// Without interrupt remapping, the IO APICs can only deliver IRQs to
+	// local APICs with 8-bit IDs.
+	bspAPICID := drv.lapic.id()
+	if bspAPICID > redirMaxDestination {
+		return errDestinationNotAddressable
+	}
+	drv.setupNMIs(bspAPICID)
+
+	drv.setupRoutes(overrides)
+	for line, route := range drv.routes {
+		if route.gsi != noGSI {
+			drv.ioapicFor(route.gsi).setRedirection(route.gsi, drv.redirEntry(uint8(line), bspAPICID)|redirMasked)
+		}
+	}
+
+	// The MADT should list the bootstrap CPU but we cannot rely on it.
+	if _, found := drv.cpuIndex(bspAPICID); !found {
+		drv.cpuAPICIDs = append(drv.cpuAPICIDs, bspAPICID)
+	}
+	drv.bspIndex, _ = drv.cpuIndex(bspAPICID)
+
+	drv.timers = make([]lapicTimer, len(drv.cpuAPICIDs))
+	for cpuIndex := range drv.timers {
+		drv.timers[cpuIndex].lapic, drv.timers[cpuIndex].tscDeadline = &drv.lapic, hasFeatureFn(features.TSCDeadline)
+	}
+
+	activeDriver = drv
+	handleInterruptFn(spuriousVector, 0, spuriousHandler)
+	handleInterruptFn(tlbShootdownVector, 0, tlbShootdownHandler)
+	handleInterruptFn(timerVector, 0, lapicTimerHandler)
+	setTLBShootdownHandlersFn(drv.currentCPU, drv.sendTLBShootdownIPI)
+	registerEventDeviceFn(&drv.timers[drv.bspIndex])
+	setControllerFn(drv)
+
+	mode := "xAPIC"
+	if drv.lapic.x2APIC {
+		mode = "x2APIC"
+	}
+	kfmt.Fprintf(w, "%s mode, %d CPU(s), %d IO APIC(s), %d IRQ lines\n", mode, len(drv.cpuAPICIDs), len(drv.ioapics), len(drv.routes))
+
+	return nil
+}
+
+// InitCPU enables the local APIC of the CPU that executes the call and sets up
+// its timer using the calibration data of the bootstrap CPU timer. It must be
+// invoked by each application processor once it has been started and returns
+// the event device that delivers timer events to the calling CPU.
+func InitCPU() (time.EventDevice, *kernel.Error) {
+	drv := activeDriver
+	if drv == nil {
+		return nil, errNotInitialized
+	}
+
+	drv.lapic.enable()
+	apicID := drv.lapic.id()
+	cpuIndex, found := drv.cpuIndex(apicID)
+	if !found {
+		return nil, errUnknownCPU
+	}
+	drv.setupNMIs(apicID)
+
+	var (
+		timer    = &drv.timers[cpuIndex]
+		bspTimer = &drv.timers[drv.bspIndex]
+	)
+	timer.frequency, timer.tscFrequency = bspTimer.frequency, bspTimer.tscFrequency
+	timer.lapic.write(lapicRegTimerDivide, timerDivideBy16)
+	timer.Stop()
+
+	return timer, nil
+}
+
+// setupNMIs programs the local APIC of the CPU that executes the call to
+// deliver the NMIs described by the MADT.
+func (drv *Driver) setupNMIs(apicID uint32) {
+	for _, nmi := range drv.nmis {
+		if nmi.Processor == 0xff || uint32(nmi.Processor) == apicID {
+			drv.lapic.setupNMI(nmi.LINT, nmi.NMIFlags())
+		}
+	}
+}
+
+// entries returns the list of MADT entries.
+func (drv *Driver) entries() []*table.MADTEntry {
+	var (
+		list   []*table.MADTEntry
+		curPtr = uintptr(unsafe.Pointer(drv.madt)) + unsafe.Sizeof(table.MADT{})
+		endPtr = uintptr(unsafe.Pointer(drv.madt)) + uintptr(drv.madt.Length)
+	)
+
+	for curPtr+unsafe.Sizeof(table.MADTEntry{}) <= endPtr {
+		entry := (*table.MADTEntry)(unsafe.Pointer(curPtr))
+		if entry.Length == 0 {
+			break
+		}
+
+		list = append(list, entry)
+		curPtr += uintptr(entry.Length)
+	}
+
+	return list
+}
+
+// setupRoutes maps each IRQ line to a GSI. Lines are identity-mapped to GSIs
+// unless the MADT contains an interrupt source override for them. GSIs that
+// are the target of an override for a different ISA IRQ are not reachable via
+// their identity-mapped line.
+func (drv *Driver) setupRoutes(overrides []*table.MADTEntryInterruptSrcOverride) {
+	var gsiCount uint32
+	for _, ioapic := range drv.ioapics {
+		if end := ioapic.gsiBase + uint32(len(ioapic.redirs)); end > gsiCount {
+			gsiCount = end
+		}
+	}
+
+	lineCount := int(gsiCount)
+	if lineCount < isaLines {
+		lineCount = isaLines
+	} else if lineCount > maxLines {
+		lineCount = maxLines
+	}
+
+	drv.routes = make([]lineRoute, lineCount)
+	for line := range drv.routes {
+		drv.routes[line].gsi = uint32(line)
+	}
+
+	for _, override := range overrides {
+		if override.BusSrc != 0 || int(override.IRQSrc) >= isaLines {
+			continue
+		}
+
+		if int(override.GlobalInterrupt) < lineCount && override.GlobalInterrupt != uint32(override.IRQSrc) {
+			drv.routes[override.GlobalInterrupt].gsi = noGSI
+		}
+
+		drv.routes[override.IRQSrc] = lineRoute{gsi: override.GlobalInterrupt, flags: override.Flags}
+	}
+
+	for line, route := range drv.routes {
+		if route.gsi != noGSI && drv.ioapicFor(route.gsi) == nil {
+			drv.routes[line].gsi = noGSI
+		}
+	}
+}
+
+// redirEntry returns the IO APIC redirection entry that delivers the
+// interrupts for line to the local APIC with the specified ID.
+func (drv *Driver) redirEntry(line uint8, dstAPICID uint32) uint64 {
+	var (
+		flags = drv.routes[line].flags
+		entry = uint64(irq.VectorBase) + uint64(line) | uint64(dstAPICID)<<redirDestinationShift
+
+		// ISA IRQs default to active-high, edge-triggered interrupts
+		// while other buses default to active-low, level-triggered.
+		activeLow = int(line) >= isaLines
+		level     = int(line) >= isaLines
+	)
+
+	switch flags & table.MADTPolarityMask {
+	case table.MADTPolarityActiveHigh:
+		activeLow = false
+	case table.MADTPolarityActiveLow:
+		activeLow = true
+	}
+
+	switch flags & table.MADTTriggerMask {
+	case table.MADTTriggerEdge:
+		level = false
+	case table.MADTTriggerLevel:
+		level = true
+	}
+
+	if activeLow {
+		entry |= redirActiveLow
+	}
+	if level {
+		entry |= redirLevelTriggered
+	}
+
+	return entry
+}
+
+// ioapicFor returns the IO APIC that routes gsi or nil if no IO APIC handles it.
+func (drv *Driver) ioapicFor(gsi uint32) *ioAPIC {
+	for _, ioapic := range drv.ioapics {
+		if ioapic.handles(gsi) {
+			return ioapic
+		}
+	}
+
+	return nil
+}
+
+// Lines returns the number of IRQ lines that can be routed via the IO APICs.
+func (drv *Driver) Lines() int {
+	return len(drv.routes)
+}
+
+// Mask prevents the IO APICs from raising interrupts for line.
+func (drv *Driver) Mask(line uint8) {
+	if gsi := drv.routes[line].gsi; gsi != noGSI {
+		ioapic := drv.ioapicFor(gsi)
+		ioapic.setRedirection(gsi, ioapic.redirection(gsi)|redirMasked)
+	}
+}
+
+// Unmask allows the IO APICs to raise interrupts for line.
+func (drv *Driver) Unmask(line uint8) {
+	if gsi := drv.routes[line].gsi; gsi != noGSI {
+		ioapic := drv.ioapicFor(gsi)
+		ioapic.setRedirection(gsi, ioapic.redirection(gsi)&^redirMasked)
+	}
+}
+
+// EOI signals the end of the interrupt raised for line to the local APIC.
+func (drv *Driver) EOI(_ uint8) {
+	drv.lapic.eoi()
+}
+
+// Spurious always returns false as the local APIC delivers spurious
+// interrupts to a dedicated vector.
+func (drv *Driver) Spurious(_ uint8) bool {
+	return false
+}
+
+// LineForGSI returns the IRQ line that gsi is routed to.
+func (drv *Driver) LineForGSI(gsi uint32) (uint8, bool) {
+	for line, route := range drv.routes {
+		if route.gsi == gsi {
+			return uint8(line), true
+		}
+	}
+
+	return 0, false
+}
+
+// currentCPU returns the index of the CPU that executes the call.
+func (drv *Driver) currentCPU() uint32 {
+	cpuIndex, _ := drv.cpuIndex(drv.lapic.id())
+	return cpuIndex
+}
+
+// cpuIndex returns the index of the CPU whose local APIC has the specified ID.
+// It returns false if the MADT does not list a CPU with that ID.
+func (drv *Driver) cpuIndex(apicID uint32) (uint32, bool) {
+	for cpuIndex, id := range drv.cpuAPICIDs {
+		if id == apicID {
+			return uint32(cpuIndex), true
+		}
+	}
+
+	return 0, false
+}
+
+// sendTLBShootdownIPI sends a TLB shootdown IPI to the specified CPU.
+func (drv *Driver) sendTLBShootdownIPI(cpuIndex uint32) {
+	if int(cpuIndex) < len(drv.cpuAPICIDs) {
+		drv.lapic.sendIPI(drv.cpuAPICIDs[cpuIndex], uint8(tlbShootdownVector))
+	}
+}
+
+// spuriousHandler is invoked for spurious local APIC interrupts which must
+// not be acknowledged.
+func spuriousHandler(_ *gate.Registers) {}
+
+// tlbShootdownHandler processes the TLB shootdown requests for the CPU that
+// received the IPI.
+func tlbShootdownHandler(_ *gate.Registers) {
+	vmm.HandleTLBShootdown()
+	activeDriver.lapic.eoi()
+}
+
+func probeForAPIC() device.Driver {
+	if !hasFeatureFn(features.APIC) {
+		return nil
+	}
+
+	header := lookupTableFn(madtSignature)
+	if header == nil {
+		return nil
+	}
+
+	return &Driver{madt: (*table.MADT)(unsafe.Pointer(header))}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderACPI,
+		Probe: probeForAPIC,
+	})
+}
@@ -0,0 +1,487 @@
+package apic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+const (
+	testLAPICAddr  = uintptr(0xfee00000)
+	testIOAPICAddr = uintptr(0xfec00000)
+)
+
+// testEnv mocks the hardware that is accessed by the driver.
+type testEnv struct {
+	lapicRegs  []byte
+	ioapicRegs []byte
+	msrs       map[uint32]uint64
+	features   features.Set
+
+	// apicBaseWrites records the values written to IA32_APIC_BASE.
+	apicBaseWrites []uint64
+
+	gateHandlers map[gate.InterruptNumber]bool
+	controller   irq.Controller
+	eventDevice  time.EventDevice
+	currentCPU   func() uint32
+	sendIPI      func(uint32)
+}
+
+func setupTestEnv(t *testing.T) *testEnv {
+	env := &testEnv{
+		lapicRegs:    make([]byte, 4096),
+		ioapicRegs:   make([]byte, 0x20),
+		msrs:         make(map[uint32]uint64),
+		gateHandlers: make(map[gate.InterruptNumber]bool),
+	}
+
+	// The IO APIC supports 24 redirection entries
+	*(*uint32)(unsafe.Pointer(&env.ioapicRegs[ioapicRegWindow])) = 0x00170011
+
+	hasFeatureFn = func(f features.Feature) bool { return f == features.APIC || env.features.Has(f) }
+	readMSRFn = func(reg uint32) uint64 { return env.msrs[reg] }
+	writeMSRFn = func(reg uint32, val uint64) {
+		if reg == msrAPICBase {
+			env.apicBaseWrites = append(env.apicBaseWrites, val)
+		}
+		env.msrs[reg] = val
+	}
+	mapMMIOFn = func(physAddr, _ uintptr, mode vmm.CacheMode) (uintptr, *kernel.Error) {
+		if mode != vmm.CacheModeUncached {
+			t.Errorf("expected registers at 0x%x to be mapped as uncached", physAddr)
+		}
+
+		switch physAddr {
+		case testLAPICAddr:
+			return uintptr(unsafe.Pointer(&env.lapicRegs[0])), nil
+		case testIOAPICAddr:
+			return uintptr(unsafe.Pointer(&env.ioapicRegs[0])), nil
+		}
+
+		t.Fatalf("unexpected MMIO mapping request for 0x%x", physAddr)
+		return 0, nil
+	}
+	handleInterruptFn = func(intNumber gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {
+		env.gateHandlers[intNumber] = true
+	}
+	setControllerFn = func(c irq.Controller) { env.controller = c }
+	registerEventDeviceFn = func(dev time.EventDevice) { env.eventDevice = dev }
+	setTLBShootdownHandlersFn = func(currentCPU func() uint32, sendIPI func(uint32)) {
+		env.currentCPU, env.sendIPI = currentCPU, sendIPI
+	}
+
+	return env
+}
+
+func (env *testEnv) lapicReg(reg uint32) uint32 {
+	return *(*uint32)(unsafe.Pointer(&env.lapicRegs[reg]))
+}
+
+func resetMocks() {
+	hasFeatureFn = features.Has
+	readMSRFn = cpu.ReadMSR
+	writeMSRFn = cpu.WriteMSR
+	mapMMIOFn = vmm.MapMMIO
+	handleInterruptFn = gate.HandleInterrupt
+	setControllerFn = irq.SetController
+	setTLBShootdownHandlersFn = vmm.SetTLBShootdownHandlers
+	registerEventDeviceFn = time.RegisterEventDevice
+	readTSCFn = cpu.ReadTSC
+	nanotimeFn = time.Nanotime
+	lookupTableFn = acpi.LookupTable
+	activeDriver = nil
+}
+
+// loadMADT loads the MADT dump from a VirtualBox VM and appends any extra
+// entries to it.
+func loadMADT(t *testing.T, extraEntries ...[]byte) *table.MADT {
+	_, f, _, _ := runtime.Caller(0)
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(f), "../acpi/table/tabletest/APIC.aml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append(data, bytes.Join(extraEntries, nil)...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)))
+
+	return (*table.MADT)(unsafe.Pointer(&data[0]))
+}
+
+func TestDriverInit(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+
+	// Local APIC NMI on LINT1 for all CPUs (active-low, level-triggered)
+	nmiEntry := []byte{byte(table.MADTEntryTypeNMI), 6, 0xff, 0x0f, 0x00, 1}
+	drv := &Driver{madt: loadMADT(t, nmiEntry)}
+
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := "xAPIC mode, 1 CPU(s), 1 IO APIC(s), 24 IRQ lines\n"; buf.String() != exp {
+		t.Fatalf("expected driver output to be %q; got %q", exp, buf.String())
+	}
+
+	if env.msrs[msrAPICBase] != apicBaseEnable {
+		t.Errorf("expected the local APIC to be enabled in xAPIC mode; IA32_APIC_BASE: 0x%x", env.msrs[msrAPICBase])
+	}
+
+	if exp := svrEnable | uint32(spuriousVector); env.lapicReg(lapicRegSVR) != exp {
+		t.Errorf("expected SVR to be 0x%x; got 0x%x", exp, env.lapicReg(lapicRegSVR))
+	}
+
+	if exp := lvtDeliveryNMI | lvtActiveLow | lvtLevelTriggered; env.lapicReg(lapicRegLVTLINT0+0x10) != exp {
+		t.Errorf("expected LINT1 LVT entry to be 0x%x; got 0x%x", exp, env.lapicReg(lapicRegLVTLINT0+0x10))
+	}
+
+	if !env.gateHandlers[spuriousVector] || !env.gateHandlers[tlbShootdownVector] || !env.gateHandlers[timerVector] {
+		t.Errorf("expected handlers for the spurious, TLB shootdown and timer vectors to be installed; got %v", env.gateHandlers)
+	}
+
+	if len(drv.timers) != 1 || env.eventDevice != &drv.timers[0] || drv.timers[0].lapic != &drv.lapic || drv.timers[0].tscDeadline {
+		t.Error("expected the local APIC timer to be registered as an event device without TSC-deadline support")
+	}
+
+	if env.controller != drv || activeDriver != drv {
+		t.Fatal("expected driver to be installed as the interrupt controller")
+	}
+
+	ioapic := drv.ioapics[0]
+	specs := []struct {
+		gsi      uint32
+		expEntry uint64
+	}{
+		// IRQ0 is overridden to GSI 2 (ISA defaults: active-high, edge)
+		{2, 0x20 | redirMasked},
+		{1, 0x21 | redirMasked},
+		// IRQ9 is overridden to GSI 9 (active-high, level)
+		{9, 0x29 | redirLevelTriggered | redirMasked},
+		// PCI defaults: active-low, level
+		{20, 0x34 | redirActiveLow | redirLevelTriggered | redirMasked},
+	}
+
+	for specIndex, spec := range specs {
+		if got := ioapic.redirection(spec.gsi); got != spec.expEntry {
+			t.Errorf("[spec %d] expected redirection entry for GSI %d to be 0x%x; got 0x%x", specIndex, spec.gsi, spec.expEntry, got)
+		}
+	}
+
+	// The last register write unmasks the entry for GSI 2
+	drv.Unmask(0)
+	if exp := uint64(0x20); ioapic.redirection(2) != exp {
+		t.Errorf("expected IRQ line 0 to be unmasked; got redirection entry 0x%x", ioapic.redirection(2))
+	}
+	if gotReg := *(*uint32)(unsafe.Pointer(&env.ioapicRegs[ioapicRegSelect])); gotReg != ioapicRegRedirTable+2<<1 {
+		t.Errorf("expected register 0x%x to be selected; got 0x%x", ioapicRegRedirTable+2<<1, gotReg)
+	}
+	if gotVal := *(*uint32)(unsafe.Pointer(&env.ioapicRegs[ioapicRegWindow])); gotVal != 0x20 {
+		t.Errorf("expected 0x20 to be written to the IO APIC window; got 0x%x", gotVal)
+	}
+
+	drv.Mask(0)
+	if ioapic.redirection(2)&redirMasked == 0 {
+		t.Error("expected IRQ line 0 to be masked")
+	}
+
+	// Line 2 is not connected as GSI 2 is used by IRQ0
+	drv.Unmask(2)
+	drv.Mask(2)
+	if drv.routes[2].gsi != noGSI || ioapic.redirection(2)&redirMasked == 0 {
+		t.Error("expected IRQ line 2 to be disconnected")
+	}
+
+	if drv.Spurious(7) {
+		t.Error("expected Spurious to return false")
+	}
+
+	*(*uint32)(unsafe.Pointer(&env.lapicRegs[lapicRegEOI])) = 0xbadf00d
+	drv.EOI(0)
+	if env.lapicReg(lapicRegEOI) != 0 {
+		t.Error("expected EOI register to be written")
+	}
+
+	if drv.DriverName() == "" {
+		t.Fatal("DriverName() returned an empty string")
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major+minor+patch == 0 {
+		t.Fatal("DriverVersion() returned an invalid version number")
+	}
+}
+
+func TestDriverInitX2APIC(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+	env.features = 1 << features.X2APIC
+
+	// A second CPU using x2APIC IDs
+	x2apicEntry := []byte{byte(table.MADTEntryTypeLocalX2APIC), 16, 0, 0, 0x42, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}
+	drv := &Driver{madt: loadMADT(t, x2apicEntry)}
+
+	if err := drv.DriverInit(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local APIC must be enabled in xAPIC mode before switching it to
+	// x2APIC mode.
+	if got := env.apicBaseWrites; len(got) != 2 || got[0] != apicBaseEnable || got[1] != apicBaseEnable|apicBaseX2APICOn {
+		t.Fatalf("expected IA32_APIC_BASE to be set to 0x%x and then to 0x%x; got %x", apicBaseEnable, apicBaseEnable|apicBaseX2APICOn, got)
+	}
+
+	if exp := uint64(svrEnable | uint32(spuriousVector)); env.msrs[msrX2APICRegsBase+lapicRegSVR>>4] != exp {
+		t.Fatalf("expected SVR MSR to be 0x%x; got 0x%x", exp, env.msrs[msrX2APICRegsBase+lapicRegSVR>>4])
+	}
+
+	if len(drv.cpuAPICIDs) != 2 || drv.cpuAPICIDs[1] != 0x42 {
+		t.Fatalf("expected CPU APIC IDs to be [0 0x42]; got %v", drv.cpuAPICIDs)
+	}
+
+	// Simulate execution on the second CPU
+	env.msrs[msrX2APICRegsBase+lapicRegID>>4] = 0x42
+	if got := env.currentCPU(); got != 1 {
+		t.Fatalf("expected current CPU index to be 1; got %d", got)
+	}
+
+	env.sendIPI(0)
+	if exp := uint64(tlbShootdownVector); env.msrs[msrX2APICRegsBase+lapicRegICRLo>>4] != exp {
+		t.Fatalf("expected ICR MSR to be 0x%x; got 0x%x", exp, env.msrs[msrX2APICRegsBase+lapicRegICRLo>>4])
+	}
+
+	env.msrs[msrX2APICRegsBase+lapicRegEOI>>4] = 0xbadf00d
+	tlbShootdownHandler(nil)
+	if env.msrs[msrX2APICRegsBase+lapicRegEOI>>4] != 0 {
+		t.Fatal("expected TLB shootdown handler to acknowledge the IPI")
+	}
+
+	t.Run("BSP APIC ID not addressable by the IO APIC", func(t *testing.T) {
+		env := setupTestEnv(t)
+		env.features = 1 << features.X2APIC
+		env.msrs[msrX2APICRegsBase+lapicRegID>>4] = 0x100
+
+		if err := (&Driver{madt: loadMADT(t)}).DriverInit(ioutil.Discard); err != errDestinationNotAddressable {
+			t.Fatalf("expected error: %v; got %v", errDestinationNotAddressable, err)
+		}
+	})
+}
+
+func TestInitCPU(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+	env.features = 1<<features.X2APIC | 1<<features.TSCDeadline
+
+	if _, err := InitCPU(); err != errNotInitialized {
+		t.Fatalf("expected error: %v; got %v", errNotInitialized, err)
+	}
+
+	// A second CPU using x2APIC IDs and an NMI on LINT1 for all CPUs
+	x2apicEntry := []byte{byte(table.MADTEntryTypeLocalX2APIC), 16, 0, 0, 0x42, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}
+	nmiEntry := []byte{byte(table.MADTEntryTypeNMI), 6, 0xff, 0x00, 0x00, 1}
+	drv := &Driver{madt: loadMADT(t, x2apicEntry, nmiEntry)}
+	if err := drv.DriverInit(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drv.timers) != 2 || env.eventDevice != &drv.timers[0] {
+		t.Fatalf("expected a timer for each CPU and the BSP timer to be registered as an event device")
+	}
+	drv.timers[0].frequency, drv.timers[0].tscFrequency = 1000, 2000
+
+	// Simulate execution on the second CPU after the CPU reset
+	env.msrs = map[uint32]uint64{msrX2APICRegsBase + lapicRegID>>4: 0x42}
+	dev, err := InitCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timer := &drv.timers[1]
+	if dev != timer || timer.frequency != 1000 || timer.tscFrequency != 2000 || !timer.tscDeadline {
+		t.Fatalf("expected the timer of the second CPU to inherit the BSP calibration data; got %+v", timer)
+	}
+
+	if exp := apicBaseEnable | apicBaseX2APICOn; env.msrs[msrAPICBase] != exp {
+		t.Errorf("expected the local APIC to be enabled in x2APIC mode; IA32_APIC_BASE: 0x%x", env.msrs[msrAPICBase])
+	}
+
+	if exp := uint64(lvtDeliveryNMI); env.msrs[msrX2APICRegsBase+(lapicRegLVTLINT0+0x10)>>4] != exp {
+		t.Errorf("expected LINT1 LVT entry to be 0x%x; got 0x%x", exp, env.msrs[msrX2APICRegsBase+(lapicRegLVTLINT0+0x10)>>4])
+	}
+
+	if exp := uint64(lvtMasked | uint32(timerVector)); env.msrs[msrX2APICRegsBase+lapicRegLVTTimer>>4] != exp {
+		t.Errorf("expected timer LVT entry to be 0x%x; got 0x%x", exp, env.msrs[msrX2APICRegsBase+lapicRegLVTTimer>>4])
+	}
+
+	// Timer interrupts are dispatched to the timer of the current CPU
+	var calls [2]int
+	drv.timers[0].fn = func() { calls[0]++ }
+	drv.timers[1].fn = func() { calls[1]++ }
+	lapicTimerHandler(nil)
+	if calls != [2]int{0, 1} {
+		t.Errorf("expected the timer interrupt to be dispatched to the second CPU timer; got calls %v", calls)
+	}
+
+	t.Run("unknown CPU", func(t *testing.T) {
+		env.msrs[msrX2APICRegsBase+lapicRegID>>4] = 0x7
+		if _, err := InitCPU(); err != errUnknownCPU {
+			t.Fatalf("expected error: %v; got %v", errUnknownCPU, err)
+		}
+	})
+}
+
+func TestDriverInitErrors(t *testing.T) {
+	defer resetMocks()
+
+	expErr := &kernel.Error{Module: "test", Message: "map failed"}
+
+	t.Run("no IO APIC", func(t *testing.T) {
+		setupTestEnv(t)
+		madt := loadMADT(t)
+		madt.Length = uint32(unsafe.Sizeof(table.MADT{}))
+
+		if err := (&Driver{madt: madt}).DriverInit(ioutil.Discard); err != errNoIOAPIC {
+			t.Fatalf("expected error: %v; got %v", errNoIOAPIC, err)
+		}
+	})
+
+	for _, failAddr := range []uintptr{testIOAPICAddr, testLAPICAddr} {
+		setupTestEnv(t)
+		origMapMMIO := mapMMIOFn
+		mapMMIOFn = func(physAddr, size uintptr, mode vmm.CacheMode) (uintptr, *kernel.Error) {
+			if physAddr == failAddr {
+				return 0, expErr
+			}
+			return origMapMMIO(physAddr, size, mode)
+		}
+
+		if err := (&Driver{madt: loadMADT(t)}).DriverInit(ioutil.Discard); err != expErr {
+			t.Errorf("expected error: %v when mapping 0x%x fails; got %v", expErr, failAddr, err)
+		}
+	}
+}
+
+func TestSendIPIXAPIC(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+
+	drv := &Driver{
+		lapic:      localAPIC{base: uintptr(unsafe.Pointer(&env.lapicRegs[0]))},
+		cpuAPICIDs: []uint32{0, 3},
+	}
+
+	*(*uint32)(unsafe.Pointer(&env.lapicRegs[lapicRegID])) = 3 << 24
+	if got := drv.currentCPU(); got != 1 {
+		t.Fatalf("expected current CPU index to be 1; got %d", got)
+	}
+
+	*(*uint32)(unsafe.Pointer(&env.lapicRegs[lapicRegID])) = 7 << 24
+	if got := drv.currentCPU(); got != 0 {
+		t.Fatalf("expected unknown APIC IDs to map to CPU index 0; got %d", got)
+	}
+
+	drv.sendTLBShootdownIPI(1)
+	if env.lapicReg(lapicRegICRHi) != 3<<24 || env.lapicReg(lapicRegICRLo) != uint32(tlbShootdownVector) {
+		t.Fatalf("unexpected ICR contents: 0x%x 0x%x", env.lapicReg(lapicRegICRHi), env.lapicReg(lapicRegICRLo))
+	}
+
+	// IPIs to unknown CPUs are ignored
+	*(*uint32)(unsafe.Pointer(&env.lapicRegs[lapicRegICRLo])) = 0
+	drv.sendTLBShootdownIPI(2)
+	if env.lapicReg(lapicRegICRLo) != 0 {
+		t.Fatal("expected no IPI to be sent")
+	}
+}
+
+func TestSetupRoutes(t *testing.T) {
+	drv := &Driver{
+		ioapics: []*ioAPIC{
+			{gsiBase: 0, redirs: make([]uint64, 8)},
+		},
+	}
+
+	drv.setupRoutes([]*table.MADTEntryInterruptSrcOverride{
+		// Ignored: not an ISA bus override
+		{BusSrc: 1, IRQSrc: 3, GlobalInterrupt: 5},
+		// Ignored: not an ISA IRQ
+		{BusSrc: 0, IRQSrc: 20, GlobalInterrupt: 5},
+		{BusSrc: 0, IRQSrc: 12, GlobalInterrupt: 4},
+	})
+
+	if drv.Lines() != isaLines {
+		t.Fatalf("expected %d IRQ lines; got %d", isaLines, drv.Lines())
+	}
+
+	for line, expGSI := range map[int]uint32{
+		3:  3,
+		4:  noGSI,
+		5:  5,
+		8:  noGSI,
+		12: 4,
+	} {
+		if got := drv.routes[line].gsi; got != expGSI {
+			t.Errorf("expected line %d to be routed to GSI 0x%x; got 0x%x", line, expGSI, got)
+		}
+	}
+
+	for gsi, expLine := range map[uint32]uint8{3: 3, 4: 12} {
+		if got, ok := drv.LineForGSI(gsi); !ok || got != expLine {
+			t.Errorf("expected GSI %d to be routed to line %d; got %d", gsi, expLine, got)
+		}
+	}
+
+	if _, ok := drv.LineForGSI(8); ok {
+		t.Error("expected GSI 8 not to be routed to any line")
+	}
+
+	t.Run("line limit", func(t *testing.T) {
+		drv.ioapics[0].redirs = make([]uint64, 240)
+		drv.setupRoutes(nil)
+
+		if drv.Lines() != maxLines {
+			t.Fatalf("expected %d IRQ lines; got %d", maxLines, drv.Lines())
+		}
+	})
+}
+
+func TestProbe(t *testing.T) {
+	defer resetMocks()
+
+	madt := loadMADT(t)
+	specs := []struct {
+		apic      bool
+		table     *table.SDTHeader
+		expDriver bool
+	}{
+		{false, &madt.SDTHeader, false},
+		{true, nil, false},
+		{true, &madt.SDTHeader, true},
+	}
+
+	for specIndex, spec := range specs {
+		hasFeatureFn = func(f features.Feature) bool { return f == features.APIC && spec.apic }
+		lookupTableFn = func(signature string) *table.SDTHeader {
+			if signature != madtSignature {
+				t.Errorf("[spec %d] unexpected table lookup for %q", specIndex, signature)
+			}
+			return spec.table
+		}
+
+		if drv := probeForAPIC(); (drv != nil) != spec.expDriver {
+			t.Errorf("[spec %d] expected probe to return a driver: %t", specIndex, spec.expDriver)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package apic
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+const (
+	// The IO APIC registers are accessed indirectly by writing the register
+	// index to the register select port and then accessing the window port.
+	ioapicRegSelect = uintptr(0x00)
+	ioapicRegWindow = uintptr(0x10)
+
+	ioapicRegVersion    = uint32(0x01)
+	ioapicRegRedirTable = uint32(0x10)
+
+	// Redirection table entry flags.
+	redirActiveLow        = uint64(1 << 13)
+	redirLevelTriggered   = uint64(1 << 15)
+	redirMasked           = uint64(1 << 16)
+	redirDestinationShift = 56
+
+	// redirMaxDestination is the largest local APIC ID that can be used
+	// as the destination of a redirection table entry.
+	redirMaxDestination = uint32(0xff)
+)
+
+// ioAPIC describes an IO APIC which routes a contiguous range of global system
+// interrupts (GSIs) to the local APICs.
+type ioAPIC struct {
+	// base is the virtual address of the memory-mapped registers.
+	base uintptr
+
+	// gsiBase is the first GSI handled by this IO APIC.
+	gsiBase uint32
+
+	// redirs caches the contents of the redirection table; the entry at
+	// index i describes GSI gsiBase+i.
+	redirs []uint64
+}
+
+// init maps the IO APIC registers at physAddr and queries the number of
+// redirection table entries.
+func (io *ioAPIC) init(physAddr uintptr, gsiBase uint32) *kernel.Error {
+	var err *kernel.Error
+	if io.base, err = mapMMIOFn(physAddr, mm.PageSize, vmm.CacheModeUncached); err != nil {
+		return err
+	}
+
+	// Bits 16-23 of the version register contain the index of the last
+	// redirection table entry.
+	io.gsiBase = gsiBase
+	io.redirs = make([]uint64, (io.read(ioapicRegVersion)>>16)&0xff+1)
+	return nil
+}
+
+// handles returns true if gsi is routed by this IO APIC.
+func (io *ioAPIC) handles(gsi uint32) bool {
+	return gsi >= io.gsiBase && gsi-io.gsiBase < uint32(len(io.redirs))
+}
+
+// setRedirection updates the redirection table entry for gsi.
+func (io *ioAPIC) setRedirection(gsi uint32, entry uint64) {
+	index := gsi - io.gsiBase
+	io.redirs[index] = entry
+
+	// Write the high dword first so the entry is never unmasked with a
+	// stale destination.
+	io.write(ioapicRegRedirTable+index<<1+1, uint32(entry>>32))
+	io.write(ioapicRegRedirTable+index<<1, uint32(entry))
+}
+
+// redirection returns the redirection table entry for gsi.
+func (io *ioAPIC) redirection(gsi uint32) uint64 {
+	return io.redirs[gsi-io.gsiBase]
+}
+
+func (io *ioAPIC) read(reg uint32) uint32 {
+	*(*uint32)(unsafe.Pointer(io.base + ioapicRegSelect)) = reg
+	return *(*uint32)(unsafe.Pointer(io.base + ioapicRegWindow))
+}
+
+func (io *ioAPIC) write(reg, val uint32) {
+	*(*uint32)(unsafe.Pointer(io.base + ioapicRegSelect)) = reg
+	*(*uint32)(unsafe.Pointer(io.base + ioapicRegWindow)) = val
+}
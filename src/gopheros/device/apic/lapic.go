@@ -0,0 +1,142 @@
+package apic
+
+import (
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+const (
+	// msrAPICBase controls the local APIC operating mode.
+	msrAPICBase       = cpu.MSRAPICBase
+	apicBaseEnable    = cpu.APICBaseEnable
+	apicBaseX2APICOn  = cpu.APICBaseX2APICEnable
+	msrX2APICRegsBase = cpu.MSRX2APICRegsBase
+
+	// Local APIC register offsets (xAPIC mode). In x2APIC mode, each
+	// register is accessed via the MSR msrX2APICRegsBase + offset/16.
+	lapicRegID       = uint32(0x20)
+	lapicRegEOI      = uint32(0xb0)
+	lapicRegSVR      = uint32(0xf0)
+	lapicRegICRLo    = uint32(0x300)
+	lapicRegICRHi    = uint32(0x310)
+	lapicRegLVTLINT0 = uint32(0x350)
+
+	// svrEnable software-enables the local APIC when set in the spurious
+	// interrupt vector register.
+	svrEnable = uint32(1 << 8)
+
+	// Local vector table and interrupt command register flags.
+	lvtDeliveryNMI     = uint32(4 << 8)
+	lvtActiveLow       = uint32(1 << 13)
+	lvtLevelTriggered  = uint32(1 << 15)
+	icrDeliveryPending = uint32(1 << 12)
+)
+
+// localAPIC provides access to the registers of the local APIC of the CPU
+// that executes the code.
+type localAPIC struct {
+	// base is the virtual address of the memory-mapped registers. It is
+	// only used when the local APIC does not operate in x2APIC mode.
+	base uintptr
+
+	// x2APIC is set to true if the registers are accessed via MSRs.
+	x2APIC bool
+}
+
+// init sets up access to the local APIC registers and enables the local APIC
+// of the CPU that executes the call. If the CPU supports it, the local APIC is
+// switched to x2APIC mode; otherwise, the register page at physAddr is mapped
+// into the kernel address space.
+func (l *localAPIC) init(physAddr uintptr) *kernel.Error {
+	if l.x2APIC = hasFeatureFn(features.X2APIC); !l.x2APIC {
+		var err *kernel.Error
+		if l.base, err = mapMMIOFn(physAddr, mm.PageSize, vmm.CacheModeUncached); err != nil {
+			return err
+		}
+	}
+
+	l.enable()
+	return nil
+}
+
+// enable enables the local APIC of the CPU that executes the call using the
+// mode selected by init. As each CPU has its own local APIC, enable must be
+// invoked by every CPU.
+func (l *localAPIC) enable() {
+	apicBase := readMSRFn(msrAPICBase) | apicBaseEnable
+	writeMSRFn(msrAPICBase, apicBase)
+
+	// Switching directly from the disabled state to x2APIC mode raises a
+	// #GP so the local APIC must be enabled in xAPIC mode first.
+	if l.x2APIC {
+		writeMSRFn(msrAPICBase, apicBase|apicBaseX2APICOn)
+	}
+
+	l.write(lapicRegSVR, svrEnable|uint32(spuriousVector))
+}
+
+// id returns the ID of the local APIC.
+func (l *localAPIC) id() uint32 {
+	if l.x2APIC {
+		return l.read(lapicRegID)
+	}
+
+	return l.read(lapicRegID) >> 24
+}
+
+// eoi signals the end of the interrupt that is currently being serviced.
+func (l *localAPIC) eoi() {
+	l.write(lapicRegEOI, 0)
+}
+
+// setupNMI programs the LINT0 or LINT1 entry of the local vector table to
+// deliver NMIs using the polarity and trigger mode encoded in MADT flags.
+func (l *localAPIC) setupNMI(lint uint8, flags uint16) {
+	val := lvtDeliveryNMI
+	if flags&table.MADTPolarityMask == table.MADTPolarityActiveLow {
+		val |= lvtActiveLow
+	}
+	if flags&table.MADTTriggerMask == table.MADTTriggerLevel {
+		val |= lvtLevelTriggered
+	}
+
+	l.write(lapicRegLVTLINT0+uint32(lint&1)<<4, val)
+}
+
+// sendIPI sends a fixed inter-processor interrupt with the supplied vector to
+// the local APIC with the specified ID.
+func (l *localAPIC) sendIPI(dstAPICID uint32, vector uint8) {
+	if l.x2APIC {
+		writeMSRFn(msrX2APICRegsBase+lapicRegICRLo>>4, uint64(dstAPICID)<<32|uint64(vector))
+		return
+	}
+
+	// Writing to the low ICR dword sends the IPI
+	l.write(lapicRegICRHi, dstAPICID<<24)
+	l.write(lapicRegICRLo, uint32(vector))
+	for l.read(lapicRegICRLo)&icrDeliveryPending != 0 {
+		// wait until the IPI is accepted
+	}
+}
+
+func (l *localAPIC) read(reg uint32) uint32 {
+	if l.x2APIC {
+		return uint32(readMSRFn(msrX2APICRegsBase + reg>>4))
+	}
+
+	return *(*uint32)(unsafe.Pointer(l.base + uintptr(reg)))
+}
+
+func (l *localAPIC) write(reg, val uint32) {
+	if l.x2APIC {
+		writeMSRFn(msrX2APICRegsBase+reg>>4, uint64(val))
+		return
+	}
+
+	*(*uint32)(unsafe.Pointer(l.base + uintptr(reg))) = val
+}
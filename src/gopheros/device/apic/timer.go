@@ -0,0 +1,157 @@
+package apic
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/time"
+)
+
+const (
+	// Local APIC timer register offsets.
+	lapicRegLVTTimer     = uint32(0x320)
+	lapicRegTimerInitial = uint32(0x380)
+	lapicRegTimerCurrent = uint32(0x390)
+	lapicRegTimerDivide  = uint32(0x3e0)
+
+	// msrTSCDeadline is the index of the IA32_TSC_DEADLINE MSR. When the
+	// timer operates in TSC-deadline mode, an interrupt is raised once
+	// the TSC reaches the value stored in this MSR.
+	msrTSCDeadline = cpu.MSRTSCDeadline
+
+	// Timer LVT entry fields.
+	lvtMasked            = uint32(1 << 16)
+	lvtTimerOneShot      = uint32(0 << 17)
+	lvtTimerPeriodic     = uint32(1 << 17)
+	lvtTimerTSCDeadline  = uint32(2 << 17)
+	timerDivideBy16      = uint32(0x3)
+	timerMaxCount        = uint64(0xffffffff)
+	timerCalibrationTime = uint64(10000000)
+
+	lapicTimerRating = 300
+)
+
+var (
+	errTimerCalibrationFailed = &kernel.Error{Module: "apic", Message: "local APIC timer calibration failed"}
+	errTimerNotCalibrated     = &kernel.Error{Module: "apic", Message: "local APIC timer has not been calibrated"}
+)
+
+// lapicTimer implements time.EventDevice using the timer of the local APIC of
+// a CPU. As each timer can only be programmed by the CPU that owns it, its
+// methods must be invoked by that CPU. If the CPU supports it, one-shot events
+// are scheduled in TSC-deadline mode.
+type lapicTimer struct {
+	lapic *localAPIC
+
+	// frequency is the rate at which the timer counter is decremented.
+	frequency uint64
+
+	// tscDeadline is set to true if the timer supports TSC-deadline mode
+	// and tscFrequency contains the calibrated TSC frequency.
+	tscDeadline  bool
+	tscFrequency uint64
+
+	fn func()
+}
+
+// Name returns the name of the event device.
+func (t *lapicTimer) Name() string { return "lapic" }
+
+// Rating returns the rating of the event device.
+func (t *lapicTimer) Rating() int { return lapicTimerRating }
+
+// Init calibrates the frequency of the timer and, if TSC-deadline mode is
+// supported, the frequency of the TSC against the monotonic clock.
+func (t *lapicTimer) Init() *kernel.Error {
+	t.lapic.write(lapicRegTimerDivide, timerDivideBy16)
+	t.lapic.write(lapicRegLVTTimer, lvtMasked|lvtTimerOneShot|uint32(timerVector))
+
+	start, startTSC := nanotimeFn(), readTSCFn()
+	t.lapic.write(lapicRegTimerInitial, uint32(timerMaxCount))
+	for nanotimeFn()-start < timerCalibrationTime {
+	}
+
+	var (
+		ticks   = timerMaxCount - uint64(t.lapic.read(lapicRegTimerCurrent))
+		elapsed = nanotimeFn() - start
+		tscTick = readTSCFn() - startTSC
+	)
+	t.lapic.write(lapicRegTimerInitial, 0)
+
+	if ticks == 0 {
+		return errTimerCalibrationFailed
+	}
+
+	t.frequency = ticks * time.NanosecondsPerSecond / elapsed
+	t.tscFrequency = tscTick * time.NanosecondsPerSecond / elapsed
+	return nil
+}
+
+// OneShot arms the timer so that fn is invoked once after the specified delay
+// in nanoseconds. Delays that exceed the timer counter range are clamped.
+func (t *lapicTimer) OneShot(delay uint64, fn func()) *kernel.Error {
+	if t.frequency == 0 {
+		return errTimerNotCalibrated
+	}
+
+	t.fn = fn
+	if t.tscDeadline {
+		t.lapic.write(lapicRegLVTTimer, lvtTimerTSCDeadline|uint32(timerVector))
+		writeMSRFn(msrTSCDeadline, readTSCFn()+ticks(delay, t.tscFrequency))
+		return nil
+	}
+
+	t.lapic.write(lapicRegLVTTimer, lvtTimerOneShot|uint32(timerVector))
+	t.lapic.write(lapicRegTimerInitial, t.count(delay))
+	return nil
+}
+
+// Periodic arms the timer so that fn is invoked every period nanoseconds.
+func (t *lapicTimer) Periodic(period uint64, fn func()) *kernel.Error {
+	if t.frequency == 0 {
+		return errTimerNotCalibrated
+	}
+
+	t.fn = fn
+	t.lapic.write(lapicRegLVTTimer, lvtTimerPeriodic|uint32(timerVector))
+	t.lapic.write(lapicRegTimerInitial, t.count(period))
+	return nil
+}
+
+// Stop disarms the timer.
+func (t *lapicTimer) Stop() {
+	t.lapic.write(lapicRegLVTTimer, lvtMasked|uint32(timerVector))
+	t.lapic.write(lapicRegTimerInitial, 0)
+	if t.tscDeadline {
+		writeMSRFn(msrTSCDeadline, 0)
+	}
+}
+
+// count converts a duration in nanoseconds to a timer initial count value.
+func (t *lapicTimer) count(ns uint64) uint32 {
+	count := ticks(ns, t.frequency)
+	if count > timerMaxCount {
+		count = timerMaxCount
+	}
+
+	return uint32(count)
+}
+
+// ticks converts a duration in nanoseconds to the number of ticks of a counter
+// with the specified frequency. The result is at least 1.
+func ticks(ns, frequency uint64) uint64 {
+	ticks := (ns/time.NanosecondsPerSecond)*frequency + (ns%time.NanosecondsPerSecond)*frequency/time.NanosecondsPerSecond
+	if ticks == 0 {
+		ticks = 1
+	}
+
+	return ticks
+}
+
+// lapicTimerHandler is invoked when the local APIC timer of a CPU fires.
+func lapicTimerHandler(_ *gate.Registers) {
+	if fn := activeDriver.timers[activeDriver.currentCPU()].fn; fn != nil {
+		fn()
+	}
+	activeDriver.lapic.eoi()
+}
@@ -0,0 +1,183 @@
+package apic
+
+import (
+	"gopheros/kernel/gate"
+	"testing"
+	"unsafe"
+)
+
+// setupTimer returns a timer for a local APIC in xAPIC mode that is backed by
+// the test environment registers.
+func setupTimer(t *testing.T, env *testEnv, tscDeadline bool) *lapicTimer {
+	lapic := &localAPIC{}
+	if err := lapic.init(testLAPICAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	return &lapicTimer{lapic: lapic, tscDeadline: tscDeadline}
+}
+
+func (env *testEnv) setLAPICReg(reg, val uint32) {
+	*(*uint32)(unsafe.Pointer(&env.lapicRegs[reg])) = val
+}
+
+func TestLAPICTimerInit(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+	timer := setupTimer(t, env, true)
+
+	// Each call advances the monotonic clock by 5ms and the TSC by 10M
+	// ticks. The calibration loop samples the clock three times.
+	var now, tsc uint64
+	nanotimeFn = func() uint64 {
+		now += 5000000
+		return now
+	}
+	readTSCFn = func() uint64 {
+		tsc += 10000000
+		return tsc
+	}
+
+	// After 15ms, the timer has counted down by 150000 ticks
+	env.setLAPICReg(lapicRegTimerCurrent, uint32(timerMaxCount-150000))
+
+	if err := timer.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := uint64(10000000); timer.frequency != exp {
+		t.Errorf("expected timer frequency to be %d; got %d", exp, timer.frequency)
+	}
+
+	if exp := uint64(10000000) * 1000 / 15; timer.tscFrequency != exp {
+		t.Errorf("expected TSC frequency to be %d; got %d", exp, timer.tscFrequency)
+	}
+
+	if got := env.lapicReg(lapicRegTimerDivide); got != timerDivideBy16 {
+		t.Errorf("expected divide configuration to be 0x%x; got 0x%x", timerDivideBy16, got)
+	}
+
+	if got := env.lapicReg(lapicRegTimerInitial); got != 0 {
+		t.Errorf("expected timer to be stopped after calibration; initial count: 0x%x", got)
+	}
+
+	t.Run("calibration failure", func(t *testing.T) {
+		env.setLAPICReg(lapicRegTimerCurrent, uint32(timerMaxCount))
+		if err := timer.Init(); err != errTimerCalibrationFailed {
+			t.Fatalf("expected to get errTimerCalibrationFailed; got %v", err)
+		}
+	})
+}
+
+func TestLAPICTimerModes(t *testing.T) {
+	defer resetMocks()
+	env := setupTestEnv(t)
+
+	var calls int
+	fn := func() { calls++ }
+
+	t.Run("not calibrated", func(t *testing.T) {
+		timer := setupTimer(t, env, false)
+		if err := timer.OneShot(1, fn); err != errTimerNotCalibrated {
+			t.Errorf("expected to get errTimerNotCalibrated; got %v", err)
+		}
+		if err := timer.Periodic(1, fn); err != errTimerNotCalibrated {
+			t.Errorf("expected to get errTimerNotCalibrated; got %v", err)
+		}
+	})
+
+	t.Run("one-shot", func(t *testing.T) {
+		timer := setupTimer(t, env, false)
+		timer.frequency = 10000000
+
+		specs := []struct {
+			delay    uint64
+			expCount uint32
+		}{
+			{0, 1},
+			{1000, 10},
+			{2000000000, 20000000},
+			// clamped to the maximum count
+			{1000000000000, uint32(timerMaxCount)},
+		}
+
+		for specIndex, spec := range specs {
+			if err := timer.OneShot(spec.delay, fn); err != nil {
+				t.Fatal(err)
+			}
+
+			if exp := lvtTimerOneShot | uint32(timerVector); env.lapicReg(lapicRegLVTTimer) != exp {
+				t.Errorf("[spec %d] expected timer LVT entry to be 0x%x; got 0x%x", specIndex, exp, env.lapicReg(lapicRegLVTTimer))
+			}
+
+			if got := env.lapicReg(lapicRegTimerInitial); got != spec.expCount {
+				t.Errorf("[spec %d] expected initial count to be %d; got %d", specIndex, spec.expCount, got)
+			}
+		}
+	})
+
+	t.Run("TSC-deadline", func(t *testing.T) {
+		timer := setupTimer(t, env, true)
+		timer.frequency, timer.tscFrequency = 10000000, 2000000000
+		readTSCFn = func() uint64 { return 5000 }
+
+		if err := timer.OneShot(1000, fn); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := lvtTimerTSCDeadline | uint32(timerVector); env.lapicReg(lapicRegLVTTimer) != exp {
+			t.Errorf("expected timer LVT entry to be 0x%x; got 0x%x", exp, env.lapicReg(lapicRegLVTTimer))
+		}
+
+		if exp := uint64(7000); env.msrs[msrTSCDeadline] != exp {
+			t.Errorf("expected TSC deadline to be %d; got %d", exp, env.msrs[msrTSCDeadline])
+		}
+
+		timer.Stop()
+		if env.msrs[msrTSCDeadline] != 0 {
+			t.Error("expected Stop to clear the TSC deadline")
+		}
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		timer := setupTimer(t, env, false)
+		timer.frequency = 10000000
+
+		if err := timer.Periodic(1000000, fn); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := lvtTimerPeriodic | uint32(timerVector); env.lapicReg(lapicRegLVTTimer) != exp {
+			t.Errorf("expected timer LVT entry to be 0x%x; got 0x%x", exp, env.lapicReg(lapicRegLVTTimer))
+		}
+
+		if exp := uint32(10000); env.lapicReg(lapicRegTimerInitial) != exp {
+			t.Errorf("expected initial count to be %d; got %d", exp, env.lapicReg(lapicRegTimerInitial))
+		}
+
+		activeDriver = &Driver{timers: []lapicTimer{*timer}, lapic: *timer.lapic}
+		env.setLAPICReg(lapicRegEOI, 0xbadf00d)
+		lapicTimerHandler(&gate.Registers{})
+		if calls != 1 || env.lapicReg(lapicRegEOI) != 0 {
+			t.Error("expected the timer handler to invoke the callback and acknowledge the interrupt")
+		}
+
+		// Interrupts are acknowledged even without a callback
+		activeDriver.timers[0].fn = nil
+		env.setLAPICReg(lapicRegEOI, 0xbadf00d)
+		lapicTimerHandler(&gate.Registers{})
+		if calls != 1 || env.lapicReg(lapicRegEOI) != 0 {
+			t.Error("expected the timer handler to acknowledge the interrupt")
+		}
+
+		timer.Stop()
+		if exp := lvtMasked | uint32(timerVector); env.lapicReg(lapicRegLVTTimer) != exp || env.lapicReg(lapicRegTimerInitial) != 0 {
+			t.Error("expected Stop to mask the timer and clear its initial count")
+		}
+	})
+
+	timer := &lapicTimer{}
+	if timer.Name() != "lapic" || timer.Rating() != lapicTimerRating {
+		t.Errorf("unexpected event device name %q or rating %d", timer.Name(), timer.Rating())
+	}
+}
@@ -43,6 +43,12 @@ const (
 	// value) for all drivers.
 	DetectOrderACPI = 0
 
+	// DetectOrderAfterACPI specifies that the driver's probe function
+	// should be executed after any drivers with DetectOrderACPI. It is
+	// used by drivers that register IRQ handlers and therefore need the
+	// ACPI-based interrupt controller drivers to be initialized first.
+	DetectOrderAfterACPI = 1
+
 	// DetectOrderLast specifies that the driver's probe function should
 	// be executed at the end of the HW detection phase.
 	DetectOrderLast = 127
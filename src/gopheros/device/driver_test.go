@@ -13,6 +13,7 @@ func TestDriverInfoListSorting(t *testing.T) {
 	origlist := []*DriverInfo{
 		{Order: DetectOrderACPI},
 		{Order: DetectOrderLast},
+		{Order: DetectOrderAfterACPI},
 		{Order: DetectOrderBeforeACPI},
 		{Order: DetectOrderEarly},
 	}
@@ -27,7 +28,7 @@ func TestDriverInfoListSorting(t *testing.T) {
 	}
 
 	sort.Sort(registeredList)
-	expOrder := []int{3, 2, 0, 1}
+	expOrder := []int{4, 3, 0, 2, 1}
 	for i, exp := range expOrder {
 		if registeredList[i] != origlist[exp] {
 			t.Errorf("expected sorted entry %d to be %v; got %v", i, registeredList[exp], origlist[i])
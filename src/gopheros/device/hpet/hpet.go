@@ -0,0 +1,442 @@
+// Package hpet provides a driver for the high precision event timer (HPET)
+// which is described by the ACPI HPET table. The driver exposes the HPET main
+// counter as a clock source and allows the HPET comparators to be used for
+// raising one-shot or periodic timer interrupts.
+package hpet
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
+	"io"
+	"unsafe"
+)
+
+const (
+	hpetSignature = "HPET"
+
+	// registerBlockSize is the size of the memory-mapped register block.
+	registerBlockSize = 1024
+
+	regCapabilities = uintptr(0x000)
+	regConfig       = uintptr(0x010)
+	regIntStatus    = uintptr(0x020)
+	regMainCounter  = uintptr(0x0f0)
+
+	// The configuration and comparator registers of timer N are located
+	// at regTimerBase + N*timerStride.
+	regTimerBase       = uintptr(0x100)
+	regTimerComparator = uintptr(0x008)
+	timerStride        = uintptr(0x020)
+
+	// General capabilities register fields.
+	capNumTimersShift = 8
+	capNumTimersMask  = 0x1f
+	capCounter64      = uint64(1 << 13)
+	capLegacyRoute    = uint64(1 << 15)
+	capPeriodShift    = 32
+
+	// General configuration register fields.
+	cfgEnable      = uint64(1 << 0)
+	cfgLegacyRoute = uint64(1 << 1)
+
+	// Timer configuration and capabilities register fields.
+	timerLevelTriggered = uint64(1 << 1)
+	timerIntEnable      = uint64(1 << 2)
+	timerPeriodic       = uint64(1 << 3)
+	timerPeriodicCap    = uint64(1 << 4)
+	timerValueSet       = uint64(1 << 6)
+	timerRouteShift     = 9
+	timerRouteCapShift  = 32
+
+	// maxPeriod is the maximum main counter tick period (100ns) allowed
+	// by the HPET specification.
+	maxPeriod = uint64(100000000)
+
+	femtosecondsPerSecond = uint64(1000000000000000)
+
+	// When legacy replacement routing is enabled, timer 0 replaces the
+	// PIT interrupt and timer 1 replaces the RTC interrupt.
+	legacyTimer0Line = uint8(0)
+	legacyTimer1Line = uint8(8)
+
+	// isaLines is the number of legacy ISA IRQ lines. The interrupts for
+	// these lines are edge-triggered while any other line is shared and
+	// level-triggered.
+	isaLines = 16
+
+	hpetRating = 250
+)
+
+var (
+	errUnsupportedAddressSpace = &kernel.Error{Module: "hpet", Message: "HPET registers are not memory-mapped"}
+	errInvalidPeriod           = &kernel.Error{Module: "hpet", Message: "HPET reports an invalid counter tick period"}
+	errNoHPET                  = &kernel.Error{Module: "hpet", Message: "no HPET available"}
+	errNoTimerAvailable        = &kernel.Error{Module: "hpet", Message: "no HPET timer with a usable IRQ route is available"}
+	errPeriodicUnsupported     = &kernel.Error{Module: "hpet", Message: "HPET timer does not support periodic mode"}
+	errTimerNotAcquired        = &kernel.Error{Module: "hpet", Message: "HPET timer has not been acquired"}
+
+	// The following functions are used by tests to mock calls to the vmm,
+	// irq, time and acpi packages and are automatically inlined by the
+	// compiler.
+	mapMMIOFn             = vmm.MapMMIO
+	registerHandlerFn     = irq.RegisterHandler
+	unregisterHandlerFn   = irq.UnregisterHandler
+	lineForGSIFn          = irq.LineForGSI
+	registerClockSourceFn = time.RegisterClockSource
+	lookupTableFn         = acpi.LookupTable
+
+	// activeDriver points to the initialized driver and is used by the
+	// timer interrupt handler.
+	activeDriver *Driver
+)
+
+// Timer describes one of the HPET comparators.
+type Timer struct {
+	drv   *Driver
+	index int
+
+	// caps contains the contents of the timer configuration and
+	// capabilities register when the driver was initialized.
+	caps uint64
+
+	acquired bool
+	line     uint8
+
+	// config contains the routing and trigger mode bits that must be
+	// set whenever the timer configuration register is updated.
+	config uint64
+
+	periodic bool
+	fn       func()
+}
+
+// Driver implements a device driver for the HPET. The driver also implements
+// time.ClockSource for the HPET main counter.
+type Driver struct {
+	table *table.HPET
+
+	// base is the virtual address of the memory-mapped registers.
+	base uintptr
+
+	frequency uint64
+	mask      uint64
+	minTicks  uint64
+
+	legacyRoute bool
+	timers      []Timer
+}
+
+// DriverName returns the name of this driver.
+func (drv *Driver) DriverName() string {
+	return "HPET"
+}
+
+// DriverVersion returns the version of this driver.
+func (drv *Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit maps the HPET registers, resets the main counter, disables all
+// timer interrupts and registers the main counter as a clock source. Legacy
+// replacement routing is left disabled until timer 0 or 1 gets acquired as it
+// takes over the PIT and RTC interrupts.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	if drv.table.BaseAddressSpace != table.AddressSpaceSysMemory {
+		return errUnsupportedAddressSpace
+	}
+
+	var err *kernel.Error
+	if drv.base, err = mapMMIOFn(uintptr(drv.table.BaseAddress()), registerBlockSize, vmm.CacheModeUncached); err != nil {
+		return err
+	}
+
+	caps := drv.read(regCapabilities)
+	period := caps >> capPeriodShift
+	if period == 0 || period > maxPeriod {
+		return errInvalidPeriod
+	}
+
+	drv.frequency = femtosecondsPerSecond / period
+	drv.minTicks = uint64(drv.table.MinClockTick())
+	drv.mask = uint64(0xffffffff)
+	if caps&capCounter64 != 0 {
+		drv.mask = ^uint64(0)
+	}
+
+	// Halt the main counter while the timers are being reset
+	drv.write(regConfig, drv.read(regConfig)&^(cfgEnable|cfgLegacyRoute))
+
+	drv.timers = make([]Timer, (caps>>capNumTimersShift)&capNumTimersMask+1)
+	for index := range drv.timers {
+		timer := &drv.timers[index]
+		timer.drv, timer.index = drv, index
+		timer.caps = drv.read(timer.reg(0))
+		drv.write(timer.reg(0), timer.caps&^(timerIntEnable|timerPeriodic|timerLevelTriggered))
+	}
+
+	drv.legacyRoute = caps&capLegacyRoute != 0
+	drv.write(regMainCounter, 0)
+	drv.write(regConfig, drv.read(regConfig)|cfgEnable)
+
+	activeDriver = drv
+	if err = registerClockSourceFn(drv); err != nil {
+		return err
+	}
+
+	legacyRoute := "unavailable"
+	if drv.legacyRoute {
+		legacyRoute = "available"
+	}
+	kfmt.Fprintf(w, "%d timer(s), %d Hz, %d-bit counter, legacy routing %s\n", len(drv.timers), drv.frequency, bitWidth(drv.mask), legacyRoute)
+
+	return nil
+}
+
+// Name returns the name of the clock source.
+func (drv *Driver) Name() string { return "hpet" }
+
+// Rating returns the rating of the clock source.
+func (drv *Driver) Rating() int { return hpetRating }
+
+// Read returns the current value of the main counter.
+func (drv *Driver) Read() uint64 { return drv.read(regMainCounter) & drv.mask }
+
+// Mask returns the bitmask for the valid counter bits.
+func (drv *Driver) Mask() uint64 { return drv.mask }
+
+// Frequency returns the main counter frequency.
+func (drv *Driver) Frequency() uint64 { return drv.frequency }
+
+// Acquire reserves an HPET timer and routes its interrupt to an IRQ line. If
+// periodic is true, only timers which support periodic mode are considered.
+// When legacy replacement routing is supported, timers 0 and 1 are routed to
+// the PIT and RTC IRQ lines; other timers are routed to one of the IO APIC
+// inputs that they support.
+func Acquire(periodic bool) (*Timer, *kernel.Error) {
+	if activeDriver == nil {
+		return nil, errNoHPET
+	}
+
+	for index := range activeDriver.timers {
+		timer := &activeDriver.timers[index]
+		if timer.acquired || (periodic && timer.caps&timerPeriodicCap == 0) {
+			continue
+		}
+
+		if timer.route() {
+			timer.acquired = true
+			return timer, nil
+		}
+	}
+
+	return nil, errNoTimerAvailable
+}
+
+// route connects the timer interrupt to an unused IRQ line and returns true
+// if the timer could be routed.
+func (t *Timer) route() bool {
+	if t.drv.legacyRoute && t.index < 2 {
+		t.line, t.config = legacyTimer0Line, 0
+		if t.index == 1 {
+			t.line = legacyTimer1Line
+		}
+
+		if registerHandlerFn(t.line, timerIRQHandler) != nil {
+			return false
+		}
+
+		t.drv.write(regConfig, t.drv.read(regConfig)|cfgLegacyRoute)
+		return true
+	}
+
+	// Prefer the higher IO APIC inputs as the ISA lines are more likely
+	// to be claimed by other devices.
+	routeCaps := uint32(t.caps >> timerRouteCapShift)
+	for gsi := int32(31); gsi >= 0; gsi-- {
+		if routeCaps&(1<<uint32(gsi)) == 0 {
+			continue
+		}
+
+		line, err := lineForGSIFn(uint32(gsi))
+		if err != nil || registerHandlerFn(line, timerIRQHandler) != nil {
+			continue
+		}
+
+		t.line, t.config = line, uint64(gsi)<<timerRouteShift
+		if line >= isaLines {
+			t.config |= timerLevelTriggered
+		}
+		return true
+	}
+
+	return false
+}
+
+// Line returns the IRQ line that the timer is routed to.
+func (t *Timer) Line() uint8 {
+	return t.line
+}
+
+// Periodic returns true if the timer supports periodic mode.
+func (t *Timer) Periodic() bool {
+	return t.caps&timerPeriodicCap != 0
+}
+
+// OneShot arms the timer so that fn is invoked once after the specified delay
+// in nanoseconds has elapsed. The callback runs in interrupt context and may
+// re-arm the timer.
+func (t *Timer) OneShot(delay uint64, fn func()) *kernel.Error {
+	if !t.acquired {
+		return errTimerNotAcquired
+	}
+
+	t.periodic, t.fn = false, fn
+	t.drv.write(t.reg(0), t.config|timerIntEnable)
+	t.drv.write(t.reg(regTimerComparator), (t.drv.read(regMainCounter)+t.drv.ticks(delay))&t.drv.mask)
+	return nil
+}
+
+// SetPeriodic arms the timer so that fn is invoked every period nanoseconds.
+// The callback runs in interrupt context.
+func (t *Timer) SetPeriodic(period uint64, fn func()) *kernel.Error {
+	switch {
+	case !t.acquired:
+		return errTimerNotAcquired
+	case !t.Periodic():
+		return errPeriodicUnsupported
+	}
+
+	t.periodic, t.fn = true, fn
+	ticks := t.drv.ticks(period)
+
+	// While the value-set bit is set, the first comparator write sets the
+	// time of the first interrupt and the second write sets the period.
+	t.drv.write(t.reg(0), t.config|timerIntEnable|timerPeriodic|timerValueSet)
+	t.drv.write(t.reg(regTimerComparator), (t.drv.read(regMainCounter)+ticks)&t.drv.mask)
+	t.drv.write(t.reg(regTimerComparator), ticks)
+	return nil
+}
+
+// Stop disarms the timer.
+func (t *Timer) Stop() {
+	t.periodic = false
+	t.drv.write(t.reg(0), t.config)
+	t.drv.write(regIntStatus, 1<<uint(t.index))
+}
+
+// Release disarms the timer and frees its IRQ line so the timer can be
+// acquired again.
+func (t *Timer) Release() *kernel.Error {
+	if !t.acquired {
+		return errTimerNotAcquired
+	}
+
+	t.Stop()
+	t.acquired, t.fn = false, nil
+
+	// Hand the PIT and RTC interrupts back once neither timer 0 nor timer 1
+	// is in use.
+	if t.drv.legacyRoute && t.index < 2 && !t.drv.legacyTimerAcquired() {
+		t.drv.write(regConfig, t.drv.read(regConfig)&^cfgLegacyRoute)
+	}
+
+	return unregisterHandlerFn(t.line)
+}
+
+// legacyTimerAcquired returns true if timer 0 or 1 is acquired.
+func (drv *Driver) legacyTimerAcquired() bool {
+	for index := 0; index < 2 && index < len(drv.timers); index++ {
+		if drv.timers[index].acquired {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reg returns the offset of a register for this timer.
+func (t *Timer) reg(offset uintptr) uintptr {
+	return regTimerBase + uintptr(t.index)*timerStride + offset
+}
+
+// ticks converts a duration in nanoseconds to main counter ticks. The result is
+// clamped to the minimum tick count reported by the HPET table.
+func (drv *Driver) ticks(ns uint64) uint64 {
+	ticks := (ns/time.NanosecondsPerSecond)*drv.frequency + (ns%time.NanosecondsPerSecond)*drv.frequency/time.NanosecondsPerSecond
+	if ticks < drv.minTicks {
+		ticks = drv.minTicks
+	}
+	if ticks == 0 {
+		ticks = 1
+	}
+
+	return ticks
+}
+
+func (drv *Driver) read(reg uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(drv.base + reg))
+}
+
+func (drv *Driver) write(reg uintptr, val uint64) {
+	*(*uint64)(unsafe.Pointer(drv.base + reg)) = val
+}
+
+// bitWidth returns the number of bits set in a contiguous mask.
+func bitWidth(mask uint64) int {
+	var width int
+	for ; mask != 0; mask >>= 1 {
+		width++
+	}
+
+	return width
+}
+
+// timerIRQHandler services the interrupts raised by the acquired timers. One-shot
+// timers are disarmed before their callback is invoked so that the callback
+// can re-arm them.
+func timerIRQHandler(regs *gate.Registers) {
+	line := uint8(regs.Info)
+	for index := range activeDriver.timers {
+		timer := &activeDriver.timers[index]
+		if !timer.acquired || timer.line != line {
+			continue
+		}
+
+		// Level-triggered interrupts remain asserted until their status
+		// bit is cleared.
+		if timer.config&timerLevelTriggered != 0 {
+			activeDriver.write(regIntStatus, 1<<uint(timer.index))
+		}
+
+		if !timer.periodic {
+			activeDriver.write(timer.reg(0), timer.config)
+		}
+
+		if timer.fn != nil {
+			timer.fn()
+		}
+	}
+}
+
+func probeForHPET() device.Driver {
+	header := lookupTableFn(hpetSignature)
+	if header == nil {
+		return nil
+	}
+
+	return &Driver{table: (*table.HPET)(unsafe.Pointer(header))}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderAfterACPI,
+		Probe: probeForHPET,
+	})
+}
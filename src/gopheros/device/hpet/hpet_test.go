@@ -0,0 +1,517 @@
+package hpet
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
+	"testing"
+	"unsafe"
+)
+
+const (
+	// testPeriod is the tick period (in femtoseconds) of the QEMU HPET
+	// which runs at 100MHz.
+	testPeriod = uint64(10000000)
+	testFreq   = uint64(100000000)
+)
+
+type testEnv struct {
+	regs  []uint64
+	table table.HPET
+
+	registeredLines map[uint8]bool
+	gsiLines        map[uint32]uint8
+	clockSource     time.ClockSource
+}
+
+func (env *testEnv) reg(offset uintptr) *uint64 {
+	return &env.regs[offset/8]
+}
+
+func (env *testEnv) timerReg(index int, offset uintptr) *uint64 {
+	return env.reg(regTimerBase + uintptr(index)*timerStride + offset)
+}
+
+// setupTestEnv mocks the HPET register file and the calls to other packages.
+// The HPET is configured with the specified capabilities and a timer
+// configuration register for each entry in timerCaps.
+func setupTestEnv(t *testing.T, caps uint64, timerCaps ...uint64) *testEnv {
+	env := &testEnv{
+		regs:            make([]uint64, registerBlockSize/8),
+		registeredLines: make(map[uint8]bool),
+		gsiLines:        make(map[uint32]uint8),
+	}
+
+	env.table.BaseAddressLo = 0xfed00000
+	*env.reg(regCapabilities) = caps | uint64(len(timerCaps)-1)<<capNumTimersShift
+	*env.reg(regMainCounter) = 0xbadf00d
+	for index, timerCaps := range timerCaps {
+		*env.timerReg(index, 0) = timerCaps
+	}
+
+	mapMMIOFn = func(physAddr, size uintptr, mode vmm.CacheMode) (uintptr, *kernel.Error) {
+		if physAddr != 0xfed00000 || size != registerBlockSize || mode != vmm.CacheModeUncached {
+			t.Errorf("unexpected MapMMIO call: 0x%x, %d, %d", physAddr, size, mode)
+		}
+		return uintptr(unsafe.Pointer(&env.regs[0])), nil
+	}
+	registerHandlerFn = func(line uint8, _ irq.Handler) *kernel.Error {
+		if env.registeredLines[line] {
+			return &kernel.Error{Module: "test", Message: "line in use"}
+		}
+		env.registeredLines[line] = true
+		return nil
+	}
+	unregisterHandlerFn = func(line uint8) *kernel.Error {
+		delete(env.registeredLines, line)
+		return nil
+	}
+	lineForGSIFn = func(gsi uint32) (uint8, *kernel.Error) {
+		if line, ok := env.gsiLines[gsi]; ok {
+			return line, nil
+		}
+		return 0, &kernel.Error{Module: "test", Message: "no route"}
+	}
+	registerClockSourceFn = func(source time.ClockSource) *kernel.Error {
+		env.clockSource = source
+		return nil
+	}
+
+	return env
+}
+
+func restoreMocks() {
+	mapMMIOFn = vmm.MapMMIO
+	registerHandlerFn = irq.RegisterHandler
+	unregisterHandlerFn = irq.UnregisterHandler
+	lineForGSIFn = irq.LineForGSI
+	registerClockSourceFn = time.RegisterClockSource
+	lookupTableFn = acpi.LookupTable
+	activeDriver = nil
+}
+
+func initDriver(t *testing.T, env *testEnv) *Driver {
+	drv := &Driver{table: &env.table}
+	var buf bytes.Buffer
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return drv
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	t.Run("64-bit counter with legacy routing", func(t *testing.T) {
+		env := setupTestEnv(t, testPeriod<<capPeriodShift|capCounter64|capLegacyRoute,
+			timerPeriodicCap|timerIntEnable|timerPeriodic,
+			timerIntEnable,
+			0,
+		)
+		*env.reg(regConfig) = cfgEnable
+
+		drv := &Driver{table: &env.table}
+		var buf bytes.Buffer
+		if err := drv.DriverInit(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := "3 timer(s), 100000000 Hz, 64-bit counter, legacy routing available\n"; buf.String() != exp {
+			t.Errorf("expected driver output to be %q; got %q", exp, buf.String())
+		}
+
+		// Legacy routing is only enabled once timer 0 or 1 is acquired
+		if got, exp := *env.reg(regConfig), cfgEnable; got != exp {
+			t.Errorf("expected general config to be 0x%x; got 0x%x", exp, got)
+		}
+
+		if got := *env.reg(regMainCounter); got != 0 {
+			t.Errorf("expected main counter to be reset; got 0x%x", got)
+		}
+
+		for index := range drv.timers {
+			if got := *env.timerReg(index, 0); got&(timerIntEnable|timerPeriodic) != 0 {
+				t.Errorf("[timer %d] expected timer interrupts to be disabled; config: 0x%x", index, got)
+			}
+		}
+
+		if env.clockSource != drv || activeDriver != drv {
+			t.Error("expected driver to be registered as a clock source and set as the active driver")
+		}
+
+		if drv.Mask() != ^uint64(0) || drv.Frequency() != testFreq {
+			t.Errorf("unexpected clock source mask 0x%x or frequency %d", drv.Mask(), drv.Frequency())
+		}
+	})
+
+	t.Run("32-bit counter without legacy routing", func(t *testing.T) {
+		env := setupTestEnv(t, testPeriod<<capPeriodShift, 0)
+
+		var buf bytes.Buffer
+		drv := &Driver{table: &env.table}
+		if err := drv.DriverInit(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := "1 timer(s), 100000000 Hz, 32-bit counter, legacy routing unavailable\n"; buf.String() != exp {
+			t.Errorf("expected driver output to be %q; got %q", exp, buf.String())
+		}
+
+		if got := *env.reg(regConfig); got != cfgEnable {
+			t.Errorf("expected general config to be 0x%x; got 0x%x", cfgEnable, got)
+		}
+
+		*env.reg(regMainCounter) = 0x1deadbeef
+		if got, exp := drv.Read(), uint64(0xdeadbeef); got != exp {
+			t.Errorf("expected Read() to return 0x%x; got 0x%x", exp, got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		env := setupTestEnv(t, testPeriod<<capPeriodShift, 0)
+
+		env.table.BaseAddressSpace = table.AddressSpaceSysIO
+		if err := (&Driver{table: &env.table}).DriverInit(nil); err != errUnsupportedAddressSpace {
+			t.Errorf("expected to get errUnsupportedAddressSpace; got %v", err)
+		}
+		env.table.BaseAddressSpace = table.AddressSpaceSysMemory
+
+		for _, period := range []uint64{0, maxPeriod + 1} {
+			*env.reg(regCapabilities) = period << capPeriodShift
+			if err := (&Driver{table: &env.table}).DriverInit(nil); err != errInvalidPeriod {
+				t.Errorf("expected to get errInvalidPeriod for period %d; got %v", period, err)
+			}
+		}
+		*env.reg(regCapabilities) = testPeriod << capPeriodShift
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapMMIOFn = func(_, _ uintptr, _ vmm.CacheMode) (uintptr, *kernel.Error) { return 0, expErr }
+		if err := (&Driver{table: &env.table}).DriverInit(nil); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+
+		env = setupTestEnv(t, testPeriod<<capPeriodShift, 0)
+		registerClockSourceFn = func(_ time.ClockSource) *kernel.Error { return expErr }
+		if err := (&Driver{table: &env.table}).DriverInit(nil); err != expErr {
+			t.Errorf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestAcquire(t *testing.T) {
+	defer restoreMocks()
+
+	if _, err := Acquire(false); err != errNoHPET {
+		t.Fatalf("expected to get errNoHPET; got %v", err)
+	}
+
+	t.Run("legacy routing", func(t *testing.T) {
+		env := setupTestEnv(t, testPeriod<<capPeriodShift|capLegacyRoute,
+			timerPeriodicCap,
+			0,
+			uint64(1<<20)<<timerRouteCapShift,
+		)
+		env.gsiLines[20] = 20
+		drv := initDriver(t, env)
+
+		if *env.reg(regConfig)&cfgLegacyRoute != 0 {
+			t.Fatal("expected legacy routing to be disabled before a legacy timer is acquired")
+		}
+
+		specs := []struct {
+			periodic  bool
+			expIndex  int
+			expLine   uint8
+			expConfig uint64
+		}{
+			{true, 0, legacyTimer0Line, 0},
+			{false, 1, legacyTimer1Line, 0},
+			{false, 2, 20, 20<<timerRouteShift | timerLevelTriggered},
+		}
+
+		for specIndex, spec := range specs {
+			timer, err := Acquire(spec.periodic)
+			if err != nil {
+				t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+			}
+
+			if timer != &drv.timers[spec.expIndex] {
+				t.Fatalf("[spec %d] expected to acquire timer %d; got %d", specIndex, spec.expIndex, timer.index)
+			}
+
+			if timer.Line() != spec.expLine || timer.config != spec.expConfig {
+				t.Errorf("[spec %d] expected timer to use line %d and config 0x%x; got line %d and config 0x%x", specIndex, spec.expLine, spec.expConfig, timer.Line(), timer.config)
+			}
+		}
+
+		if _, err := Acquire(false); err != errNoTimerAvailable {
+			t.Fatalf("expected to get errNoTimerAvailable; got %v", err)
+		}
+
+		if *env.reg(regConfig)&cfgLegacyRoute == 0 {
+			t.Fatal("expected legacy routing to be enabled after acquiring a legacy timer")
+		}
+
+		if err := drv.timers[1].Release(); err != nil {
+			t.Fatal(err)
+		}
+
+		if env.registeredLines[legacyTimer1Line] {
+			t.Fatal("expected Release to unregister the timer IRQ handler")
+		}
+
+		if *env.reg(regConfig)&cfgLegacyRoute == 0 {
+			t.Fatal("expected legacy routing to remain enabled while timer 0 is acquired")
+		}
+
+		if err := drv.timers[1].Release(); err != errTimerNotAcquired {
+			t.Fatalf("expected to get errTimerNotAcquired; got %v", err)
+		}
+
+		// Periodic mode is not supported by any of the free timers
+		if _, err := Acquire(true); err != errNoTimerAvailable {
+			t.Fatalf("expected to get errNoTimerAvailable; got %v", err)
+		}
+
+		if err := drv.timers[0].Release(); err != nil {
+			t.Fatal(err)
+		}
+
+		if *env.reg(regConfig)&cfgLegacyRoute != 0 {
+			t.Fatal("expected legacy routing to be disabled after releasing all legacy timers")
+		}
+	})
+
+	t.Run("fallback without legacy routing", func(t *testing.T) {
+		env := setupTestEnv(t, testPeriod<<capPeriodShift,
+			// The timer can be routed to GSIs 2, 9 and 22 but GSI 22
+			// is not routed to a line and line 9 is in use.
+			uint64(1<<2|1<<9|1<<22)<<timerRouteCapShift,
+			// The timer cannot be routed at all
+			0,
+		)
+		env.gsiLines[2] = 0
+		env.gsiLines[9] = 9
+		env.registeredLines[9] = true
+		initDriver(t, env)
+
+		timer, err := Acquire(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uint64(2 << timerRouteShift); timer.index != 0 || timer.Line() != 0 || timer.config != exp {
+			t.Fatalf("expected timer 0 to be routed to line 0 with config 0x%x; got timer %d, line %d, config 0x%x", exp, timer.index, timer.Line(), timer.config)
+		}
+
+		if _, err := Acquire(false); err != errNoTimerAvailable {
+			t.Fatalf("expected to get errNoTimerAvailable; got %v", err)
+		}
+	})
+}
+
+func TestTimerModes(t *testing.T) {
+	defer restoreMocks()
+
+	env := setupTestEnv(t, testPeriod<<capPeriodShift|capCounter64|capLegacyRoute,
+		timerPeriodicCap,
+		0,
+		uint64(1<<20)<<timerRouteCapShift,
+	)
+	env.gsiLines[20] = 20
+	drv := initDriver(t, env)
+	drv.minTicks = 100
+
+	var (
+		periodicTimer, _ = Acquire(true)
+		oneShotTimer, _  = Acquire(false)
+		levelTimer, _    = Acquire(false)
+		periodicCalls    int
+		oneShotCalls     int
+		levelCalls       int
+	)
+
+	t.Run("not acquired", func(t *testing.T) {
+		timer := &Timer{drv: drv}
+		if err := timer.OneShot(1, nil); err != errTimerNotAcquired {
+			t.Errorf("expected to get errTimerNotAcquired; got %v", err)
+		}
+		if err := timer.SetPeriodic(1, nil); err != errTimerNotAcquired {
+			t.Errorf("expected to get errTimerNotAcquired; got %v", err)
+		}
+	})
+
+	t.Run("periodic unsupported", func(t *testing.T) {
+		if oneShotTimer.Periodic() {
+			t.Fatal("expected timer 1 not to support periodic mode")
+		}
+
+		if err := oneShotTimer.SetPeriodic(1000, nil); err != errPeriodicUnsupported {
+			t.Fatalf("expected to get errPeriodicUnsupported; got %v", err)
+		}
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		*env.reg(regMainCounter) = 1000
+
+		// 10ms at 100MHz = 1000000 ticks. As the comparator register
+		// is mocked, only the last write (the period) is visible.
+		if err := periodicTimer.SetPeriodic(10000000, func() { periodicCalls++ }); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, exp := *env.timerReg(0, 0), timerIntEnable|timerPeriodic|timerValueSet; got != exp {
+			t.Errorf("expected timer config to be 0x%x; got 0x%x", exp, got)
+		}
+
+		if got, exp := *env.timerReg(0, regTimerComparator), uint64(1000000); got != exp {
+			t.Errorf("expected comparator to be %d; got %d", exp, got)
+		}
+
+		// Periodic timers remain armed after their callback is invoked
+		timerIRQHandler(&gate.Registers{Info: uint64(legacyTimer0Line)})
+		if periodicCalls != 1 || *env.timerReg(0, 0)&timerIntEnable == 0 {
+			t.Error("expected periodic timer callback to be invoked and the timer to remain armed")
+		}
+
+		periodicTimer.Stop()
+		if got := *env.timerReg(0, 0); got&(timerIntEnable|timerPeriodic) != 0 {
+			t.Errorf("expected Stop to disarm the timer; config: 0x%x", got)
+		}
+	})
+
+	t.Run("one-shot", func(t *testing.T) {
+		*env.reg(regMainCounter) = 1000
+
+		// The delay is below the minimum tick count
+		if err := oneShotTimer.OneShot(1, func() { oneShotCalls++ }); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, exp := *env.timerReg(1, 0), timerIntEnable; got != exp {
+			t.Errorf("expected timer config to be 0x%x; got 0x%x", exp, got)
+		}
+
+		if got, exp := *env.timerReg(1, regTimerComparator), uint64(1100); got != exp {
+			t.Errorf("expected comparator to be %d; got %d", exp, got)
+		}
+
+		timerIRQHandler(&gate.Registers{Info: uint64(legacyTimer1Line)})
+		if oneShotCalls != 1 || *env.timerReg(1, 0)&timerIntEnable != 0 {
+			t.Error("expected one-shot timer callback to be invoked and the timer to be disarmed")
+		}
+	})
+
+	t.Run("level-triggered", func(t *testing.T) {
+		*env.reg(regIntStatus) = 0
+		*env.reg(regMainCounter) = 0
+		if err := levelTimer.OneShot(2*time.NanosecondsPerSecond, func() { levelCalls++ }); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, exp := *env.timerReg(2, regTimerComparator), 2*testFreq; got != exp {
+			t.Errorf("expected comparator to be %d; got %d", exp, got)
+		}
+
+		timerIRQHandler(&gate.Registers{Info: 20})
+		if levelCalls != 1 {
+			t.Error("expected level-triggered timer callback to be invoked")
+		}
+
+		if got := *env.reg(regIntStatus); got != 1<<2 {
+			t.Errorf("expected the interrupt status of timer 2 to be cleared; got 0x%x", got)
+		}
+
+		// Timers without a callback and unrelated lines are ignored
+		levelTimer.fn = nil
+		timerIRQHandler(&gate.Registers{Info: 20})
+		timerIRQHandler(&gate.Registers{Info: 5})
+		if levelCalls != 1 {
+			t.Error("expected callback not to be invoked")
+		}
+	})
+}
+
+func TestTicks(t *testing.T) {
+	drv := &Driver{frequency: testFreq}
+
+	specs := []struct {
+		ns       uint64
+		minTicks uint64
+		exp      uint64
+	}{
+		{0, 0, 1},
+		{10, 0, 1},
+		{1000, 0, 100},
+		{1000, 500, 500},
+		{3*time.NanosecondsPerSecond + 50, 0, 3*testFreq + 5},
+	}
+
+	for specIndex, spec := range specs {
+		drv.minTicks = spec.minTicks
+		if got := drv.ticks(spec.ns); got != spec.exp {
+			t.Errorf("[spec %d] expected ticks(%d) to return %d; got %d", specIndex, spec.ns, spec.exp, got)
+		}
+	}
+}
+
+func TestHPETTable(t *testing.T) {
+	if exp, got := uintptr(56), unsafe.Sizeof(table.HPET{}); got != exp {
+		t.Fatalf("expected HPET table size to be %d; got %d", exp, got)
+	}
+
+	hpet := table.HPET{
+		BaseAddressLo:  0xfed00000,
+		BaseAddressHi:  0x1,
+		MinClockTickLo: 0x80,
+		MinClockTickHi: 0x01,
+	}
+
+	if got, exp := hpet.BaseAddress(), uint64(0x1fed00000); got != exp {
+		t.Errorf("expected BaseAddress() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := hpet.MinClockTick(), uint16(0x180); got != exp {
+		t.Errorf("expected MinClockTick() to return 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	defer restoreMocks()
+
+	lookupTableFn = func(_ string) *table.SDTHeader { return nil }
+	if drv := probeForHPET(); drv != nil {
+		t.Fatal("expected probe to return nil when the HPET table is missing")
+	}
+
+	var hpet table.HPET
+	lookupTableFn = func(signature string) *table.SDTHeader {
+		if signature != hpetSignature {
+			t.Errorf("unexpected table lookup: %s", signature)
+		}
+		return &hpet.SDTHeader
+	}
+
+	drv := probeForHPET()
+	if drv == nil {
+		t.Fatal("expected probe to return a driver")
+	}
+
+	if drv.DriverName() != "HPET" {
+		t.Errorf("unexpected driver name: %s", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+
+	if src := drv.(*Driver); src.Name() != "hpet" || src.Rating() != hpetRating {
+		t.Errorf("unexpected clock source name %q or rating %d", src.Name(), src.Rating())
+	}
+}
@@ -0,0 +1,178 @@
+// Package pic provides a driver for the legacy 8259 programmable interrupt
+// controller (PIC). PCs contain two cascaded PICs which provide 16 IRQ lines;
+// the slave PIC is connected to line 2 of the master PIC.
+package pic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"io"
+)
+
+const (
+	masterCmdPort  = uint16(0x20)
+	masterDataPort = uint16(0x21)
+	slaveCmdPort   = uint16(0xa0)
+	slaveDataPort  = uint16(0xa1)
+
+	// ioDelayPort is an unused port that is written to in order to give
+	// the PICs enough time to process initialization commands.
+	ioDelayPort = uint16(0x80)
+
+	// icw1Init starts the initialization sequence (in cascade mode) and
+	// indicates that ICW4 will be sent.
+	icw1Init = uint8(0x11)
+
+	// icw4Mode8086 selects the 8086/88 operating mode.
+	icw4Mode8086 = uint8(0x01)
+
+	// ocw3ReadISR instructs the PIC to return the contents of its
+	// in-service register on the next read from its command port.
+	ocw3ReadISR = uint8(0x0b)
+
+	// cmdEOI is the non-specific end-of-interrupt command.
+	cmdEOI = uint8(0x20)
+
+	// cascadeLine is the master PIC line that the slave PIC is wired to.
+	cascadeLine = uint8(2)
+
+	// numLines is the number of IRQ lines provided by both PICs.
+	numLines = 16
+)
+
+var (
+	// The following functions are used by tests to mock port I/O and are
+	// automatically inlined by the compiler.
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn  = cpu.PortReadByte
+	setControllerFn = irq.SetController
+)
+
+// Driver implements a device driver and an irq.Controller for the cascaded
+// 8259 PICs.
+type Driver struct {
+	// mask caches the interrupt mask registers of both PICs; bits 0-7
+	// correspond to the master PIC and bits 8-15 to the slave PIC.
+	mask uint16
+}
+
+// DriverName returns the name of this driver.
+func (drv *Driver) DriverName() string {
+	return "pic8259"
+}
+
+// DriverVersion returns the version of this driver.
+func (drv *Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit remaps the PIC IRQs so they start at irq.VectorBase, masks all
+// IRQ lines and installs the driver as the active interrupt controller.
+func (drv *Driver) DriverInit(_ io.Writer) *kernel.Error {
+	// The 8259 PICs are initialized by sending 4 initialization command
+	// words (ICW) to each PIC.
+	drv.write(masterCmdPort, icw1Init)
+	drv.write(slaveCmdPort, icw1Init)
+	drv.write(masterDataPort, uint8(irq.VectorBase))
+	drv.write(slaveDataPort, uint8(irq.VectorBase)+8)
+	drv.write(masterDataPort, 1<<cascadeLine)
+	drv.write(slaveDataPort, cascadeLine)
+	drv.write(masterDataPort, icw4Mode8086)
+	drv.write(slaveDataPort, icw4Mode8086)
+
+	// Mask everything except for the cascade line so that unmasking a
+	// slave line is enough to receive its interrupts.
+	drv.mask = 0xffff &^ (1 << cascadeLine)
+	drv.syncMask()
+
+	setControllerFn(drv)
+	return nil
+}
+
+// Disable masks all IRQ lines. It is used when switching to a different
+// interrupt controller.
+func (drv *Driver) Disable() {
+	drv.mask = 0xffff
+	drv.syncMask()
+}
+
+// Lines returns the number of IRQ lines supported by the PICs.
+func (drv *Driver) Lines() int {
+	return numLines
+}
+
+// Mask prevents the PICs from raising interrupts for line.
+func (drv *Driver) Mask(line uint8) {
+	drv.mask |= 1 << line
+	drv.syncMask()
+}
+
+// Unmask allows the PICs to raise interrupts for line.
+func (drv *Driver) Unmask(line uint8) {
+	drv.mask &^= 1 << line
+	drv.syncMask()
+}
+
+// EOI signals the end of the interrupt raised for line. Interrupts raised by
+// the slave PIC need to be acknowledged by both PICs.
+func (drv *Driver) EOI(line uint8) {
+	if line >= 8 {
+		portWriteByteFn(slaveCmdPort, cmdEOI)
+	}
+	portWriteByteFn(masterCmdPort, cmdEOI)
+}
+
+// Spurious returns true if an interrupt raised for line is spurious. A PIC
+// raises a spurious interrupt on its lowest priority line (IRQ7 for the
+// master, IRQ15 for the slave) when the device that asserted an IRQ deasserts
+// it before the CPU acknowledges the interrupt. Spurious interrupts can be
+// identified by checking whether the line is set in the in-service register.
+func (drv *Driver) Spurious(line uint8) bool {
+	switch line {
+	case 7:
+		return readISR(masterCmdPort)&(1<<7) == 0
+	case 15:
+		if readISR(slaveCmdPort)&(1<<7) != 0 {
+			return false
+		}
+
+		// The master PIC is not aware that the slave interrupt was
+		// spurious and still expects an EOI for the cascade line.
+		portWriteByteFn(masterCmdPort, cmdEOI)
+		return true
+	}
+
+	return false
+}
+
+// syncMask writes the cached interrupt masks to the PIC data ports.
+func (drv *Driver) syncMask() {
+	portWriteByteFn(masterDataPort, uint8(drv.mask))
+	portWriteByteFn(slaveDataPort, uint8(drv.mask>>8))
+}
+
+// write sends a command to a PIC port and waits for the PIC to process it.
+func (drv *Driver) write(port uint16, val uint8) {
+	portWriteByteFn(port, val)
+	portWriteByteFn(ioDelayPort, 0)
+}
+
+// readISR returns the contents of the in-service register for the PIC with
+// the specified command port.
+func readISR(cmdPort uint16) uint8 {
+	portWriteByteFn(cmdPort, ocw3ReadISR)
+	return portReadByteFn(cmdPort)
+}
+
+func probeForPIC() device.Driver {
+	return &Driver{}
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderBeforeACPI,
+		Probe: probeForPIC,
+	})
+}
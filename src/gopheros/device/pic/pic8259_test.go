@@ -0,0 +1,173 @@
+package pic
+
+import (
+	"gopheros/device"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/irq"
+	"testing"
+)
+
+type portWrite struct {
+	port uint16
+	val  uint8
+}
+
+func mockPorts(isr map[uint16]uint8) *[]portWrite {
+	var writes []portWrite
+
+	portWriteByteFn = func(port uint16, val uint8) {
+		// Skip the I/O delay writes
+		if port != ioDelayPort {
+			writes = append(writes, portWrite{port, val})
+		}
+	}
+	portReadByteFn = func(port uint16) uint8 { return isr[port] }
+
+	return &writes
+}
+
+func resetMocks() {
+	portWriteByteFn = cpu.PortWriteByte
+	portReadByteFn = cpu.PortReadByte
+	setControllerFn = irq.SetController
+}
+
+func TestDriverInit(t *testing.T) {
+	defer resetMocks()
+	writes := mockPorts(nil)
+
+	var installed irq.Controller
+	setControllerFn = func(c irq.Controller) { installed = c }
+
+	drv := probeForPIC().(*Driver)
+	if err := drv.DriverInit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []portWrite{
+		{masterCmdPort, icw1Init},
+		{slaveCmdPort, icw1Init},
+		{masterDataPort, 0x20},
+		{slaveDataPort, 0x28},
+		{masterDataPort, 0x04},
+		{slaveDataPort, 0x02},
+		{masterDataPort, icw4Mode8086},
+		{slaveDataPort, icw4Mode8086},
+		{masterDataPort, 0xfb},
+		{slaveDataPort, 0xff},
+	}
+
+	if len(*writes) != len(exp) {
+		t.Fatalf("expected %d port writes; got %d: %v", len(exp), len(*writes), *writes)
+	}
+
+	for index, w := range *writes {
+		if w != exp[index] {
+			t.Errorf("[write %d] expected 0x%x to be written to port 0x%x; got 0x%x to port 0x%x", index, exp[index].val, exp[index].port, w.val, w.port)
+		}
+	}
+
+	if installed != drv {
+		t.Fatal("expected driver to be installed as the interrupt controller")
+	}
+
+	if drv.DriverName() == "" {
+		t.Fatal("DriverName() returned an empty string")
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major+minor+patch == 0 {
+		t.Fatal("DriverVersion() returned an invalid version number")
+	}
+
+	if drv.Lines() != 16 {
+		t.Fatalf("expected driver to support 16 lines; got %d", drv.Lines())
+	}
+}
+
+func TestMaskAndEOI(t *testing.T) {
+	defer resetMocks()
+	writes := mockPorts(nil)
+
+	drv := &Driver{mask: 0xfffb}
+
+	drv.Unmask(1)
+	drv.Unmask(12)
+	drv.Mask(1)
+
+	if drv.mask != 0xeffb {
+		t.Fatalf("expected mask to be 0xeffb; got 0x%x", drv.mask)
+	}
+
+	if got := (*writes)[len(*writes)-2:]; got[0] != (portWrite{masterDataPort, 0xfb}) || got[1] != (portWrite{slaveDataPort, 0xef}) {
+		t.Fatalf("unexpected mask writes: %v", got)
+	}
+
+	*writes = nil
+	drv.EOI(3)
+	drv.EOI(12)
+
+	exp := []portWrite{
+		{masterCmdPort, cmdEOI},
+		{slaveCmdPort, cmdEOI},
+		{masterCmdPort, cmdEOI},
+	}
+	if len(*writes) != len(exp) || (*writes)[0] != exp[0] || (*writes)[1] != exp[1] || (*writes)[2] != exp[2] {
+		t.Fatalf("expected EOI writes %v; got %v", exp, *writes)
+	}
+
+	drv.Disable()
+	if drv.mask != 0xffff {
+		t.Fatalf("expected all lines to be masked; got 0x%x", drv.mask)
+	}
+}
+
+func TestSpurious(t *testing.T) {
+	defer resetMocks()
+
+	specs := []struct {
+		line        uint8
+		masterISR   uint8
+		slaveISR    uint8
+		expSpurious bool
+		expEOI      bool
+	}{
+		{1, 0, 0, false, false},
+		{7, 0x80, 0, false, false},
+		{7, 0x00, 0, true, false},
+		{15, 0, 0x80, false, false},
+		{15, 0, 0x00, true, true},
+	}
+
+	drv := &Driver{}
+	for specIndex, spec := range specs {
+		writes := mockPorts(map[uint16]uint8{
+			masterCmdPort: spec.masterISR,
+			slaveCmdPort:  spec.slaveISR,
+		})
+
+		if got := drv.Spurious(spec.line); got != spec.expSpurious {
+			t.Errorf("[spec %d] expected Spurious to return %t; got %t", specIndex, spec.expSpurious, got)
+		}
+
+		var gotEOI bool
+		for _, w := range *writes {
+			if w == (portWrite{masterCmdPort, cmdEOI}) {
+				gotEOI = true
+			}
+		}
+
+		if gotEOI != spec.expEOI {
+			t.Errorf("[spec %d] expected master EOI to be sent: %t", specIndex, spec.expEOI)
+		}
+	}
+}
+
+func TestProbeRegistration(t *testing.T) {
+	for _, info := range device.DriverList() {
+		if _, ok := info.Probe().(*Driver); ok {
+			return
+		}
+	}
+
+	t.Fatal("expected the PIC driver to be registered")
+}
@@ -0,0 +1,274 @@
+// Package rtc provides a driver for the CMOS real-time clock (RTC). The driver
+// reads the current date and time from the RTC and uses it to seed the kernel
+// wall clock. In addition, the RTC periodic interrupt can be used as a
+// fallback tick source.
+package rtc
+
+import (
+	"gopheros/device"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/time"
+	"io"
+	"unsafe"
+)
+
+const (
+	cmosIndexPort = uint16(0x70)
+	cmosDataPort  = uint16(0x71)
+
+	regSeconds = uint8(0x00)
+	regMinutes = uint8(0x02)
+	regHours   = uint8(0x04)
+	regDay     = uint8(0x07)
+	regMonth   = uint8(0x08)
+	regYear    = uint8(0x09)
+	regStatusA = uint8(0x0a)
+	regStatusB = uint8(0x0b)
+	regStatusC = uint8(0x0c)
+
+	// Status register A fields.
+	statusAUpdateInProgress = uint8(1 << 7)
+	statusARateMask         = uint8(0x0f)
+
+	// Status register B fields.
+	statusB24Hour            = uint8(1 << 1)
+	statusBBinary            = uint8(1 << 2)
+	statusBPeriodicInterrupt = uint8(1 << 6)
+
+	// hourPM is set in the hours register for PM times in 12-hour mode.
+	hourPM = uint8(1 << 7)
+
+	// rtcLine is the IRQ line used by the RTC.
+	rtcLine = uint8(8)
+
+	// baseFrequency is the frequency of the RTC oscillator. The periodic
+	// interrupt frequency is baseFrequency >> (rate-1).
+	baseFrequency = uint32(32768)
+
+	// The RTC only supports the rates 3 (8192 Hz) to 15 (2 Hz) for the
+	// periodic interrupt.
+	minRate = uint8(3)
+	maxRate = uint8(15)
+
+	// defaultCentury is used when the FADT does not define a century
+	// register.
+	defaultCentury = 2000
+
+	fadtSignature = "FACP"
+)
+
+var (
+	errInvalidRate = &kernel.Error{Module: "rtc", Message: "invalid RTC periodic interrupt rate"}
+
+	// The following functions are used by tests to mock calls to the cpu,
+	// irq, time and acpi packages and are automatically inlined by the
+	// compiler.
+	portReadByteFn      = cpu.PortReadByte
+	portWriteByteFn     = cpu.PortWriteByte
+	registerHandlerFn   = irq.RegisterHandler
+	unregisterHandlerFn = irq.UnregisterHandler
+	setWallClockFn      = time.SetWallClock
+	lookupTableFn       = acpi.LookupTable
+
+	// periodicFn is invoked by the RTC interrupt handler.
+	periodicFn func()
+)
+
+// DateTime describes a date and time read from the RTC.
+type DateTime struct {
+	Year   int
+	Month  int
+	Day    int
+	Hour   int
+	Minute int
+	Second int
+}
+
+// rawDateTime contains the unprocessed contents of the RTC date and time
+// registers.
+type rawDateTime struct {
+	second, minute, hour, day, month, year, century uint8
+}
+
+// Driver implements a device driver for the CMOS RTC.
+type Driver struct {
+	// centuryReg is the index of the CMOS register that holds the century
+	// or 0 if the system does not provide one.
+	centuryReg uint8
+}
+
+// DriverName returns the name of this driver.
+func (drv *Driver) DriverName() string {
+	return "rtc_cmos"
+}
+
+// DriverVersion returns the version of this driver.
+func (drv *Driver) DriverVersion() (uint16, uint16, uint16) {
+	return 0, 0, 1
+}
+
+// DriverInit reads the current date and time from the RTC and uses it to seed
+// the wall clock.
+func (drv *Driver) DriverInit(w io.Writer) *kernel.Error {
+	now := drv.Read()
+	setWallClockFn(time.UnixSeconds(now.Year, now.Month, now.Day, now.Hour, now.Minute, now.Second), 0)
+
+	kfmt.Fprintf(w, "%d-%s-%s %s:%s:%s UTC\n", now.Year, twoDigits(now.Month), twoDigits(now.Day), twoDigits(now.Hour), twoDigits(now.Minute), twoDigits(now.Second))
+	return nil
+}
+
+// Read returns the date and time stored in the RTC. The RTC is assumed to
+// keep time in UTC.
+func (drv *Driver) Read() DateTime {
+	// The registers are read repeatedly until two consecutive reads match to
+	// make sure that no update occurred while they were being read.
+	cur := drv.readRaw()
+	for {
+		prev := cur
+		if cur = drv.readRaw(); cur == prev {
+			break
+		}
+	}
+
+	statusB := readRegister(regStatusB)
+	if statusB&statusBBinary == 0 {
+		cur.second = bcdToBinary(cur.second)
+		cur.minute = bcdToBinary(cur.minute)
+		cur.hour = bcdToBinary(cur.hour&^hourPM) | cur.hour&hourPM
+		cur.day = bcdToBinary(cur.day)
+		cur.month = bcdToBinary(cur.month)
+		cur.year = bcdToBinary(cur.year)
+		cur.century = bcdToBinary(cur.century)
+	}
+
+	// In 12-hour mode, 12AM is encoded as 12 and 12PM as 12|hourPM.
+	if statusB&statusB24Hour == 0 {
+		pm := cur.hour&hourPM != 0
+		cur.hour = (cur.hour &^ hourPM) % 12
+		if pm {
+			cur.hour += 12
+		}
+	}
+
+	year := defaultCentury + int(cur.year)
+	if drv.centuryReg != 0 {
+		year = int(cur.century)*100 + int(cur.year)
+	}
+
+	return DateTime{
+		Year:   year,
+		Month:  int(cur.month),
+		Day:    int(cur.day),
+		Hour:   int(cur.hour),
+		Minute: int(cur.minute),
+		Second: int(cur.second),
+	}
+}
+
+// readRaw waits for any RTC update in progress to complete and reads the date
+// and time registers.
+func (drv *Driver) readRaw() rawDateTime {
+	for readRegister(regStatusA)&statusAUpdateInProgress != 0 {
+	}
+
+	raw := rawDateTime{
+		second: readRegister(regSeconds),
+		minute: readRegister(regMinutes),
+		hour:   readRegister(regHours),
+		day:    readRegister(regDay),
+		month:  readRegister(regMonth),
+		year:   readRegister(regYear),
+	}
+
+	if drv.centuryReg != 0 {
+		raw.century = readRegister(drv.centuryReg)
+	}
+
+	return raw
+}
+
+// StartPeriodicInterrupt enables the RTC periodic interrupt and arranges for
+// fn to be invoked at a frequency of 32768 >> (rate-1) Hz. The rate must be in
+// the range [3, 15]. The callback runs in interrupt context.
+func StartPeriodicInterrupt(rate uint8, fn func()) *kernel.Error {
+	if rate < minRate || rate > maxRate {
+		return errInvalidRate
+	}
+
+	if err := registerHandlerFn(rtcLine, rtcIRQHandler); err != nil {
+		return err
+	}
+
+	periodicFn = fn
+	writeRegister(regStatusA, readRegister(regStatusA)&^statusARateMask|rate)
+	writeRegister(regStatusB, readRegister(regStatusB)|statusBPeriodicInterrupt)
+
+	// Reading status register C clears any pending interrupt
+	readRegister(regStatusC)
+	return nil
+}
+
+// StopPeriodicInterrupt disables the RTC periodic interrupt.
+func StopPeriodicInterrupt() *kernel.Error {
+	writeRegister(regStatusB, readRegister(regStatusB)&^statusBPeriodicInterrupt)
+	periodicFn = nil
+	return unregisterHandlerFn(rtcLine)
+}
+
+// PeriodicFrequency returns the frequency of the RTC periodic interrupt for the
+// specified rate.
+func PeriodicFrequency(rate uint8) uint32 {
+	return baseFrequency >> (rate - 1)
+}
+
+// rtcIRQHandler services the RTC periodic interrupt.
+func rtcIRQHandler(_ *gate.Registers) {
+	// The RTC does not raise further interrupts until status register C
+	// is read.
+	readRegister(regStatusC)
+
+	if periodicFn != nil {
+		periodicFn()
+	}
+}
+
+func readRegister(reg uint8) uint8 {
+	portWriteByteFn(cmosIndexPort, reg)
+	return portReadByteFn(cmosDataPort)
+}
+
+func writeRegister(reg, val uint8) {
+	portWriteByteFn(cmosIndexPort, reg)
+	portWriteByteFn(cmosDataPort, val)
+}
+
+func bcdToBinary(v uint8) uint8 {
+	return (v>>4)*10 + v&0x0f
+}
+
+// twoDigits formats a value in the range [0, 99] as a zero-padded string.
+func twoDigits(v int) string {
+	return string([]byte{byte('0' + v/10), byte('0' + v%10)})
+}
+
+func probeForRTC() device.Driver {
+	drv := &Driver{}
+	if header := lookupTableFn(fadtSignature); header != nil {
+		drv.centuryReg = (*table.FADT)(unsafe.Pointer(header)).Century
+	}
+
+	return drv
+}
+
+func init() {
+	device.RegisterDriver(&device.DriverInfo{
+		Order: device.DetectOrderAfterACPI,
+		Probe: probeForRTC,
+	})
+}
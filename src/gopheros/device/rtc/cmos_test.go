@@ -0,0 +1,281 @@
+package rtc
+
+import (
+	"bytes"
+	"gopheros/device/acpi"
+	"gopheros/device/acpi/table"
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/irq"
+	"gopheros/kernel/time"
+	"testing"
+)
+
+// fakeCMOS emulates the CMOS registers. If updates is not empty, each read of
+// status register A pops the next entry and applies it to the registers before
+// the read completes.
+type fakeCMOS struct {
+	regs    [128]uint8
+	index   uint8
+	updates []func(regs *[128]uint8)
+}
+
+func (c *fakeCMOS) install() {
+	portWriteByteFn = func(port uint16, val uint8) {
+		switch port {
+		case cmosIndexPort:
+			c.index = val
+		case cmosDataPort:
+			c.regs[c.index] = val
+		}
+	}
+
+	portReadByteFn = func(port uint16) uint8 {
+		if port != cmosDataPort {
+			return 0
+		}
+
+		if c.index == regStatusA && len(c.updates) != 0 {
+			c.updates[0](&c.regs)
+			c.updates = c.updates[1:]
+		}
+
+		return c.regs[c.index]
+	}
+}
+
+func (c *fakeCMOS) setTime(year, month, day, hour, minute, second uint8) {
+	c.regs[regYear] = year
+	c.regs[regMonth] = month
+	c.regs[regDay] = day
+	c.regs[regHours] = hour
+	c.regs[regMinutes] = minute
+	c.regs[regSeconds] = second
+}
+
+func restoreMocks() {
+	portReadByteFn = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+	registerHandlerFn = irq.RegisterHandler
+	unregisterHandlerFn = irq.UnregisterHandler
+	setWallClockFn = time.SetWallClock
+	lookupTableFn = acpi.LookupTable
+	periodicFn = nil
+}
+
+func TestRead(t *testing.T) {
+	defer restoreMocks()
+
+	specs := []struct {
+		statusB    uint8
+		centuryReg uint8
+		century    uint8
+		regs       [6]uint8
+		exp        DateTime
+	}{
+		// BCD, 24-hour mode, no century register
+		{
+			statusB: statusB24Hour,
+			regs:    [6]uint8{0x26, 0x10, 0x18, 0x23, 0x59, 0x58},
+			exp:     DateTime{2026, 10, 18, 23, 59, 58},
+		},
+		// Binary, 24-hour mode, century register
+		{
+			statusB:    statusB24Hour | statusBBinary,
+			centuryReg: 0x32,
+			century:    19,
+			regs:       [6]uint8{99, 12, 31, 13, 5, 7},
+			exp:        DateTime{1999, 12, 31, 13, 5, 7},
+		},
+		// BCD, 12-hour mode, BCD century register
+		{
+			centuryReg: 0x32,
+			century:    0x21,
+			regs:       [6]uint8{0x01, 0x02, 0x03, hourPM | 0x11, 0x30, 0x00},
+			exp:        DateTime{2101, 2, 3, 23, 30, 0},
+		},
+		// BCD, 12-hour mode, 12AM
+		{
+			regs: [6]uint8{0x20, 0x01, 0x01, 0x12, 0x00, 0x00},
+			exp:  DateTime{2020, 1, 1, 0, 0, 0},
+		},
+		// Binary, 12-hour mode, 12PM
+		{
+			statusB: statusBBinary,
+			regs:    [6]uint8{20, 1, 1, hourPM | 12, 0, 0},
+			exp:     DateTime{2020, 1, 1, 12, 0, 0},
+		},
+	}
+
+	for specIndex, spec := range specs {
+		cmos := &fakeCMOS{}
+		cmos.install()
+		cmos.regs[regStatusB] = spec.statusB
+		cmos.regs[spec.centuryReg] = spec.century
+		cmos.setTime(spec.regs[0], spec.regs[1], spec.regs[2], spec.regs[3], spec.regs[4], spec.regs[5])
+
+		drv := &Driver{centuryReg: spec.centuryReg}
+		if got := drv.Read(); got != spec.exp {
+			t.Errorf("[spec %d] expected Read() to return %v; got %v", specIndex, spec.exp, got)
+		}
+	}
+
+	t.Run("update in progress", func(t *testing.T) {
+		cmos := &fakeCMOS{}
+		cmos.install()
+		cmos.regs[regStatusB] = statusB24Hour | statusBBinary
+		cmos.setTime(26, 10, 18, 23, 59, 59)
+
+		cmos.updates = []func(regs *[128]uint8){
+			// The first read waits for an update to complete
+			func(regs *[128]uint8) { regs[regStatusA] = statusAUpdateInProgress },
+			func(regs *[128]uint8) { regs[regStatusA] = 0 },
+			// The time changes between the first and second read
+			func(regs *[128]uint8) {
+				regs[regDay], regs[regHours], regs[regMinutes], regs[regSeconds] = 19, 0, 0, 0
+			},
+		}
+
+		exp := DateTime{2026, 10, 19, 0, 0, 0}
+		if got := (&Driver{}).Read(); got != exp {
+			t.Fatalf("expected Read() to return %v; got %v", exp, got)
+		}
+	})
+}
+
+func TestDriverInit(t *testing.T) {
+	defer restoreMocks()
+
+	cmos := &fakeCMOS{}
+	cmos.install()
+	cmos.regs[regStatusB] = statusB24Hour
+	cmos.setTime(0x26, 0x10, 0x08, 0x09, 0x05, 0x03)
+
+	var gotSec int64
+	setWallClockFn = func(sec int64, _ int32) { gotSec = sec }
+
+	var buf bytes.Buffer
+	drv := &Driver{}
+	if err := drv.DriverInit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := time.UnixSeconds(2026, 10, 8, 9, 5, 3); gotSec != exp {
+		t.Errorf("expected wall clock to be set to %d; got %d", exp, gotSec)
+	}
+
+	if exp := "2026-10-08 09:05:03 UTC\n"; buf.String() != exp {
+		t.Errorf("expected driver output to be %q; got %q", exp, buf.String())
+	}
+
+	if drv.DriverName() != "rtc_cmos" {
+		t.Errorf("unexpected driver name: %s", drv.DriverName())
+	}
+
+	if major, minor, patch := drv.DriverVersion(); major != 0 || minor != 0 || patch != 1 {
+		t.Errorf("unexpected driver version: %d.%d.%d", major, minor, patch)
+	}
+}
+
+func TestPeriodicInterrupt(t *testing.T) {
+	defer restoreMocks()
+
+	cmos := &fakeCMOS{}
+	cmos.install()
+	cmos.regs[regStatusA] = 0x26
+	cmos.regs[regStatusB] = statusB24Hour
+
+	var (
+		registeredLine = -1
+		handler        irq.Handler
+		calls          int
+	)
+	registerHandlerFn = func(line uint8, h irq.Handler) *kernel.Error {
+		registeredLine, handler = int(line), h
+		return nil
+	}
+	unregisterHandlerFn = func(line uint8) *kernel.Error {
+		registeredLine = -1
+		return nil
+	}
+
+	for _, rate := range []uint8{0, minRate - 1, maxRate + 1} {
+		if err := StartPeriodicInterrupt(rate, nil); err != errInvalidRate {
+			t.Errorf("expected to get errInvalidRate for rate %d; got %v", rate, err)
+		}
+	}
+
+	if err := StartPeriodicInterrupt(10, func() { calls++ }); err != nil {
+		t.Fatal(err)
+	}
+
+	if registeredLine != int(rtcLine) {
+		t.Fatalf("expected handler to be registered for line %d; got %d", rtcLine, registeredLine)
+	}
+
+	if got, exp := cmos.regs[regStatusA], uint8(0x2a); got != exp {
+		t.Errorf("expected status register A to be 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := cmos.regs[regStatusB], statusB24Hour|statusBPeriodicInterrupt; got != exp {
+		t.Errorf("expected status register B to be 0x%x; got 0x%x", exp, got)
+	}
+
+	cmos.index = 0
+	handler(&gate.Registers{Info: uint64(rtcLine)})
+	if calls != 1 || cmos.index != regStatusC {
+		t.Error("expected handler to acknowledge the interrupt and invoke the callback")
+	}
+
+	if err := StopPeriodicInterrupt(); err != nil {
+		t.Fatal(err)
+	}
+
+	if registeredLine != -1 || cmos.regs[regStatusB] != statusB24Hour {
+		t.Error("expected StopPeriodicInterrupt to disable the interrupt and unregister the handler")
+	}
+
+	// Interrupts received after the callback is removed are ignored
+	rtcIRQHandler(&gate.Registers{})
+	if calls != 1 {
+		t.Error("expected callback not to be invoked")
+	}
+
+	t.Run("register error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "line in use"}
+		registerHandlerFn = func(_ uint8, _ irq.Handler) *kernel.Error { return expErr }
+
+		if err := StartPeriodicInterrupt(10, nil); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+
+	for rate, exp := range map[uint8]uint32{3: 8192, 6: 1024, 15: 2} {
+		if got := PeriodicFrequency(rate); got != exp {
+			t.Errorf("expected frequency for rate %d to be %d; got %d", rate, exp, got)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	defer restoreMocks()
+
+	lookupTableFn = func(_ string) *table.SDTHeader { return nil }
+	if drv := probeForRTC().(*Driver); drv.centuryReg != 0 {
+		t.Fatalf("expected century register to be 0 without a FADT; got 0x%x", drv.centuryReg)
+	}
+
+	var fadt table.FADT
+	fadt.Century = 0x32
+	lookupTableFn = func(signature string) *table.SDTHeader {
+		if signature != fadtSignature {
+			t.Errorf("unexpected table lookup: %s", signature)
+		}
+		return &fadt.SDTHeader
+	}
+
+	if drv := probeForRTC().(*Driver); drv.centuryReg != 0x32 {
+		t.Fatalf("expected century register to be 0x32; got 0x%x", drv.centuryReg)
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 var (
 	mapRegionFn          = vmm.MapRegion
+	mapMMIOFn            = vmm.MapMMIO
 	portWriteByteFn      = cpu.PortWriteByte
 	getFramebufferInfoFn = multiboot.GetFramebufferInfo
 )
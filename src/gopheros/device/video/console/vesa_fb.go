@@ -6,7 +6,6 @@ import (
 	"gopheros/device/video/console/logo"
 	"gopheros/kernel"
 	"gopheros/kernel/kfmt"
-	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
 	"gopheros/multiboot"
 	"image/color"
@@ -558,14 +557,11 @@ func (cons *VesaFbConsole) DriverVersion() (uint16, uint16, uint16) {
 
 // DriverInit initializes this driver.
 func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
-	// Map the framebuffer so we can write to it
+	// Map the framebuffer so we can write to it. Using write-combining
+	// allows the CPU to batch framebuffer writes which greatly speeds up
+	// operations like scrolling.
 	fbSize := uintptr(cons.height * cons.pitch)
-	fbPage, err := mapRegionFn(
-		mm.Frame(cons.fbPhysAddr>>mm.PageShift),
-		fbSize,
-		vmm.FlagPresent|vmm.FlagRW,
-	)
-
+	fbAddr, err := mapMMIOFn(cons.fbPhysAddr, fbSize, vmm.CacheModeWriteCombine)
 	if err != nil {
 		return err
 	}
@@ -573,10 +569,10 @@ func (cons *VesaFbConsole) DriverInit(w io.Writer) *kernel.Error {
 	cons.fb = *(*[]uint8)(unsafe.Pointer(&reflect.SliceHeader{
 		Len:  int(fbSize),
 		Cap:  int(fbSize),
-		Data: fbPage.Address(),
+		Data: fbAddr,
 	}))
 
-	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbPage.Address())
+	kfmt.Fprintf(w, "mapped framebuffer to 0x%x\n", fbAddr)
 	kfmt.Fprintf(w, "framebuffer dimensions: %dx%dx%d\n", cons.width, cons.height, cons.bpp)
 
 	cons.loadDefaultPalette()
@@ -8,7 +8,6 @@ import (
 	"gopheros/device/video/console/logo"
 	"gopheros/kernel"
 	"gopheros/kernel/cpu"
-	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
 	"gopheros/multiboot"
 	"image/color"
@@ -1438,7 +1437,7 @@ func TestVesaFbReplace24(t *testing.T) {
 
 func TestVesaFbDriverInterface(t *testing.T) {
 	defer func() {
-		mapRegionFn = vmm.MapRegion
+		mapMMIOFn = vmm.MapMMIO
 		portWriteByteFn = cpu.PortWriteByte
 	}()
 	var dev device.Driver = NewVesaFbConsole(320, 200, 8, 320, nil, uintptr(0xa0000))
@@ -1452,7 +1451,10 @@ func TestVesaFbDriverInterface(t *testing.T) {
 	}
 
 	t.Run("init success", func(t *testing.T) {
-		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mapMMIOFn = func(_, _ uintptr, mode vmm.CacheMode) (uintptr, *kernel.Error) {
+			if mode != vmm.CacheModeWriteCombine {
+				t.Errorf("expected framebuffer to be mapped with CacheModeWriteCombine; got %d", mode)
+			}
 			return 0xa0000, nil
 		}
 
@@ -1465,7 +1467,7 @@ func TestVesaFbDriverInterface(t *testing.T) {
 
 	t.Run("init fail", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
-		mapRegionFn = func(_ mm.Frame, _ uintptr, _ vmm.PageTableEntryFlag) (mm.Page, *kernel.Error) {
+		mapMMIOFn = func(_, _ uintptr, _ vmm.CacheMode) (uintptr, *kernel.Error) {
 			return 0, expErr
 		}
 
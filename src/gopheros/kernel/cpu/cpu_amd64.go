@@ -16,21 +16,57 @@ func Halt()
 // FlushTLBEntry flushes a TLB entry for a particular virtual address.
 func FlushTLBEntry(virtAddr uintptr)
 
+// FlushTLB flushes all non-global TLB entries. If process-context
+// identifiers are enabled, only the entries tagged with the active PCID are
+// flushed.
+func FlushTLB()
+
 // SwitchPDT sets the root page table directory to point to the specified
-// physical address and flushes the TLB.
+// physical address and flushes the TLB. If process-context identifiers are
+// enabled, the lower 12 bits of pdtPhysAddr select the PCID to switch to and
+// setting bit 63 preserves the TLB entries tagged with it.
 func SwitchPDT(pdtPhysAddr uintptr)
 
 // ActivePDT returns the physical address of the currently active page table.
+// Any PCID bits in the CR3 register are masked out.
 func ActivePDT() uintptr
 
 // ReadCR2 returns the value stored in the CR2 register.
 func ReadCR2() uint64
 
+// ReadCR3 returns the value stored in the CR3 register. Unlike ActivePDT, the
+// PCID and cache control bits are not masked.
+func ReadCR3() uint64
+
+// ReadCR0 returns the value stored in the CR0 register.
+func ReadCR0() uint64
+
+// WriteCR0 stores a value to the CR0 register.
+func WriteCR0(val uint64)
+
+// ReadCR4 returns the value stored in the CR4 register.
+func ReadCR4() uint64
+
+// WriteCR4 stores a value to the CR4 register.
+func WriteCR4(val uint64)
+
+// ReadMSR returns the value of the model-specific register with the given
+// index.
+func ReadMSR(reg uint32) uint64
+
+// WriteMSR stores a value to the model-specific register with the given index.
+func WriteMSR(reg uint32, val uint64)
+
 // ID returns information about the CPU and its features. It
 // is implemented as a CPUID instruction with EAX=leaf and
-// returns the values in EAX, EBX, ECX and EDX.
+// ECX=0 and returns the values in EAX, EBX, ECX and EDX.
+// Leaves that support sub-leaves report sub-leaf 0.
 func ID(leaf uint32) (uint32, uint32, uint32, uint32)
 
+// IDSubleaf is a variant of ID that allows the caller to specify the sub-leaf
+// to be reported via ECX for leaves that support sub-leaves.
+func IDSubleaf(leaf, subleaf uint32) (uint32, uint32, uint32, uint32)
+
 // IsIntel returns true if the code is running on an Intel processor.
 func IsIntel() bool {
 	_, ebx, ecx, edx := cpuidFn(0)
@@ -56,3 +92,18 @@ func PortReadWord(port uint16) uint16
 
 // PortReadDword reads a uint32 value from the requested port.
 func PortReadDword(port uint16) uint32
+
+// ReadTSC returns the current value of the CPU time-stamp counter.
+func ReadTSC() uint64
+
+// ReadRandom returns a random value generated by the on-chip random number
+// generator using the RDRAND instruction. The second return value is false if
+// the generator could not provide a value. Callers must ensure that the CPU
+// supports RDRAND before invoking this function.
+func ReadRandom() (uint64, bool)
+
+// ReadRandomSeed returns a random value from the on-chip entropy source using
+// the RDSEED instruction. The second return value is false if the entropy
+// source could not provide a value. Callers must ensure that the CPU supports
+// RDSEED before invoking this function.
+func ReadRandomSeed() (uint64, bool)
@@ -18,14 +18,22 @@ TEXT ·FlushTLBEntry(SB),NOSPLIT,$0
 	INVLPG (AX)
 	RET
 
+TEXT ·FlushTLB(SB),NOSPLIT,$0
+	// reloading CR3 flushes all non-global TLB entries
+	MOVQ CR3, AX
+	MOVQ AX, CR3
+	RET
+
 TEXT ·SwitchPDT(SB),NOSPLIT,$0
-	// loading CR3 also triggers a TLB flush
+	// loading CR3 also triggers a TLB flush unless bit 63 is set
 	MOVQ pdtPhysAddr+0(FP), AX
 	MOVQ AX, CR3
 	RET
 
 TEXT ·ActivePDT(SB),NOSPLIT,$0
 	MOVQ CR3, AX
+	// mask the PCID and cache control bits
+	ANDQ $-4096, AX
 	MOVQ AX, ret+0(FP)
 	RET
 
@@ -34,13 +42,66 @@ TEXT ·ReadCR2(SB),NOSPLIT,$0
 	MOVQ AX, ret+0(FP)
 	RET
 
+TEXT ·ReadCR3(SB),NOSPLIT,$0
+	MOVQ CR3, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadCR0(SB),NOSPLIT,$0
+	MOVQ CR0, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR0(SB),NOSPLIT,$0
+	MOVQ val+0(FP), AX
+	MOVQ AX, CR0
+	RET
+
+TEXT ·ReadCR4(SB),NOSPLIT,$0
+	MOVQ CR4, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·WriteCR4(SB),NOSPLIT,$0
+	MOVQ val+0(FP), AX
+	MOVQ AX, CR4
+	RET
+
+TEXT ·ReadMSR(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	RDMSR
+	// RDMSR returns the 64-bit MSR value in EDX:EAX
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+8(FP)
+	RET
+
+TEXT ·WriteMSR(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	MOVQ val+8(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	WRMSR
+	RET
+
 TEXT ·ID(SB),NOSPLIT,$0
-	MOVQ leaf+0(FP), AX
+	MOVL leaf+0(FP), AX
+	XORL CX, CX
+	CPUID
+	MOVL AX, ret+8(FP)
+	MOVL BX, ret1+12(FP)
+	MOVL CX, ret2+16(FP)
+	MOVL DX, ret3+20(FP)
+	RET
+
+TEXT ·IDSubleaf(SB),NOSPLIT,$0
+	MOVL leaf+0(FP), AX
+	MOVL subleaf+4(FP), CX
 	CPUID
-	MOVL AX, ret+0(FP)
-	MOVL BX, ret+4(FP)
-	MOVL CX, ret+8(FP)
-	MOVL DX, ret+12(FP)
+	MOVL AX, ret+8(FP)
+	MOVL BX, ret1+12(FP)
+	MOVL CX, ret2+16(FP)
+	MOVL DX, ret3+20(FP)
 	RET
 
 TEXT ·PortWriteByte(SB),NOSPLIT,$0
@@ -58,25 +119,102 @@ TEXT ·PortWriteWord(SB),NOSPLIT,$0
 
 TEXT ·PortWriteDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
-	MOVL val+2(FP), AX
+	MOVL val+4(FP), AX
 	BYTE $0xef  // out eax, dx
 	RET
 
 TEXT ·PortReadByte(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xec  // in al, dx
-	MOVB AX, ret+0(FP)
+	MOVB AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadWord(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0x66  
 	BYTE $0xed  // in ax, dx
-	MOVW AX, ret+0(FP)
+	MOVW AX, ret+8(FP)
 	RET
 
 TEXT ·PortReadDword(SB),NOSPLIT,$0
 	MOVW port+0(FP), DX
 	BYTE $0xed  // in eax, dx
-	MOVL AX, ret+0(FP)
+	MOVL AX, ret+8(FP)
+	RET
+
+TEXT ·ReadTSC(SB),NOSPLIT,$0
+	RDTSC
+	// RDTSC returns the 64-bit counter value in EDX:EAX
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadRandom(SB),NOSPLIT,$0
+	RDRANDQ AX
+	// CF is set if a random value was available
+	SETCS ret1+8(FP)
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadRandomSeed(SB),NOSPLIT,$0
+	RDSEEDQ AX
+	// CF is set if a random value was available
+	SETCS ret1+8(FP)
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·ReadMSRSafe(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	// readMSRInsn shares our argument frame
+	JMP ·readMSRInsn(SB)
+
+TEXT ·readMSRInsn(SB),NOSPLIT,$0
+	RDMSR
+	SHLQ $32, DX
+	ORQ DX, AX
+	MOVQ AX, ret+8(FP)
+	MOVB $1, ret1+16(FP)
+	RET
+
+TEXT ·readMSRFixup(SB),NOSPLIT,$0
+	MOVQ $0, ret+8(FP)
+	MOVB $0, ret1+16(FP)
+	RET
+
+TEXT ·WriteMSRSafe(SB),NOSPLIT,$0
+	MOVL reg+0(FP), CX
+	MOVQ val+8(FP), AX
+	MOVQ AX, DX
+	SHRQ $32, DX
+	// writeMSRInsn shares our argument frame
+	JMP ·writeMSRInsn(SB)
+
+TEXT ·writeMSRInsn(SB),NOSPLIT,$0
+	WRMSR
+	MOVB $1, ret+16(FP)
+	RET
+
+TEXT ·writeMSRFixup(SB),NOSPLIT,$0
+	MOVB $0, ret+16(FP)
+	RET
+
+TEXT ·readMSRInsnAddr(SB),NOSPLIT,$0
+	MOVQ $·readMSRInsn(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·writeMSRInsnAddr(SB),NOSPLIT,$0
+	MOVQ $·writeMSRInsn(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·readMSRFixupAddr(SB),NOSPLIT,$0
+	MOVQ $·readMSRFixup(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·writeMSRFixupAddr(SB),NOSPLIT,$0
+	MOVQ $·writeMSRFixup(SB), AX
+	MOVQ AX, ret+0(FP)
 	RET
@@ -0,0 +1,424 @@
+// Package features detects the capabilities of the CPU by decoding the
+// standard and extended CPUID leaves. The detected features, cache and topology
+// information can be queried by other subsystems once Init has been invoked.
+package features
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"reflect"
+	"unsafe"
+)
+
+// Feature identifies a CPU feature.
+type Feature uint8
+
+// The list of features that are detected by this package.
+const (
+	FPU Feature = iota
+	TSC
+	PAE
+	APIC
+	PGE
+	PAT
+	HTT
+	SSE
+	SSE2
+	SSE3
+	SSSE3
+	SSE41
+	SSE42
+	PCLMULQDQ
+	FMA
+	POPCNT
+	AES
+	XSAVE
+	OSXSAVE
+	AVX
+	AVX2
+	AVX512F
+	F16C
+	RDRAND
+	RDSEED
+	BMI1
+	BMI2
+	FSGSBASE
+	ERMS
+	PCID
+	INVPCID
+	X2APIC
+	TSCDeadline
+	InvariantTSC
+	SMEP
+	SMAP
+	NX
+	Pages1G
+	RDTSCP
+	LongMode
+	TopologyExt
+	Hypervisor
+	featureCount
+)
+
+var featureNames = [featureCount]string{
+	"fpu", "tsc", "pae", "apic", "pge", "pat", "htt", "sse", "sse2", "sse3",
+	"ssse3", "sse4.1", "sse4.2", "pclmulqdq", "fma", "popcnt", "aes", "xsave",
+	"osxsave", "avx", "avx2", "avx512f", "f16c", "rdrand", "rdseed", "bmi1",
+	"bmi2", "fsgsbase", "erms", "pcid", "invpcid", "x2apic", "tsc_deadline",
+	"invariant_tsc", "smep", "smap", "nx", "pdpe1gb", "rdtscp", "lm",
+	"topoext", "hypervisor",
+}
+
+// String returns the name of the feature.
+func (f Feature) String() string {
+	if f >= featureCount {
+		return "unknown"
+	}
+
+	return featureNames[f]
+}
+
+// Set is a bitmap of detected features.
+type Set uint64
+
+// Has returns true if the set contains feature f.
+func (s Set) Has(f Feature) bool {
+	return s&(1<<f) != 0
+}
+
+// CacheType describes the kind of data stored in a cache.
+type CacheType uint8
+
+// The list of supported cache types.
+const (
+	CacheData CacheType = iota + 1
+	CacheInstruction
+	CacheUnified
+)
+
+// String returns a short description of the cache type.
+func (t CacheType) String() string {
+	switch t {
+	case CacheData:
+		return "d"
+	case CacheInstruction:
+		return "i"
+	default:
+		return ""
+	}
+}
+
+// Cache describes a CPU cache.
+type Cache struct {
+	Level    uint8
+	Type     CacheType
+	Size     uint32
+	LineSize uint32
+	Ways     uint32
+}
+
+// Topology describes the number of logical processors in the CPU package.
+type Topology struct {
+	ThreadsPerCore    uint32
+	LogicalPerPackage uint32
+}
+
+// Info contains the information detected by Init.
+type Info struct {
+	Vendor string
+	Brand  string
+
+	Family   uint32
+	Model    uint32
+	Stepping uint32
+
+	Features Set
+	Caches   []Cache
+	Topology Topology
+
+	// HypervisorVendor contains the vendor signature reported by the
+	// hypervisor or an empty string if no hypervisor is present.
+	HypervisorVendor string
+}
+
+const (
+	regEAX = iota
+	regEBX
+	regECX
+	regEDX
+)
+
+// maxCaches is the maximum number of caches reported by Init.
+const maxCaches = 8
+
+// featureBit describes the CPUID leaf, register and bit that report a feature.
+type featureBit struct {
+	feature Feature
+	leaf    uint32
+	reg     uint8
+	bit     uint8
+}
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// package and are automatically inlined by the compiler.
+	cpuidFn        = cpu.ID
+	cpuidSubleafFn = cpu.IDSubleaf
+
+	featureBits = []featureBit{
+		{FPU, 1, regEDX, 0},
+		{TSC, 1, regEDX, 4},
+		{PAE, 1, regEDX, 6},
+		{APIC, 1, regEDX, 9},
+		{PGE, 1, regEDX, 13},
+		{PAT, 1, regEDX, 16},
+		{SSE, 1, regEDX, 25},
+		{SSE2, 1, regEDX, 26},
+		{HTT, 1, regEDX, 28},
+		{SSE3, 1, regECX, 0},
+		{PCLMULQDQ, 1, regECX, 1},
+		{SSSE3, 1, regECX, 9},
+		{FMA, 1, regECX, 12},
+		{PCID, 1, regECX, 17},
+		{SSE41, 1, regECX, 19},
+		{SSE42, 1, regECX, 20},
+		{X2APIC, 1, regECX, 21},
+		{POPCNT, 1, regECX, 23},
+		{TSCDeadline, 1, regECX, 24},
+		{AES, 1, regECX, 25},
+		{XSAVE, 1, regECX, 26},
+		{OSXSAVE, 1, regECX, 27},
+		{AVX, 1, regECX, 28},
+		{F16C, 1, regECX, 29},
+		{RDRAND, 1, regECX, 30},
+		{Hypervisor, 1, regECX, 31},
+		{FSGSBASE, 7, regEBX, 0},
+		{BMI1, 7, regEBX, 3},
+		{AVX2, 7, regEBX, 5},
+		{SMEP, 7, regEBX, 7},
+		{BMI2, 7, regEBX, 8},
+		{ERMS, 7, regEBX, 9},
+		{INVPCID, 7, regEBX, 10},
+		{AVX512F, 7, regEBX, 16},
+		{RDSEED, 7, regEBX, 18},
+		{SMAP, 7, regEBX, 20},
+		{TopologyExt, 0x80000001, regECX, 22},
+		{NX, 0x80000001, regEDX, 20},
+		{Pages1G, 0x80000001, regEDX, 26},
+		{RDTSCP, 0x80000001, regEDX, 27},
+		{LongMode, 0x80000001, regEDX, 29},
+		{InvariantTSC, 0x80000007, regEDX, 8},
+	}
+
+	// info contains the detected CPU information.
+	info Info
+
+	// The following buffers back the strings and cache list in info so
+	// that Init does not need to allocate memory.
+	vendorBuf   [12]byte
+	brandBuf    [48]byte
+	hvVendorBuf [12]byte
+	cacheBuf    [maxCaches]Cache
+)
+
+// Init detects the CPU features, cache hierarchy and topology. Init does not
+// allocate memory and can therefore be invoked before the Go allocator has
+// been initialized.
+func Init() {
+	var (
+		maxLeaf, b, c, d    = cpuidFn(0)
+		maxExtLeaf, _, _, _ = cpuidFn(0x80000000)
+	)
+
+	info = Info{Vendor: regString(vendorBuf[:], b, d, c)}
+	info.Features = detectFeatures(maxLeaf, maxExtLeaf)
+
+	// Decode the family, model and stepping as described in the Intel SDM
+	// (CPUID.01H:EAX).
+	eax, _, _, _ := cpuidFn(1)
+	info.Stepping = eax & 0xf
+	info.Model = (eax >> 4) & 0xf
+	info.Family = (eax >> 8) & 0xf
+	if info.Family == 0xf {
+		info.Family += (eax >> 20) & 0xff
+	}
+	if info.Family == 0x6 || info.Family >= 0xf {
+		info.Model += ((eax >> 16) & 0xf) << 4
+	}
+
+	if maxExtLeaf >= 0x80000004 {
+		for leaf := uint32(0x80000002); leaf <= 0x80000004; leaf++ {
+			a, b, c, d := cpuidFn(leaf)
+			offset := (leaf - 0x80000002) * 16
+			regString(brandBuf[offset:offset+16], a, b, c, d)
+		}
+		info.Brand = trim(regString(brandBuf[:]))
+	}
+
+	info.Caches = detectCaches(maxLeaf, maxExtLeaf)
+	info.Topology = detectTopology(maxLeaf, maxExtLeaf)
+
+	if info.Features.Has(Hypervisor) {
+		_, b, c, d := cpuidFn(0x40000000)
+		info.HypervisorVendor = trim(regString(hvVendorBuf[:], b, c, d))
+	}
+}
+
+// Has returns true if the CPU supports feature f.
+func Has(f Feature) bool {
+	return info.Features.Has(f)
+}
+
+// Current returns the information detected by Init.
+func Current() *Info {
+	return &info
+}
+
+// PrintInfo outputs the detected CPU information.
+func PrintInfo() {
+	kfmt.Printf("[cpu] %s %s (family 0x%x, model 0x%x, stepping 0x%x)\n", info.Vendor, info.Brand, info.Family, info.Model, info.Stepping)
+
+	kfmt.Printf("[cpu] features:")
+	for f := Feature(0); f < featureCount; f++ {
+		if info.Features.Has(f) {
+			kfmt.Printf(" %s", f.String())
+		}
+	}
+	kfmt.Printf("\n")
+
+	for _, cache := range info.Caches {
+		kfmt.Printf("[cpu] L%d%s cache: %d KB, %d-way, %d byte lines\n", cache.Level, cache.Type.String(), cache.Size>>10, cache.Ways, cache.LineSize)
+	}
+
+	kfmt.Printf("[cpu] topology: %d logical CPU(s) per package, %d thread(s) per core\n", info.Topology.LogicalPerPackage, info.Topology.ThreadsPerCore)
+
+	if info.HypervisorVendor != "" {
+		kfmt.Printf("[cpu] hypervisor: %s\n", info.HypervisorVendor)
+	}
+}
+
+// detectFeatures queries the CPUID leaves that report features.
+func detectFeatures(maxLeaf, maxExtLeaf uint32) Set {
+	var set Set
+	for _, fb := range featureBits {
+		if (fb.leaf < 0x80000000 && fb.leaf > maxLeaf) || (fb.leaf >= 0x80000000 && fb.leaf > maxExtLeaf) {
+			continue
+		}
+
+		var regs [4]uint32
+		regs[regEAX], regs[regEBX], regs[regECX], regs[regEDX] = cpuidFn(fb.leaf)
+		if regs[fb.reg]&(1<<fb.bit) != 0 {
+			set |= 1 << fb.feature
+		}
+	}
+
+	return set
+}
+
+// detectCaches enumerates the cache hierarchy using the deterministic cache
+// parameters leaf (CPUID.04H on Intel and CPUID.8000001DH on AMD).
+func detectCaches(maxLeaf, maxExtLeaf uint32) []Cache {
+	var leaf uint32
+	switch {
+	case info.Features.Has(TopologyExt) && maxExtLeaf >= 0x8000001d:
+		leaf = 0x8000001d
+	case maxLeaf >= 4:
+		leaf = 4
+	default:
+		return nil
+	}
+
+	var count int
+	for subleaf := uint32(0); count < maxCaches; subleaf++ {
+		a, b, c, _ := cpuidSubleafFn(leaf, subleaf)
+		cacheType := CacheType(a & 0x1f)
+		if cacheType == 0 || cacheType > CacheUnified {
+			break
+		}
+
+		var (
+			ways       = (b >> 22) + 1
+			partitions = ((b >> 12) & 0x3ff) + 1
+			lineSize   = (b & 0xfff) + 1
+			sets       = c + 1
+		)
+
+		cacheBuf[count] = Cache{
+			Level:    uint8((a >> 5) & 0x7),
+			Type:     cacheType,
+			Size:     ways * partitions * lineSize * sets,
+			LineSize: lineSize,
+			Ways:     ways,
+		}
+		count++
+	}
+
+	return cacheBuf[:count]
+}
+
+// detectTopology queries the number of logical processors per package and the
+// number of threads per core. The extended topology leaf (CPUID.0BH) is used
+// if available; otherwise, the legacy leaves are used.
+func detectTopology(maxLeaf, maxExtLeaf uint32) Topology {
+	topo := Topology{ThreadsPerCore: 1, LogicalPerPackage: 1}
+
+	if maxLeaf >= 0xb {
+		// Sub-leaf 0 describes the SMT level and sub-leaf 1 the core
+		// level.
+		if _, smt, _, _ := cpuidSubleafFn(0xb, 0); smt&0xffff != 0 {
+			_, core, _, _ := cpuidSubleafFn(0xb, 1)
+			topo.ThreadsPerCore = smt & 0xffff
+			topo.LogicalPerPackage = core & 0xffff
+			if topo.LogicalPerPackage == 0 {
+				topo.LogicalPerPackage = topo.ThreadsPerCore
+			}
+			return topo
+		}
+	}
+
+	if info.Features.Has(HTT) {
+		_, b, _, _ := cpuidFn(1)
+		topo.LogicalPerPackage = (b >> 16) & 0xff
+	}
+
+	if maxExtLeaf >= 0x80000008 {
+		if _, _, c, _ := cpuidFn(0x80000008); c&0xff != 0 {
+			topo.LogicalPerPackage = c&0xff + 1
+		}
+	}
+
+	if info.Features.Has(TopologyExt) && maxExtLeaf >= 0x8000001e {
+		_, b, _, _ := cpuidFn(0x8000001e)
+		topo.ThreadsPerCore = (b>>8)&0xff + 1
+	}
+
+	return topo
+}
+
+// regString stores the contents of a list of registers into buf and returns
+// a string that points to the contents of buf. If no registers are specified,
+// the current contents of buf are returned.
+func regString(buf []byte, regs ...uint32) string {
+	for i, reg := range regs {
+		buf[4*i], buf[4*i+1], buf[4*i+2], buf[4*i+3] = byte(reg), byte(reg>>8), byte(reg>>16), byte(reg>>24)
+	}
+
+	var str string
+	strHdr := (*reflect.StringHeader)(unsafe.Pointer(&str))
+	strHdr.Data = uintptr(unsafe.Pointer(&buf[0]))
+	strHdr.Len = len(buf)
+	return str
+}
+
+// trim removes leading and trailing spaces and NUL characters from s.
+func trim(s string) string {
+	start, end := 0, len(s)
+	for start < end && (s[start] == ' ' || s[start] == 0) {
+		start++
+	}
+	for end > start && (s[end-1] == ' ' || s[end-1] == 0) {
+		end--
+	}
+
+	return s[start:end]
+}
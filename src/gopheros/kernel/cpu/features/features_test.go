@@ -0,0 +1,213 @@
+package features
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+// fakeCPUID maps a (leaf, subleaf) pair to the values of the EAX, EBX, ECX and
+// EDX registers returned by the CPUID instruction.
+type fakeCPUID map[[2]uint32][4]uint32
+
+func (f fakeCPUID) install() {
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		regs := f[[2]uint32{leaf, 0}]
+		return regs[0], regs[1], regs[2], regs[3]
+	}
+	cpuidSubleafFn = func(leaf, subleaf uint32) (uint32, uint32, uint32, uint32) {
+		regs := f[[2]uint32{leaf, subleaf}]
+		return regs[0], regs[1], regs[2], regs[3]
+	}
+}
+
+// vendorRegs packs a 12-byte string into the EBX, EDX and ECX registers in the order
+// used by CPUID leaf 0.
+func vendorRegs(maxLeaf uint32, vendor string) [4]uint32 {
+	r := strRegs(vendor)
+	return [4]uint32{maxLeaf, r[0], r[2], r[1]}
+}
+
+func strRegs(s string) []uint32 {
+	var regs []uint32
+	for i := 0; i+4 <= len(s); i += 4 {
+		regs = append(regs, uint32(s[i])|uint32(s[i+1])<<8|uint32(s[i+2])<<16|uint32(s[i+3])<<24)
+	}
+	return regs
+}
+
+func restoreMocks() {
+	cpuidFn = cpu.ID
+	cpuidSubleafFn = cpu.IDSubleaf
+	info = Info{}
+}
+
+func TestInitIntel(t *testing.T) {
+	defer restoreMocks()
+
+	brand := strRegs("        Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz\x00\x00\x00\x00\x00")
+	hv := strRegs("KVMKVMKVM\x00\x00\x00")
+
+	fakeCPUID{
+		{0, 0}: vendorRegs(0x16, "GenuineIntel"),
+		// family 6, extended model 9, model 0xe, stepping 0xa; 12 logical CPUs
+		{1, 0}: {0x000906ea, 12 << 16, 1<<0 | 1<<9 | 1<<17 | 1<<19 | 1<<20 | 1<<21 | 1<<24 | 1<<26 | 1<<28 | 1<<30 | 1<<31, 1<<0 | 1<<25 | 1<<26 | 1<<28},
+		// L1d: 8 ways, 64 byte lines, 64 sets = 32K
+		{4, 0}: {1 | 1<<5, 7<<22 | 63, 63, 0},
+		// L1i: 8 ways, 64 byte lines, 64 sets = 32K
+		{4, 1}: {2 | 1<<5, 7<<22 | 63, 63, 0},
+		// L2 unified: 4 ways, 64 byte lines, 1024 sets = 256K
+		{4, 2}: {3 | 2<<5, 3<<22 | 63, 1023, 0},
+		{7, 0}: {0, 1<<5 | 1<<7 | 1<<10 | 1<<18 | 1<<20, 0, 0},
+		// SMT level: 2 threads; core level: 12 logical CPUs
+		{0xb, 0}:        {1, 2, 0x100, 0},
+		{0xb, 1}:        {4, 12, 0x201, 0},
+		{0x40000000, 0}: {0x40000001, hv[0], hv[1], hv[2]},
+		{0x80000000, 0}: {0x80000008, 0, 0, 0},
+		{0x80000001, 0}: {0, 0, 0, 1<<20 | 1<<29},
+		{0x80000002, 0}: {brand[0], brand[1], brand[2], brand[3]},
+		{0x80000003, 0}: {brand[4], brand[5], brand[6], brand[7]},
+		{0x80000004, 0}: {brand[8], brand[9], brand[10], brand[11]},
+		{0x80000007, 0}: {0, 0, 0, 1 << 8},
+	}.install()
+
+	Init()
+
+	cur := Current()
+	if exp := "GenuineIntel"; cur.Vendor != exp {
+		t.Errorf("expected vendor to be %q; got %q", exp, cur.Vendor)
+	}
+
+	if exp := "Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz"; cur.Brand != exp {
+		t.Errorf("expected brand to be %q; got %q", exp, cur.Brand)
+	}
+
+	if cur.Family != 6 || cur.Model != 0x9e || cur.Stepping != 0xa {
+		t.Errorf("expected family/model/stepping to be 6/0x9e/0xa; got %d/0x%x/0x%x", cur.Family, cur.Model, cur.Stepping)
+	}
+
+	for _, f := range []Feature{FPU, SSE, SSE2, SSE3, SSSE3, SSE41, SSE42, PCID, X2APIC, TSCDeadline, XSAVE, AVX, RDRAND, Hypervisor, AVX2, SMEP, INVPCID, RDSEED, SMAP, NX, LongMode, InvariantTSC} {
+		if !Has(f) {
+			t.Errorf("expected feature %s to be detected", f.String())
+		}
+	}
+
+	for _, f := range []Feature{OSXSAVE, AVX512F, Pages1G, TopologyExt} {
+		if Has(f) {
+			t.Errorf("expected feature %s not to be detected", f.String())
+		}
+	}
+
+	expCaches := []Cache{
+		{Level: 1, Type: CacheData, Size: 32 << 10, LineSize: 64, Ways: 8},
+		{Level: 1, Type: CacheInstruction, Size: 32 << 10, LineSize: 64, Ways: 8},
+		{Level: 2, Type: CacheUnified, Size: 256 << 10, LineSize: 64, Ways: 4},
+	}
+	if len(cur.Caches) != len(expCaches) {
+		t.Fatalf("expected %d caches; got %d", len(expCaches), len(cur.Caches))
+	}
+	for i, exp := range expCaches {
+		if cur.Caches[i] != exp {
+			t.Errorf("[cache %d] expected %+v; got %+v", i, exp, cur.Caches[i])
+		}
+	}
+
+	if exp := (Topology{ThreadsPerCore: 2, LogicalPerPackage: 12}); cur.Topology != exp {
+		t.Errorf("expected topology to be %+v; got %+v", exp, cur.Topology)
+	}
+
+	if exp := "KVMKVMKVM"; cur.HypervisorVendor != exp {
+		t.Errorf("expected hypervisor vendor to be %q; got %q", exp, cur.HypervisorVendor)
+	}
+}
+
+func TestInitAMD(t *testing.T) {
+	defer restoreMocks()
+
+	fakeCPUID{
+		{0, 0}: vendorRegs(0xd, "AuthenticAMD"),
+		// family 0xf + 0x8, model 0x1, stepping 0x1; 16 logical CPUs
+		{1, 0}:          {0x00800f11, 16 << 16, 1 << 0, 1<<25 | 1<<26 | 1<<28},
+		{7, 0}:          {0, 1 << 7, 0, 0},
+		{0x80000000, 0}: {0x8000001e, 0, 0, 0},
+		{0x80000001, 0}: {0, 0, 1 << 22, 1 << 20},
+		// L1d: 8 ways, 64 byte lines, 64 sets = 32K
+		{0x8000001d, 0}: {1 | 1<<5, 7<<22 | 63, 63, 0},
+		// 16 logical CPUs per package
+		{0x80000008, 0}: {0, 0, 15, 0},
+		// 2 threads per core
+		{0x8000001e, 0}: {0, 1 << 8, 0, 0},
+	}.install()
+
+	Init()
+
+	cur := Current()
+	if exp := "AuthenticAMD"; cur.Vendor != exp {
+		t.Errorf("expected vendor to be %q; got %q", exp, cur.Vendor)
+	}
+
+	if cur.Brand != "" {
+		t.Errorf("expected brand to be empty; got %q", cur.Brand)
+	}
+
+	if cur.Family != 0x17 || cur.Model != 0x1 || cur.Stepping != 0x1 {
+		t.Errorf("expected family/model/stepping to be 0x17/0x1/0x1; got 0x%x/0x%x/0x%x", cur.Family, cur.Model, cur.Stepping)
+	}
+
+	for _, f := range []Feature{HTT, SSE, SSE2, SSE3, SMEP, NX, TopologyExt} {
+		if !Has(f) {
+			t.Errorf("expected feature %s to be detected", f.String())
+		}
+	}
+
+	if Has(InvariantTSC) || Has(Hypervisor) {
+		t.Error("expected features from unsupported leaves not to be detected")
+	}
+
+	if len(cur.Caches) != 1 || cur.Caches[0].Size != 32<<10 {
+		t.Errorf("expected a single 32K cache; got %+v", cur.Caches)
+	}
+
+	if exp := (Topology{ThreadsPerCore: 2, LogicalPerPackage: 16}); cur.Topology != exp {
+		t.Errorf("expected topology to be %+v; got %+v", exp, cur.Topology)
+	}
+
+	if cur.HypervisorVendor != "" {
+		t.Errorf("expected hypervisor vendor to be empty; got %q", cur.HypervisorVendor)
+	}
+}
+
+func TestFeatureString(t *testing.T) {
+	specs := map[Feature]string{
+		SSE41:        "sse4.1",
+		TSCDeadline:  "tsc_deadline",
+		InvariantTSC: "invariant_tsc",
+		Hypervisor:   "hypervisor",
+		featureCount: "unknown",
+	}
+
+	for f, exp := range specs {
+		if got := f.String(); got != exp {
+			t.Errorf("expected feature %d to be named %q; got %q", f, exp, got)
+		}
+	}
+}
+
+func TestInitDoesNotAllocate(t *testing.T) {
+	defer restoreMocks()
+
+	brand := strRegs("Fake CPU\x00\x00\x00\x00\x00\x00\x00\x00")
+	fakeCPUID{
+		{0, 0}:          vendorRegs(4, "GenuineIntel"),
+		{4, 0}:          {1 | 1<<5, 7<<22 | 63, 63, 0},
+		{0x80000000, 0}: {0x80000004, 0, 0, 0},
+		{0x80000002, 0}: {brand[0], brand[1], brand[2], brand[3]},
+	}.install()
+
+	if allocs := testing.AllocsPerRun(10, Init); allocs != 0 {
+		t.Fatalf("expected Init not to allocate; got %v allocations per call", allocs)
+	}
+
+	if cur := Current(); cur.Brand != "Fake CPU" || len(cur.Caches) != 1 {
+		t.Fatalf("unexpected CPU info: %+v", cur)
+	}
+}
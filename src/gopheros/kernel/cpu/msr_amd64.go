@@ -0,0 +1,292 @@
+package cpu
+
+// The indices of the architectural model-specific registers used by the
+// kernel. See the Intel SDM Vol. 4 (Model-Specific Registers) for details.
+const (
+	// MSRTimeStampCounter provides access to the time-stamp counter.
+	MSRTimeStampCounter = uint32(0x10)
+
+	// MSRAPICBase holds the physical address of the local APIC registers
+	// and controls its operating mode.
+	MSRAPICBase = uint32(0x1b)
+
+	// MSRFeatureControl controls the availability of VMX and SMX. Once its
+	// lock bit is set, it cannot be modified until the next reset.
+	MSRFeatureControl = uint32(0x3a)
+
+	// MSRMTRRCap reports the number of variable-range MTRRs and whether
+	// fixed-range MTRRs and write-combining are supported.
+	MSRMTRRCap = uint32(0xfe)
+
+	// MSRMCGCap reports the number of machine-check error reporting
+	// banks and MSRMCGStatus describes the state of the CPU after a
+	// machine-check exception.
+	MSRMCGCap    = uint32(0x179)
+	MSRMCGStatus = uint32(0x17a)
+
+	// MSRMiscEnable enables various processor features.
+	MSRMiscEnable = uint32(0x1a0)
+
+	// MSRPAT defines the memory types of the 8 page attribute table
+	// entries.
+	MSRPAT = uint32(0x277)
+
+	// MSRMTRRDefType sets the default memory type for memory regions that
+	// are not covered by an MTRR.
+	MSRMTRRDefType = uint32(0x2ff)
+
+	// MSRTSCDeadline holds the TSC value at which the local APIC timer
+	// raises an interrupt when it operates in TSC-deadline mode.
+	MSRTSCDeadline = uint32(0x6e0)
+
+	// MSRX2APICRegsBase is the index of the first MSR that maps the local
+	// APIC registers when the APIC operates in x2APIC mode. The register
+	// at xAPIC offset off is accessed via MSR MSRX2APICRegsBase + off/16.
+	MSRX2APICRegsBase = uint32(0x800)
+
+	// MSREFER is the extended feature enable register.
+	MSREFER = uint32(0xc0000080)
+
+	// MSRSTAR holds the segment selectors loaded by SYSCALL and SYSRET.
+	MSRSTAR = uint32(0xc0000081)
+
+	// MSRLSTAR holds the 64-bit SYSCALL entrypoint address.
+	MSRLSTAR = uint32(0xc0000082)
+
+	// MSRCSTAR holds the SYSCALL entrypoint address for compatibility
+	// mode code.
+	MSRCSTAR = uint32(0xc0000083)
+
+	// MSRFMask holds the RFLAGS bits that are cleared by SYSCALL.
+	MSRFMask = uint32(0xc0000084)
+
+	// MSRFSBase and MSRGSBase hold the base address of the FS and GS
+	// segments.
+	MSRFSBase = uint32(0xc0000100)
+	MSRGSBase = uint32(0xc0000101)
+
+	// MSRKernelGSBase holds the value that SWAPGS exchanges with
+	// MSRGSBase.
+	MSRKernelGSBase = uint32(0xc0000102)
+
+	// MSRTSCAux holds the value returned by RDTSCP in ECX.
+	MSRTSCAux = uint32(0xc0000103)
+)
+
+// MSRMCStatus returns the index of the status register of the machine-check
+// error reporting bank with the given index.
+func MSRMCStatus(bank uint8) uint32 {
+	return 0x401 + uint32(bank)<<2
+}
+
+// MSRMCAddr returns the index of the address register of the machine-check
+// error reporting bank with the given index.
+func MSRMCAddr(bank uint8) uint32 {
+	return 0x402 + uint32(bank)<<2
+}
+
+// MSRAPICBase flags.
+const (
+	// APICBaseBSP is set if the CPU is the bootstrap processor.
+	APICBaseBSP = uint64(1 << 8)
+
+	// APICBaseX2APICEnable switches the local APIC to x2APIC mode.
+	APICBaseX2APICEnable = uint64(1 << 10)
+
+	// APICBaseEnable enables the local APIC.
+	APICBaseEnable = uint64(1 << 11)
+)
+
+// MSRFeatureControl flags.
+const (
+	FeatureControlLocked     = uint64(1 << 0)
+	FeatureControlVMXOutside = uint64(1 << 2)
+)
+
+// MSRMCGStatus flags.
+const (
+	// MCGStatusRIPValid is set if execution can be restarted at the RIP
+	// pushed to the stack by the machine-check exception.
+	MCGStatusRIPValid = uint64(1 << 0)
+
+	// MCGStatusErrorIPValid is set if the RIP pushed to the stack is
+	// directly associated with the error.
+	MCGStatusErrorIPValid = uint64(1 << 1)
+
+	// MCGStatusInProgress is set while a machine-check exception is being
+	// serviced.
+	MCGStatusInProgress = uint64(1 << 2)
+)
+
+// MSRMCStatus flags.
+const (
+	MCStatusAddrValid   = uint64(1 << 58)
+	MCStatusUncorrected = uint64(1 << 61)
+	MCStatusOverflow    = uint64(1 << 62)
+	MCStatusValid       = uint64(1 << 63)
+)
+
+// MSRMiscEnable flags.
+const (
+	MiscEnableFastStrings = uint64(1 << 0)
+	MiscEnableXDDisable   = uint64(1 << 34)
+)
+
+// MSRMTRRDefType flags.
+const (
+	MTRRDefTypeFixedEnable = uint64(1 << 10)
+	MTRRDefTypeEnable      = uint64(1 << 11)
+)
+
+// MSREFER flags.
+const (
+	// EFERSyscallEnable enables the SYSCALL and SYSRET instructions.
+	EFERSyscallEnable = uint64(1 << 0)
+
+	// EFERLongModeEnable and EFERLongModeActive indicate that long mode
+	// is enabled and active.
+	EFERLongModeEnable = uint64(1 << 8)
+	EFERLongModeActive = uint64(1 << 10)
+
+	// EFERNoExecuteEnable enables support for no-execute pages.
+	EFERNoExecuteEnable = uint64(1 << 11)
+)
+
+// PATType describes a memory type that can be assigned to a PAT entry.
+type PATType uint8
+
+// The list of memory types supported by the PAT.
+const (
+	PATUncacheable    PATType = 0
+	PATWriteCombining PATType = 1
+	PATWriteThrough   PATType = 4
+	PATWriteProtected PATType = 5
+	PATWriteBack      PATType = 6
+	PATUncached       PATType = 7
+)
+
+// MSRField describes a bitfield within the value of a model-specific register.
+type MSRField struct {
+	Shift uint8
+	Width uint8
+}
+
+// The bitfields of the architectural MSRs.
+var (
+	// APICBaseAddress contains the page number of the local APIC
+	// registers.
+	APICBaseAddress = MSRField{Shift: 12, Width: 40}
+
+	// MCGCapBankCount contains the number of machine-check error
+	// reporting banks.
+	MCGCapBankCount = MSRField{Shift: 0, Width: 8}
+
+	// MCStatusErrorCode contains the MCA error code of a bank status
+	// register.
+	MCStatusErrorCode = MSRField{Shift: 0, Width: 16}
+
+	// MTRRCapVariableCount contains the number of variable-range MTRRs.
+	MTRRCapVariableCount = MSRField{Shift: 0, Width: 8}
+
+	// MTRRDefTypeMemType contains the default memory type.
+	MTRRDefTypeMemType = MSRField{Shift: 0, Width: 8}
+
+	// STARSyscallCS contains the kernel CS selector loaded by SYSCALL. SS
+	// is set to STARSyscallCS + 8.
+	STARSyscallCS = MSRField{Shift: 32, Width: 16}
+
+	// STARSysretCS contains the selector used for deriving the user CS and
+	// SS selectors loaded by SYSRET.
+	STARSysretCS = MSRField{Shift: 48, Width: 16}
+)
+
+// Mask returns the bits of an MSR value that are occupied by the field.
+func (f MSRField) Mask() uint64 {
+	return ((1 << f.Width) - 1) << f.Shift
+}
+
+// Get extracts the field from an MSR value.
+func (f MSRField) Get(val uint64) uint64 {
+	return (val & f.Mask()) >> f.Shift
+}
+
+// Set returns a copy of the MSR value with the field set to fieldVal. Any
+// fieldVal bits that do not fit in the field are ignored.
+func (f MSRField) Set(val, fieldVal uint64) uint64 {
+	return (val &^ f.Mask()) | ((fieldVal << f.Shift) & f.Mask())
+}
+
+// PATEntry returns the field that holds the memory type of the PAT entry with
+// the given index (0-7).
+func PATEntry(index uint8) MSRField {
+	return MSRField{Shift: index << 3, Width: 3}
+}
+
+// PATValue returns the value for the MSRPAT register that assigns the supplied
+// memory types to the PAT entries 0-7.
+func PATValue(types [8]PATType) uint64 {
+	var val uint64
+	for index, memType := range types {
+		val = PATEntry(uint8(index)).Set(val, uint64(memType))
+	}
+
+	return val
+}
+
+// ReadMSRSafe returns the value of the model-specific register with the given
+// index. Unlike ReadMSR, it returns false instead of raising an unrecoverable
+// general protection fault if the register is not supported by the CPU.
+func ReadMSRSafe(reg uint32) (uint64, bool)
+
+// WriteMSRSafe stores a value to the model-specific register with the given
+// index. Unlike WriteMSR, it returns false instead of raising an unrecoverable
+// general protection fault if the register is not supported by the CPU or if
+// the value sets reserved bits.
+func WriteMSRSafe(reg uint32, val uint64) bool
+
+// readMSRInsn and writeMSRInsn contain the RDMSR/WRMSR instructions used by the
+// safe MSR accessors which jump to them after loading their arguments. They
+// are never called directly. As the instructions are located at the entry
+// point of these functions, their addresses can be recorded in the exception
+// fixup table.
+func readMSRInsn(reg uint32) (uint64, bool)
+func writeMSRInsn(reg uint32, val uint64) bool
+
+// readMSRFixup and writeMSRFixup are never called directly. If the safe MSR
+// accessors fault, execution resumes at their entry point so that the
+// accessors report the failure to their caller.
+func readMSRFixup(reg uint32) (uint64, bool)
+func writeMSRFixup(reg uint32, val uint64) bool
+
+// The following functions return the addresses of the functions that
+// participate in the exception fixup table.
+func readMSRInsnAddr() uintptr
+func writeMSRInsnAddr() uintptr
+func readMSRFixupAddr() uintptr
+func writeMSRFixupAddr() uintptr
+
+// exceptionFixups maps the addresses of instructions that may fault to the
+// address where execution should resume if they do. The entries store address
+// getters as the addresses of assembly functions cannot be used in constant
+// initializers.
+var exceptionFixups = [...]struct {
+	faultAddr func() uintptr
+	fixupAddr func() uintptr
+}{
+	{readMSRInsnAddr, readMSRFixupAddr},
+	{writeMSRInsnAddr, writeMSRFixupAddr},
+}
+
+// ExceptionFixup checks whether the exception fixup table contains an entry
+// for the instruction at faultAddr. If so, it returns the address where the
+// exception handler should resume execution. Exception handlers must not
+// modify the stack pointer before resuming at the returned address.
+func ExceptionFixup(faultAddr uintptr) (uintptr, bool) {
+	for _, entry := range exceptionFixups {
+		if entry.faultAddr() == faultAddr {
+			return entry.fixupAddr(), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package cpu
+
+import "testing"
+
+func TestMSRField(t *testing.T) {
+	specs := []struct {
+		field    MSRField
+		val      uint64
+		fieldVal uint64
+		expSet   uint64
+	}{
+		{APICBaseAddress, 0xfee00900, 0xfec00, 0xfec00900},
+		{STARSyscallCS, 0, 0x08, 0x0000000800000000},
+		{STARSysretCS, 0x0000000800000000, 0x1b, 0x001b000800000000},
+		// bits that do not fit in the field are ignored
+		{PATEntry(1), 0, 0xff, 0x700},
+	}
+
+	for specIndex, spec := range specs {
+		got := spec.field.Set(spec.val, spec.fieldVal)
+		if got != spec.expSet {
+			t.Errorf("[spec %d] expected Set to return 0x%x; got 0x%x", specIndex, spec.expSet, got)
+		}
+
+		if exp := spec.fieldVal & (spec.field.Mask() >> spec.field.Shift); spec.field.Get(got) != exp {
+			t.Errorf("[spec %d] expected Get to return 0x%x; got 0x%x", specIndex, exp, spec.field.Get(got))
+		}
+	}
+
+	if got := APICBaseAddress.Get(0xfee00900 | APICBaseEnable | APICBaseBSP); got != 0xfee00 {
+		t.Errorf("expected APIC base page to be 0xfee00; got 0x%x", got)
+	}
+}
+
+func TestPATValue(t *testing.T) {
+	// The power-on default PAT value
+	exp := uint64(0x0007040600070406)
+	got := PATValue([8]PATType{
+		PATWriteBack, PATWriteThrough, PATUncached, PATUncacheable,
+		PATWriteBack, PATWriteThrough, PATUncached, PATUncacheable,
+	})
+
+	if got != exp {
+		t.Fatalf("expected PAT value to be 0x%x; got 0x%x", exp, got)
+	}
+}
+
+func TestExceptionFixup(t *testing.T) {
+	specs := []struct {
+		faultAddr, fixupAddr uintptr
+	}{
+		{readMSRInsnAddr(), readMSRFixupAddr()},
+		{writeMSRInsnAddr(), writeMSRFixupAddr()},
+	}
+
+	for specIndex, spec := range specs {
+		got, ok := ExceptionFixup(spec.faultAddr)
+		if !ok || got != spec.fixupAddr {
+			t.Errorf("[spec %d] expected fixup address for 0x%x to be 0x%x; got 0x%x, %t", specIndex, spec.faultAddr, spec.fixupAddr, got, ok)
+		}
+	}
+
+	if _, ok := ExceptionFixup(readMSRFixupAddr()); ok {
+		t.Error("expected no fixup entry for an address outside the fixup table")
+	}
+}
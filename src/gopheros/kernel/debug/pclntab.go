@@ -0,0 +1,182 @@
+package debug
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+const (
+	// pclnTabMagic identifies the pclntab layout that is emitted by the Go
+	// linker versions which are able to build the kernel.
+	pclnTabMagic = 0xfffffffb
+
+	// The following constants describe the offsets of the fields of the
+	// runtime _func struct which are used for symbolizing addresses.
+	funcNameOffset   = ptrSize
+	funcPCFileOffset = ptrSize + 16
+	funcPCLineOffset = ptrSize + 20
+)
+
+// pclnTable provides access to the symbol and line table (pclntab) that the
+// Go linker embeds into the kernel image. The table is accessed in place so
+// that lookups do not need to allocate memory.
+//
+// The table starts with a header containing the table magic, the instruction
+// size quantum, the pointer size and the number of functions (nfunc). The
+// header is followed by nfunc (entry PC, function offset) pairs, sorted by
+// entry PC, the end PC of the last function and the offset of the file
+// table. All offsets are relative to the start of the table.
+type pclnTable struct {
+	base    uintptr
+	quantum uintptr
+	nfunc   uintptr
+
+	// funcTab and fileTab point to the function and file tables.
+	funcTab uintptr
+	fileTab uintptr
+}
+
+// init sets up the table using the pclntab located at addr. It returns false
+// if addr does not point to a table with a supported layout.
+func (t *pclnTable) init(addr uintptr) bool {
+	if addr == 0 ||
+		*(*uint32)(unsafe.Pointer(addr)) != pclnTabMagic ||
+		*(*uint16)(unsafe.Pointer(addr + 4)) != 0 ||
+		uintptr(*(*uint8)(unsafe.Pointer(addr + 7))) != ptrSize {
+		return false
+	}
+
+	t.base = addr
+	t.quantum = uintptr(*(*uint8)(unsafe.Pointer(addr + 6)))
+	t.nfunc = *(*uintptr)(unsafe.Pointer(addr + 8))
+	t.funcTab = addr + 8 + ptrSize
+	t.fileTab = addr + uintptr(*(*uint32)(unsafe.Pointer(t.funcTab + (2*t.nfunc+1)*ptrSize)))
+	return true
+}
+
+// findFunc returns the address of the _func struct for the function that
+// contains pc or 0 if pc does not belong to any function.
+func (t *pclnTable) findFunc(pc uintptr) uintptr {
+	if t.nfunc == 0 || pc < t.funcEntry(0) || pc >= t.funcEntry(t.nfunc) {
+		return 0
+	}
+
+	lo, hi := uintptr(0), t.nfunc
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if t.funcEntry(mid) <= pc {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return t.base + *(*uintptr)(unsafe.Pointer(t.funcTab + (2*lo+1)*ptrSize))
+}
+
+// funcEntry returns the entry PC for the function at the specified function
+// table index.
+func (t *pclnTable) funcEntry(index uintptr) uintptr {
+	return *(*uintptr)(unsafe.Pointer(t.funcTab + 2*index*ptrSize))
+}
+
+// funcName returns the name of the function described by fn.
+func (t *pclnTable) funcName(fn uintptr) string {
+	return t.str(*(*int32)(unsafe.Pointer(fn + funcNameOffset)))
+}
+
+// fileLine returns the file and line that correspond to pc which must belong
+// to the function described by fn.
+func (t *pclnTable) fileLine(fn, pc uintptr) (string, int) {
+	fileNo, ok := t.pcValue(fn, *(*int32)(unsafe.Pointer(fn + funcPCFileOffset)), pc)
+	if !ok || fileNo <= 0 || uint32(fileNo) >= *(*uint32)(unsafe.Pointer(t.fileTab)) {
+		return "", 0
+	}
+
+	line, ok := t.pcValue(fn, *(*int32)(unsafe.Pointer(fn + funcPCLineOffset)), pc)
+	if !ok {
+		return "", 0
+	}
+
+	return t.str(int32(*(*uint32)(unsafe.Pointer(t.fileTab + uintptr(fileNo)*4)))), int(line)
+}
+
+// pcValue decodes the PC-value table at the specified offset for the function
+// described by fn and returns the value that corresponds to pc. Each table
+// entry consists of a zig-zag encoded value delta followed by a PC delta, in
+// units of the instruction size quantum, both stored as varints. The table is
+// terminated by a zero value delta.
+func (t *pclnTable) pcValue(fn uintptr, offset int32, pc uintptr) (int32, bool) {
+	if offset == 0 {
+		return -1, false
+	}
+
+	var (
+		ptr       = t.base + uintptr(offset)
+		val       = int32(-1)
+		curPC     = *(*uintptr)(unsafe.Pointer(fn))
+		valDelta  uint32
+		pcDelta   uint32
+		readBytes uintptr
+	)
+
+	for first := true; ; first = false {
+		valDelta, readBytes = readVarint(ptr)
+		if valDelta == 0 && !first {
+			return -1, false
+		}
+		ptr += readBytes
+
+		if valDelta&1 != 0 {
+			val += int32(^(valDelta >> 1))
+		} else {
+			val += int32(valDelta >> 1)
+		}
+
+		pcDelta, readBytes = readVarint(ptr)
+		ptr += readBytes
+		curPC += uintptr(pcDelta) * t.quantum
+
+		if pc < curPC {
+			return val, true
+		}
+	}
+}
+
+// str returns the NULL-terminated string stored at the specified table
+// offset. The returned string points to the table contents.
+func (t *pclnTable) str(offset int32) string {
+	var (
+		start = t.base + uintptr(offset)
+		end   = start
+		str   string
+	)
+
+	for ; *(*byte)(unsafe.Pointer(end)) != 0; end++ {
+	}
+
+	strHdr := (*reflect.StringHeader)(unsafe.Pointer(&str))
+	strHdr.Data = start
+	strHdr.Len = int(end - start)
+	return str
+}
+
+// readVarint decodes the unsigned varint stored at ptr and returns its value
+// and the number of bytes it occupies.
+func readVarint(ptr uintptr) (uint32, uintptr) {
+	var (
+		val   uint32
+		shift uint32
+		n     uintptr
+	)
+
+	for {
+		b := *(*byte)(unsafe.Pointer(ptr + n))
+		n++
+		val |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return val, n
+		}
+		shift += 7
+	}
+}
@@ -0,0 +1,153 @@
+package debug
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+// buildPCLNTable returns a buffer containing a pclntab with two functions:
+//   - pkg.first: [0x1000, 0x1100) in first.go; line 10 for the first 0x10
+//     bytes and line 15 for the rest of the function.
+//   - pkg.second: [0x1100, 0x1200) in second.go; line 30 for the first 0x20
+//     bytes and line 29 for the rest of the function.
+func buildPCLNTable() []uint64 {
+	var (
+		buf = make([]byte, 512)
+		le  = binary.LittleEndian
+	)
+
+	// header
+	le.PutUint32(buf[0:], pclnTabMagic)
+	buf[6], buf[7] = 1, byte(ptrSize)
+	le.PutUint64(buf[8:], 2)
+
+	// function table, end PC and file table offset
+	le.PutUint64(buf[16:], 0x1000)
+	le.PutUint64(buf[24:], 160)
+	le.PutUint64(buf[32:], 0x1100)
+	le.PutUint64(buf[40:], 200)
+	le.PutUint64(buf[48:], 0x1200)
+	le.PutUint32(buf[56:], 64)
+
+	// file table and strings
+	le.PutUint32(buf[64:], 3)
+	le.PutUint32(buf[68:], 80)
+	le.PutUint32(buf[72:], 96)
+	copy(buf[80:], "first.go\x00")
+	copy(buf[96:], "second.go\x00")
+	copy(buf[112:], "pkg.first\x00")
+	copy(buf[128:], "pkg.second\x00")
+
+	// _func structs
+	putFunc := func(offset int, entry uint64, nameOff, pcFileOff, pcLineOff uint32) {
+		le.PutUint64(buf[offset:], entry)
+		le.PutUint32(buf[offset+int(funcNameOffset):], nameOff)
+		le.PutUint32(buf[offset+int(funcPCFileOffset):], pcFileOff)
+		le.PutUint32(buf[offset+int(funcPCLineOffset):], pcLineOff)
+	}
+	putFunc(160, 0x1000, 112, 240, 250)
+	putFunc(200, 0x1100, 128, 260, 270)
+
+	// PC-value tables
+	copy(buf[240:], []byte{4, 0x80, 0x02, 0})
+	copy(buf[250:], []byte{22, 0x10, 10, 0xf0, 0x01, 0})
+	copy(buf[260:], []byte{6, 0x80, 0x02, 0})
+	copy(buf[270:], []byte{62, 0x20, 1, 0xe0, 0x01, 0})
+
+	table := make([]uint64, len(buf)/8)
+	for i := range table {
+		table[i] = le.Uint64(buf[i*8:])
+	}
+	return table
+}
+
+func TestPCLNTableInit(t *testing.T) {
+	table := buildPCLNTable()
+	addr := uintptr(unsafe.Pointer(&table[0]))
+
+	var tab pclnTable
+	if !tab.init(addr) {
+		t.Fatal("expected table to be accepted")
+	}
+
+	if tab.quantum != 1 || tab.nfunc != 2 || tab.fileTab != addr+64 {
+		t.Fatalf("unexpected table header contents: %+v", tab)
+	}
+
+	table[0]++
+	if tab.init(addr) {
+		t.Fatal("expected table with an unsupported magic value to be rejected")
+	}
+
+	if tab.init(0) {
+		t.Fatal("expected missing table to be rejected")
+	}
+}
+
+func TestSymbolizeWithPCLNTable(t *testing.T) {
+	defer func() {
+		pclnTabAddrFn = pclnTabAddr
+		pclnTableReady = false
+	}()
+
+	table := buildPCLNTable()
+	pclnTabAddrFn = func() uintptr { return uintptr(unsafe.Pointer(&table[0])) }
+	pclnTableReady = false
+
+	specs := []struct {
+		pc      uintptr
+		expFunc string
+		expFile string
+		expLine int
+	}{
+		{0x1000, "pkg.first", "first.go", 10},
+		{0x100f, "pkg.first", "first.go", 10},
+		{0x1010, "pkg.first", "first.go", 15},
+		{0x10ff, "pkg.first", "first.go", 15},
+		{0x1100, "pkg.second", "second.go", 30},
+		{0x1180, "pkg.second", "second.go", 29},
+	}
+
+	for specIndex, spec := range specs {
+		frame, ok := Symbolize(spec.pc)
+		if !ok {
+			t.Errorf("[spec %d] expected pc 0x%x to be resolved", specIndex, spec.pc)
+			continue
+		}
+
+		if frame.PC != spec.pc || frame.Function != spec.expFunc || frame.File != spec.expFile || frame.Line != spec.expLine {
+			t.Errorf("[spec %d] expected pc 0x%x to resolve to %s at %s:%d; got %+v", specIndex, spec.pc, spec.expFunc, spec.expFile, spec.expLine, frame)
+		}
+	}
+
+	for _, pc := range []uintptr{0, 0xfff, 0x1200} {
+		if frame, ok := Symbolize(pc); ok || frame.Function != "" {
+			t.Errorf("expected pc 0x%x not to be resolved; got %+v", pc, frame)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(10, func() { Symbolize(0x1180) }); allocs != 0 {
+		t.Errorf("expected Symbolize not to allocate; got %v allocations per call", allocs)
+	}
+}
+
+func TestReadVarint(t *testing.T) {
+	specs := []struct {
+		input    []byte
+		expVal   uint32
+		expBytes uintptr
+	}{
+		{[]byte{0}, 0, 1},
+		{[]byte{0x7f}, 0x7f, 1},
+		{[]byte{0x80, 0x02}, 0x100, 2},
+		{[]byte{0xff, 0xff, 0x03}, 0xffff, 3},
+	}
+
+	for specIndex, spec := range specs {
+		val, n := readVarint(uintptr(unsafe.Pointer(&spec.input[0])))
+		if val != spec.expVal || n != spec.expBytes {
+			t.Errorf("[spec %d] expected (%d, %d); got (%d, %d)", specIndex, spec.expVal, spec.expBytes, val, n)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package debug provides helpers for inspecting the state of the kernel while
+// diagnosing crashes.
+package debug
+
+import (
+	"gopheros/kernel/kfmt"
+	"io"
+	"unsafe"
+)
+
+const (
+	// maxStackDepth is the maximum number of frames reported by WalkStack.
+	maxStackDepth = 32
+
+	ptrSize = unsafe.Sizeof(uintptr(0))
+)
+
+var (
+	// stackBoundsFn is used by tests to mock the bounds of the current
+	// stack and is automatically inlined by the compiler.
+	stackBoundsFn = stackBounds
+)
+
+// WalkStack unwinds the stack by following the chain of saved frame pointers
+// starting at framePtr and invokes fn with the return address stored in each
+// frame. The Go compiler sets up a frame pointer for every function with a
+// non-empty frame; each frame pointer points to the caller's saved frame
+// pointer which is followed by the return address.
+//
+// The walk stops once fn returns false, the chain ends or maxStackDepth frames
+// have been visited. As WalkStack is used while handling faults, frame pointers
+// that are misaligned, do not point further up the stack or point to a frame
+// outside the stack of the current goroutine are treated as the end of the
+// chain instead of being dereferenced.
+func WalkStack(framePtr uintptr, fn func(pc uintptr) bool) {
+	stackLo, stackHi := stackBoundsFn()
+
+	for depth := 0; depth < maxStackDepth; depth++ {
+		if framePtr == 0 || framePtr&(ptrSize-1) != 0 ||
+			framePtr < stackLo || framePtr >= stackHi || stackHi-framePtr < 2*ptrSize {
+			return
+		}
+
+		var (
+			nextFramePtr = *(*uintptr)(unsafe.Pointer(framePtr))
+			retAddr      = *(*uintptr)(unsafe.Pointer(framePtr + ptrSize))
+		)
+
+		if retAddr == 0 || !fn(retAddr) || nextFramePtr <= framePtr {
+			return
+		}
+
+		framePtr = nextFramePtr
+	}
+}
+
+// PrintStackTrace outputs to w the program counter pc followed by the return
+// addresses of the frames reachable from framePtr. Each address is resolved to
+// the function, file and line that it belongs to.
+func PrintStackTrace(w io.Writer, pc, framePtr uintptr) {
+	kfmt.Fprintf(w, "Stack trace:\n")
+
+	frame, _ := Symbolize(pc)
+	printFrame(w, 0, frame)
+
+	index := 1
+	WalkStack(framePtr, func(retAddr uintptr) bool {
+		frame, _ = symbolizeReturnAddr(retAddr)
+		printFrame(w, index, frame)
+		index++
+		return true
+	})
+}
+
+// printFrame outputs a stack trace entry for frame. Frames that could not be
+// symbolized are reported using their address.
+func printFrame(w io.Writer, index int, frame Frame) {
+	if frame.Function == "" {
+		kfmt.Fprintf(w, "  #%d 0x%16x ?\n", index, frame.PC)
+		return
+	}
+
+	kfmt.Fprintf(w, "  #%d 0x%16x %s\n", index, frame.PC, frame.Function)
+	kfmt.Fprintf(w, "        %s:%d\n", frame.File, frame.Line)
+}
@@ -0,0 +1,8 @@
+package debug
+
+// framePointer returns the frame pointer of the function that invokes it.
+func framePointer() uintptr
+
+// stackBounds returns the lowest and highest (exclusive) address of the stack
+// used by the current goroutine.
+func stackBounds() (lo, hi uintptr)
@@ -0,0 +1,19 @@
+#include "textflag.h"
+
+TEXT ·framePointer(SB),NOSPLIT,$0
+	// As this function does not set up a frame, BP still holds the frame
+	// pointer of the caller.
+	MOVQ BP, AX
+	MOVQ AX, ret+0(FP)
+	RET
+
+TEXT ·stackBounds(SB),NOSPLIT,$0
+	// The stack bounds are stored at the beginning of the g struct for
+	// the current goroutine which is accessed via TLS.
+	MOVQ TLS, CX
+	MOVQ 0(CX)(TLS*1), AX
+	MOVQ 0(AX), BX
+	MOVQ BX, lo+0(FP)
+	MOVQ 8(AX), BX
+	MOVQ BX, hi+8(FP)
+	RET
@@ -0,0 +1,170 @@
+package debug
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// fakeStack returns the address of the first frame in a stack that contains a
+// frame pointer chain with the supplied return addresses. It also mocks the
+// stack bounds reported to WalkStack so that they cover the fake stack.
+func fakeStack(stack []uintptr, retAddrs ...uintptr) uintptr {
+	stackBoundsFn = func() (uintptr, uintptr) {
+		return uintptr(unsafe.Pointer(&stack[0])), uintptr(unsafe.Pointer(&stack[0])) + uintptr(len(stack))*ptrSize
+	}
+
+	for i, retAddr := range retAddrs {
+		stack[2*i+1] = retAddr
+		if i < len(retAddrs)-1 {
+			stack[2*i] = uintptr(unsafe.Pointer(&stack[2*i+2]))
+		}
+	}
+
+	return uintptr(unsafe.Pointer(&stack[0]))
+}
+
+func TestWalkStack(t *testing.T) {
+	defer func() { stackBoundsFn = stackBounds }()
+
+	t.Run("full chain", func(t *testing.T) {
+		stack := make([]uintptr, 8)
+		framePtr := fakeStack(stack, 0x100, 0x200, 0x300)
+
+		var got []uintptr
+		WalkStack(framePtr, func(pc uintptr) bool {
+			got = append(got, pc)
+			return true
+		})
+
+		if exp := []uintptr{0x100, 0x200, 0x300}; !equal(got, exp) {
+			t.Fatalf("expected return addresses %v; got %v", exp, got)
+		}
+	})
+
+	t.Run("stop walk", func(t *testing.T) {
+		stack := make([]uintptr, 8)
+		framePtr := fakeStack(stack, 0x100, 0x200, 0x300)
+
+		var got []uintptr
+		WalkStack(framePtr, func(pc uintptr) bool {
+			got = append(got, pc)
+			return len(got) < 2
+		})
+
+		if exp := []uintptr{0x100, 0x200}; !equal(got, exp) {
+			t.Fatalf("expected return addresses %v; got %v", exp, got)
+		}
+	})
+
+	t.Run("invalid frame pointers", func(t *testing.T) {
+		stack := make([]uintptr, 8)
+		framePtr := fakeStack(stack, 0x100, 0x200, 0x300)
+
+		// A frame pointer pointing down the stack ends the chain
+		stack[2] = framePtr
+
+		var got []uintptr
+		WalkStack(framePtr, func(pc uintptr) bool {
+			got = append(got, pc)
+			return true
+		})
+
+		if exp := []uintptr{0x100, 0x200}; !equal(got, exp) {
+			t.Fatalf("expected return addresses %v; got %v", exp, got)
+		}
+
+		for _, framePtr := range []uintptr{0, framePtr + 1} {
+			WalkStack(framePtr, func(_ uintptr) bool {
+				t.Errorf("expected walk from frame pointer 0x%x not to visit any frames", framePtr)
+				return true
+			})
+		}
+	})
+
+	t.Run("frames outside the stack", func(t *testing.T) {
+		var other [4]uintptr
+		otherFramePtr := fakeStack(other[:], 0x100)
+
+		stack := make([]uintptr, 8)
+		framePtr := fakeStack(stack, 0x100, 0x200, 0x300)
+
+		// Exclude the last frame from the stack bounds
+		stackLo, _ := stackBoundsFn()
+		stackBoundsFn = func() (uintptr, uintptr) { return stackLo, uintptr(unsafe.Pointer(&stack[5])) }
+
+		var got []uintptr
+		WalkStack(framePtr, func(pc uintptr) bool {
+			got = append(got, pc)
+			return true
+		})
+
+		if exp := []uintptr{0x100, 0x200}; !equal(got, exp) {
+			t.Fatalf("expected return addresses %v; got %v", exp, got)
+		}
+
+		// A chain starting outside the stack is not followed
+		WalkStack(otherFramePtr, func(_ uintptr) bool {
+			t.Error("expected walk starting outside the stack not to visit any frames")
+			return true
+		})
+	})
+
+	t.Run("max depth", func(t *testing.T) {
+		var (
+			stack    = make([]uintptr, 2*(maxStackDepth+4))
+			retAddrs = make([]uintptr, maxStackDepth+4)
+		)
+		for i := range retAddrs {
+			retAddrs[i] = uintptr(i + 1)
+		}
+
+		var count int
+		WalkStack(fakeStack(stack, retAddrs...), func(_ uintptr) bool {
+			count++
+			return true
+		})
+
+		if count != maxStackDepth {
+			t.Fatalf("expected walk to visit %d frames; got %d", maxStackDepth, count)
+		}
+	})
+}
+
+func TestPrintStackTrace(t *testing.T) {
+	defer func() { stackBoundsFn = stackBounds }()
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	_, file, line, _ := runtime.Caller(0)
+
+	stack := make([]uintptr, 4)
+	framePtr := fakeStack(stack, pcs[0])
+
+	var buf bytes.Buffer
+	PrintStackTrace(&buf, 1, framePtr)
+
+	exp := fmt.Sprintf(
+		"Stack trace:\n  #0 0x0000000000000001 ?\n  #1 0x%016x gopheros/kernel/debug.TestPrintStackTrace\n        %s:%d\n",
+		pcs[0], file, line-1,
+	)
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+}
+
+func equal(a, b []uintptr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package debug
+
+import (
+	"gopheros/kernel/kfmt"
+	"runtime"
+)
+
+// Frame describes a location in the kernel image.
+type Frame struct {
+	PC uintptr
+
+	// Function is the fully qualified name of the function that contains
+	// PC. Function, File and Line are empty if PC could not be resolved.
+	Function string
+	File     string
+	Line     int
+}
+
+var (
+	// kernelPCLNTable provides access to the pclntab of the kernel image.
+	// It is set up the first time Symbolize is invoked.
+	kernelPCLNTable pclnTable
+	pclnTableReady  bool
+
+	// pclnTabAddrFn is used by tests to mock the location of the pclntab
+	// and is automatically inlined by the compiler.
+	pclnTabAddrFn = pclnTabAddr
+
+	// skipPanicStackTrace is set via SkipPanicStackTrace.
+	skipPanicStackTrace bool
+)
+
+// Symbolize resolves pc to the function, file and line that it belongs to
+// using the symbol and line tables (pclntab) that the Go linker embeds into
+// the kernel image. As Symbolize is used while handling faults, the lookup
+// reads the tables in place and does not allocate memory. It returns false if
+// pc does not belong to any function.
+func Symbolize(pc uintptr) (Frame, bool) {
+	frame := Frame{PC: pc}
+
+	if !pclnTableReady {
+		pclnTableReady = kernelPCLNTable.init(pclnTabAddrFn())
+	}
+
+	// Images built by Go versions that use a different pclntab layout
+	// (e.g. the test binaries) are symbolized using the runtime.
+	if !pclnTableReady {
+		return symbolizeWithRuntime(frame)
+	}
+
+	fn := kernelPCLNTable.findFunc(pc)
+	if fn == 0 {
+		return frame, false
+	}
+
+	frame.Function = kernelPCLNTable.funcName(fn)
+	frame.File, frame.Line = kernelPCLNTable.fileLine(fn, pc)
+	return frame, true
+}
+
+// symbolizeWithRuntime resolves frame.PC using runtime.FuncForPC. Unlike the
+// pclntab lookup, this may allocate memory for PCs that belong to inlined
+// functions.
+func symbolizeWithRuntime(frame Frame) (Frame, bool) {
+	fn := runtime.FuncForPC(frame.PC)
+	if fn == nil {
+		return frame, false
+	}
+
+	frame.Function = fn.Name()
+	frame.File, frame.Line = fn.FileLine(frame.PC)
+	return frame, true
+}
+
+// symbolizeReturnAddr resolves a return address obtained while unwinding the
+// stack. As the return address points to the instruction following the CALL,
+// the lookup uses the address of the last byte of the CALL instruction so the
+// reported line and function are the ones of the call site.
+func symbolizeReturnAddr(retAddr uintptr) (Frame, bool) {
+	frame, ok := Symbolize(retAddr - 1)
+	frame.PC = retAddr
+	return frame, ok
+}
+
+// Caller reports the location of a call in the stack of the calling
+// goroutine. The skip argument is the number of stack frames to ascend, with 0
+// identifying the caller of Caller. Unlike runtime.Caller, the stack is
+// unwound by following the frame pointer chain which makes Caller safe to use
+// while handling exceptions. It returns false if the stack contains fewer than
+// skip+1 frames.
+//
+//go:noinline
+func Caller(skip int) (Frame, bool) {
+	var (
+		frame Frame
+		found bool
+	)
+
+	WalkStack(framePointer(), func(retAddr uintptr) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+
+		frame, _ = symbolizeReturnAddr(retAddr)
+		found = true
+		return false
+	})
+
+	return frame, found
+}
+
+// SkipPanicStackTrace prevents the next kernel panic from outputting a stack
+// trace. Code that has already output the stack trace of the code that caused
+// a fatal condition (e.g. an exception handler) invokes it before panicking so
+// that the less useful trace of the panic path is not printed as well.
+func SkipPanicStackTrace() {
+	skipPanicStackTrace = true
+}
+
+// printPanicStackTrace is registered as a kfmt panic info function and outputs
+// the stack of the code that triggered the panic.
+//
+//go:noinline
+func printPanicStackTrace() {
+	if skipPanicStackTrace {
+		skipPanicStackTrace = false
+		return
+	}
+
+	w := kfmt.GetOutputSink()
+	kfmt.Fprintf(w, "Stack trace:\n")
+
+	index := 0
+	WalkStack(framePointer(), func(retAddr uintptr) bool {
+		frame, _ := symbolizeReturnAddr(retAddr)
+		printFrame(w, index, frame)
+		index++
+		return true
+	})
+}
+
+func init() {
+	kfmt.RegisterPanicInfoFn(printPanicStackTrace)
+}
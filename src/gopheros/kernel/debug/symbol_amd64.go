@@ -0,0 +1,5 @@
+package debug
+
+// pclnTabAddr returns the address of the symbol and line table (pclntab) that
+// the Go linker embeds into the kernel image.
+func pclnTabAddr() uintptr
@@ -0,0 +1,6 @@
+#include "textflag.h"
+
+TEXT ·pclnTabAddr(SB),NOSPLIT,$0
+	MOVQ $runtime·pclntab(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
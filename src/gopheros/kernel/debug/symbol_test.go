@@ -0,0 +1,96 @@
+package debug
+
+import (
+	"bytes"
+	"gopheros/kernel/kfmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSymbolize(t *testing.T) {
+	pc := reflect.ValueOf(TestSymbolize).Pointer()
+
+	frame, ok := Symbolize(pc)
+	if !ok {
+		t.Fatalf("expected pc 0x%x to be resolved", pc)
+	}
+
+	if exp := "gopheros/kernel/debug.TestSymbolize"; frame.Function != exp {
+		t.Errorf("expected function to be %q; got %q", exp, frame.Function)
+	}
+
+	if !strings.HasSuffix(frame.File, "symbol_test.go") || frame.Line == 0 {
+		t.Errorf("expected location to be in symbol_test.go; got %s:%d", frame.File, frame.Line)
+	}
+
+	if frame, ok = Symbolize(1); ok || frame.PC != 1 || frame.Function != "" {
+		t.Errorf("expected pc 0x1 not to be resolved; got %+v", frame)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	frame, ok := Caller(0)
+	_, file, line, _ := runtime.Caller(0)
+
+	if !ok {
+		t.Fatal("expected Caller(0) to succeed")
+	}
+
+	if exp := "gopheros/kernel/debug.TestCaller"; frame.Function != exp {
+		t.Errorf("expected function to be %q; got %q", exp, frame.Function)
+	}
+
+	if frame.File != file || frame.Line != line-1 {
+		t.Errorf("expected location to be %s:%d; got %s:%d", file, line-1, frame.File, frame.Line)
+	}
+
+	if frame, ok = callerOfHelper(); !ok || frame.Function != "gopheros/kernel/debug.TestCaller" {
+		t.Errorf("expected Caller(1) to report the caller of the helper; got %+v", frame)
+	}
+
+	if _, ok = Caller(maxStackDepth); ok {
+		t.Error("expected Caller to fail when skipping past the end of the walked frames")
+	}
+}
+
+//go:noinline
+func callerOfHelper() (Frame, bool) {
+	return Caller(1)
+}
+
+func TestPrintPanicStackTrace(t *testing.T) {
+	defer kfmt.SetOutputSink(nil)
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	printPanicStackTrace()
+
+	exp := "Stack trace:\n  #0 0x"
+	if got := buf.String(); !strings.HasPrefix(got, exp) || !strings.Contains(got, "gopheros/kernel/debug.TestPrintPanicStackTrace\n") {
+		t.Fatalf("expected output to contain a stack trace including the caller; got:\n%s", got)
+	}
+}
+
+func TestSkipPanicStackTrace(t *testing.T) {
+	defer func() {
+		kfmt.SetOutputSink(nil)
+		skipPanicStackTrace = false
+	}()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	SkipPanicStackTrace()
+	printPanicStackTrace()
+	if buf.Len() != 0 {
+		t.Fatalf("expected stack trace to be skipped; got:\n%s", buf.String())
+	}
+
+	printPanicStackTrace()
+	if !strings.HasPrefix(buf.String(), "Stack trace:\n") {
+		t.Fatalf("expected only the first panic stack trace to be skipped; got:\n%s", buf.String())
+	}
+}
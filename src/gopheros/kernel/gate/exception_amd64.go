@@ -0,0 +1,376 @@
+package gate
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/debug"
+	"gopheros/kernel/kfmt"
+	"io"
+)
+
+const (
+	// Debug occurs when a debug trap or fault condition (e.g. a hardware
+	// breakpoint or single-stepping) is detected.
+	Debug = InterruptNumber(1)
+
+	// Breakpoint occurs when the INT3 instruction is executed.
+	Breakpoint = InterruptNumber(3)
+
+	// CoprocessorSegmentOverrun is reserved on CPUs newer than the 386.
+	CoprocessorSegmentOverrun = InterruptNumber(9)
+
+	// VirtualizationException occurs when an EPT violation is reported to
+	// a guest as a #VE.
+	VirtualizationException = InterruptNumber(20)
+
+	// ControlProtectionException occurs when a control-flow enforcement
+	// check fails.
+	ControlProtectionException = InterruptNumber(21)
+
+	// SecurityException is raised by SVM-capable CPUs on security-sensitive
+	// events.
+	SecurityException = InterruptNumber(30)
+
+	// numExceptions is the number of interrupt slots reserved for CPU
+	// exceptions.
+	numExceptions = 32
+
+	// systemControlPortB reports the chipset conditions that raise an NMI.
+	systemControlPortB = 0x61
+	nmiSystemError     = 1 << 7
+	nmiIOCheckError    = 1 << 6
+
+	rflagsTrap   = 1 << 8
+	rflagsResume = 1 << 16
+)
+
+var (
+	// exceptionNames contains the name of each CPU exception. Reserved
+	// slots have an empty name.
+	exceptionNames = [numExceptions]string{
+		DivideByZero:               "divide error",
+		Debug:                      "debug exception",
+		NMI:                        "non-maskable interrupt",
+		Breakpoint:                 "breakpoint",
+		Overflow:                   "overflow",
+		BoundRangeExceeded:         "bound range exceeded",
+		InvalidOpcode:              "invalid opcode",
+		DeviceNotAvailable:         "device not available",
+		DoubleFault:                "double fault",
+		CoprocessorSegmentOverrun:  "coprocessor segment overrun",
+		InvalidTSS:                 "invalid TSS",
+		SegmentNotPresent:          "segment not present",
+		StackSegmentFault:          "stack-segment fault",
+		GPFException:               "general protection fault",
+		PageFaultException:         "page fault",
+		FloatingPointException:     "x87 floating-point exception",
+		AlignmentCheck:             "alignment check",
+		MachineCheck:               "machine check",
+		SIMDFloatingPointException: "SIMD floating-point exception",
+		VirtualizationException:    "virtualization exception",
+		ControlProtectionException: "control protection exception",
+		SecurityException:          "security exception",
+	}
+
+	// errUnhandledException is passed to panic when an exception without a
+	// registered handler occurs. Its message is set to the exception name.
+	errUnhandledException = &kernel.Error{Module: "gate", Message: "unhandled exception"}
+
+	// The following functions are used by tests to mock calls to the cpu
+	// and debug packages as well as calls to HandleInterrupt and are
+	// automatically inlined by the compiler.
+	readCR0Fn             = cpu.ReadCR0
+	readCR2Fn             = cpu.ReadCR2
+	readCR3Fn             = cpu.ReadCR3
+	readCR4Fn             = cpu.ReadCR4
+	readMSRSafeFn         = cpu.ReadMSRSafe
+	portReadByteFn        = cpu.PortReadByte
+	exceptionFixupFn      = cpu.ExceptionFixup
+	printStackTraceFn     = debug.PrintStackTrace
+	skipPanicStackTraceFn = debug.SkipPanicStackTrace
+	handleInterruptFn     = HandleInterrupt
+)
+
+// String returns the name of the exception or interrupt.
+func (n InterruptNumber) String() string {
+	switch {
+	case n >= numExceptions:
+		return "interrupt"
+	case exceptionNames[n] == "":
+		return "reserved exception"
+	default:
+		return exceptionNames[n]
+	}
+}
+
+// hasSelectorErrorCode returns true if the CPU pushes a segment selector error
+// code for the exception.
+func (n InterruptNumber) hasSelectorErrorCode() bool {
+	switch n {
+	case InvalidTSS, SegmentNotPresent, StackSegmentFault, GPFException:
+		return true
+	default:
+		return false
+	}
+}
+
+// installDefaultExceptionHandlers installs a handler for every CPU exception.
+// Debug exceptions, breakpoints and NMIs that are not caused by hardware
+// errors are reported and execution resumes; all other exceptions output
+// diagnostic information and panic. Subsystems that can recover from
+// particular exceptions (e.g. page faults) override these handlers.
+func installDefaultExceptionHandlers() {
+	for n := InterruptNumber(0); n < numExceptions; n++ {
+		if exceptionNames[n] == "" {
+			continue
+		}
+
+		// For exceptions that do not push an error code, the gate
+		// entrypoint stores the exception number in Registers.Info so
+		// a single handler can service all of them.
+		handler := exceptionWithoutCodeHandler
+		switch n {
+		case Debug:
+			handler = debugExceptionHandler
+		case NMI:
+			handler = nmiHandler
+		case Breakpoint:
+			handler = breakpointHandler
+		case DoubleFault:
+			handler = doubleFaultHandler
+		case InvalidTSS:
+			handler = invalidTSSHandler
+		case SegmentNotPresent:
+			handler = segmentNotPresentHandler
+		case StackSegmentFault:
+			handler = stackSegmentFaultHandler
+		case GPFException:
+			handler = generalProtectionFaultHandler
+		case PageFaultException:
+			handler = pageFaultHandler
+		case AlignmentCheck:
+			handler = alignmentCheckHandler
+		case ControlProtectionException:
+			handler = controlProtectionHandler
+		case SecurityException:
+			handler = securityExceptionHandler
+		}
+
+		handleInterruptFn(n, 0, handler)
+	}
+}
+
+func exceptionWithoutCodeHandler(regs *Registers) {
+	HandleFatalException(InterruptNumber(regs.Info), regs)
+}
+
+func doubleFaultHandler(regs *Registers)       { HandleFatalException(DoubleFault, regs) }
+func invalidTSSHandler(regs *Registers)        { HandleFatalException(InvalidTSS, regs) }
+func segmentNotPresentHandler(regs *Registers) { HandleFatalException(SegmentNotPresent, regs) }
+func stackSegmentFaultHandler(regs *Registers) { HandleFatalException(StackSegmentFault, regs) }
+func alignmentCheckHandler(regs *Registers)    { HandleFatalException(AlignmentCheck, regs) }
+func controlProtectionHandler(regs *Registers) {
+	HandleFatalException(ControlProtectionException, regs)
+}
+func securityExceptionHandler(regs *Registers) { HandleFatalException(SecurityException, regs) }
+func pageFaultHandler(regs *Registers)         { HandleFatalException(PageFaultException, regs) }
+
+// debugExceptionHandler reports debug exceptions and resumes execution. As
+// the kernel does not use single-stepping or hardware breakpoints, the trap
+// flag is cleared so that a stray single-step does not trap after every
+// instruction and the resume flag is set so that an instruction breakpoint
+// does not fire again for the same instruction.
+func debugExceptionHandler(regs *Registers) {
+	kfmt.Printf("\n%s at RIP: 0x%16x; resuming execution\n", Debug.String(), regs.RIP)
+	regs.RFlags = (regs.RFlags &^ rflagsTrap) | rflagsResume
+}
+
+// breakpointHandler reports the execution of an INT3 instruction together
+// with a stack trace and resumes execution at the following instruction.
+func breakpointHandler(regs *Registers) {
+	w := kfmt.GetOutputSink()
+	kfmt.Fprintf(w, "\n%s at RIP: 0x%16x; resuming execution\n", Breakpoint.String(), regs.RIP-1)
+	printStackTraceFn(w, uintptr(regs.RIP), uintptr(regs.RBP))
+}
+
+// nmiHandler services non-maskable interrupts. NMIs raised by the chipset to
+// report a system (e.g. memory parity) or I/O channel check error indicate a
+// hardware failure and are fatal. Other NMIs (e.g. watchdog or profiling
+// NMIs) are reported and execution resumes.
+func nmiHandler(regs *Registers) {
+	reason := portReadByteFn(systemControlPortB)
+	if reason&(nmiSystemError|nmiIOCheckError) == 0 {
+		kfmt.Printf("\n%s at RIP: 0x%16x; resuming execution\n", NMI.String(), regs.RIP)
+		return
+	}
+
+	kfmt.Printf("\nNMI reason: 0x%x (system error: %t, I/O check error: %t)\n",
+		reason,
+		reason&nmiSystemError != 0,
+		reason&nmiIOCheckError != 0,
+	)
+	HandleFatalException(NMI, regs)
+}
+
+// generalProtectionFaultHandler resumes execution at the fixup code of
+// instructions listed in the exception fixup table (e.g. the safe MSR
+// accessors). All other general protection faults are fatal.
+func generalProtectionFaultHandler(regs *Registers) {
+	if fixupAddr, ok := exceptionFixupFn(uintptr(regs.RIP)); ok {
+		regs.RIP = uint64(fixupAddr)
+		return
+	}
+
+	HandleFatalException(GPFException, regs)
+}
+
+// HandleFatalException outputs diagnostic information for exception n and
+// panics with an error describing the exception. As the diagnostic information
+// already includes the stack trace of the code that triggered the exception,
+// the panic does not output a stack trace.
+func HandleFatalException(n InterruptNumber, regs *Registers) {
+	w := kfmt.GetOutputSink()
+	kfmt.Fprintf(w, "\n%s at RIP: 0x%16x\n", n.String(), regs.RIP)
+	DumpExceptionState(w, n, regs)
+
+	errUnhandledException.Message = n.String()
+	skipPanicStackTraceFn()
+	panic(errUnhandledException)
+}
+
+// DumpExceptionState outputs to w the decoded error code for exception n, the
+// contents of the general purpose and control registers and a stack trace
+// that starts at the code that triggered the exception.
+func DumpExceptionState(w io.Writer, n InterruptNumber, regs *Registers) {
+	switch {
+	case n.hasSelectorErrorCode():
+		dumpSelectorErrorCode(w, regs.Info)
+	case n == PageFaultException:
+		dumpPageFaultErrorCode(w, regs.Info, readCR2Fn())
+	case n == ControlProtectionException:
+		dumpControlProtectionErrorCode(w, regs.Info)
+	case n == MachineCheck:
+		dumpMachineCheckState(w)
+	}
+
+	kfmt.Fprintf(w, "\nRegisters:\n")
+	regs.DumpTo(w)
+	kfmt.Fprintf(w, "CR0 = %16x CR3 = %16x\n", readCR0Fn(), readCR3Fn())
+	kfmt.Fprintf(w, "CR4 = %16x\n\n", readCR4Fn())
+
+	printStackTraceFn(w, uintptr(regs.RIP), uintptr(regs.RBP))
+}
+
+// dumpControlProtectionErrorCode decodes the error code pushed by #CP which
+// describes the control-flow transfer that failed the CET checks.
+func dumpControlProtectionErrorCode(w io.Writer, code uint64) {
+	var cause string
+	switch code & 0x7fff {
+	case 1:
+		cause = "near RET"
+	case 2:
+		cause = "far RET/IRET"
+	case 3:
+		cause = "missing ENDBRANCH"
+	case 4:
+		cause = "RSTORSSP"
+	case 5:
+		cause = "SETSSBSY"
+	default:
+		cause = "unknown"
+	}
+
+	kfmt.Fprintf(w, "Error code: 0x%x (%s", code, cause)
+	if code&(1<<15) != 0 {
+		kfmt.Fprintf(w, ", in enclave")
+	}
+	kfmt.Fprintf(w, ")\n")
+}
+
+// dumpSelectorErrorCode decodes the error code pushed by exceptions that
+// reference a segment selector. The error code contains the index of the
+// selector, the descriptor table it refers to and whether the exception was
+// triggered by an event external to the program.
+func dumpSelectorErrorCode(w io.Writer, code uint64) {
+	if code == 0 {
+		kfmt.Fprintf(w, "Error code: 0 (not selector-related)\n")
+		return
+	}
+
+	table := "GDT"
+	switch {
+	case code&(1<<1) != 0:
+		table = "IDT"
+	case code&(1<<2) != 0:
+		table = "LDT"
+	}
+
+	kfmt.Fprintf(w, "Error code: 0x%x (%s selector index %d", code, table, (code>>3)&0x1fff)
+	if code&1 != 0 {
+		kfmt.Fprintf(w, ", external event")
+	}
+	kfmt.Fprintf(w, ")\n")
+}
+
+// dumpPageFaultErrorCode decodes the error code pushed by page faults.
+func dumpPageFaultErrorCode(w io.Writer, code, faultAddress uint64) {
+	access := "read"
+	switch {
+	case code&(1<<4) != 0:
+		access = "instruction fetch"
+	case code&(1<<1) != 0:
+		access = "write"
+	}
+
+	kfmt.Fprintf(w, "Error code: 0x%x (%s at address 0x%16x", code, access, faultAddress)
+	if code&1 == 0 {
+		kfmt.Fprintf(w, ", page not present")
+	} else {
+		kfmt.Fprintf(w, ", protection violation")
+	}
+	if code&(1<<2) != 0 {
+		kfmt.Fprintf(w, ", user-mode")
+	}
+	if code&(1<<3) != 0 {
+		kfmt.Fprintf(w, ", reserved bit set")
+	}
+	kfmt.Fprintf(w, ")\n")
+}
+
+// dumpMachineCheckState outputs the global machine-check status and the
+// status of every error reporting bank that contains a valid error.
+func dumpMachineCheckState(w io.Writer) {
+	mcgCap, ok := readMSRSafeFn(cpu.MSRMCGCap)
+	if !ok {
+		kfmt.Fprintf(w, "Machine-check architecture not supported\n")
+		return
+	}
+
+	mcgStatus, _ := readMSRSafeFn(cpu.MSRMCGStatus)
+	kfmt.Fprintf(w, "MCG status: 0x%x (restart RIP valid: %t, error RIP valid: %t)\n",
+		mcgStatus,
+		mcgStatus&cpu.MCGStatusRIPValid != 0,
+		mcgStatus&cpu.MCGStatusErrorIPValid != 0,
+	)
+
+	bankCount := uint8(cpu.MCGCapBankCount.Get(mcgCap))
+	for bank := uint8(0); bank < bankCount; bank++ {
+		status, ok := readMSRSafeFn(cpu.MSRMCStatus(bank))
+		if !ok || status&cpu.MCStatusValid == 0 {
+			continue
+		}
+
+		kfmt.Fprintf(w, "MC%d status: 0x%16x (error code: 0x%x", bank, status, cpu.MCStatusErrorCode.Get(status))
+		if status&cpu.MCStatusUncorrected != 0 {
+			kfmt.Fprintf(w, ", uncorrected")
+		}
+		if status&cpu.MCStatusOverflow != 0 {
+			kfmt.Fprintf(w, ", overflow")
+		}
+		if status&cpu.MCStatusAddrValid != 0 {
+			addr, _ := readMSRSafeFn(cpu.MSRMCAddr(bank))
+			kfmt.Fprintf(w, ", address: 0x%x", addr)
+		}
+		kfmt.Fprintf(w, ")\n")
+	}
+}
@@ -0,0 +1,312 @@
+package gate
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/debug"
+	"gopheros/kernel/kfmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func mockExceptionState() {
+	readCR0Fn = func() uint64 { return 0x80010033 }
+	readCR2Fn = func() uint64 { return 0xbadf00d000 }
+	readCR3Fn = func() uint64 { return 0x1000 }
+	readCR4Fn = func() uint64 { return 0x3006a0 }
+	printStackTraceFn = func(w io.Writer, pc, _ uintptr) {
+		kfmt.Fprintf(w, "Stack trace:\n  #0 0x%16x\n", pc)
+	}
+}
+
+func restoreMocks() {
+	readCR0Fn = cpu.ReadCR0
+	readCR2Fn = cpu.ReadCR2
+	readCR3Fn = cpu.ReadCR3
+	readCR4Fn = cpu.ReadCR4
+	readMSRSafeFn = cpu.ReadMSRSafe
+	portReadByteFn = cpu.PortReadByte
+	exceptionFixupFn = cpu.ExceptionFixup
+	printStackTraceFn = debug.PrintStackTrace
+	skipPanicStackTraceFn = debug.SkipPanicStackTrace
+	handleInterruptFn = HandleInterrupt
+	kfmt.SetOutputSink(nil)
+}
+
+func TestInterruptNumberString(t *testing.T) {
+	specs := map[InterruptNumber]string{
+		DivideByZero:      "divide error",
+		GPFException:      "general protection fault",
+		SecurityException: "security exception",
+		15:                "reserved exception",
+		32:                "interrupt",
+	}
+
+	for n, exp := range specs {
+		if got := n.String(); got != exp {
+			t.Errorf("expected interrupt %d to be named %q; got %q", n, exp, got)
+		}
+	}
+}
+
+func TestInstallDefaultExceptionHandlers(t *testing.T) {
+	defer restoreMocks()
+
+	installed := make(map[InterruptNumber]func(*Registers))
+	handleInterruptFn = func(n InterruptNumber, istOffset uint8, handler func(*Registers)) {
+		if istOffset != 0 {
+			t.Errorf("expected handler for %s to use IST offset 0; got %d", n.String(), istOffset)
+		}
+		installed[n] = handler
+	}
+
+	installDefaultExceptionHandlers()
+
+	for n := InterruptNumber(0); n < numExceptions; n++ {
+		if _, found := installed[n]; found != (exceptionNames[n] != "") {
+			t.Errorf("expected handler for exception %d to be installed: %t", n, !found)
+		}
+	}
+
+	// Debug exceptions and breakpoints must not panic
+	mockExceptionState()
+	kfmt.SetOutputSink(&bytes.Buffer{})
+	regs := Registers{RIP: 0xc0ffee00}
+	installed[Debug](&regs)
+	installed[Breakpoint](&regs)
+}
+
+func TestDefaultExceptionHandlers(t *testing.T) {
+	defer restoreMocks()
+	mockExceptionState()
+
+	var (
+		buf        bytes.Buffer
+		skipCalled bool
+	)
+	kfmt.SetOutputSink(&buf)
+	skipPanicStackTraceFn = func() { skipCalled = true }
+	portReadByteFn = func(_ uint16) uint8 { return nmiSystemError }
+
+	specs := []struct {
+		handler func(*Registers)
+		info    uint64
+		exp     InterruptNumber
+	}{
+		{exceptionWithoutCodeHandler, uint64(DivideByZero), DivideByZero},
+		{exceptionWithoutCodeHandler, uint64(InvalidOpcode), InvalidOpcode},
+		{doubleFaultHandler, 0, DoubleFault},
+		{invalidTSSHandler, 0x18, InvalidTSS},
+		{segmentNotPresentHandler, 0x18, SegmentNotPresent},
+		{stackSegmentFaultHandler, 0, StackSegmentFault},
+		{generalProtectionFaultHandler, 0, GPFException},
+		{pageFaultHandler, 2, PageFaultException},
+		{alignmentCheckHandler, 0, AlignmentCheck},
+		{controlProtectionHandler, 3, ControlProtectionException},
+		{securityExceptionHandler, 0, SecurityException},
+	}
+
+	for specIndex, spec := range specs {
+		buf.Reset()
+		skipCalled = false
+		func() {
+			defer func() {
+				err := recover()
+				if err != errUnhandledException || errUnhandledException.Message != spec.exp.String() {
+					t.Errorf("[spec %d] expected a panic with errUnhandledException for %s; got %v", specIndex, spec.exp.String(), err)
+				}
+			}()
+
+			spec.handler(&Registers{RIP: 0xc0ffee00, Info: spec.info})
+		}()
+
+		if exp := "\n" + spec.exp.String() + " at RIP: 0x00000000c0ffee00\n"; !strings.HasPrefix(buf.String(), exp) {
+			t.Errorf("[spec %d] expected output to start with %q; got:\n%s", specIndex, exp, buf.String())
+		}
+
+		if !skipCalled {
+			t.Errorf("[spec %d] expected the panic stack trace to be suppressed", specIndex)
+		}
+	}
+}
+
+func TestNonFatalExceptionHandlers(t *testing.T) {
+	defer restoreMocks()
+	mockExceptionState()
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	t.Run("debug exception", func(t *testing.T) {
+		buf.Reset()
+		regs := Registers{RIP: 0xc0ffee00, RFlags: 0x202 | rflagsTrap}
+		debugExceptionHandler(&regs)
+
+		if exp := uint64(0x202 | rflagsResume); regs.RFlags != exp {
+			t.Errorf("expected RFlags to be 0x%x; got 0x%x", exp, regs.RFlags)
+		}
+
+		if exp := "debug exception at RIP: 0x00000000c0ffee00; resuming execution"; !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected output to contain %q; got:\n%s", exp, buf.String())
+		}
+	})
+
+	t.Run("breakpoint", func(t *testing.T) {
+		buf.Reset()
+		regs := Registers{RIP: 0xc0ffee01}
+		breakpointHandler(&regs)
+
+		if regs.RIP != 0xc0ffee01 {
+			t.Errorf("expected RIP to remain unchanged; got 0x%x", regs.RIP)
+		}
+
+		exp := "\nbreakpoint at RIP: 0x00000000c0ffee00; resuming execution\nStack trace:\n  #0 0x00000000c0ffee01\n"
+		if got := buf.String(); got != exp {
+			t.Errorf("expected output:\n%q\ngot:\n%q", exp, got)
+		}
+	})
+
+	t.Run("NMI", func(t *testing.T) {
+		buf.Reset()
+		portReadByteFn = func(port uint16) uint8 {
+			if port != systemControlPortB {
+				t.Errorf("expected NMI reason to be read from port 0x%x; got 0x%x", systemControlPortB, port)
+			}
+			return 0x0f
+		}
+		nmiHandler(&Registers{RIP: 0xc0ffee00})
+
+		if exp := "non-maskable interrupt at RIP: 0x00000000c0ffee00; resuming execution"; !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected output to contain %q; got:\n%s", exp, buf.String())
+		}
+	})
+
+	t.Run("NMI caused by hardware error", func(t *testing.T) {
+		buf.Reset()
+		portReadByteFn = func(_ uint16) uint8 { return nmiIOCheckError }
+
+		defer func() {
+			if err := recover(); err != errUnhandledException || errUnhandledException.Message != NMI.String() {
+				t.Errorf("expected a panic with errUnhandledException for %s; got %v", NMI.String(), err)
+			}
+
+			if exp := "NMI reason: 0x40 (system error: false, I/O check error: true)"; !strings.Contains(buf.String(), exp) {
+				t.Errorf("expected output to contain %q; got:\n%s", exp, buf.String())
+			}
+		}()
+
+		nmiHandler(&Registers{RIP: 0xc0ffee00})
+	})
+}
+
+func TestGPFHandlerFixup(t *testing.T) {
+	defer restoreMocks()
+
+	exceptionFixupFn = func(faultAddr uintptr) (uintptr, bool) {
+		if faultAddr != 0xc0ffee00 {
+			t.Errorf("expected fixup lookup for address 0xc0ffee00; got 0x%x", faultAddr)
+		}
+		return 0xc0ffee80, true
+	}
+
+	regs := Registers{RIP: 0xc0ffee00}
+	generalProtectionFaultHandler(&regs)
+
+	if regs.RIP != 0xc0ffee80 {
+		t.Fatalf("expected handler to resume execution at 0xc0ffee80; got 0x%x", regs.RIP)
+	}
+}
+
+func TestDumpExceptionState(t *testing.T) {
+	defer restoreMocks()
+	mockExceptionState()
+
+	specs := []struct {
+		n         InterruptNumber
+		code      uint64
+		expOutput []string
+	}{
+		{GPFException, 0, []string{"Error code: 0 (not selector-related)"}},
+		{GPFException, 0x1b, []string{"Error code: 0x1b (IDT selector index 3, external event)"}},
+		{SegmentNotPresent, 0x54, []string{"Error code: 0x54 (LDT selector index 10)"}},
+		{InvalidTSS, 0x18, []string{"Error code: 0x18 (GDT selector index 3)"}},
+		{PageFaultException, 0x3, []string{"Error code: 0x3 (write at address 0x000000badf00d000, protection violation)"}},
+		{PageFaultException, 0x14, []string{"Error code: 0x14 (instruction fetch at address 0x000000badf00d000, page not present, user-mode)"}},
+		{PageFaultException, 0x8, []string{"Error code: 0x8 (read at address 0x000000badf00d000, page not present, reserved bit set)"}},
+		{ControlProtectionException, 0x3, []string{"Error code: 0x3 (missing ENDBRANCH)"}},
+		{ControlProtectionException, 0x8001, []string{"Error code: 0x8001 (near RET, in enclave)"}},
+		{
+			DivideByZero, 0,
+			[]string{
+				"Registers:\nRAX = ",
+				"CR0 = 0000000080010033 CR3 = 0000000000001000\nCR4 = 00000000003006a0\n",
+				"Stack trace:\n  #0 0x00000000c0ffee00\n",
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	for specIndex, spec := range specs {
+		buf.Reset()
+		DumpExceptionState(&buf, spec.n, &Registers{RIP: 0xc0ffee00, Info: spec.code})
+
+		for _, exp := range spec.expOutput {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("[spec %d] expected output to contain %q; got:\n%s", specIndex, exp, buf.String())
+			}
+		}
+
+		if spec.n == DivideByZero && strings.Contains(buf.String(), "Error code") {
+			t.Errorf("[spec %d] expected no error code to be reported; got:\n%s", specIndex, buf.String())
+		}
+	}
+}
+
+func TestDumpMachineCheckState(t *testing.T) {
+	defer restoreMocks()
+	mockExceptionState()
+
+	t.Run("MCA not supported", func(t *testing.T) {
+		readMSRSafeFn = func(_ uint32) (uint64, bool) { return 0, false }
+
+		var buf bytes.Buffer
+		DumpExceptionState(&buf, MachineCheck, &Registers{})
+
+		if exp := "Machine-check architecture not supported\n"; !strings.Contains(buf.String(), exp) {
+			t.Fatalf("expected output to contain %q; got:\n%s", exp, buf.String())
+		}
+	})
+
+	t.Run("bank status", func(t *testing.T) {
+		msrs := map[uint32]uint64{
+			cpu.MSRMCGCap:        3,
+			cpu.MSRMCGStatus:     cpu.MCGStatusErrorIPValid | cpu.MCGStatusInProgress,
+			cpu.MSRMCStatus(1):   cpu.MCStatusValid | cpu.MCStatusUncorrected | cpu.MCStatusAddrValid | 0x150,
+			cpu.MSRMCAddr(1):     0xdead000,
+			cpu.MSRMCStatus(2):   cpu.MCStatusValid | cpu.MCStatusOverflow | 0x5,
+			cpu.MSRMCStatus(0x7): cpu.MCStatusValid,
+		}
+		readMSRSafeFn = func(reg uint32) (uint64, bool) {
+			val, ok := msrs[reg]
+			return val, ok
+		}
+
+		var buf bytes.Buffer
+		DumpExceptionState(&buf, MachineCheck, &Registers{})
+
+		for _, exp := range []string{
+			"MCG status: 0x6 (restart RIP valid: false, error RIP valid: true)\n",
+			"MC1 status: 0xa400000000000150 (error code: 0x150, uncorrected, address: 0xdead000)\n",
+			"MC2 status: 0xc000000000000005 (error code: 0x5, overflow)\n",
+		} {
+			if !strings.Contains(buf.String(), exp) {
+				t.Errorf("expected output to contain %q; got:\n%s", exp, buf.String())
+			}
+		}
+
+		if strings.Contains(buf.String(), "MC0 ") || strings.Contains(buf.String(), "MC7 ") {
+			t.Errorf("expected only banks with valid errors below the bank count to be reported; got:\n%s", buf.String())
+		}
+	})
+}
@@ -3,6 +3,7 @@ package gate
 import (
 	"gopheros/kernel/kfmt"
 	"io"
+	"unsafe"
 )
 
 // Registers contains a snapshot of all register values when an exception,
@@ -127,12 +128,79 @@ const (
 	SIMDFloatingPointException = InterruptNumber(19)
 )
 
+const (
+	// tssSize is the size of the 64-bit task state segment.
+	tssSize = 104
+
+	// tssISTOffset is the offset of the first interrupt stack table entry
+	// in the TSS.
+	tssISTOffset = 0x24
+
+	// tssIOMapBaseOffset is the offset of the I/O permission bitmap base
+	// address in the TSS.
+	tssIOMapBaseOffset = 0x66
+
+	// tssSelector is the GDT selector for the TSS descriptor.
+	tssSelector = 0x18
+)
+
+var (
+	// tss contains the task state segment for the CPU. In long mode the
+	// TSS is only used for specifying the stacks that the CPU switches to
+	// when servicing interrupts. As its fields are not naturally aligned
+	// it is defined as a byte array.
+	tss [tssSize]byte
+
+	// gdt replaces the GDT loaded by the rt0 code. It contains the same
+	// kernel code and data segments followed by a descriptor for the TSS
+	// which occupies two entries.
+	gdt = [5]uint64{
+		0,
+		0x00209a0000000000, // kernel code
+		0x0000920000000000, // kernel data
+	}
+)
+
 // Init runs the appropriate CPU-specific initialization code for enabling
 // support for interrupt handling.
 func Init() {
+	installTSS()
 	installIDT()
+	installDefaultExceptionHandlers()
+}
+
+// SetInterruptStack sets the stack that the CPU switches to when servicing
+// interrupts whose handlers were registered with the given istOffset. Valid
+// istOffset values are in the range [1, 7] and stackTop must point to the end
+// of the stack region.
+func SetInterruptStack(istOffset uint8, stackTop uintptr) {
+	*(*uint64)(unsafe.Pointer(&tss[tssISTOffset+(uintptr(istOffset)-1)<<3])) = uint64(stackTop)
 }
 
+// installTSS populates the TSS descriptor, loads the updated GDT and then
+// loads the task register with the TSS selector.
+func installTSS() {
+	// Placing the I/O permission bitmap past the end of the TSS denies
+	// port access to user-mode code.
+	*(*uint16)(unsafe.Pointer(&tss[tssIOMapBaseOffset])) = tssSize
+
+	tssAddr := uint64(uintptr(unsafe.Pointer(&tss[0])))
+	gdt[3] = (tssSize - 1) | // limit
+		(tssAddr&0xffffff)<<16 | // base (bits 0:23)
+		0x89<<40 | // present, 64-bit available TSS
+		((tssAddr>>24)&0xff)<<56 // base (bits 24:31)
+	gdt[4] = tssAddr >> 32 // base (bits 32:63)
+
+	loadGDT(uintptr(unsafe.Pointer(&gdt[0])), uint16(unsafe.Sizeof(gdt)-1))
+	loadTR(tssSelector)
+}
+
+// loadGDT loads the GDT at the supplied address.
+func loadGDT(gdtAddr uintptr, limit uint16)
+
+// loadTR loads the task register with the supplied TSS selector.
+func loadTR(selector uint16)
+
 // HandleInterrupt ensures that the provided handler will be invoked when a
 // particular interrupt number occurs. The value of the istOffset argument
 // specifies the offset in the interrupt stack table (if 0 then IST is not
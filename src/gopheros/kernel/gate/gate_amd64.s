@@ -39,6 +39,27 @@ TEXT ·installIDT(SB),NOSPLIT,$0
 	MOVQ 0(AX), IDTR 	// LIDT[RAX]
 	RET
 
+// The 64-bit SGDT consists of 10 bytes and has the same layout as the SIDT.
+GLOBL ·gdtDescriptor<>(SB), NOPTR, $10
+
+// loadGDT populates gdtDescriptor with the supplied GDT address and limit and
+// loads it to the CPU. The caller must ensure that the segment selectors in
+// use remain valid.
+TEXT ·loadGDT(SB),NOSPLIT,$0-10
+	LEAQ ·gdtDescriptor<>(SB), AX
+	MOVW limit+8(FP), BX
+	MOVW BX, 0(AX)
+	MOVQ gdtAddr+0(FP), BX
+	MOVQ BX, 2(AX)
+	MOVQ 0(AX), GDTR 	// LGDT[RAX]
+	RET
+
+// loadTR loads the task register with the supplied TSS selector.
+TEXT ·loadTR(SB),NOSPLIT,$0-2
+	MOVW selector+0(FP), AX
+	LTR AX
+	RET
+
 // HandleInterrupt ensures that the provided handler will be invoked when a
 // particular interrupt number occurs. The value of the istOffset argument
 // specifies the offset in the interrupt stack table (if 0 then IST is not
@@ -276,7 +297,9 @@ TEXT ·interruptGateEntries(SB),NOSPLIT,$0
 	INT_ENTRY_WITH_CODE(10) INT_ENTRY_WITH_CODE(11) INT_ENTRY_WITH_CODE(12) INT_ENTRY_WITH_CODE(13) INT_ENTRY_WITH_CODE(14)
 	INT_ENTRY_WITHOUT_CODE(15) INT_ENTRY_WITHOUT_CODE(16)
 	INT_ENTRY_WITH_CODE(17)
-	INT_ENTRY_WITHOUT_CODE(18) INT_ENTRY_WITHOUT_CODE(19) INT_ENTRY_WITHOUT_CODE(20) INT_ENTRY_WITHOUT_CODE(21) INT_ENTRY_WITHOUT_CODE(22) INT_ENTRY_WITHOUT_CODE(23) INT_ENTRY_WITHOUT_CODE(24) INT_ENTRY_WITHOUT_CODE(25) INT_ENTRY_WITHOUT_CODE(26) INT_ENTRY_WITHOUT_CODE(27) INT_ENTRY_WITHOUT_CODE(28) INT_ENTRY_WITHOUT_CODE(29)
+	INT_ENTRY_WITHOUT_CODE(18) INT_ENTRY_WITHOUT_CODE(19) INT_ENTRY_WITHOUT_CODE(20)
+	INT_ENTRY_WITH_CODE(21)
+	INT_ENTRY_WITHOUT_CODE(22) INT_ENTRY_WITHOUT_CODE(23) INT_ENTRY_WITHOUT_CODE(24) INT_ENTRY_WITHOUT_CODE(25) INT_ENTRY_WITHOUT_CODE(26) INT_ENTRY_WITHOUT_CODE(27) INT_ENTRY_WITHOUT_CODE(28) INT_ENTRY_WITHOUT_CODE(29)
 	INT_ENTRY_WITH_CODE(30)
 	INT_ENTRY_WITHOUT_CODE(31) INT_ENTRY_WITHOUT_CODE(32) INT_ENTRY_WITHOUT_CODE(33) INT_ENTRY_WITHOUT_CODE(34) INT_ENTRY_WITHOUT_CODE(35) INT_ENTRY_WITHOUT_CODE(36) INT_ENTRY_WITHOUT_CODE(37) INT_ENTRY_WITHOUT_CODE(38) INT_ENTRY_WITHOUT_CODE(39) INT_ENTRY_WITHOUT_CODE(40) INT_ENTRY_WITHOUT_CODE(41) INT_ENTRY_WITHOUT_CODE(42)
 	INT_ENTRY_WITHOUT_CODE(43) INT_ENTRY_WITHOUT_CODE(44) INT_ENTRY_WITHOUT_CODE(45) INT_ENTRY_WITHOUT_CODE(46) INT_ENTRY_WITHOUT_CODE(47) INT_ENTRY_WITHOUT_CODE(48) INT_ENTRY_WITHOUT_CODE(49) INT_ENTRY_WITHOUT_CODE(50) INT_ENTRY_WITHOUT_CODE(51) INT_ENTRY_WITHOUT_CODE(52) INT_ENTRY_WITHOUT_CODE(53) INT_ENTRY_WITHOUT_CODE(54)
@@ -6,23 +6,30 @@ import (
 	"gopheros/kernel"
 	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
 	"unsafe"
 )
 
 var (
-	mapFn                = vmm.Map
-	earlyReserveRegionFn = vmm.EarlyReserveRegion
-	memsetFn             = kernel.Memset
-	mallocInitFn         = mallocInit
-	algInitFn            = algInit
-	modulesInitFn        = modulesInit
-	typeLinksInitFn      = typeLinksInit
-	itabsInitFn          = itabsInit
-	initGoPackagesFn     = initGoPackages
-	procResizeFn         = procResize
+	mapFn                         = vmm.Map
+	earlyReserveRegionFn          = vmm.EarlyReserveRegion
+	earlyReserveUntrackedRegionFn = vmm.EarlyReserveUntrackedRegion
+	heapSlideFn                   = vmm.HeapSlide
+	memsetFn                      = kernel.Memset
+	mallocInitFn                  = mallocInit
+	algInitFn                     = algInit
+	modulesInitFn                 = modulesInit
+	typeLinksInitFn               = typeLinksInit
+	itabsInitFn                   = itabsInit
+	initGoPackagesFn              = initGoPackages
+	procResizeFn                  = procResize
 
 	// A seed for the pseudo-random number generator used by getRandomData
 	prngSeed = 0xdeadc0de
+
+	// heapSlideApplied is set to true once the randomized gap in front of
+	// the Go heap has been reserved.
+	heapSlideApplied bool
 )
 
 // initGoPackages is an alias to main.init which recursively calls the init()
@@ -51,6 +58,18 @@ func runtimeInit() {
 //go:redirect-from runtime.sysReserve
 //go:nosplit
 func sysReserve(_ unsafe.Pointer, size uintptr, reserved *bool) unsafe.Pointer {
+	// Leave a randomized gap in front of the first region reserved by the
+	// Go allocator so the heap base differs across boots. The gap is never
+	// mapped so it does not count towards the reserved address space.
+	if !heapSlideApplied {
+		heapSlideApplied = true
+		if slide := heapSlideFn(); slide != 0 {
+			if _, err := earlyReserveUntrackedRegionFn(slide); err != nil {
+				panic(err)
+			}
+		}
+	}
+
 	regionSize := (size + mm.PageSize - 1) & ^(mm.PageSize - 1)
 	regionStartAddr, err := earlyReserveRegionFn(regionSize)
 	if err != nil {
@@ -87,6 +106,7 @@ func sysMap(virtAddr unsafe.Pointer, size uintptr, reserved bool, sysStat *uint6
 	}
 
 	mSysStatInc(sysStat, uintptr(regionSize))
+	mm.TrackGoHeapBytes(regionSize)
 	return unsafe.Pointer(regionStartAddr)
 }
 
@@ -122,12 +142,12 @@ func sysAlloc(size uintptr, sysStat *uint64) unsafe.Pointer {
 	}
 
 	mSysStatInc(sysStat, uintptr(regionSize))
+	mm.TrackGoHeapBytes(regionSize)
 	return unsafe.Pointer(regionStartAddr)
 }
 
-// nanotime returns a monotonically increasing clock value. This is a dummy
-// implementation and will be replaced when the timekeeper package is
-// implemented.
+// nanotime returns the number of nanoseconds elapsed since the monotonic
+// clock was started. Before the clock is initialized, nanotime returns 0.
 //
 // This function replaces runtime.nanotime and is invoked by the Go allocator
 // when a span allocation is performed.
@@ -138,7 +158,7 @@ func nanotime() uint64 {
 	// Use a dummy loop to prevent the compiler from inlining this function.
 	for i := 0; i < 100; i++ {
 	}
-	return 1
+	return time.Nanotime()
 }
 
 // getRandomData populates the given slice with random data. The implementation
@@ -194,4 +214,6 @@ func init() {
 	sysAlloc(0, &stat)
 	getRandomData(nil)
 	stat = nanotime()
+	walltime()
+	timeNow()
 }
@@ -0,0 +1,50 @@
+// +build go1.8,!go1.9
+
+package goruntime
+
+import (
+	"gopheros/kernel/time"
+	_ "unsafe" // required for go:linkname
+)
+
+//go:linkname algInit runtime.alginit
+func algInit()
+
+//go:linkname modulesInit runtime.modulesinit
+func modulesInit()
+
+//go:linkname typeLinksInit runtime.typelinksinit
+func typeLinksInit()
+
+//go:linkname itabsInit runtime.itabsinit
+func itabsInit()
+
+//go:linkname mallocInit runtime.mallocinit
+func mallocInit()
+
+//go:linkname mSysStatInc runtime.mSysStatInc
+func mSysStatInc(*uint64, uintptr)
+
+//go:linkname procResize runtime.procresize
+func procResize(int32) uintptr
+
+// timeNow is only referenced so that the linker keeps the runtime
+// implementation of time.now which gets redirected to walltime.
+//
+//go:linkname timeNow time.now
+func timeNow() (int64, int32)
+
+// walltime returns the current wall-clock time as the number of seconds and
+// nanoseconds elapsed since the Unix epoch.
+//
+// This function replaces time.now which is implemented by the runtime package
+// and is invoked by time.Now.
+//
+//go:redirect-from time.now
+//go:nosplit
+func walltime() (int64, int32) {
+	// Use a dummy loop to prevent the compiler from inlining this function.
+	for i := 0; i < 100; i++ {
+	}
+	return time.Now()
+}
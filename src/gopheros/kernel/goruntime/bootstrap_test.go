@@ -12,6 +12,7 @@ import (
 func TestSysReserve(t *testing.T) {
 	defer func() {
 		earlyReserveRegionFn = vmm.EarlyReserveRegion
+		earlyReserveUntrackedRegionFn = vmm.EarlyReserveUntrackedRegion
 	}()
 	var reserved bool
 
@@ -56,6 +57,53 @@ func TestSysReserve(t *testing.T) {
 
 		sysReserve(nil, uintptr(0xf00), &reserved)
 	})
+
+	t.Run("with heap slide", func(t *testing.T) {
+		defer func() {
+			heapSlideFn = vmm.HeapSlide
+		}()
+
+		heapSlideApplied = false
+		heapSlideFn = func() uintptr { return 0x200000 }
+
+		var rsvSizes, untrackedSizes []uintptr
+		earlyReserveRegionFn = func(rsvSize uintptr) (uintptr, *kernel.Error) {
+			rsvSizes = append(rsvSizes, rsvSize)
+			return 0xbadf00d, nil
+		}
+		earlyReserveUntrackedRegionFn = func(rsvSize uintptr) (uintptr, *kernel.Error) {
+			untrackedSizes = append(untrackedSizes, rsvSize)
+			return 0xbadf00d, nil
+		}
+
+		sysReserve(nil, mm.PageSize, &reserved)
+		sysReserve(nil, mm.PageSize, &reserved)
+
+		if exp := []uintptr{0x200000}; !reflect.DeepEqual(untrackedSizes, exp) {
+			t.Fatalf("expected the heap slide to reserve untracked regions of size %v; got %v", exp, untrackedSizes)
+		}
+
+		if exp := []uintptr{mm.PageSize, mm.PageSize}; !reflect.DeepEqual(rsvSizes, exp) {
+			t.Fatalf("expected reservation sizes to be %v; got %v", exp, rsvSizes)
+		}
+	})
+
+	t.Run("heap slide reservation fails", func(t *testing.T) {
+		defer func() {
+			heapSlideFn = vmm.HeapSlide
+			if err := recover(); err == nil {
+				t.Fatal("expected sysReserve to panic")
+			}
+		}()
+
+		heapSlideApplied = false
+		heapSlideFn = func() uintptr { return 0x200000 }
+		earlyReserveUntrackedRegionFn = func(rsvSize uintptr) (uintptr, *kernel.Error) {
+			return 0, &kernel.Error{Module: "test", Message: "consumed available address space"}
+		}
+
+		sysReserve(nil, mm.PageSize, &reserved)
+	})
 }
 
 func TestSysMap(t *testing.T) {
@@ -13,6 +13,12 @@ import (
 
 	// import and register acpi driver
 	_ "gopheros/device/acpi"
+
+	// import and register the interrupt controller drivers
+	_ "gopheros/device/apic"
+	_ "gopheros/device/hpet"
+	_ "gopheros/device/pic"
+	_ "gopheros/device/rtc"
 )
 
 // managedDevices contains the devices discovered by the HAL.
@@ -37,9 +43,10 @@ func ActiveTTY() tty.Device {
 // DetectHardware probes for hardware devices and initializes the appropriate
 // drivers.
 func DetectHardware() {
-	// Get driver list and sort by detection priority
+	// Get driver list and sort by detection priority. Drivers with the
+	// same priority are probed in registration order.
 	drivers := device.DriverList()
-	sort.Sort(drivers)
+	sort.Stable(drivers)
 
 	probe(drivers)
 }
@@ -0,0 +1,232 @@
+// Package irq routes hardware interrupts to their registered handlers. The
+// actual interrupt controller (e.g. the legacy 8259 PIC) is abstracted behind
+// the Controller interface and is registered by its device driver via a call
+// to SetController.
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"sync/atomic"
+)
+
+const (
+	// VectorBase is the interrupt vector that IRQ line 0 is mapped to.
+	// Controllers must map IRQ line N to vector VectorBase+N so that
+	// hardware interrupts do not overlap with the CPU exception vectors.
+	VectorBase = gate.InterruptNumber(0x20)
+
+	// MaxLines is the maximum number of IRQ lines that can be routed.
+	MaxLines = 256 - int(VectorBase)
+)
+
+var (
+	errNoController      = &kernel.Error{Module: "irq", Message: "no interrupt controller available"}
+	errInvalidLine       = &kernel.Error{Module: "irq", Message: "IRQ line not supported by the interrupt controller"}
+	errHandlerRegistered = &kernel.Error{Module: "irq", Message: "a handler is already registered for this IRQ line"}
+	errHandlerNotFound   = &kernel.Error{Module: "irq", Message: "no handler registered for this IRQ line"}
+	errNoGSIRouting      = &kernel.Error{Module: "irq", Message: "global system interrupt is not routed to an IRQ line"}
+
+	// The following functions are used by tests to mock calls to the gate
+	// and cpu packages and are automatically inlined by the compiler.
+	handleInterruptFn  = gate.HandleInterrupt
+	enableInterruptsFn = cpu.EnableInterrupts
+
+	controller   Controller
+	handlers     [MaxLines]Handler
+	spuriousIRQs uint64
+)
+
+// Handler is a function that services an IRQ. When the handler is invoked,
+// the Info field of the supplied registers contains the IRQ line number.
+// Handlers run with interrupts disabled; the end-of-interrupt signal is sent
+// to the controller after the handler returns.
+type Handler func(regs *gate.Registers)
+
+// Controller is implemented by interrupt controller drivers.
+type Controller interface {
+	// Lines returns the number of IRQ lines supported by the controller.
+	Lines() int
+
+	// Mask prevents the controller from raising interrupts for line.
+	Mask(line uint8)
+
+	// Unmask allows the controller to raise interrupts for line.
+	Unmask(line uint8)
+
+	// EOI signals the end of the interrupt raised for line.
+	EOI(line uint8)
+
+	// Spurious returns true if an interrupt raised for line was not
+	// caused by an actual device. Controllers must perform any required
+	// end-of-interrupt handling for spurious interrupts before returning.
+	Spurious(line uint8) bool
+}
+
+// Disabler is implemented by controllers that need to be disabled when they
+// get replaced by a different controller.
+type Disabler interface {
+	// Disable masks all IRQ lines of the controller.
+	Disable()
+}
+
+// GSIRouter is implemented by controllers that deliver global system
+// interrupts (GSIs) such as the inputs of an IO APIC.
+type GSIRouter interface {
+	// LineForGSI returns the IRQ line that gsi is routed to. If gsi is
+	// not routed to any line, LineForGSI returns false.
+	LineForGSI(gsi uint32) (uint8, bool)
+}
+
+// SetController installs the interrupt controller used for routing IRQs. If
+// the previously installed controller implements Disabler, it is disabled.
+//
+// The IRQ dispatcher is installed for every line supported by the controller
+// so that spurious IRQs, which are raised even for lines without a registered
+// handler, are detected instead of triggering a fault. Any lines with
+// registered handlers are unmasked on the new controller.
+func SetController(c Controller) {
+	if disabler, ok := controller.(Disabler); ok && controller != c {
+		disabler.Disable()
+	}
+
+	controller = c
+	if c == nil {
+		return
+	}
+
+	for line := 0; line < MaxLines && line < c.Lines(); line++ {
+		handleInterruptFn(VectorBase+gate.InterruptNumber(line), 0, dispatchIRQ)
+		if handlers[line] != nil {
+			c.Unmask(uint8(line))
+		}
+	}
+}
+
+// RegisterHandler installs a handler for the specified IRQ line and unmasks
+// the line.
+func RegisterHandler(line uint8, handler Handler) *kernel.Error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+
+	if handlers[line] != nil {
+		return errHandlerRegistered
+	}
+
+	handlers[line] = handler
+	controller.Unmask(line)
+	return nil
+}
+
+// UnregisterHandler masks the specified IRQ line and removes its handler.
+func UnregisterHandler(line uint8) *kernel.Error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+
+	if handlers[line] == nil {
+		return errHandlerNotFound
+	}
+
+	controller.Mask(line)
+	handlers[line] = nil
+	return nil
+}
+
+// Mask prevents the interrupt controller from raising interrupts for line.
+func Mask(line uint8) *kernel.Error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+
+	controller.Mask(line)
+	return nil
+}
+
+// Unmask allows the interrupt controller to raise interrupts for line.
+func Unmask(line uint8) *kernel.Error {
+	if err := validateLine(line); err != nil {
+		return err
+	}
+
+	controller.Unmask(line)
+	return nil
+}
+
+// LineForGSI returns the IRQ line that the specified global system interrupt is
+// routed to. An error is returned if the installed controller does not
+// implement GSIRouter or if gsi is not routed to any line.
+func LineForGSI(gsi uint32) (uint8, *kernel.Error) {
+	if controller == nil {
+		return 0, errNoController
+	}
+
+	router, ok := controller.(GSIRouter)
+	if !ok {
+		return 0, errNoGSIRouting
+	}
+
+	line, ok := router.LineForGSI(gsi)
+	if !ok {
+		return 0, errNoGSIRouting
+	}
+
+	return line, nil
+}
+
+// Enable allows the CPU to service hardware interrupts. It returns an error
+// if no interrupt controller has been installed as there would be no way to
+// acknowledge the raised IRQs.
+func Enable() *kernel.Error {
+	if controller == nil {
+		return errNoController
+	}
+
+	enableInterruptsFn()
+	return nil
+}
+
+// SpuriousCount returns the number of spurious IRQs detected so far.
+func SpuriousCount() uint64 {
+	return atomic.LoadUint64(&spuriousIRQs)
+}
+
+// validateLine checks that a controller is installed and that it supports line.
+func validateLine(line uint8) *kernel.Error {
+	switch {
+	case controller == nil:
+		return errNoController
+	case int(line) >= controller.Lines() || int(line) >= MaxLines:
+		return errInvalidLine
+	}
+
+	return nil
+}
+
+// dispatchIRQ is registered as the gate handler for all IRQ vectors. It
+// filters out spurious IRQs, invokes the handler for the IRQ line and signals
+// the end of the interrupt to the controller.
+func dispatchIRQ(regs *gate.Registers) {
+	line := uint8(regs.Info - uint64(VectorBase))
+
+	// The dispatcher remains installed for the lines of a previously
+	// installed controller that the current one does not support.
+	if controller == nil || int(line) >= controller.Lines() {
+		atomic.AddUint64(&spuriousIRQs, 1)
+		return
+	}
+
+	if controller.Spurious(line) {
+		atomic.AddUint64(&spuriousIRQs, 1)
+		return
+	}
+
+	regs.Info = uint64(line)
+	if handler := handlers[line]; handler != nil {
+		handler(regs)
+	}
+
+	controller.EOI(line)
+}
@@ -0,0 +1,297 @@
+package irq
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"testing"
+)
+
+type mockController struct {
+	lines    int
+	masked   map[uint8]bool
+	eois     []uint8
+	spurious map[uint8]bool
+}
+
+func newMockController(lines int) *mockController {
+	return &mockController{
+		lines:    lines,
+		masked:   make(map[uint8]bool),
+		spurious: make(map[uint8]bool),
+	}
+}
+
+func (c *mockController) Lines() int               { return c.lines }
+func (c *mockController) Mask(line uint8)          { c.masked[line] = true }
+func (c *mockController) Unmask(line uint8)        { c.masked[line] = false }
+func (c *mockController) EOI(line uint8)           { c.eois = append(c.eois, line) }
+func (c *mockController) Spurious(line uint8) bool { return c.spurious[line] }
+
+type mockDisablerController struct {
+	mockController
+	disabled bool
+}
+
+func (c *mockDisablerController) Disable() { c.disabled = true }
+
+type mockGSIRouterController struct {
+	mockController
+	gsiLines map[uint32]uint8
+}
+
+func (c *mockGSIRouterController) LineForGSI(gsi uint32) (uint8, bool) {
+	line, ok := c.gsiLines[gsi]
+	return line, ok
+}
+
+func resetGlobals() {
+	handleInterruptFn = gate.HandleInterrupt
+	enableInterruptsFn = cpu.EnableInterrupts
+	controller = nil
+	handlers = [MaxLines]Handler{}
+	spuriousIRQs = 0
+}
+
+func TestRegisterHandler(t *testing.T) {
+	defer resetGlobals()
+
+	var installedVectors []gate.InterruptNumber
+	handleInterruptFn = func(intNumber gate.InterruptNumber, istOffset uint8, _ func(*gate.Registers)) {
+		if istOffset != 0 {
+			t.Errorf("expected IST offset to be 0; got %d", istOffset)
+		}
+		installedVectors = append(installedVectors, intNumber)
+	}
+
+	handler := func(_ *gate.Registers) {}
+
+	if err := RegisterHandler(1, handler); err != errNoController {
+		t.Fatalf("expected error: %v; got %v", errNoController, err)
+	}
+
+	ctrl := newMockController(16)
+	SetController(ctrl)
+
+	// The dispatcher is installed for all controller lines
+	if len(installedVectors) != 16 || installedVectors[0] != VectorBase || installedVectors[15] != VectorBase+15 {
+		t.Fatalf("expected gate handlers to be installed for vectors %d to %d; got %v", VectorBase, VectorBase+15, installedVectors)
+	}
+	installedVectors = nil
+
+	specs := []struct {
+		line   uint8
+		expErr *kernel.Error
+	}{
+		{1, nil},
+		{15, nil},
+		{1, errHandlerRegistered},
+		{16, errInvalidLine},
+	}
+
+	for specIndex, spec := range specs {
+		if err := RegisterHandler(spec.line, handler); err != spec.expErr {
+			t.Errorf("[spec %d] expected error: %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if len(installedVectors) != 0 {
+		t.Fatalf("expected RegisterHandler not to install any gate handlers; got %v", installedVectors)
+	}
+
+	for _, line := range []uint8{1, 15} {
+		if masked, found := ctrl.masked[line]; !found || masked {
+			t.Errorf("expected line %d to be unmasked", line)
+		}
+	}
+
+	if err := Mask(1); err != nil || !ctrl.masked[1] {
+		t.Errorf("expected line 1 to be masked; err: %v", err)
+	}
+
+	if err := Unmask(1); err != nil || ctrl.masked[1] {
+		t.Errorf("expected line 1 to be unmasked; err: %v", err)
+	}
+
+	for _, fn := range []func(uint8) *kernel.Error{Mask, Unmask, UnregisterHandler} {
+		if err := fn(200); err != errInvalidLine {
+			t.Errorf("expected error: %v; got %v", errInvalidLine, err)
+		}
+	}
+
+	if err := UnregisterHandler(1); err != nil || !ctrl.masked[1] || handlers[1] != nil {
+		t.Fatalf("expected line 1 to be masked and its handler removed; err: %v", err)
+	}
+
+	if err := UnregisterHandler(1); err != errHandlerNotFound {
+		t.Fatalf("expected error: %v; got %v", errHandlerNotFound, err)
+	}
+
+	t.Run("replace controller", func(t *testing.T) {
+		disablerCtrl := &mockDisablerController{mockController: *newMockController(16)}
+		SetController(disablerCtrl)
+
+		// Re-installing the same controller must not disable it
+		SetController(disablerCtrl)
+		if disablerCtrl.disabled {
+			t.Fatal("expected re-installed controller not to be disabled")
+		}
+
+		newCtrl := newMockController(24)
+		SetController(newCtrl)
+
+		if !disablerCtrl.disabled {
+			t.Fatal("expected the replaced controller to be disabled")
+		}
+
+		if len(newCtrl.masked) != 1 || newCtrl.masked[15] {
+			t.Fatalf("expected only line 15 to be unmasked on the new controller; got %v", newCtrl.masked)
+		}
+
+		SetController(nil)
+		if err := Unmask(15); err != errNoController {
+			t.Fatalf("expected error: %v; got %v", errNoController, err)
+		}
+	})
+}
+
+func TestDispatchIRQ(t *testing.T) {
+	defer resetGlobals()
+
+	handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+	ctrl := newMockController(16)
+	SetController(ctrl)
+
+	var handledLines []uint64
+	if err := RegisterHandler(7, func(regs *gate.Registers) {
+		handledLines = append(handledLines, regs.Info)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Raise IRQ 7 followed by a spurious IRQ 7 and an IRQ without handler
+	regs := gate.Registers{Info: uint64(VectorBase + 7)}
+	dispatchIRQ(&regs)
+
+	ctrl.spurious[7] = true
+	regs.Info = uint64(VectorBase + 7)
+	dispatchIRQ(&regs)
+
+	regs.Info = uint64(VectorBase + 3)
+	dispatchIRQ(&regs)
+
+	if len(handledLines) != 1 || handledLines[0] != 7 {
+		t.Fatalf("expected handler to be invoked once with IRQ line 7; got %v", handledLines)
+	}
+
+	if len(ctrl.eois) != 2 || ctrl.eois[0] != 7 || ctrl.eois[1] != 3 {
+		t.Fatalf("expected EOIs for lines 7 and 3; got %v", ctrl.eois)
+	}
+
+	if got := SpuriousCount(); got != 1 {
+		t.Fatalf("expected spurious IRQ count to be 1; got %d", got)
+	}
+}
+
+func TestSpuriousIRQWithoutHandler(t *testing.T) {
+	defer resetGlobals()
+	resetGlobals()
+
+	gateHandlers := make(map[gate.InterruptNumber]func(*gate.Registers))
+	handleInterruptFn = func(intNumber gate.InterruptNumber, _ uint8, handler func(*gate.Registers)) {
+		gateHandlers[intNumber] = handler
+	}
+
+	ctrl := newMockController(16)
+	ctrl.spurious[7] = true
+	ctrl.spurious[15] = true
+	SetController(ctrl)
+
+	for _, line := range []uint8{7, 15} {
+		handler := gateHandlers[VectorBase+gate.InterruptNumber(line)]
+		if handler == nil {
+			t.Fatalf("expected a gate handler to be installed for IRQ line %d", line)
+		}
+
+		handler(&gate.Registers{Info: uint64(VectorBase) + uint64(line)})
+	}
+
+	if got := SpuriousCount(); got != 2 {
+		t.Fatalf("expected spurious IRQ count to be 2; got %d", got)
+	}
+
+	if len(ctrl.eois) != 0 {
+		t.Fatalf("expected no EOIs to be sent for spurious IRQs; got %v", ctrl.eois)
+	}
+
+	// IRQs for lines not supported by the controller are ignored
+	SetController(newMockController(8))
+	gateHandlers[VectorBase+15](&gate.Registers{Info: uint64(VectorBase) + 15})
+	if got := SpuriousCount(); got != 3 {
+		t.Fatalf("expected spurious IRQ count to be 3; got %d", got)
+	}
+}
+
+func TestLineForGSI(t *testing.T) {
+	defer resetGlobals()
+	resetGlobals()
+
+	if _, err := LineForGSI(2); err != errNoController {
+		t.Fatalf("expected to get errNoController; got %v", err)
+	}
+
+	SetController(newMockController(16))
+	if _, err := LineForGSI(2); err != errNoGSIRouting {
+		t.Fatalf("expected to get errNoGSIRouting; got %v", err)
+	}
+
+	SetController(&mockGSIRouterController{
+		mockController: *newMockController(24),
+		gsiLines:       map[uint32]uint8{2: 0, 20: 20},
+	})
+
+	specs := []struct {
+		gsi     uint32
+		expLine uint8
+		expErr  *kernel.Error
+	}{
+		{2, 0, nil},
+		{20, 20, nil},
+		{9, 0, errNoGSIRouting},
+	}
+
+	for specIndex, spec := range specs {
+		line, err := LineForGSI(spec.gsi)
+		if err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if err == nil && line != spec.expLine {
+			t.Errorf("[spec %d] expected GSI %d to be routed to line %d; got %d", specIndex, spec.gsi, spec.expLine, line)
+		}
+	}
+}
+
+func TestEnable(t *testing.T) {
+	defer resetGlobals()
+	resetGlobals()
+
+	var enabled bool
+	enableInterruptsFn = func() { enabled = true }
+
+	if err := Enable(); err != errNoController {
+		t.Fatalf("expected to get error %v; got %v", errNoController, err)
+	}
+	if enabled {
+		t.Fatal("expected interrupts to remain disabled when no controller is installed")
+	}
+
+	SetController(newMockController(16))
+	if err := Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Fatal("expected interrupts to be enabled")
+	}
+}
@@ -10,8 +10,31 @@ var (
 	cpuHaltFn = cpu.Halt
 
 	errRuntimePanic = &kernel.Error{Module: "rt", Message: "unknown cause"}
+
+	// panicInfoFns contains the functions registered via RegisterPanicInfoFn.
+	// A fixed-size array is used as functions may be registered before the
+	// Go allocator is initialized.
+	panicInfoFns     [maxPanicInfoFns]func()
+	panicInfoFnCount int
 )
 
+// maxPanicInfoFns is the maximum number of functions that can be registered
+// via RegisterPanicInfoFn.
+const maxPanicInfoFns = 8
+
+// RegisterPanicInfoFn registers a function that outputs additional
+// information when the kernel panics. Registered functions are invoked in
+// registration order after the panic error has been printed. Registrations
+// beyond the first maxPanicInfoFns functions are ignored.
+func RegisterPanicInfoFn(fn func()) {
+	if panicInfoFnCount == maxPanicInfoFns {
+		return
+	}
+
+	panicInfoFns[panicInfoFnCount] = fn
+	panicInfoFnCount++
+}
+
 // Panic outputs the supplied error (if not nil) to the console and halts the
 // CPU. Calls to Panic never return. Panic also works as a redirection target
 // for calls to panic() (resolved via runtime.gopanic)
@@ -34,6 +57,9 @@ func Panic(e interface{}) {
 	if err != nil {
 		Printf("[%s] unrecoverable error: %s\n", err.Module, err.Message)
 	}
+	for index := 0; index < panicInfoFnCount; index++ {
+		panicInfoFns[index]()
+	}
 	Printf("*** kernel panic: system halted ***")
 	Printf("\n-----------------------------------\n")
 
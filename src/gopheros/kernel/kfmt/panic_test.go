@@ -93,3 +93,31 @@ func TestPanic(t *testing.T) {
 		}
 	})
 }
+
+func TestPanicInfoFns(t *testing.T) {
+	defer func() {
+		cpuHaltFn = cpu.Halt
+		panicInfoFnCount = 0
+		SetOutputSink(nil)
+	}()
+
+	var buf bytes.Buffer
+	SetOutputSink(&buf)
+	cpuHaltFn = func() {}
+
+	for index := 0; index < maxPanicInfoFns+1; index++ {
+		RegisterPanicInfoFn(func() {
+			Printf("info\n")
+		})
+	}
+
+	Panic(&kernel.Error{Module: "test", Message: "panic test"})
+
+	exp := "\n-----------------------------------\n[test] unrecoverable error: panic test\n" +
+		"info\ninfo\ninfo\ninfo\ninfo\ninfo\ninfo\ninfo\n" +
+		"*** kernel panic: system halted ***\n-----------------------------------\n"
+
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected to get:\n%q\ngot:\n%q", exp, got)
+	}
+}
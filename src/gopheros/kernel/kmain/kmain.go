@@ -2,15 +2,24 @@ package kmain
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/cpu/features"
 	"gopheros/kernel/gate"
 	"gopheros/kernel/goruntime"
 	"gopheros/kernel/hal"
+	"gopheros/kernel/irq"
 	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
 	"gopheros/kernel/mm/pmm"
+	"gopheros/kernel/mm/slab"
 	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/time"
 	"gopheros/multiboot"
 )
 
+// bootStackSize is the size of the stack that Kmain switches to once the vmm
+// has been initialized.
+const bootStackSize = 64 * 1024
+
 var (
 	errKmainReturned = &kernel.Error{Module: "kmain", Message: "Kmain returned"}
 )
@@ -25,19 +34,48 @@ var (
 // addition, the start of the kernel virtual address space is passed to the
 // kernelPageOffset argument.
 //
+// The stack set up by the rt0 code is only used until the vmm is initialized.
+// Kmain then allocates a larger boot stack from the kernel address space, with
+// a guard page below it, and continues the initialization on that stack.
+//
 // Kmain is not expected to return. If it does, the rt0 code will halt the CPU.
 //
 //go:noinline
 func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
+	// Detect the CPU features first so they can be queried by the memory
+	// management code and by drivers.
+	features.Init()
+	features.PrintInfo()
+
 	multiboot.SetInfoPtr(multibootInfoPtr)
 
 	var err *kernel.Error
 	gate.Init()
+
+	// Randomize the kernel address space layout before any virtual memory
+	// regions get reserved.
+	vmm.RandomizeLayout()
+
 	if err = pmm.Init(kernelStart, kernelEnd); err != nil {
 		panic(err)
 	} else if err = vmm.Init(kernelPageOffset); err != nil {
 		panic(err)
-	} else if err = goruntime.Init(); err != nil {
+	}
+
+	bootStackTop, err := vmm.AllocKernelStack(bootStackSize)
+	if err != nil {
+		panic(err)
+	}
+	switchStack(bootStackTop-bootStackSize, bootStackTop, kmainOnBootStack)
+}
+
+// kmainOnBootStack completes the kernel initialization after Kmain has
+// switched to the guard-paged boot stack.
+//
+//go:noinline
+func kmainOnBootStack() {
+	var err *kernel.Error
+	if err = goruntime.Init(); err != nil {
 		panic(err)
 	}
 
@@ -48,6 +86,38 @@ func Kmain(multibootInfoPtr, kernelStart, kernelEnd, kernelPageOffset uintptr) {
 		kfmt.Panic(errKmainReturned)
 	}()
 
+	// The boot cmdline can only be parsed once the Go allocator is up
+	if _, found := multiboot.GetBootCmdLine()["allocDebug"]; found {
+		if err = pmm.EnableDebugMode(); err != nil {
+			panic(err)
+		}
+	}
+
 	// Detect and initialize hardware
 	hal.DetectHardware()
+
+	// Start the monotonic clock now that all clock source drivers have
+	// been initialized.
+	if err = time.Init(); err != nil {
+		panic(err)
+	}
+
+	// Start servicing IRQs so that timer events and device interrupts get
+	// delivered. Without an interrupt controller the kernel keeps running
+	// with interrupts disabled.
+	if err = irq.Enable(); err != nil {
+		kfmt.Printf("[kmain] interrupts not enabled: %s\n", err.Message)
+	}
+
+	// The ACPI driver has copied the tables it needs so the memory used
+	// while booting can now be handed over to the frame allocator.
+	if err = pmm.ReclaimBootMemory(); err != nil {
+		panic(err)
+	}
+
+	// Report memory usage if requested via the boot cmdline
+	if _, found := multiboot.GetBootCmdLine()["memStats"]; found {
+		mm.PrintStats()
+		slab.PrintStats()
+	}
 }
@@ -0,0 +1,7 @@
+package kmain
+
+// switchStack updates the stack bounds of the current goroutine to
+// [stackLo, stackHi), switches to the stack whose top is stackHi and invokes
+// fn. Once fn returns, switchStack restores the original stack pointer and
+// returns to its caller.
+func switchStack(stackLo, stackHi uintptr, fn func())
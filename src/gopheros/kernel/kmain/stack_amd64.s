@@ -0,0 +1,31 @@
+#include "textflag.h"
+
+TEXT ·switchStack(SB),NOSPLIT,$0-24
+	MOVQ stackLo+0(FP), AX
+	MOVQ stackHi+8(FP), BX
+	MOVQ fn+16(FP), DX
+
+	// The stack bounds and the stack guard used by the split-stack checks
+	// are stored at the beginning of the g struct for the current
+	// goroutine which is accessed via TLS. Like the rt0 code, the stack
+	// guard is set to the bottom of the stack.
+	MOVQ TLS, CX
+	MOVQ 0(CX)(TLS*1), CX
+	MOVQ AX, 0(CX)  // g.stack.lo
+	MOVQ BX, 8(CX)  // g.stack.hi
+	MOVQ AX, 16(CX) // g.stackguard0
+
+	// Save the current stack and frame pointers to the new stack so they
+	// can be restored if fn returns.
+	MOVQ SP, SI
+	MOVQ BX, SP
+	PUSHQ SI
+	PUSHQ BP
+
+	// Invoke fn; its closure context is passed in DX.
+	MOVQ 0(DX), AX
+	CALL AX
+
+	POPQ BP
+	POPQ SP
+	RET
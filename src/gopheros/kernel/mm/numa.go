@@ -0,0 +1,169 @@
+package mm
+
+import "gopheros/kernel"
+
+const (
+	// LocalDistance is the relative distance between a node and itself.
+	LocalDistance = uint8(10)
+
+	// RemoteDistance is the relative distance between two different nodes
+	// when no distance information is available.
+	RemoteDistance = uint8(20)
+)
+
+// NodeID identifies a NUMA node (ACPI proximity domain).
+type NodeID uint32
+
+// NodeMemRange describes a physical memory range that is attached to a NUMA
+// node.
+type NodeMemRange struct {
+	Node NodeID
+
+	// StartFrame and EndFrame describe the (inclusive) frame range
+	// attached to the node.
+	StartFrame Frame
+	EndFrame   Frame
+}
+
+// NUMATopology describes the NUMA nodes present in the system.
+type NUMATopology struct {
+	// MemRanges lists the physical memory ranges attached to each node.
+	MemRanges []NodeMemRange
+
+	// CPUNodes maps local APIC IDs to the node that contains them.
+	CPUNodes map[uint32]NodeID
+
+	// Distances contains the relative distance between node pairs;
+	// Distances[from][to] is the distance from node from to node to. If
+	// nil, all remote nodes are assumed to be at RemoteDistance.
+	Distances [][]uint8
+}
+
+// NodeMemRangesFn is a function that tags the physical memory managed by a
+// frame allocator with the nodes it is attached to.
+type NodeMemRangesFn func([]NodeMemRange) *kernel.Error
+
+// NodeFrameAllocatorFn is a function that allocates physical frames attached
+// to a particular node. It returns an error if the node has no free frames.
+type NodeFrameAllocatorFn func(NodeID) (Frame, *kernel.Error)
+
+var (
+	// numaTopology holds the topology registered via SetNUMATopology.
+	numaTopology NUMATopology
+
+	// nodeCount is the number of nodes in numaTopology.
+	nodeCount int
+
+	// nodeMemRangesFn and nodeFrameAllocator point to the NUMA-aware frame
+	// allocator functions registered via SetNodeFrameAllocator.
+	nodeMemRangesFn    NodeMemRangesFn
+	nodeFrameAllocator NodeFrameAllocatorFn
+)
+
+// SetNodeFrameAllocator registers the functions used by the NUMA-aware
+// frame allocation code. The memRangesFn will be invoked to tag the memory
+// managed by the allocator when a NUMA topology is registered.
+func SetNodeFrameAllocator(memRangesFn NodeMemRangesFn, allocFn NodeFrameAllocatorFn) {
+	nodeMemRangesFn = memRangesFn
+	nodeFrameAllocator = allocFn
+}
+
+// SetNUMATopology registers the system NUMA topology and forwards the node
+// memory ranges to the registered NUMA-aware frame allocator.
+func SetNUMATopology(topology NUMATopology) *kernel.Error {
+	count := len(topology.Distances)
+	for _, memRange := range topology.MemRanges {
+		if int(memRange.Node) >= count {
+			count = int(memRange.Node) + 1
+		}
+	}
+	for _, node := range topology.CPUNodes {
+		if int(node) >= count {
+			count = int(node) + 1
+		}
+	}
+
+	if nodeMemRangesFn != nil {
+		if err := nodeMemRangesFn(topology.MemRanges); err != nil {
+			return err
+		}
+	}
+
+	numaTopology, nodeCount = topology, count
+	return nil
+}
+
+// NodeCount returns the number of NUMA nodes. Systems without NUMA support
+// are treated as having a single node.
+func NodeCount() int {
+	if nodeCount == 0 {
+		return 1
+	}
+
+	return nodeCount
+}
+
+// CPUNode returns the node that contains the CPU with the specified local
+// APIC ID. CPUs not described by the NUMA topology are assigned to node 0.
+func CPUNode(apicID uint32) NodeID {
+	return numaTopology.CPUNodes[apicID]
+}
+
+// NodeDistance returns the relative distance between two nodes.
+func NodeDistance(from, to NodeID) uint8 {
+	if int(from) < len(numaTopology.Distances) && int(to) < len(numaTopology.Distances[from]) {
+		return numaTopology.Distances[from][to]
+	}
+
+	if from == to {
+		return LocalDistance
+	}
+
+	return RemoteDistance
+}
+
+// AllocFrameOnNode allocates a physical frame attached to the specified node.
+// If the node has no free frames, AllocFrameOnNode falls back to the
+// remaining nodes in order of increasing distance from the requested node.
+// If no NUMA-aware allocator has been registered, AllocFrameOnNode behaves
+// like AllocFrame.
+func AllocFrameOnNode(node NodeID) (Frame, *kernel.Error) {
+	// The registered allocator is invoked directly so that the number of
+	// stack frames between the caller and the allocator matches the one
+	// for AllocFrame.
+	if nodeFrameAllocator == nil || nodeCount == 0 {
+		return frameAllocator()
+	}
+
+	var (
+		frame     Frame
+		err       *kernel.Error
+		lastDist  = -1
+		lastNode  = -1
+		nodeLimit = NodeCount()
+	)
+
+	// Visit nodes in (distance, node ID) order without allocating a
+	// sorted node list.
+	for visited := 0; visited < nodeLimit; visited++ {
+		nextNode, nextDist := -1, 0
+		for candidate := 0; candidate < nodeLimit; candidate++ {
+			dist := int(NodeDistance(node, NodeID(candidate)))
+			if dist < lastDist || (dist == lastDist && candidate <= lastNode) {
+				continue
+			}
+
+			if nextNode == -1 || dist < nextDist {
+				nextNode, nextDist = candidate, dist
+			}
+		}
+
+		if frame, err = nodeFrameAllocator(NodeID(nextNode)); err == nil {
+			return frame, nil
+		}
+
+		lastNode, lastDist = nextNode, nextDist
+	}
+
+	return InvalidFrame, err
+}
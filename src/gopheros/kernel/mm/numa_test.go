@@ -0,0 +1,139 @@
+package mm
+
+import (
+	"gopheros/kernel"
+	"reflect"
+	"testing"
+)
+
+func TestSetNUMATopology(t *testing.T) {
+	defer func() {
+		numaTopology, nodeCount = NUMATopology{}, 0
+		SetNodeFrameAllocator(nil, nil)
+	}()
+
+	if got := NodeCount(); got != 1 {
+		t.Fatalf("expected node count to be 1 when no topology is registered; got %d", got)
+	}
+
+	var gotRanges []NodeMemRange
+	SetNodeFrameAllocator(
+		func(memRanges []NodeMemRange) *kernel.Error {
+			gotRanges = memRanges
+			return nil
+		},
+		nil,
+	)
+
+	topology := NUMATopology{
+		MemRanges: []NodeMemRange{
+			{Node: 0, StartFrame: 0, EndFrame: 0xff},
+			{Node: 2, StartFrame: 0x100, EndFrame: 0x1ff},
+		},
+		CPUNodes: map[uint32]NodeID{0: 0, 1: 2},
+	}
+
+	if err := SetNUMATopology(topology); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(gotRanges, topology.MemRanges) {
+		t.Fatalf("expected memory ranges to be forwarded to the frame allocator; got %v", gotRanges)
+	}
+
+	if got := NodeCount(); got != 3 {
+		t.Errorf("expected node count to be 3; got %d", got)
+	}
+
+	if got := CPUNode(1); got != 2 {
+		t.Errorf("expected CPU 1 to belong to node 2; got %d", got)
+	}
+
+	if got := CPUNode(42); got != 0 {
+		t.Errorf("expected unknown CPU to belong to node 0; got %d", got)
+	}
+
+	if got := NodeDistance(2, 2); got != LocalDistance {
+		t.Errorf("expected local distance to be %d; got %d", LocalDistance, got)
+	}
+
+	if got := NodeDistance(0, 2); got != RemoteDistance {
+		t.Errorf("expected remote distance to be %d; got %d", RemoteDistance, got)
+	}
+
+	t.Run("allocator error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+		SetNodeFrameAllocator(func(_ []NodeMemRange) *kernel.Error { return expErr }, nil)
+
+		if err := SetNUMATopology(NUMATopology{}); err != expErr {
+			t.Fatalf("expected error %v; got %v", expErr, err)
+		}
+
+		// The previous topology should remain active
+		if got := NodeCount(); got != 3 {
+			t.Errorf("expected node count to be 3; got %d", got)
+		}
+	})
+}
+
+func TestAllocFrameOnNode(t *testing.T) {
+	defer func() {
+		numaTopology, nodeCount = NUMATopology{}, 0
+		SetNodeFrameAllocator(nil, nil)
+		SetFrameAllocator(nil)
+	}()
+
+	SetFrameAllocator(func() (Frame, *kernel.Error) { return Frame(0xf00), nil })
+
+	t.Run("no NUMA support", func(t *testing.T) {
+		if got, err := AllocFrameOnNode(1); err != nil || got != Frame(0xf00) {
+			t.Fatalf("expected AllocFrameOnNode to fall back to AllocFrame; got %v, %v", got, err)
+		}
+	})
+
+	// 4 nodes; node 3 is closer to node 0 than nodes 1 and 2
+	if err := SetNUMATopology(NUMATopology{
+		Distances: [][]uint8{
+			{10, 20, 20, 15},
+			{20, 10, 15, 20},
+			{20, 15, 10, 20},
+			{15, 20, 20, 10},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+	specs := []struct {
+		node      NodeID
+		freeNodes map[NodeID]bool
+		expVisits []NodeID
+		expFrame  Frame
+		expErr    *kernel.Error
+	}{
+		{0, map[NodeID]bool{0: true}, []NodeID{0}, Frame(0), nil},
+		{0, map[NodeID]bool{1: true, 2: true}, []NodeID{0, 3, 1}, Frame(1), nil},
+		{2, map[NodeID]bool{0: true, 3: true}, []NodeID{2, 1, 0}, Frame(0), nil},
+		{1, nil, []NodeID{1, 2, 0, 3}, InvalidFrame, expErr},
+	}
+
+	for specIndex, spec := range specs {
+		var visits []NodeID
+		SetNodeFrameAllocator(nil, func(node NodeID) (Frame, *kernel.Error) {
+			visits = append(visits, node)
+			if spec.freeNodes[node] {
+				return Frame(node), nil
+			}
+			return InvalidFrame, expErr
+		})
+
+		frame, err := AllocFrameOnNode(spec.node)
+		if frame != spec.expFrame || err != spec.expErr {
+			t.Errorf("[spec %d] expected to get (%v, %v); got (%v, %v)", specIndex, spec.expFrame, spec.expErr, frame, err)
+		}
+
+		if !reflect.DeepEqual(visits, spec.expVisits) {
+			t.Errorf("[spec %d] expected nodes to be visited in order %v; got %v", specIndex, spec.expVisits, visits)
+		}
+	}
+}
@@ -37,6 +37,10 @@ var (
 	// frameAllocator points to a frame allocator function registered using
 	// SetFrameAllocator.
 	frameAllocator FrameAllocatorFn
+
+	// frameFreer points to a frame release function registered using
+	// SetFrameFreer.
+	frameFreer FrameFreerFn
 )
 
 // FrameAllocatorFn is a function that can allocate physical frames.
@@ -50,6 +54,18 @@ func SetFrameAllocator(allocFn FrameAllocatorFn) { frameAllocator = allocFn }
 // physical frame allocator.
 func AllocFrame() (Frame, *kernel.Error) { return frameAllocator() }
 
+// FrameFreerFn is a function that can release physical frames back to the
+// allocator that reserved them.
+type FrameFreerFn func(Frame) *kernel.Error
+
+// SetFrameFreer registers a function that will be used by the vmm code when
+// physical frames are no longer needed.
+func SetFrameFreer(freeFn FrameFreerFn) { frameFreer = freeFn }
+
+// FreeFrame releases a physical frame using the currently active physical
+// frame allocator.
+func FreeFrame(frame Frame) *kernel.Error { return frameFreer(frame) }
+
 // Page describes a virtual memory page index.
 type Page uintptr
 
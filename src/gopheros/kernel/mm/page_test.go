@@ -61,6 +61,25 @@ func TestFrameAllocator(t *testing.T) {
 	}
 }
 
+func TestFrameFreer(t *testing.T) {
+	var freedFrame Frame
+	customFreer := func(frame Frame) *kernel.Error {
+		freedFrame = frame
+		return nil
+	}
+
+	defer SetFrameFreer(nil)
+	SetFrameFreer(customFreer)
+
+	if err := FreeFrame(Frame(42)); err != nil {
+		t.Fatal(err)
+	}
+
+	if freedFrame != Frame(42) {
+		t.Fatalf("expected custom freer to be invoked with frame 42; got %d", freedFrame)
+	}
+}
+
 func TestPageMethods(t *testing.T) {
 	for pageIndex := uint64(0); pageIndex < 128; pageIndex++ {
 		page := Page(pageIndex)
@@ -44,9 +44,21 @@ type framePool struct {
 	// to scan the free bitmap.
 	freeCount uint32
 
+	// reservedCount tracks the pages in this pool that were reserved
+	// while bootstrapping the allocator (e.g. kernel image frames).
+	reservedCount uint32
+
+	// node is the NUMA node that the pool memory is attached to.
+	node mm.NodeID
+
 	// freeBitmap tracks used/free pages in the pool.
 	freeBitmap    []uint64
 	freeBitmapHdr reflect.SliceHeader
+
+	// debugInfo tracks per-frame information when the allocator operates
+	// in debug mode.
+	debugInfo    []frameDebugInfo
+	debugInfoHdr reflect.SliceHeader
 }
 
 // BitmapAllocator implements a physical frame allocator that tracks frame
@@ -62,6 +74,16 @@ type BitmapAllocator struct {
 
 	pools    []framePool
 	poolsHdr reflect.SliceHeader
+
+	// nodeMemRanges holds the node memory ranges registered via
+	// setNodeMemRanges.
+	nodeMemRanges []mm.NodeMemRange
+
+	// debugMode is set to true when the allocator operates in debug mode.
+	// While in debug mode, debugTempAddr holds the virtual address used
+	// by the vmm for temporary mappings.
+	debugMode     bool
+	debugTempAddr uintptr
 }
 
 // init allocates space for the allocator structures using the early bootmem
@@ -186,6 +208,17 @@ func (alloc *BitmapAllocator) markFrame(poolIndex int, frame mm.Frame, flag mark
 	}
 }
 
+// reserveBootFrame marks a frame that is in use while bootstrapping the
+// allocator as reserved and updates the reserved frame count for its pool.
+func (alloc *BitmapAllocator) reserveBootFrame(poolIndex int, frame mm.Frame) {
+	if poolIndex < 0 || frame > alloc.pools[poolIndex].endFrame {
+		return
+	}
+
+	alloc.markFrame(poolIndex, frame, markReserved)
+	alloc.pools[poolIndex].reservedCount++
+}
+
 // poolForFrame returns the index of the pool that contains frame or -1 if
 // the frame is not contained in any of the available memory pools (e.g it
 // points to a reserved memory region).
@@ -207,7 +240,7 @@ func (alloc *BitmapAllocator) reserveKernelFrames() {
 	// fall into one of the available memory pools
 	poolIndex := alloc.poolForFrame(bootMemAllocator.kernelStartFrame)
 	for frame := bootMemAllocator.kernelStartFrame; frame <= bootMemAllocator.kernelEndFrame; frame++ {
-		alloc.markFrame(poolIndex, frame, markReserved)
+		alloc.reserveBootFrame(poolIndex, frame)
 	}
 }
 
@@ -215,19 +248,23 @@ func (alloc *BitmapAllocator) reserveKernelFrames() {
 // already allocated by the early allocator.
 func (alloc *BitmapAllocator) reserveEarlyAllocatorFrames() {
 	// We now need to decomission the early allocator by flagging all frames
-	// allocated by it as reserved. The allocator itself does not track
-	// individual frames but only a counter of allocated frames. To get
-	// the list of frames we reset its internal state and "replay" the
-	// allocation requests to get the correct frames.
+	// allocated by it as reserved.
+	visitEarlyAllocatorFrames(func(frame mm.Frame) {
+		alloc.reserveBootFrame(alloc.poolForFrame(frame), frame)
+	})
+}
+
+// visitEarlyAllocatorFrames invokes visitor for each frame that has been
+// allocated by the early allocator.
+func visitEarlyAllocatorFrames(visitor func(mm.Frame)) {
+	// The early allocator does not track individual frames but only a
+	// counter of allocated frames. To get the list of frames we reset its
+	// internal state and "replay" the allocation requests.
 	allocCount := bootMemAllocator.allocCount
 	bootMemAllocator.allocCount, bootMemAllocator.lastAllocFrame = 0, 0
 	for i := uint64(0); i < allocCount; i++ {
 		frame, _ := bootMemAllocator.AllocFrame()
-		alloc.markFrame(
-			alloc.poolForFrame(frame),
-			frame,
-			markReserved,
-		)
+		visitor(frame)
 	}
 }
 
@@ -240,44 +277,78 @@ func (alloc *BitmapAllocator) printStats() {
 	)
 }
 
+// poolStats returns the frame usage for each one of the allocator pools.
+func (alloc *BitmapAllocator) poolStats() []mm.PoolStats {
+	stats := make([]mm.PoolStats, len(alloc.pools))
+
+	alloc.mutex.Acquire()
+	for poolIndex, pool := range alloc.pools {
+		stats[poolIndex].StartFrame = pool.startFrame
+		stats[poolIndex].EndFrame = pool.endFrame
+		stats[poolIndex].FreeFrames = pool.freeCount
+		stats[poolIndex].ReservedFrames = pool.reservedCount
+		stats[poolIndex].UsedFrames = uint32(pool.endFrame-pool.startFrame+1) - pool.freeCount - pool.reservedCount
+	}
+	alloc.mutex.Release()
+
+	return stats
+}
+
 // AllocFrame reserves and returns a physical memory frame. An error will be
 // returned if no more memory can be allocated.
 func (alloc *BitmapAllocator) AllocFrame() (mm.Frame, *kernel.Error) {
 	alloc.mutex.Acquire()
 
 	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
-		if alloc.pools[poolIndex].freeCount == 0 {
+		if frame, ok := alloc.allocFromPool(poolIndex); ok {
+			if alloc.debugMode {
+				alloc.debugAllocFrame(poolIndex, frame)
+			}
+
+			alloc.mutex.Release()
+			return frame, nil
+		}
+	}
+
+	alloc.mutex.Release()
+	return mm.InvalidFrame, errBitmapAllocOutOfMemory
+}
+
+// allocFromPool reserves a free frame from the specified pool. It returns
+// false if the pool has no free frames. It must be invoked while holding the
+// allocator mutex.
+func (alloc *BitmapAllocator) allocFromPool(poolIndex int) (mm.Frame, bool) {
+	if alloc.pools[poolIndex].freeCount == 0 {
+		return mm.InvalidFrame, false
+	}
+
+	fullBlock := uint64(math.MaxUint64)
+	for blockIndex, block := range alloc.pools[poolIndex].freeBitmap {
+		if block == fullBlock {
 			continue
 		}
 
-		fullBlock := uint64(math.MaxUint64)
-		for blockIndex, block := range alloc.pools[poolIndex].freeBitmap {
-			if block == fullBlock {
+		// Block has at least one free slot; we need to scan its bits
+		for blockOffset, mask := 0, uint64(1<<63); mask > 0; blockOffset, mask = blockOffset+1, mask>>1 {
+			if block&mask != 0 {
 				continue
 			}
 
-			// Block has at least one free slot; we need to scan its bits
-			for blockOffset, mask := 0, uint64(1<<63); mask > 0; blockOffset, mask = blockOffset+1, mask>>1 {
-				if block&mask != 0 {
-					continue
-				}
-
-				alloc.pools[poolIndex].freeCount--
-				alloc.pools[poolIndex].freeBitmap[blockIndex] |= mask
-				alloc.reservedPages++
-				alloc.mutex.Release()
-				return alloc.pools[poolIndex].startFrame + mm.Frame((blockIndex<<6)+blockOffset), nil
-			}
+			alloc.pools[poolIndex].freeCount--
+			alloc.pools[poolIndex].freeBitmap[blockIndex] |= mask
+			alloc.reservedPages++
+			return alloc.pools[poolIndex].startFrame + mm.Frame((blockIndex<<6)+blockOffset), true
 		}
 	}
 
-	alloc.mutex.Release()
-	return mm.InvalidFrame, errBitmapAllocOutOfMemory
+	return mm.InvalidFrame, false
 }
 
 // FreeFrame releases a frame previously allocated via a call to AllocFrame.
 // Trying to release a frame not part of the allocator pools or a frame that
-// is already marked as free will cause an error to be returned.
+// is already marked as free will cause an error to be returned. While in
+// debug mode, double frees as well as attempts to release frames reserved
+// while the kernel booted cause a kernel panic.
 func (alloc *BitmapAllocator) FreeFrame(frame mm.Frame) *kernel.Error {
 	alloc.mutex.Acquire()
 
@@ -291,7 +362,16 @@ func (alloc *BitmapAllocator) FreeFrame(frame mm.Frame) *kernel.Error {
 	block := relFrame >> 6
 	mask := uint64(1 << (63 - (relFrame - block<<6)))
 
-	if alloc.pools[poolIndex].freeBitmap[block]&mask == 0 {
+	isFree := alloc.pools[poolIndex].freeBitmap[block]&mask == 0
+	if alloc.debugMode && !alloc.debugFreeFrame(poolIndex, frame, isFree) {
+		alloc.mutex.Release()
+		if isFree {
+			return errBitmapAllocDoubleFree
+		}
+		return errBitmapAllocReservedFree
+	}
+
+	if isFree {
 		alloc.mutex.Release()
 		return errBitmapAllocDoubleFree
 	}
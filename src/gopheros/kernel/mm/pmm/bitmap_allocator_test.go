@@ -6,6 +6,7 @@ import (
 	"gopheros/kernel/mm/vmm"
 	"gopheros/multiboot"
 	"math"
+	"reflect"
 	"strconv"
 	"testing"
 	"unsafe"
@@ -385,6 +386,51 @@ func TestBitmapAllocatorAllocAndFreeFrame(t *testing.T) {
 	}
 }
 
+func TestBitmapAllocatorPoolStats(t *testing.T) {
+	var alloc = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: mm.Frame(0),
+				endFrame:   mm.Frame(7),
+				freeCount:  8,
+				freeBitmap: make([]uint64, 1),
+			},
+			{
+				startFrame: mm.Frame(64),
+				endFrame:   mm.Frame(191),
+				freeCount:  128,
+				freeBitmap: make([]uint64, 2),
+			},
+		},
+		totalPages: 136,
+	}
+
+	// Reserve 2 frames in the first pool and allocate 3 frames
+	alloc.reserveBootFrame(0, mm.Frame(0))
+	alloc.reserveBootFrame(0, mm.Frame(1))
+	for i := 0; i < 3; i++ {
+		if _, err := alloc.AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reserve two frames in the second pool and then reclaim one of them
+	alloc.reserveBootFrame(1, mm.Frame(100))
+	alloc.reserveBootFrame(1, mm.Frame(101))
+	if !alloc.releaseBootFrame(mm.Frame(100)) {
+		t.Fatal("expected boot frame to be released")
+	}
+
+	exp := []mm.PoolStats{
+		{StartFrame: 0, EndFrame: 7, FreeFrames: 3, ReservedFrames: 2, UsedFrames: 3},
+		{StartFrame: 64, EndFrame: 191, FreeFrames: 127, ReservedFrames: 1, UsedFrames: 0},
+	}
+
+	if got := alloc.poolStats(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected pool stats to be:\n%+v\ngot:\n%+v", exp, got)
+	}
+}
+
 func TestAllocatorPackageInit(t *testing.T) {
 	defer func() {
 		mapFn = vmm.Map
@@ -410,9 +456,18 @@ func TestAllocatorPackageInit(t *testing.T) {
 		}
 
 		// At this point the bitmap allocator should be up and running
-		if _, err := bitmapAllocFrame(); err != nil {
+		frame, err := bitmapAllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = mm.FreeFrame(frame); err != nil {
 			t.Fatal(err)
 		}
+
+		if got := len(mm.Stats().Pools); got != len(bitmapAllocator.pools) {
+			t.Fatalf("expected mm.Stats to report %d pools; got %d", len(bitmapAllocator.pools), got)
+		}
 	})
 
 	t.Run("error", func(t *testing.T) {
@@ -0,0 +1,284 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// debugPoisonByte is used to fill frames released while the debug mode
+	// is enabled.
+	debugPoisonByte    = 0x6b
+	debugPoisonPattern = uint64(0x6b6b6b6b6b6b6b6b)
+
+	// debugCallerSkip is the number of stack frames that runtime.Callers
+	// needs to skip to reach the code that requested a frame via
+	// mm.AllocFrame, mm.AllocFrameOnNode or mm.FreeFrame:
+	// runtime.Callers, callerPC, debugAllocFrame/debugFreeFrame, the
+	// BitmapAllocator method, the function registered with the mm package
+	// and the mm package helper. TestDebugCallerSkip verifies this value.
+	debugCallerSkip = 6
+)
+
+var (
+	errBitmapAllocReservedFree    = &kernel.Error{Module: "bitmap_alloc", Message: "attempt to free a reserved frame"}
+	errBitmapAllocPoisonCorrupted = &kernel.Error{Module: "bitmap_alloc", Message: "free frame modified after being released"}
+
+	// The following functions are used by tests to mock calls to the vmm
+	// and kfmt packages and are automatically inlined by the compiler.
+	mapTemporaryFn = vmm.MapTemporary
+	unmapFn        = vmm.Unmap
+	translateFn    = vmm.Translate
+	panicFn        = kfmt.Panic
+)
+
+type frameDebugFlag uint8
+
+const (
+	// frameBootReserved is set for frames reserved while bootstrapping
+	// the allocator (kernel image and early allocator frames).
+	frameBootReserved frameDebugFlag = 1 << iota
+
+	// framePoisoned is set for frames that have been filled with the
+	// poison pattern when they were released.
+	framePoisoned
+)
+
+// frameDebugInfo tracks the state of a single frame while the allocator
+// operates in debug mode.
+type frameDebugInfo struct {
+	// allocPC and freePC hold the caller PC for the last allocation and
+	// release of the frame.
+	allocPC uintptr
+	freePC  uintptr
+
+	flags frameDebugFlag
+}
+
+// EnableDebugMode switches the kernel frame allocator to debug mode. While in
+// debug mode, the allocator:
+//   - fills released frames with a poison pattern and verifies that the
+//     pattern is intact when the frame gets allocated again.
+//   - detects double frees and attempts to free frames that were reserved
+//     while the kernel booted.
+//   - records the caller PC for the last allocation and release of each
+//     frame.
+//
+// Any detected violation causes a kernel panic.
+func EnableDebugMode() *kernel.Error {
+	return bitmapAllocator.enableDebugMode()
+}
+
+// enableDebugMode allocates the per-frame debug information for all pools
+// and enables the debug checks.
+func (alloc *BitmapAllocator) enableDebugMode() *kernel.Error {
+	if alloc.debugMode {
+		return nil
+	}
+
+	var (
+		err            *kernel.Error
+		sizeofInfo     = unsafe.Sizeof(frameDebugInfo{})
+		pageSizeMinus1 = mm.PageSize - 1
+		requiredBytes  uintptr
+	)
+
+	for _, pool := range alloc.pools {
+		requiredBytes += uintptr(pool.endFrame-pool.startFrame+1) * sizeofInfo
+	}
+	requiredBytes = (requiredBytes + pageSizeMinus1) & ^pageSizeMinus1
+
+	infoStartAddr, err := reserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, index := mm.PageFromAddress(infoStartAddr), uintptr(0); index < requiredBytes>>mm.PageShift; page, index = page+1, index+1 {
+		nextFrame, err := alloc.AllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	// Query the address used for temporary mappings so that existing
+	// temporary mappings can be restored after poisoning a frame.
+	infoPhysAddr, err := translateFn(infoStartAddr)
+	if err != nil {
+		return err
+	}
+
+	tmpPage, err := mapTemporaryFn(mm.FrameFromAddress(infoPhysAddr))
+	if err != nil {
+		return err
+	}
+	alloc.debugTempAddr = tmpPage.Address()
+	_ = unmapFn(tmpPage)
+
+	for poolIndex := range alloc.pools {
+		pool := &alloc.pools[poolIndex]
+		pool.debugInfoHdr.Len = int(pool.endFrame - pool.startFrame + 1)
+		pool.debugInfoHdr.Cap = pool.debugInfoHdr.Len
+		pool.debugInfoHdr.Data = infoStartAddr
+		pool.debugInfo = *(*[]frameDebugInfo)(unsafe.Pointer(&pool.debugInfoHdr))
+
+		infoStartAddr += uintptr(pool.debugInfoHdr.Len) * sizeofInfo
+	}
+
+	// Flag the kernel image and early allocator frames as reserved
+	markBootReserved := func(frame mm.Frame) {
+		if info := alloc.frameDebugInfo(alloc.poolForFrame(frame), frame); info != nil {
+			info.flags |= frameBootReserved
+		}
+	}
+	for frame := bootMemAllocator.kernelStartFrame; frame <= bootMemAllocator.kernelEndFrame; frame++ {
+		markBootReserved(frame)
+	}
+	visitEarlyAllocatorFrames(markBootReserved)
+
+	alloc.mutex.Acquire()
+	alloc.debugMode = true
+	alloc.mutex.Release()
+
+	kfmt.Printf("[bitmap_alloc] debug mode enabled\n")
+	return nil
+}
+
+// frameDebugInfo returns the debug information for a frame in the specified
+// pool or nil if the frame does not belong to the pool.
+func (alloc *BitmapAllocator) frameDebugInfo(poolIndex int, frame mm.Frame) *frameDebugInfo {
+	if poolIndex < 0 || frame < alloc.pools[poolIndex].startFrame || frame > alloc.pools[poolIndex].endFrame {
+		return nil
+	}
+
+	return &alloc.pools[poolIndex].debugInfo[frame-alloc.pools[poolIndex].startFrame]
+}
+
+// debugAllocFrame verifies that the poison pattern of a previously released
+// frame is intact and records the caller PC for the allocation. It must be
+// invoked while holding the allocator mutex.
+func (alloc *BitmapAllocator) debugAllocFrame(poolIndex int, frame mm.Frame) {
+	var (
+		pc   = callerPC()
+		info = alloc.frameDebugInfo(poolIndex, frame)
+	)
+
+	if info.flags&framePoisoned != 0 {
+		var (
+			offset       uintptr
+			poisonIntact = true
+		)
+
+		// The poison pattern cannot be verified if the frame cannot be
+		// mapped.
+		mapped := alloc.withFrameMapped(frame, func(frameAddr uintptr) {
+			offset = poisonMismatchOffset(frameAddr)
+			poisonIntact = offset == mm.PageSize
+		})
+
+		if mapped && !poisonIntact {
+			kfmt.Printf("[bitmap_alloc] poison mismatch at offset 0x%x\n", offset)
+			alloc.debugReport(errBitmapAllocPoisonCorrupted, info, frame, pc)
+		}
+	}
+
+	info.flags &^= framePoisoned
+	info.allocPC = pc
+}
+
+// debugFreeFrame ensures that the frame is not already free and that it was
+// not reserved while the kernel booted. It then fills the frame with the
+// poison pattern and records the caller PC for the release. It returns false
+// if the frame cannot be released. It must be invoked while holding the
+// allocator mutex.
+func (alloc *BitmapAllocator) debugFreeFrame(poolIndex int, frame mm.Frame, isFree bool) bool {
+	var (
+		pc   = callerPC()
+		info = alloc.frameDebugInfo(poolIndex, frame)
+	)
+
+	switch {
+	case isFree:
+		alloc.debugReport(errBitmapAllocDoubleFree, info, frame, pc)
+		return false
+	case info.flags&frameBootReserved != 0:
+		alloc.debugReport(errBitmapAllocReservedFree, info, frame, pc)
+		return false
+	}
+
+	if alloc.withFrameMapped(frame, func(frameAddr uintptr) {
+		kernel.Memset(frameAddr, debugPoisonByte, mm.PageSize)
+	}) {
+		info.flags |= framePoisoned
+	}
+
+	info.freePC = pc
+	return true
+}
+
+// debugReport prints out the details for an allocator violation and panics.
+func (alloc *BitmapAllocator) debugReport(err *kernel.Error, info *frameDebugInfo, frame mm.Frame, pc uintptr) {
+	kfmt.Printf("[bitmap_alloc] %s (frame: 0x%x, phys address: 0x%16x)\n", err.Message, uint64(frame), frame.Address())
+	kfmt.Printf("[bitmap_alloc] caller:            0x%16x\n", pc)
+	kfmt.Printf("[bitmap_alloc] last allocated by: 0x%16x\n", info.allocPC)
+	kfmt.Printf("[bitmap_alloc] last freed by:     0x%16x\n", info.freePC)
+
+	panicFn(err)
+}
+
+// withFrameMapped establishes a temporary mapping for frame and invokes fn
+// with the virtual address of the mapped frame. As the allocator may be
+// invoked while the caller is using the temporary mapping, any existing
+// temporary mapping is restored before withFrameMapped returns. The function
+// returns false if the frame could not be mapped.
+func (alloc *BitmapAllocator) withFrameMapped(frame mm.Frame, fn func(uintptr)) bool {
+	prevPhysAddr, prevErr := translateFn(alloc.debugTempAddr)
+
+	tmpPage, err := mapTemporaryFn(frame)
+	if err != nil {
+		return false
+	}
+
+	fn(tmpPage.Address())
+
+	if prevErr == nil {
+		_, _ = mapTemporaryFn(mm.FrameFromAddress(prevPhysAddr))
+	} else {
+		_ = unmapFn(tmpPage)
+	}
+
+	return true
+}
+
+// poisonMismatchOffset returns the offset of the first 64-bit word in the
+// frame mapped at frameAddr that does not match the poison pattern or
+// mm.PageSize if the pattern is intact.
+func poisonMismatchOffset(frameAddr uintptr) uintptr {
+	for offset := uintptr(0); offset < mm.PageSize; offset += 8 {
+		if *(*uint64)(unsafe.Pointer(frameAddr + offset)) != debugPoisonPattern {
+			return offset
+		}
+	}
+
+	return mm.PageSize
+}
+
+// callerPC returns the PC of the code that invoked the allocator via the mm
+// package helpers.
+func callerPC() uintptr {
+	var pcs [1]uintptr
+	if runtime.Callers(debugCallerSkip, pcs[:]) == 0 {
+		return 0
+	}
+
+	return pcs[0]
+}
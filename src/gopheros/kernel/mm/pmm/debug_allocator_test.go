@@ -0,0 +1,374 @@
+package pmm
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestBitmapAllocatorDebugMode(t *testing.T) {
+	defer func() {
+		reserveRegionFn = vmm.EarlyReserveRegion
+		mapFn = vmm.Map
+		mapTemporaryFn = vmm.MapTemporary
+		unmapFn = vmm.Unmap
+		translateFn = vmm.Translate
+		panicFn = kfmt.Panic
+		kfmt.SetOutputSink(nil)
+		bootMemAllocator = BootMemAllocator{}
+	}()
+
+	var (
+		// Allocate 8 frames plus an extra page so the frames can be
+		// page-aligned and an extra page for the frame debug info
+		physMem  = make([]byte, 10*mm.PageSize)
+		physBase = (uintptr(unsafe.Pointer(&physMem[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		infoAddr = physBase + 8*mm.PageSize
+
+		startFrame = mm.Frame(physBase >> mm.PageShift)
+		buf        bytes.Buffer
+		tmpMaps    []mm.Frame
+	)
+
+	alloc := BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: startFrame,
+				endFrame:   startFrame + 7,
+				freeCount:  8,
+				freeBitmap: make([]uint64, 1),
+			},
+		},
+		totalPages: 8,
+	}
+
+	// The last frame in the pool is occupied by the kernel image
+	bootMemAllocator = BootMemAllocator{kernelStartFrame: startFrame + 7, kernelEndFrame: startFrame + 7}
+	alloc.reserveKernelFrames()
+
+	reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return infoAddr, nil }
+	mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
+	mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) {
+		tmpMaps = append(tmpMaps, frame)
+		return mm.Page(frame), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) { return virtAddr, nil }
+	panicFn = func(e interface{}) { panic(e) }
+	kfmt.SetOutputSink(&buf)
+
+	if err := alloc.enableDebugMode(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !alloc.debugMode {
+		t.Fatal("expected debug mode to be enabled")
+	}
+
+	// The first free frame is used for storing the debug info
+	if info := alloc.frameDebugInfo(0, startFrame+7); info.flags&frameBootReserved == 0 {
+		t.Fatal("expected kernel frame to be flagged as reserved")
+	}
+
+	expPanic := func(t *testing.T, expErr *kernel.Error, expOutput string, fn func()) {
+		buf.Reset()
+		defer func() {
+			if err := recover(); err != expErr {
+				t.Errorf("expected a panic with %v; got %v", expErr, err)
+			}
+
+			// The allocator lock is still held when the panic occurs
+			alloc.mutex.Release()
+
+			if got := buf.String(); !strings.Contains(got, expOutput) {
+				t.Errorf("expected output to contain %q; got:\n%s", expOutput, got)
+			}
+		}()
+
+		fn()
+	}
+
+	frameContents := func(frame mm.Frame) []byte {
+		offset := frame.Address() - uintptr(unsafe.Pointer(&physMem[0]))
+		return physMem[offset : offset+mm.PageSize]
+	}
+
+	t.Run("alloc and free", func(t *testing.T) {
+		frame, err := alloc.AllocFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := startFrame + 1; frame != exp {
+			t.Fatalf("expected allocated frame to be %d; got %d", exp, frame)
+		}
+
+		info := alloc.frameDebugInfo(0, frame)
+		if info.allocPC == 0 {
+			t.Error("expected alloc PC to be recorded")
+		}
+
+		tmpMaps = tmpMaps[:0]
+		if err = alloc.FreeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.freePC == 0 || info.flags&framePoisoned == 0 {
+			t.Errorf("expected frame to be poisoned and the free PC to be recorded; got flags %d, freePC %x", info.flags, info.freePC)
+		}
+
+		for i, b := range frameContents(frame) {
+			if b != debugPoisonByte {
+				t.Fatalf("expected byte %d of released frame to be 0x%x; got 0x%x", i, debugPoisonByte, b)
+			}
+		}
+
+		// The previous temporary mapping should be restored
+		if exp := mm.FrameFromAddress(alloc.debugTempAddr); len(tmpMaps) != 2 || tmpMaps[1] != exp {
+			t.Errorf("expected temporary mapping to be restored to frame %d; got mappings %v", exp, tmpMaps)
+		}
+
+		// Reallocating the frame should verify the poison pattern
+		if frame, err = alloc.AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+
+		if info.flags&framePoisoned != 0 {
+			t.Error("expected poisoned flag to be cleared after the frame is reallocated")
+		}
+
+		if err = alloc.FreeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("poisoned frame modified", func(t *testing.T) {
+		frameContents(startFrame + 1)[128] = 0xff
+
+		expPanic(t, errBitmapAllocPoisonCorrupted, "poison mismatch at offset 0x80", func() {
+			_, _ = alloc.AllocFrame()
+		})
+	})
+
+	t.Run("double free", func(t *testing.T) {
+		expPanic(t, errBitmapAllocDoubleFree, "frame is already free", func() {
+			_ = alloc.FreeFrame(startFrame + 2)
+		})
+	})
+
+	t.Run("reserved frame free", func(t *testing.T) {
+		expPanic(t, errBitmapAllocReservedFree, "attempt to free a reserved frame", func() {
+			_ = alloc.FreeFrame(startFrame + 7)
+		})
+	})
+
+	t.Run("errors reported without panicking", func(t *testing.T) {
+		panicFn = func(_ interface{}) {}
+		defer func() { panicFn = func(e interface{}) { panic(e) } }()
+
+		if err := alloc.FreeFrame(startFrame + 2); err != errBitmapAllocDoubleFree {
+			t.Errorf("expected error errBitmapAllocDoubleFree; got %v", err)
+		}
+
+		if err := alloc.FreeFrame(startFrame + 7); err != errBitmapAllocReservedFree {
+			t.Errorf("expected error errBitmapAllocReservedFree; got %v", err)
+		}
+	})
+}
+
+func TestDebugCallerSkip(t *testing.T) {
+	defer func(origAlloc BitmapAllocator) {
+		bitmapAllocator = origAlloc
+		mapTemporaryFn = vmm.MapTemporary
+		unmapFn = vmm.Unmap
+		translateFn = vmm.Translate
+		mm.SetFrameAllocator(nil)
+		mm.SetFrameFreer(nil)
+		mm.SetNodeFrameAllocator(nil, nil)
+		_ = mm.SetNUMATopology(mm.NUMATopology{})
+	}(bitmapAllocator)
+
+	var (
+		physMem    = make([]byte, 2*mm.PageSize)
+		physBase   = (uintptr(unsafe.Pointer(&physMem[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		startFrame = mm.Frame(physBase >> mm.PageShift)
+		mapErr     *kernel.Error
+	)
+
+	bitmapAllocator = BitmapAllocator{
+		pools: []framePool{
+			{
+				startFrame: startFrame,
+				endFrame:   startFrame,
+				freeCount:  1,
+				freeBitmap: make([]uint64, 1),
+				debugInfo:  make([]frameDebugInfo, 1),
+			},
+		},
+		totalPages: 1,
+		debugMode:  true,
+	}
+	info := &bitmapAllocator.pools[0].debugInfo[0]
+
+	mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(frame), mapErr }
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, vmm.ErrInvalidMapping }
+	mm.SetFrameAllocator(bitmapAllocFrame)
+	mm.SetFrameFreer(bitmapFreeFrame)
+	mm.SetNodeFrameAllocator(nil, bitmapAllocFrameOnNode)
+
+	funcName := func(pc uintptr) string {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			return fn.Name()
+		}
+		return ""
+	}
+
+	pc, _, _, _ := runtime.Caller(0)
+	expCaller := funcName(pc)
+
+	for specIndex, allocFn := range []func() (mm.Frame, *kernel.Error){
+		mm.AllocFrame,
+		func() (mm.Frame, *kernel.Error) { return mm.AllocFrameOnNode(0) },
+		func() (mm.Frame, *kernel.Error) {
+			if err := mm.SetNUMATopology(mm.NUMATopology{CPUNodes: map[uint32]mm.NodeID{0: 0}}); err != nil {
+				t.Fatal(err)
+			}
+			return mm.AllocFrameOnNode(0)
+		},
+	} {
+		// Each allocation function is invoked by a closure defined
+		// inside this test.
+		expAllocCaller := expCaller + ".func"
+		if specIndex == 0 {
+			expAllocCaller = expCaller
+		}
+
+		frame, err := allocFn()
+		if err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got := funcName(info.allocPC); !strings.HasPrefix(got, expAllocCaller) {
+			t.Errorf("[spec %d] expected the recorded alloc PC to belong to %s; got %s", specIndex, expAllocCaller, got)
+		}
+
+		if err = mm.FreeFrame(frame); err != nil {
+			t.Fatalf("[spec %d] unexpected error: %v", specIndex, err)
+		}
+
+		if got := funcName(info.freePC); got != expCaller {
+			t.Errorf("[spec %d] expected the recorded free PC to belong to %s; got %s", specIndex, expCaller, got)
+		}
+	}
+
+	t.Run("poison not verified if the frame cannot be mapped", func(t *testing.T) {
+		physMem[physBase-uintptr(unsafe.Pointer(&physMem[0]))] = 0xff
+		mapErr = &kernel.Error{Module: "test", Message: "map failed"}
+
+		if _, err := mm.AllocFrame(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBitmapAllocatorEnableDebugModeErrors(t *testing.T) {
+	defer func() {
+		reserveRegionFn = vmm.EarlyReserveRegion
+		mapFn = vmm.Map
+		mapTemporaryFn = vmm.MapTemporary
+		unmapFn = vmm.Unmap
+		translateFn = vmm.Translate
+	}()
+
+	var (
+		physMem  = make([]byte, 2*mm.PageSize)
+		physBase = (uintptr(unsafe.Pointer(&physMem[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		expErr   = &kernel.Error{Module: "test", Message: "something went wrong"}
+	)
+
+	newAlloc := func(freeCount uint32) *BitmapAllocator {
+		return &BitmapAllocator{
+			pools: []framePool{
+				{
+					startFrame: mm.Frame(0),
+					endFrame:   mm.Frame(7),
+					freeCount:  freeCount,
+					freeBitmap: make([]uint64, 1),
+				},
+			},
+		}
+	}
+
+	resetMocks := func() {
+		reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return physBase, nil }
+		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
+		mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(frame), nil }
+		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) { return virtAddr, nil }
+	}
+
+	specs := []struct {
+		setup  func()
+		alloc  *BitmapAllocator
+		expErr *kernel.Error
+	}{
+		{
+			func() {
+				reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+			},
+			newAlloc(8),
+			expErr,
+		},
+		{
+			func() {},
+			newAlloc(0),
+			errBitmapAllocOutOfMemory,
+		},
+		{
+			func() {
+				mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
+			},
+			newAlloc(8),
+			expErr,
+		},
+		{
+			func() {
+				translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+			},
+			newAlloc(8),
+			expErr,
+		},
+		{
+			func() {
+				mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) { return 0, expErr }
+			},
+			newAlloc(8),
+			expErr,
+		},
+	}
+
+	for specIndex, spec := range specs {
+		resetMocks()
+		spec.setup()
+
+		// The free bitmap of an exhausted pool must be full
+		if spec.alloc.pools[0].freeCount == 0 {
+			spec.alloc.pools[0].freeBitmap[0] = ^uint64(0)
+		}
+
+		if err := spec.alloc.enableDebugMode(); err != spec.expErr {
+			t.Errorf("[spec %d] expected error %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if spec.alloc.debugMode {
+			t.Errorf("[spec %d] expected debug mode to remain disabled", specIndex)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+// maxPoolSplits is the maximum number of node boundaries that may be used to
+// split a single pool.
+const maxPoolSplits = 64
+
+// poolSplits holds the frames where a pool must be split so that each
+// resulting pool is attached to a single node.
+type poolSplits struct {
+	count  int
+	frames [maxPoolSplits]mm.Frame
+}
+
+// add inserts a split frame keeping the list sorted and free of duplicates.
+func (ps *poolSplits) add(frame mm.Frame) {
+	index := 0
+	for ; index < ps.count && ps.frames[index] < frame; index++ {
+	}
+
+	if (index < ps.count && ps.frames[index] == frame) || ps.count == maxPoolSplits {
+		return
+	}
+
+	copy(ps.frames[index+1:ps.count+1], ps.frames[index:ps.count])
+	ps.frames[index] = frame
+	ps.count++
+}
+
+// poolSplitsFor calculates the frames where the specified pool must be split
+// so that each resulting pool is attached to a single node. As pools track
+// their frames using 64-bit bitmap blocks, split frames are rounded down to
+// the nearest block boundary; a few frames at the end of a node may therefore
+// be attributed to the next node.
+func poolSplitsFor(pool *framePool, memRanges []mm.NodeMemRange) poolSplits {
+	var splits poolSplits
+
+	addSplit := func(frame mm.Frame) {
+		if frame <= pool.startFrame || frame > pool.endFrame {
+			return
+		}
+
+		if frame = pool.startFrame + ((frame - pool.startFrame) &^ 63); frame > pool.startFrame {
+			splits.add(frame)
+		}
+	}
+
+	for _, memRange := range memRanges {
+		if memRange.EndFrame < pool.startFrame || memRange.StartFrame > pool.endFrame {
+			continue
+		}
+
+		addSplit(memRange.StartFrame)
+		addSplit(memRange.EndFrame + 1)
+	}
+
+	return splits
+}
+
+// nodeForFrames returns the node attached to the memory range with the
+// largest overlap with the frame range [start, end]. Frames not covered by any
+// range are attached to node 0.
+func nodeForFrames(start, end mm.Frame, memRanges []mm.NodeMemRange) mm.NodeID {
+	var (
+		node        mm.NodeID
+		bestOverlap mm.Frame
+	)
+
+	for _, memRange := range memRanges {
+		overlapStart, overlapEnd := memRange.StartFrame, memRange.EndFrame
+		if overlapStart < start {
+			overlapStart = start
+		}
+		if overlapEnd > end {
+			overlapEnd = end
+		}
+
+		if overlapStart <= overlapEnd && overlapEnd-overlapStart+1 > bestOverlap {
+			node, bestOverlap = memRange.Node, overlapEnd-overlapStart+1
+		}
+	}
+
+	return node
+}
+
+// setNodeMemRanges splits the allocator pools at node boundaries and tags
+// each pool with the node that its memory is attached to.
+func (alloc *BitmapAllocator) setNodeMemRanges(memRanges []mm.NodeMemRange) *kernel.Error {
+	newPoolCount := 0
+	for poolIndex := range alloc.pools {
+		newPoolCount += poolSplitsFor(&alloc.pools[poolIndex], memRanges).count + 1
+	}
+
+	// Reserve space for the new pool list if any pools need to be split
+	var (
+		newPools    = alloc.pools
+		newPoolsHdr = alloc.poolsHdr
+	)
+	if newPoolCount != len(alloc.pools) {
+		requiredBytes := (uintptr(newPoolCount)*unsafe.Sizeof(framePool{}) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		poolsAddr, err := reserveRegionFn(requiredBytes)
+		if err != nil {
+			return err
+		}
+
+		for page, index := mm.PageFromAddress(poolsAddr), uintptr(0); index < requiredBytes>>mm.PageShift; page, index = page+1, index+1 {
+			nextFrame, err := alloc.AllocFrame()
+			if err != nil {
+				return err
+			}
+
+			if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+				return err
+			}
+
+			kernel.Memset(page.Address(), 0, mm.PageSize)
+		}
+
+		newPoolsHdr.Data, newPoolsHdr.Len, newPoolsHdr.Cap = poolsAddr, newPoolCount, newPoolCount
+		newPools = *(*[]framePool)(unsafe.Pointer(&newPoolsHdr))
+	}
+
+	alloc.mutex.Acquire()
+
+	// Pools are processed in reverse order so that they can be updated in
+	// place when no splits are required.
+	for poolIndex, newIndex := len(alloc.pools)-1, newPoolCount-1; poolIndex >= 0; poolIndex-- {
+		pool := alloc.pools[poolIndex]
+		splits := poolSplitsFor(&pool, memRanges)
+
+		for splitIndex := splits.count; splitIndex >= 0; splitIndex, newIndex = splitIndex-1, newIndex-1 {
+			segStart, segEnd := pool.startFrame, pool.endFrame
+			if splitIndex > 0 {
+				segStart = splits.frames[splitIndex-1]
+			}
+			if splitIndex < splits.count {
+				segEnd = splits.frames[splitIndex] - 1
+			}
+
+			newPools[newIndex] = pool.subPool(segStart, segEnd)
+			newPools[newIndex].node = nodeForFrames(segStart, segEnd, memRanges)
+		}
+	}
+
+	alloc.poolsHdr = newPoolsHdr
+	alloc.pools = newPools
+	alloc.nodeMemRanges = memRanges
+	alloc.recountReservedFrames()
+
+	alloc.mutex.Release()
+
+	for _, pool := range alloc.pools {
+		kfmt.Printf("[bitmap_alloc] node %d: frames 0x%x - 0x%x\n", uint32(pool.node), uint64(pool.startFrame), uint64(pool.endFrame))
+	}
+
+	return nil
+}
+
+// subPool returns a pool that manages the frame range [start, end] of this
+// pool. The start frame must be aligned to a free bitmap block boundary
+// relative to the pool start frame.
+func (pool *framePool) subPool(start, end mm.Frame) framePool {
+	var (
+		firstBlock = (start - pool.startFrame) >> 6
+		lastBlock  = (end - pool.startFrame) >> 6
+		sub        = framePool{
+			startFrame: start,
+			endFrame:   end,
+			node:       pool.node,
+			freeBitmap: pool.freeBitmap[firstBlock : lastBlock+1],
+		}
+	)
+
+	if len(pool.debugInfo) != 0 {
+		sub.debugInfo = pool.debugInfo[start-pool.startFrame : end-pool.startFrame+1]
+	}
+
+	// Count the free frames in the new pool
+	var usedCount uint32
+	for frame := start; frame <= end; frame++ {
+		relFrame := frame - start
+		if sub.freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) != 0 {
+			usedCount++
+		}
+	}
+	sub.freeCount = uint32(end-start+1) - usedCount
+
+	return sub
+}
+
+// recountReservedFrames updates the per-pool count of frames that were
+// reserved while bootstrapping the allocator.
+func (alloc *BitmapAllocator) recountReservedFrames() {
+	for poolIndex := range alloc.pools {
+		alloc.pools[poolIndex].reservedCount = 0
+	}
+
+	countFrame := func(frame mm.Frame) {
+		if poolIndex := alloc.poolForFrame(frame); poolIndex >= 0 {
+			alloc.pools[poolIndex].reservedCount++
+		}
+	}
+
+	for frame := bootMemAllocator.kernelStartFrame; frame <= bootMemAllocator.kernelEndFrame; frame++ {
+		countFrame(frame)
+	}
+	visitEarlyAllocatorFrames(countFrame)
+}
+
+// allocFrameOnNode reserves and returns a physical memory frame attached to
+// the specified node. An error will be returned if the node has no free
+// frames.
+func (alloc *BitmapAllocator) allocFrameOnNode(node mm.NodeID) (mm.Frame, *kernel.Error) {
+	alloc.mutex.Acquire()
+
+	for poolIndex := 0; poolIndex < len(alloc.pools); poolIndex++ {
+		if alloc.pools[poolIndex].node != node {
+			continue
+		}
+
+		if frame, ok := alloc.allocFromPool(poolIndex); ok {
+			if alloc.debugMode {
+				alloc.debugAllocFrame(poolIndex, frame)
+			}
+
+			alloc.mutex.Release()
+			return frame, nil
+		}
+	}
+
+	alloc.mutex.Release()
+	return mm.InvalidFrame, errBitmapAllocOutOfMemory
+}
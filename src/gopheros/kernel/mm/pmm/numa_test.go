@@ -0,0 +1,138 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"testing"
+	"unsafe"
+)
+
+func TestBitmapAllocatorSetNodeMemRanges(t *testing.T) {
+	defer func() {
+		reserveRegionFn = vmm.EarlyReserveRegion
+		mapFn = vmm.Map
+		bootMemAllocator = BootMemAllocator{}
+		kfmt.SetOutputSink(nil)
+	}()
+
+	var (
+		poolMem      = make([]byte, 2*mm.PageSize)
+		poolMemAlign = (uintptr(unsafe.Pointer(&poolMem[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		alloc        = BitmapAllocator{
+			pools: []framePool{
+				{
+					startFrame: mm.Frame(0),
+					endFrame:   mm.Frame(63),
+					freeCount:  64,
+					freeBitmap: make([]uint64, 1),
+				},
+				{
+					startFrame: mm.Frame(256),
+					endFrame:   mm.Frame(511),
+					freeCount:  256,
+					freeBitmap: make([]uint64, 4),
+				},
+			},
+			totalPages: 320,
+		}
+		memRanges = []mm.NodeMemRange{
+			{Node: 0, StartFrame: 0, EndFrame: 383},
+			{Node: 1, StartFrame: 384, EndFrame: 449},
+			{Node: 2, StartFrame: 450, EndFrame: 511},
+		}
+	)
+
+	// The kernel image occupies the first 2 frames of node 1
+	bootMemAllocator = BootMemAllocator{kernelStartFrame: 384, kernelEndFrame: 385}
+	alloc.reserveKernelFrames()
+
+	reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return poolMemAlign, nil }
+	mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
+
+	if err := alloc.setNodeMemRanges(memRanges); err != nil {
+		t.Fatal(err)
+	}
+
+	// The split at frame 450 is rounded down to the nearest bitmap block
+	// boundary. Frame 0 is used for storing the new pool list.
+	exp := []struct {
+		node                 mm.NodeID
+		startFrame, endFrame mm.Frame
+		freeCount            uint32
+		reservedCount        uint32
+	}{
+		{0, 0, 63, 63, 0},
+		{0, 256, 383, 128, 0},
+		{1, 384, 447, 62, 2},
+		{2, 448, 511, 64, 0},
+	}
+
+	if len(alloc.pools) != len(exp) {
+		t.Fatalf("expected %d pools after splitting; got %d", len(exp), len(alloc.pools))
+	}
+
+	for poolIndex, spec := range exp {
+		pool := alloc.pools[poolIndex]
+		if pool.node != spec.node || pool.startFrame != spec.startFrame || pool.endFrame != spec.endFrame ||
+			pool.freeCount != spec.freeCount || pool.reservedCount != spec.reservedCount {
+			t.Errorf("[pool %d] expected node: %d, frames: %d-%d, free: %d, reserved: %d; got node: %d, frames: %d-%d, free: %d, reserved: %d",
+				poolIndex, spec.node, spec.startFrame, spec.endFrame, spec.freeCount, spec.reservedCount,
+				pool.node, pool.startFrame, pool.endFrame, pool.freeCount, pool.reservedCount,
+			)
+		}
+	}
+
+	t.Run("alloc on node", func(t *testing.T) {
+		frame, err := alloc.allocFrameOnNode(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := mm.Frame(386); frame != exp {
+			t.Fatalf("expected allocated frame to be %d; got %d", exp, frame)
+		}
+
+		// Allocations should be reflected in the original bitmap
+		if err = alloc.FreeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = alloc.allocFrameOnNode(3); err != errBitmapAllocOutOfMemory {
+			t.Fatalf("expected errBitmapAllocOutOfMemory; got %v", err)
+		}
+	})
+
+	t.Run("retag without splitting", func(t *testing.T) {
+		reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			t.Fatal("unexpected call to reserveRegionFn")
+			return 0, nil
+		}
+
+		if err := alloc.setNodeMemRanges([]mm.NodeMemRange{{Node: 5, StartFrame: 0, EndFrame: 511}}); err != nil {
+			t.Fatal(err)
+		}
+
+		for poolIndex, pool := range alloc.pools {
+			if pool.node != 5 {
+				t.Errorf("[pool %d] expected pool to be tagged with node 5; got %d", poolIndex, pool.node)
+			}
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+		if err := alloc.setNodeMemRanges([]mm.NodeMemRange{{Node: 1, StartFrame: 0, EndFrame: 319}}); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+
+		reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return poolMemAlign, nil }
+		mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
+		if err := alloc.setNodeMemRanges([]mm.NodeMemRange{{Node: 1, StartFrame: 0, EndFrame: 319}}); err != expErr {
+			t.Errorf("expected error %v; got %v", expErr, err)
+		}
+	})
+}
@@ -26,6 +26,9 @@ func Init(kernelStart, kernelEnd uintptr) *kernel.Error {
 		return err
 	}
 	mm.SetFrameAllocator(bitmapAllocFrame)
+	mm.SetFrameFreer(bitmapFreeFrame)
+	mm.SetPoolStatsFn(bitmapPoolStats)
+	mm.SetNodeFrameAllocator(bitmapSetNodeMemRanges, bitmapAllocFrameOnNode)
 
 	return nil
 }
@@ -37,3 +40,19 @@ func earlyAllocFrame() (mm.Frame, *kernel.Error) {
 func bitmapAllocFrame() (mm.Frame, *kernel.Error) {
 	return bitmapAllocator.AllocFrame()
 }
+
+func bitmapFreeFrame(frame mm.Frame) *kernel.Error {
+	return bitmapAllocator.FreeFrame(frame)
+}
+
+func bitmapPoolStats() []mm.PoolStats {
+	return bitmapAllocator.poolStats()
+}
+
+func bitmapSetNodeMemRanges(memRanges []mm.NodeMemRange) *kernel.Error {
+	return bitmapAllocator.setNodeMemRanges(memRanges)
+}
+
+func bitmapAllocFrameOnNode(node mm.NodeID) (mm.Frame, *kernel.Error) {
+	return bitmapAllocator.allocFrameOnNode(node)
+}
@@ -0,0 +1,225 @@
+package pmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
+	"unsafe"
+)
+
+var (
+	// The following functions are used by tests to mock calls to the
+	// multiboot and vmm packages and are automatically inlined by the
+	// compiler.
+	visitMemRegionsFn        = multiboot.VisitMemRegions
+	relocateInfoFn           = multiboot.RelocateInfo
+	visitBootPageTablesFn    = vmm.VisitBootPageTables
+	releaseKernelImagePageFn = vmm.ReleaseKernelImagePage
+)
+
+// frameRange describes an (inclusive) range of physical frames.
+type frameRange struct {
+	start, end mm.Frame
+}
+
+// ReclaimBootMemory hands memory that is only needed while the kernel boots
+// over to the frame allocator. This includes:
+//   - the ACPI-reclaimable memory regions.
+//   - the frames that hold the multiboot info data. The data is copied to the
+//     Go heap before its frames are released.
+//   - the frames used by the page tables that were set up by the rt0 code.
+//
+// As the ACPI tables are not copied by this function, ReclaimBootMemory must
+// be invoked after the hardware detection code has given the ACPI driver a
+// chance to copy any tables it needs.
+func ReclaimBootMemory() *kernel.Error {
+	return bitmapAllocator.reclaimBootMemory()
+}
+
+// reclaimBootMemory implements ReclaimBootMemory and logs the amount of memory
+// that was reclaimed.
+func (alloc *BitmapAllocator) reclaimBootMemory() *kernel.Error {
+	var (
+		acpiRanges                        []frameRange
+		acpiFrames, infoFrames, pdtFrames uint32
+		pageSizeMinus1                    = mm.PageSize - 1
+		err                               *kernel.Error
+	)
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAcpiReclaimable {
+			return true
+		}
+
+		// Only reclaim the frames that are fully contained in the region
+		regionStartFrame := mm.Frame(((uintptr(region.PhysAddress) + pageSizeMinus1) & ^pageSizeMinus1) >> mm.PageShift)
+		regionEndFrame := mm.Frame(uintptr(region.PhysAddress+region.Length) >> mm.PageShift)
+		if regionEndFrame > regionStartFrame {
+			acpiRanges = append(acpiRanges, frameRange{regionStartFrame, regionEndFrame - 1})
+			acpiFrames += uint32(regionEndFrame - regionStartFrame)
+		}
+		return true
+	})
+
+	if len(acpiRanges) != 0 {
+		if err = alloc.addPools(acpiRanges); err != nil {
+			return err
+		}
+	}
+
+	// The rt0 code copies the multiboot data into a page-aligned buffer
+	// inside the kernel image which is not shared with any other data.
+	infoAddr, infoSize := relocateInfoFn()
+	for page, lastPage := mm.PageFromAddress(infoAddr), mm.PageFromAddress(infoAddr+infoSize-1); infoSize != 0 && page <= lastPage; page++ {
+		physAddr, err := translateFn(page.Address())
+		if err != nil {
+			continue
+		}
+
+		if err = releaseKernelImagePageFn(page, mm.FrameFromAddress(physAddr)); err != nil {
+			return err
+		}
+
+		if alloc.releaseBootFrame(mm.FrameFromAddress(physAddr)) {
+			infoFrames++
+		}
+	}
+
+	if visitErr := visitBootPageTablesFn(func(page mm.Page, frame mm.Frame) {
+		if err != nil {
+			return
+		}
+
+		if err = releaseKernelImagePageFn(page, frame); err == nil && alloc.releaseBootFrame(frame) {
+			pdtFrames++
+		}
+	}); visitErr != nil {
+		return visitErr
+	} else if err != nil {
+		return err
+	}
+
+	kfmt.Printf("[bitmap_alloc] reclaimed %dKb of boot memory (ACPI: %dKb, multiboot info: %dKb, boot page tables: %dKb)\n",
+		uint64(acpiFrames+infoFrames+pdtFrames)<<(mm.PageShift-10),
+		uint64(acpiFrames)<<(mm.PageShift-10),
+		uint64(infoFrames)<<(mm.PageShift-10),
+		uint64(pdtFrames)<<(mm.PageShift-10),
+	)
+
+	return nil
+}
+
+// releaseBootFrame marks a frame that was reserved while bootstrapping the
+// allocator as free. It returns false if the frame is not managed by the
+// allocator or is not reserved.
+func (alloc *BitmapAllocator) releaseBootFrame(frame mm.Frame) bool {
+	alloc.mutex.Acquire()
+
+	poolIndex := alloc.poolForFrame(frame)
+	if poolIndex < 0 {
+		alloc.mutex.Release()
+		return false
+	}
+
+	relFrame := frame - alloc.pools[poolIndex].startFrame
+	if alloc.pools[poolIndex].freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) == 0 {
+		alloc.mutex.Release()
+		return false
+	}
+
+	alloc.markFrame(poolIndex, frame, markFree)
+	alloc.pools[poolIndex].reservedCount--
+
+	// The frame is no longer considered to be reserved by the debug
+	// mode checks.
+	if alloc.debugMode {
+		alloc.frameDebugInfo(poolIndex, frame).flags = 0
+	}
+
+	alloc.mutex.Release()
+	return true
+}
+
+// addPools adds a new pool to the allocator for each one of the supplied frame
+// ranges. All frames in the new pools are marked as free.
+func (alloc *BitmapAllocator) addPools(ranges []frameRange) *kernel.Error {
+	var (
+		sizeofPool     = unsafe.Sizeof(framePool{})
+		sizeofInfo     = unsafe.Sizeof(frameDebugInfo{})
+		pageSizeMinus1 = mm.PageSize - 1
+		newPoolCount   = len(alloc.pools) + len(ranges)
+		requiredBytes  = uintptr(newPoolCount) * sizeofPool
+	)
+
+	for _, r := range ranges {
+		frameCount := uintptr(r.end - r.start + 1)
+		requiredBytes += ((frameCount + 63) &^ 63) >> 3
+		if alloc.debugMode {
+			requiredBytes += frameCount * sizeofInfo
+		}
+	}
+	requiredBytes = (requiredBytes + pageSizeMinus1) & ^pageSizeMinus1
+
+	regionAddr, err := reserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, index := mm.PageFromAddress(regionAddr), uintptr(0); index < requiredBytes>>mm.PageShift; page, index = page+1, index+1 {
+		nextFrame, err := alloc.AllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, nextFrame, vmm.FlagPresent|vmm.FlagRW|vmm.FlagNoExecute); err != nil {
+			return err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	newPoolsHdr := alloc.poolsHdr
+	newPoolsHdr.Data, newPoolsHdr.Len, newPoolsHdr.Cap = regionAddr, newPoolCount, newPoolCount
+	newPools := *(*[]framePool)(unsafe.Pointer(&newPoolsHdr))
+
+	alloc.mutex.Acquire()
+
+	copy(newPools, alloc.pools)
+
+	dataAddr := regionAddr + uintptr(newPoolCount)*sizeofPool
+	for rangeIndex, r := range ranges {
+		var (
+			pool       = &newPools[len(alloc.pools)+rangeIndex]
+			frameCount = uintptr(r.end - r.start + 1)
+		)
+
+		pool.startFrame = r.start
+		pool.endFrame = r.end
+		pool.freeCount = uint32(frameCount)
+		pool.node = nodeForFrames(r.start, r.end, alloc.nodeMemRanges)
+
+		pool.freeBitmapHdr.Len = int(((frameCount + 63) &^ 63) >> 6)
+		pool.freeBitmapHdr.Cap = pool.freeBitmapHdr.Len
+		pool.freeBitmapHdr.Data = dataAddr
+		pool.freeBitmap = *(*[]uint64)(unsafe.Pointer(&pool.freeBitmapHdr))
+		dataAddr += uintptr(pool.freeBitmapHdr.Len) << 3
+
+		if alloc.debugMode {
+			pool.debugInfoHdr.Len = int(frameCount)
+			pool.debugInfoHdr.Cap = pool.debugInfoHdr.Len
+			pool.debugInfoHdr.Data = dataAddr
+			pool.debugInfo = *(*[]frameDebugInfo)(unsafe.Pointer(&pool.debugInfoHdr))
+			dataAddr += frameCount * sizeofInfo
+		}
+
+		alloc.totalPages += uint32(frameCount)
+	}
+
+	alloc.poolsHdr = newPoolsHdr
+	alloc.pools = newPools
+
+	alloc.mutex.Release()
+	return nil
+}
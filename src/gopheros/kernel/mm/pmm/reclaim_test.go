@@ -0,0 +1,178 @@
+package pmm
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/multiboot"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestBitmapAllocatorReclaimBootMemory(t *testing.T) {
+	defer func() {
+		reserveRegionFn = vmm.EarlyReserveRegion
+		mapFn = vmm.Map
+		releaseKernelImagePageFn = vmm.ReleaseKernelImagePage
+		translateFn = vmm.Translate
+		visitMemRegionsFn = multiboot.VisitMemRegions
+		relocateInfoFn = multiboot.RelocateInfo
+		visitBootPageTablesFn = vmm.VisitBootPageTables
+		kfmt.SetOutputSink(nil)
+	}()
+
+	// Emulate the region reserved for the new pools using a page-aligned
+	// buffer.
+	var (
+		regionMem  = make([]byte, 2*mm.PageSize)
+		regionAddr = (uintptr(unsafe.Pointer(&regionMem[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+	)
+
+	newAllocator := func() *BitmapAllocator {
+		alloc := &BitmapAllocator{
+			pools: []framePool{
+				{
+					startFrame: mm.Frame(0),
+					endFrame:   mm.Frame(63),
+					freeCount:  64,
+					freeBitmap: make([]uint64, 1),
+				},
+			},
+			totalPages: 64,
+		}
+
+		// Frames 10-12 hold the multiboot info and frames 20-21 hold
+		// the boot page tables.
+		for _, frame := range []mm.Frame{10, 11, 12, 20, 21} {
+			alloc.reserveBootFrame(0, frame)
+		}
+
+		return alloc
+	}
+
+	reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return regionAddr, nil }
+	mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return nil }
+	releaseKernelImagePageFn = func(_ mm.Page, _ mm.Frame) *kernel.Error { return nil }
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) { return virtAddr, nil }
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for _, region := range []multiboot.MemoryMapEntry{
+			{PhysAddress: 0, Length: 64 * uint64(mm.PageSize), Type: multiboot.MemAvailable},
+			// Only frames 0x101 to 0x103 are fully contained in the region
+			{PhysAddress: 0x100800, Length: 0x3900, Type: multiboot.MemAcpiReclaimable},
+		} {
+			if !visitor(&region) {
+				return
+			}
+		}
+	}
+	relocateInfoFn = func() (uintptr, uintptr) {
+		return mm.Frame(10).Address() + 8, 2*mm.PageSize + 16
+	}
+	visitBootPageTablesFn = func(visitor vmm.BootPageTableVisitor) *kernel.Error {
+		// Frame 30 is not reserved and should be ignored
+		for _, frame := range []mm.Frame{20, 21, 30} {
+			visitor(mm.Page(frame), frame)
+		}
+		return nil
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var buf bytes.Buffer
+		kfmt.SetOutputSink(&buf)
+
+		alloc := newAllocator()
+		if err := alloc.reclaimBootMemory(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(alloc.pools) != 2 {
+			t.Fatalf("expected a new pool to be added for the ACPI-reclaimable region; got %d pools", len(alloc.pools))
+		}
+
+		pool := alloc.pools[1]
+		if pool.startFrame != 0x101 || pool.endFrame != 0x103 || pool.freeCount != 3 {
+			t.Fatalf("expected new pool to contain 3 free frames [0x101, 0x103]; got [0x%x, 0x%x] (free: %d)", pool.startFrame, pool.endFrame, pool.freeCount)
+		}
+
+		if exp := uint32(67); alloc.totalPages != exp {
+			t.Fatalf("expected total pages to be %d; got %d", exp, alloc.totalPages)
+		}
+
+		// Frame 0 is allocated for the new pool data
+		if exp := uint32(1); alloc.reservedPages != exp {
+			t.Fatalf("expected reserved pages to be %d; got %d", exp, alloc.reservedPages)
+		}
+
+		if got := alloc.poolStats()[0]; got.ReservedFrames != 0 || got.UsedFrames != 1 {
+			t.Fatalf("expected reclaimed frames not to be reported as reserved; got %+v", got)
+		}
+
+		for _, frame := range []mm.Frame{10, 11, 12, 20, 21, 0x101, 0x103} {
+			poolIndex := alloc.poolForFrame(frame)
+			relFrame := frame - alloc.pools[poolIndex].startFrame
+			if alloc.pools[poolIndex].freeBitmap[relFrame>>6]&(1<<(63-(relFrame&63))) != 0 {
+				t.Errorf("expected frame 0x%x to be free", frame)
+			}
+		}
+
+		exp := "reclaimed 32Kb of boot memory (ACPI: 12Kb, multiboot info: 12Kb, boot page tables: 8Kb)"
+		if got := buf.String(); !strings.Contains(got, exp) {
+			t.Fatalf("expected output to contain %q; got %q", exp, got)
+		}
+	})
+
+	t.Run("debug mode", func(t *testing.T) {
+		kfmt.SetOutputSink(&bytes.Buffer{})
+
+		alloc := newAllocator()
+		alloc.debugMode = true
+		alloc.pools[0].debugInfo = make([]frameDebugInfo, 64)
+		alloc.pools[0].debugInfo[10].flags = frameBootReserved
+
+		if err := alloc.reclaimBootMemory(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := alloc.pools[0].debugInfo[10].flags; got != 0 {
+			t.Fatalf("expected debug flags for released frame to be cleared; got %d", got)
+		}
+
+		if got := len(alloc.pools[1].debugInfo); got != 3 {
+			t.Fatalf("expected new pool to track debug info for 3 frames; got %d", got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		kfmt.SetOutputSink(&bytes.Buffer{})
+		expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		specs := []func(){
+			func() {
+				reserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+			},
+			func() {
+				mapFn = func(_ mm.Page, _ mm.Frame, _ vmm.PageTableEntryFlag) *kernel.Error { return expErr }
+			},
+			func() {
+				releaseKernelImagePageFn = func(_ mm.Page, _ mm.Frame) *kernel.Error { return expErr }
+			},
+			func() {
+				visitBootPageTablesFn = func(_ vmm.BootPageTableVisitor) *kernel.Error { return expErr }
+			},
+		}
+
+		for specIndex, spec := range specs {
+			origReserve, origMap, origRelease, origVisit := reserveRegionFn, mapFn, releaseKernelImagePageFn, visitBootPageTablesFn
+			spec()
+
+			if err := newAllocator().reclaimBootMemory(); err != expErr {
+				t.Errorf("[spec %d] expected error: %v; got %v", specIndex, expErr, err)
+			}
+
+			reserveRegionFn, mapFn, releaseKernelImagePageFn, visitBootPageTablesFn = origReserve, origMap, origRelease, origVisit
+		}
+	})
+}
@@ -0,0 +1,407 @@
+// Package slab implements an object cache allocator that carves physical
+// frames obtained from the frame allocator into fixed-size objects. Unlike the
+// Go allocator, caches never allocate Go memory and only use spinlocks so they
+// can be used by interrupt handlers and by code running with interrupts
+// disabled.
+package slab
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"gopheros/kernel/sync"
+	"unsafe"
+)
+
+const (
+	// slabMagic is stored in the header of each slab and is used to detect
+	// attempts to free objects that were not allocated by a cache.
+	slabMagic = uint32(0x51ab51ab)
+
+	// poisonByte is used to fill released objects for caches created with
+	// FlagPoison.
+	poisonByte    = 0x6b
+	poisonPattern = uint64(0x6b6b6b6b6b6b6b6b)
+
+	// objectAlign is the alignment of the objects returned by a cache.
+	objectAlign = uintptr(8)
+
+	// maxCaches is the maximum number of caches that can be initialized.
+	maxCaches = 32
+
+	// maxEmptySlabs is the number of empty slabs that each cache retains
+	// before returning their frames to the frame allocator.
+	maxEmptySlabs = 1
+)
+
+// CacheFlag customizes the behavior of a Cache.
+type CacheFlag uint8
+
+const (
+	// FlagPoison fills released objects with a poison pattern that is
+	// verified when the objects get reallocated.
+	FlagPoison CacheFlag = 1 << iota
+
+	// FlagZero clears objects before they are returned by Alloc.
+	FlagZero
+)
+
+var (
+	errInvalidObjectSize = &kernel.Error{Module: "slab", Message: "object size must be non-zero and fit in a single slab"}
+	errTooManyCaches     = &kernel.Error{Module: "slab", Message: "maximum number of caches reached"}
+	errInvalidObject     = &kernel.Error{Module: "slab", Message: "object does not belong to the cache"}
+	errDoubleFree        = &kernel.Error{Module: "slab", Message: "object is already free"}
+	errPoisonCorrupted   = &kernel.Error{Module: "slab", Message: "free object modified after being released"}
+
+	// The following functions are used by tests to mock calls to the vmm
+	// and kfmt packages and are automatically inlined by the compiler.
+	physToVirtFn = vmm.PhysToVirt
+	virtToPhysFn = vmm.VirtToPhys
+	panicFn      = kfmt.Panic
+
+	// caches tracks all initialized caches so their stats can be reported.
+	caches     [maxCaches]*Cache
+	cacheCount int
+	cachesLock sync.Spinlock
+)
+
+// slabHeader is stored at the beginning of each slab. Slabs are linked
+// together using their virtual addresses.
+type slabHeader struct {
+	magic uint32
+
+	// inUse is the number of allocated objects in the slab.
+	inUse uint32
+
+	// cacheID is the address of the Cache that owns the slab.
+	cacheID uintptr
+
+	// prev and next link the slab to the other slabs in the same list.
+	prev, next uintptr
+
+	// freeList points to the first free object in the slab. The first
+	// word of each free object points to the next free object.
+	freeList uintptr
+
+	// allocBitmap tracks the allocated objects in the slab.
+	allocBitmap [8]uint64
+}
+
+// slabList is a doubly-linked list of slabs.
+type slabList struct {
+	head  uintptr
+	count uint32
+}
+
+// push adds the slab at slabAddr to the front of the list.
+func (l *slabList) push(slabAddr uintptr) {
+	slab := header(slabAddr)
+	slab.prev, slab.next = 0, l.head
+	if l.head != 0 {
+		header(l.head).prev = slabAddr
+	}
+	l.head = slabAddr
+	l.count++
+}
+
+// remove unlinks the slab at slabAddr from the list.
+func (l *slabList) remove(slabAddr uintptr) {
+	slab := header(slabAddr)
+	if slab.prev != 0 {
+		header(slab.prev).next = slab.next
+	} else {
+		l.head = slab.next
+	}
+	if slab.next != 0 {
+		header(slab.next).prev = slab.prev
+	}
+	slab.prev, slab.next = 0, 0
+	l.count--
+}
+
+// header returns the slab header stored at slabAddr.
+func header(slabAddr uintptr) *slabHeader {
+	return (*slabHeader)(unsafe.Pointer(slabAddr))
+}
+
+// CacheStats contains the usage statistics for a Cache.
+type CacheStats struct {
+	Name string
+
+	// ObjectSize is the size of each object including any padding.
+	ObjectSize uintptr
+
+	// Slabs is the number of frames used by the cache.
+	Slabs uint32
+
+	// ActiveObjects is the number of allocated objects and TotalObjects
+	// is the number of objects that fit in the slabs of the cache.
+	ActiveObjects uint32
+	TotalObjects  uint32
+
+	// Allocs and Frees count the calls to Alloc and Free that succeeded.
+	Allocs uint64
+	Frees  uint64
+}
+
+// Cache allocates objects of a fixed size. Each slab of the cache is backed
+// by a single physical frame which is accessed via the direct physical memory
+// map.
+//
+// A Cache can be used with interrupts disabled. Code that shares a cache with
+// interrupt handlers must disable interrupts while calling Alloc or Free to
+// avoid deadlocks.
+type Cache struct {
+	lock sync.Spinlock
+
+	name         string
+	flags        CacheFlag
+	objSize      uintptr
+	objOffset    uintptr
+	objsPerSlab  uint32
+	activeObjs   uint32
+	allocs       uint64
+	frees        uint64
+	partialSlabs slabList
+	fullSlabs    slabList
+	emptySlabs   slabList
+}
+
+// Init prepares the cache for allocating objects of the requested size and
+// registers it so that its stats are included in the output of PrintStats.
+// Caches must be initialized after the vmm has established the direct
+// physical memory map.
+func (c *Cache) Init(name string, objSize uintptr, flags CacheFlag) *kernel.Error {
+	objOffset := (unsafe.Sizeof(slabHeader{}) + objectAlign - 1) & ^(objectAlign - 1)
+	objSize = (objSize + objectAlign - 1) & ^(objectAlign - 1)
+	if objSize == 0 || objSize > mm.PageSize-objOffset {
+		return errInvalidObjectSize
+	}
+
+	cachesLock.Acquire()
+	if !registered(c) {
+		if cacheCount == maxCaches {
+			cachesLock.Release()
+			return errTooManyCaches
+		}
+		caches[cacheCount] = c
+		cacheCount++
+	}
+	cachesLock.Release()
+
+	*c = Cache{
+		name:        name,
+		flags:       flags,
+		objSize:     objSize,
+		objOffset:   objOffset,
+		objsPerSlab: uint32((mm.PageSize - objOffset) / objSize),
+	}
+
+	return nil
+}
+
+// registered returns true if c is included in the list of initialized caches.
+// It must be invoked while holding cachesLock.
+func registered(c *Cache) bool {
+	for index := 0; index < cacheCount; index++ {
+		if caches[index] == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Alloc returns the address of a free object. New slabs are allocated from
+// the physical frame allocator when all existing slabs are full.
+func (c *Cache) Alloc() (uintptr, *kernel.Error) {
+	c.lock.Acquire()
+
+	slabAddr := c.partialSlabs.head
+	if slabAddr == 0 {
+		if slabAddr = c.emptySlabs.head; slabAddr != 0 {
+			c.emptySlabs.remove(slabAddr)
+		} else {
+			var err *kernel.Error
+			if slabAddr, err = c.grow(); err != nil {
+				c.lock.Release()
+				return 0, err
+			}
+		}
+		c.partialSlabs.push(slabAddr)
+	}
+
+	slab := header(slabAddr)
+	obj := slab.freeList
+	slab.freeList = *(*uintptr)(unsafe.Pointer(obj))
+
+	index := (obj - slabAddr - c.objOffset) / c.objSize
+	slab.allocBitmap[index>>6] |= 1 << (index & 63)
+
+	slab.inUse++
+	if slab.inUse == c.objsPerSlab {
+		c.partialSlabs.remove(slabAddr)
+		c.fullSlabs.push(slabAddr)
+	}
+
+	c.activeObjs++
+	c.allocs++
+	c.lock.Release()
+
+	if c.flags&FlagPoison != 0 {
+		if offset := poisonMismatchOffset(obj+objectAlign, c.objSize-objectAlign); offset != c.objSize-objectAlign {
+			kfmt.Printf("[slab] %s: poison mismatch at offset 0x%x of object 0x%16x\n", c.name, offset+objectAlign, obj)
+			panicFn(errPoisonCorrupted)
+		}
+	}
+
+	if c.flags&FlagZero != 0 {
+		kernel.Memset(obj, 0, c.objSize)
+	}
+
+	return obj, nil
+}
+
+// Free returns an object allocated via a call to Alloc to the cache. Empty
+// slabs are returned to the physical frame allocator once the cache retains
+// more than maxEmptySlabs empty slabs.
+func (c *Cache) Free(obj uintptr) *kernel.Error {
+	slabAddr := obj & ^(mm.PageSize - 1)
+	slab := header(slabAddr)
+
+	if obj == 0 || slab.magic != slabMagic || slab.cacheID != uintptr(unsafe.Pointer(c)) ||
+		obj < slabAddr+c.objOffset || (obj-slabAddr-c.objOffset)%c.objSize != 0 {
+		return errInvalidObject
+	}
+
+	index := (obj - slabAddr - c.objOffset) / c.objSize
+	if index >= uintptr(c.objsPerSlab) {
+		return errInvalidObject
+	}
+
+	c.lock.Acquire()
+
+	if slab.allocBitmap[index>>6]&(1<<(index&63)) == 0 {
+		c.lock.Release()
+		return errDoubleFree
+	}
+	slab.allocBitmap[index>>6] &^= 1 << (index & 63)
+
+	if c.flags&FlagPoison != 0 {
+		kernel.Memset(obj, poisonByte, c.objSize)
+	}
+	*(*uintptr)(unsafe.Pointer(obj)) = slab.freeList
+	slab.freeList = obj
+
+	if slab.inUse == c.objsPerSlab {
+		c.fullSlabs.remove(slabAddr)
+		c.partialSlabs.push(slabAddr)
+	}
+
+	slab.inUse--
+	if slab.inUse == 0 {
+		c.partialSlabs.remove(slabAddr)
+		c.emptySlabs.push(slabAddr)
+	}
+
+	c.activeObjs--
+	c.frees++
+
+	var err *kernel.Error
+	if c.emptySlabs.count > maxEmptySlabs {
+		err = c.release(c.emptySlabs.head)
+	}
+
+	c.lock.Release()
+	return err
+}
+
+// Stats returns the usage statistics for this cache.
+func (c *Cache) Stats() CacheStats {
+	c.lock.Acquire()
+	slabs := c.partialSlabs.count + c.fullSlabs.count + c.emptySlabs.count
+	stats := CacheStats{
+		Name:          c.name,
+		ObjectSize:    c.objSize,
+		Slabs:         slabs,
+		ActiveObjects: c.activeObjs,
+		TotalObjects:  slabs * c.objsPerSlab,
+		Allocs:        c.allocs,
+		Frees:         c.frees,
+	}
+	c.lock.Release()
+
+	return stats
+}
+
+// grow allocates a frame for a new slab and links all its objects into the
+// slab free list. It must be invoked while holding the cache lock.
+func (c *Cache) grow() (uintptr, *kernel.Error) {
+	frame, err := mm.AllocFrame()
+	if err != nil {
+		return 0, err
+	}
+
+	slabAddr := physToVirtFn(frame.Address())
+	slab := header(slabAddr)
+	*slab = slabHeader{
+		magic:   slabMagic,
+		cacheID: uintptr(unsafe.Pointer(c)),
+	}
+
+	for index := int(c.objsPerSlab) - 1; index >= 0; index-- {
+		obj := slabAddr + c.objOffset + uintptr(index)*c.objSize
+		if c.flags&FlagPoison != 0 {
+			kernel.Memset(obj, poisonByte, c.objSize)
+		}
+		*(*uintptr)(unsafe.Pointer(obj)) = slab.freeList
+		slab.freeList = obj
+	}
+
+	return slabAddr, nil
+}
+
+// release unlinks an empty slab and returns its frame to the physical frame
+// allocator. It must be invoked while holding the cache lock.
+func (c *Cache) release(slabAddr uintptr) *kernel.Error {
+	c.emptySlabs.remove(slabAddr)
+	header(slabAddr).magic = 0
+
+	physAddr, err := virtToPhysFn(slabAddr)
+	if err != nil {
+		return err
+	}
+
+	return mm.FreeFrame(mm.FrameFromAddress(physAddr))
+}
+
+// poisonMismatchOffset returns the offset of the first 64-bit word in the
+// region [addr, addr+size) that does not match the poison pattern or size if
+// the pattern is intact.
+func poisonMismatchOffset(addr, size uintptr) uintptr {
+	for offset := uintptr(0); offset < size; offset += 8 {
+		if *(*uint64)(unsafe.Pointer(addr + offset)) != poisonPattern {
+			return offset
+		}
+	}
+
+	return size
+}
+
+// PrintStats outputs the usage statistics for all initialized caches.
+func PrintStats() {
+	cachesLock.Acquire()
+	count := cacheCount
+	cachesLock.Release()
+
+	kfmt.Printf("[slab] cache stats\n")
+	for index := 0; index < count; index++ {
+		stats := caches[index].Stats()
+		kfmt.Printf(
+			"[slab] %s: object size: %d, slabs: %d, objects: %d/%d, allocs: %d, frees: %d\n",
+			stats.Name, uint64(stats.ObjectSize), stats.Slabs,
+			stats.ActiveObjects, stats.TotalObjects, stats.Allocs, stats.Frees,
+		)
+	}
+}
@@ -0,0 +1,425 @@
+package slab
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/mm/vmm"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// setupFrames mocks the frame allocator so that it hands out up to
+// frameCount page-aligned frames backed by a Go buffer. It returns a pointer
+// to the list of frames released via mm.FreeFrame.
+func setupFrames(frameCount int) *[]mm.Frame {
+	var (
+		buf      = make([]byte, (frameCount+1)*int(mm.PageSize))
+		nextAddr = (uintptr(unsafe.Pointer(&buf[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		endAddr  = nextAddr + uintptr(frameCount)*mm.PageSize
+		freed    []mm.Frame
+	)
+
+	physToVirtFn = func(addr uintptr) uintptr { return addr }
+	virtToPhysFn = func(addr uintptr) (uintptr, *kernel.Error) { return addr, nil }
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		// Referencing buf keeps it alive while the allocator is in use
+		if nextAddr == endAddr || len(buf) == 0 {
+			return mm.InvalidFrame, &kernel.Error{Module: "test", Message: "out of memory"}
+		}
+
+		frame := mm.FrameFromAddress(nextAddr)
+		nextAddr += mm.PageSize
+		return frame, nil
+	})
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freed = append(freed, frame)
+		return nil
+	})
+
+	return &freed
+}
+
+func resetGlobals() {
+	physToVirtFn = vmm.PhysToVirt
+	virtToPhysFn = vmm.VirtToPhys
+	panicFn = kfmt.Panic
+	mm.SetFrameAllocator(nil)
+	mm.SetFrameFreer(nil)
+	caches = [maxCaches]*Cache{}
+	cacheCount = 0
+	kfmt.SetOutputSink(nil)
+}
+
+func TestCacheInit(t *testing.T) {
+	defer resetGlobals()
+
+	specs := []struct {
+		objSize    uintptr
+		expErr     *kernel.Error
+		expObjSize uintptr
+	}{
+		{0, errInvalidObjectSize, 0},
+		{mm.PageSize, errInvalidObjectSize, 0},
+		{1, nil, 8},
+		{13, nil, 16},
+		{512, nil, 512},
+	}
+
+	for specIndex, spec := range specs {
+		var c Cache
+		if err := c.Init("test", spec.objSize, 0); err != spec.expErr {
+			t.Errorf("[spec %d] expected error: %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr != nil {
+			continue
+		}
+
+		if c.objSize != spec.expObjSize {
+			t.Errorf("[spec %d] expected object size to be %d; got %d", specIndex, spec.expObjSize, c.objSize)
+		}
+
+		if exp := uint32((mm.PageSize - c.objOffset) / c.objSize); c.objsPerSlab != exp {
+			t.Errorf("[spec %d] expected %d objects per slab; got %d", specIndex, exp, c.objsPerSlab)
+		}
+	}
+
+	if cacheCount != 3 {
+		t.Fatalf("expected 3 caches to be registered; got %d", cacheCount)
+	}
+
+	t.Run("re-init", func(t *testing.T) {
+		if err := caches[0].Init("renamed", 64, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if cacheCount != 3 {
+			t.Fatalf("expected re-initialized cache not to be registered twice; got %d caches", cacheCount)
+		}
+	})
+
+	t.Run("cache limit", func(t *testing.T) {
+		var extra [maxCaches]Cache
+		for index := cacheCount; index < maxCaches; index++ {
+			if err := extra[index].Init("test", 8, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var c Cache
+		if err := c.Init("test", 8, 0); err != errTooManyCaches {
+			t.Fatalf("expected error: %v; got %v", errTooManyCaches, err)
+		}
+	})
+}
+
+func TestCacheAllocFree(t *testing.T) {
+	defer resetGlobals()
+	freed := setupFrames(3)
+
+	var c Cache
+	if err := c.Init("test", 1024, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slab header occupies the start of each slab so only 3 objects
+	// fit in each frame.
+	if c.objsPerSlab != 3 {
+		t.Fatalf("expected 3 objects per slab; got %d", c.objsPerSlab)
+	}
+
+	var objs []uintptr
+	for index := 0; index < 9; index++ {
+		obj, err := c.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, other := range objs {
+			if other == obj {
+				t.Fatalf("object 0x%x allocated twice", obj)
+			}
+		}
+
+		if obj&(objectAlign-1) != 0 {
+			t.Fatalf("expected object 0x%x to be aligned", obj)
+		}
+
+		objs = append(objs, obj)
+	}
+
+	if _, err := c.Alloc(); err == nil {
+		t.Fatal("expected Alloc to fail when no frames are available")
+	}
+
+	stats := c.Stats()
+	if stats.Slabs != 3 || stats.ActiveObjects != 9 || stats.TotalObjects != 9 || stats.Allocs != 9 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if c.fullSlabs.count != 3 || c.partialSlabs.count != 0 {
+		t.Fatalf("expected all slabs to be full; full: %d, partial: %d", c.fullSlabs.count, c.partialSlabs.count)
+	}
+
+	t.Run("invalid objects", func(t *testing.T) {
+		var other Cache
+		if err := other.Init("other", 1024, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		invalid := []uintptr{
+			0,
+			objs[0] + 1,
+			objs[0] & ^(mm.PageSize - 1),
+		}
+
+		for _, obj := range invalid {
+			if err := c.Free(obj); err != errInvalidObject {
+				t.Errorf("expected Free(0x%x) to return %v; got %v", obj, errInvalidObject, err)
+			}
+		}
+
+		if err := other.Free(objs[0]); err != errInvalidObject {
+			t.Errorf("expected Free from another cache to return %v; got %v", errInvalidObject, err)
+		}
+
+		notASlab := make([]byte, 2*mm.PageSize)
+		obj := (uintptr(unsafe.Pointer(&notASlab[0]))+mm.PageSize-1) & ^(mm.PageSize-1) + c.objOffset
+		if err := c.Free(obj); err != errInvalidObject {
+			t.Errorf("expected Free for object outside a slab to return %v; got %v", errInvalidObject, err)
+		}
+	})
+
+	// Free all objects in the first slab plus one object from the second slab
+	for _, obj := range objs[:4] {
+		if err := c.Free(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Free(objs[0]); err != errDoubleFree {
+		t.Fatalf("expected error: %v; got %v", errDoubleFree, err)
+	}
+
+	if c.emptySlabs.count != 1 || c.partialSlabs.count != 1 || c.fullSlabs.count != 1 {
+		t.Fatalf("unexpected slab list lengths; empty: %d, partial: %d, full: %d", c.emptySlabs.count, c.partialSlabs.count, c.fullSlabs.count)
+	}
+
+	if len(*freed) != 0 {
+		t.Fatalf("expected empty slab to be retained; freed frames: %v", *freed)
+	}
+
+	// Partial slabs are preferred over empty slabs
+	obj, err := c.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj != objs[3] {
+		t.Fatalf("expected Alloc to reuse object 0x%x; got 0x%x", objs[3], obj)
+	}
+
+	// Emptying the remaining slabs releases all but one of them
+	for _, obj := range append(objs[3:4], objs[4:]...) {
+		if err := c.Free(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.emptySlabs.count != maxEmptySlabs || len(*freed) != 2 {
+		t.Fatalf("expected %d empty slab to be retained and 2 frames to be freed; got %d empty slabs and freed frames %v", maxEmptySlabs, c.emptySlabs.count, *freed)
+	}
+
+	stats = c.Stats()
+	if stats.Slabs != 1 || stats.ActiveObjects != 0 || stats.TotalObjects != 3 || stats.Allocs != 10 || stats.Frees != 10 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	t.Run("release error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "translation failed"}
+		setupFrames(1)
+		virtToPhysFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+
+		objs = objs[:0]
+		for index := 0; index < 6; index++ {
+			obj, err := c.Alloc()
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs = append(objs, obj)
+		}
+
+		for index, obj := range objs {
+			err := c.Free(obj)
+			if index == len(objs)-1 {
+				if err != expErr {
+					t.Fatalf("expected error: %v; got %v", expErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCachePoisonAndZero(t *testing.T) {
+	defer resetGlobals()
+	setupFrames(2)
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	t.Run("poison", func(t *testing.T) {
+		var c Cache
+		if err := c.Init("poisoned", 64, FlagPoison); err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := c.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		objData := (*[64]byte)(unsafe.Pointer(obj))
+		for i := 0; i < len(objData); i++ {
+			objData[i] = 0xaa
+		}
+
+		if err = c.Free(obj); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := int(objectAlign); i < len(objData); i++ {
+			if objData[i] != poisonByte {
+				t.Fatalf("expected byte %d of released object to be poisoned; got 0x%x", i, objData[i])
+			}
+		}
+
+		// Scribble over the released object
+		objData[40] = 0
+		var panicErr interface{}
+		panicFn = func(e interface{}) { panicErr = e }
+
+		if got, _ := c.Alloc(); got != obj {
+			t.Fatalf("expected Alloc to return object 0x%x; got 0x%x", obj, got)
+		}
+
+		if panicErr != errPoisonCorrupted {
+			t.Fatalf("expected panic with error %v; got %v", errPoisonCorrupted, panicErr)
+		}
+
+		if exp := "poison mismatch at offset 0x28"; !strings.Contains(buf.String(), exp) {
+			t.Fatalf("expected output to contain %q; got %q", exp, buf.String())
+		}
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		var c Cache
+		if err := c.Init("zeroed", 64, FlagPoison|FlagZero); err != nil {
+			t.Fatal(err)
+		}
+
+		obj, err := c.Alloc()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		objData := (*[64]byte)(unsafe.Pointer(obj))
+		for i := 0; i < len(objData); i++ {
+			if objData[i] != 0 {
+				t.Fatalf("expected byte %d of allocated object to be cleared; got 0x%x", i, objData[i])
+			}
+		}
+	})
+}
+
+func TestTypedCaches(t *testing.T) {
+	defer resetGlobals()
+	setupFrames(2)
+
+	var asCache AddressSpaceCache
+	if err := asCache.Init("address spaces", FlagZero); err != nil {
+		t.Fatal(err)
+	}
+
+	as, err := asCache.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := uintptr(unsafe.Sizeof(vmm.AddressSpace{})+objectAlign-1) & ^(objectAlign - 1); asCache.Stats().ObjectSize != exp {
+		t.Fatalf("expected object size to be %d; got %d", exp, asCache.Stats().ObjectSize)
+	}
+
+	if err = asCache.Free(as); err != nil {
+		t.Fatal(err)
+	}
+
+	var regsCache RegistersCache
+	if err = regsCache.Init("registers", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := regsCache.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs.RAX = 0xbadf00d
+
+	if stats := regsCache.Stats(); stats.ActiveObjects != 1 || stats.ObjectSize != unsafe.Sizeof(gate.Registers{}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if err = regsCache.Free(regs); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("alloc errors", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr })
+
+		var (
+			asCache   AddressSpaceCache
+			regsCache RegistersCache
+		)
+
+		_ = asCache.Init("address spaces", 0)
+		if got, err := asCache.Alloc(); got != nil || err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+
+		_ = regsCache.Init("registers", 0)
+		if got, err := regsCache.Alloc(); got != nil || err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestPrintStats(t *testing.T) {
+	defer resetGlobals()
+	setupFrames(1)
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+
+	var c Cache
+	if err := c.Init("test", 100, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Alloc(); err != nil {
+		t.Fatal(err)
+	}
+
+	PrintStats()
+
+	exp := "[slab] cache stats\n[slab] test: object size: 104, slabs: 1, objects: 1/38, allocs: 1, frees: 0\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected output:\n%q\ngot:\n%q", exp, got)
+	}
+}
@@ -0,0 +1,70 @@
+package slab
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/mm/vmm"
+	"unsafe"
+)
+
+// AddressSpaceCache allocates vmm.AddressSpace objects. Callers must invoke
+// Init on the allocated address spaces before using them.
+type AddressSpaceCache struct {
+	cache Cache
+}
+
+// Init prepares the cache for allocating address spaces.
+func (c *AddressSpaceCache) Init(name string, flags CacheFlag) *kernel.Error {
+	return c.cache.Init(name, unsafe.Sizeof(vmm.AddressSpace{}), flags)
+}
+
+// Alloc returns a new address space from the cache.
+func (c *AddressSpaceCache) Alloc() (*vmm.AddressSpace, *kernel.Error) {
+	obj, err := c.cache.Alloc()
+	if err != nil {
+		return nil, err
+	}
+
+	return (*vmm.AddressSpace)(unsafe.Pointer(obj)), nil
+}
+
+// Free returns an address space to the cache.
+func (c *AddressSpaceCache) Free(as *vmm.AddressSpace) *kernel.Error {
+	return c.cache.Free(uintptr(unsafe.Pointer(as)))
+}
+
+// Stats returns the usage statistics for the cache.
+func (c *AddressSpaceCache) Stats() CacheStats {
+	return c.cache.Stats()
+}
+
+// RegistersCache allocates gate.Registers objects which can be used for
+// saving the register state of interrupted tasks.
+type RegistersCache struct {
+	cache Cache
+}
+
+// Init prepares the cache for allocating register snapshots.
+func (c *RegistersCache) Init(name string, flags CacheFlag) *kernel.Error {
+	return c.cache.Init(name, unsafe.Sizeof(gate.Registers{}), flags)
+}
+
+// Alloc returns a new register snapshot from the cache.
+func (c *RegistersCache) Alloc() (*gate.Registers, *kernel.Error) {
+	obj, err := c.cache.Alloc()
+	if err != nil {
+		return nil, err
+	}
+
+	return (*gate.Registers)(unsafe.Pointer(obj)), nil
+}
+
+// Free returns a register snapshot to the cache.
+func (c *RegistersCache) Free(regs *gate.Registers) *kernel.Error {
+	return c.cache.Free(uintptr(unsafe.Pointer(regs)))
+}
+
+// Stats returns the usage statistics for the cache.
+func (c *RegistersCache) Stats() CacheStats {
+	return c.cache.Stats()
+}
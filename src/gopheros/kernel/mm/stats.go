@@ -0,0 +1,139 @@
+package mm
+
+import (
+	"gopheros/kernel/kfmt"
+	"sync/atomic"
+)
+
+// PoolStats describes the frame usage for a physical memory pool managed by
+// the physical frame allocator.
+type PoolStats struct {
+	// StartFrame and EndFrame describe the (inclusive) frame range
+	// spanned by the pool.
+	StartFrame Frame
+	EndFrame   Frame
+
+	// FreeFrames is the number of frames that can be allocated.
+	FreeFrames uint32
+
+	// ReservedFrames is the number of frames that were reserved while
+	// booting the kernel (e.g. kernel image and early allocator frames).
+	ReservedFrames uint32
+
+	// UsedFrames is the number of frames allocated after the kernel booted.
+	UsedFrames uint32
+}
+
+// MemStats contains a snapshot of the physical and virtual memory usage.
+type MemStats struct {
+	// Pools contains the frame usage for each physical memory pool.
+	Pools []PoolStats
+
+	// PageTableFrames is the number of frames used by page tables.
+	PageTableFrames uint64
+
+	// KernelVirtualBytes is the amount of kernel virtual address space
+	// that has been reserved.
+	KernelVirtualBytes uint64
+
+	// GoHeapBytes is the amount of memory mapped for use by the Go
+	// allocator.
+	GoHeapBytes uint64
+
+	// CoWFaults is the number of copy-on-write page faults that have been
+	// resolved.
+	CoWFaults uint64
+
+	// DemandFaults is the number of page faults that have been resolved by
+	// populating a page via a pager.
+	DemandFaults uint64
+}
+
+// PoolStatsFn is a function that reports the usage of the physical memory
+// pools managed by a frame allocator.
+type PoolStatsFn func() []PoolStats
+
+var (
+	// poolStatsFn points to a pool stats function registered using
+	// SetPoolStatsFn.
+	poolStatsFn PoolStatsFn
+
+	// The following counters are updated by the various memory management
+	// sub-systems via the Track* helpers.
+	pageTableFrames    uint64
+	kernelVirtualBytes uint64
+	goHeapBytes        uint64
+	cowFaults          uint64
+	demandFaults       uint64
+)
+
+// SetPoolStatsFn registers a function that will be used by Stats to query the
+// usage of the physical memory pools.
+func SetPoolStatsFn(statsFn PoolStatsFn) { poolStatsFn = statsFn }
+
+// TrackPageTableFrames adjusts the number of frames used by page tables by
+// delta.
+func TrackPageTableFrames(delta int) { atomic.AddUint64(&pageTableFrames, uint64(delta)) }
+
+// TrackKernelVirtualBytes records the reservation of size bytes of kernel
+// virtual address space.
+func TrackKernelVirtualBytes(size uintptr) { atomic.AddUint64(&kernelVirtualBytes, uint64(size)) }
+
+// UntrackKernelVirtualBytes records the release of size bytes of kernel
+// virtual address space.
+func UntrackKernelVirtualBytes(size uintptr) { atomic.AddUint64(&kernelVirtualBytes, -uint64(size)) }
+
+// TrackGoHeapBytes records that size bytes were mapped for use by the Go
+// allocator.
+func TrackGoHeapBytes(size uintptr) { atomic.AddUint64(&goHeapBytes, uint64(size)) }
+
+// TrackCoWFault records the resolution of a copy-on-write page fault.
+func TrackCoWFault() { atomic.AddUint64(&cowFaults, 1) }
+
+// TrackDemandFault records the resolution of a page fault by a pager.
+func TrackDemandFault() { atomic.AddUint64(&demandFaults, 1) }
+
+// Stats returns a snapshot of the current memory usage.
+func Stats() MemStats {
+	stats := MemStats{
+		PageTableFrames:    atomic.LoadUint64(&pageTableFrames),
+		KernelVirtualBytes: atomic.LoadUint64(&kernelVirtualBytes),
+		GoHeapBytes:        atomic.LoadUint64(&goHeapBytes),
+		CoWFaults:          atomic.LoadUint64(&cowFaults),
+		DemandFaults:       atomic.LoadUint64(&demandFaults),
+	}
+
+	if poolStatsFn != nil {
+		stats.Pools = poolStatsFn()
+	}
+
+	return stats
+}
+
+// PrintStats outputs a report of the current memory usage.
+func PrintStats() {
+	var (
+		stats                = Stats()
+		free, reserved, used uint64
+	)
+
+	kfmt.Printf("[mm] memory stats\n")
+	for poolIndex, pool := range stats.Pools {
+		kfmt.Printf(
+			"[mm] pool %d (frames 0x%x - 0x%x): free: %d, reserved: %d, used: %d\n",
+			poolIndex, uint64(pool.StartFrame), uint64(pool.EndFrame),
+			pool.FreeFrames, pool.ReservedFrames, pool.UsedFrames,
+		)
+
+		free += uint64(pool.FreeFrames)
+		reserved += uint64(pool.ReservedFrames)
+		used += uint64(pool.UsedFrames)
+	}
+
+	kfmt.Printf("[mm] frames: free: %d, reserved: %d, used: %d\n", free, reserved, used)
+	kfmt.Printf("[mm] page table frames: %d\n", stats.PageTableFrames)
+	kfmt.Printf("[mm] kernel virtual address space: %d KB\n", stats.KernelVirtualBytes>>10)
+	kfmt.Printf("[mm] go heap: %d KB\n", stats.GoHeapBytes>>10)
+	kfmt.Printf("[mm] copy-on-write faults resolved: %d\n", stats.CoWFaults)
+	kfmt.Printf("[mm] demand-paging faults resolved: %d\n", stats.DemandFaults)
+}
@@ -0,0 +1,67 @@
+package mm
+
+import (
+	"bytes"
+	"gopheros/kernel/kfmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	defer func() {
+		poolStatsFn = nil
+		pageTableFrames, kernelVirtualBytes, goHeapBytes, cowFaults, demandFaults = 0, 0, 0, 0, 0
+		kfmt.SetOutputSink(nil)
+	}()
+
+	pools := []PoolStats{
+		{StartFrame: 0, EndFrame: 7, FreeFrames: 3, ReservedFrames: 2, UsedFrames: 3},
+		{StartFrame: 64, EndFrame: 191, FreeFrames: 100, ReservedFrames: 8, UsedFrames: 20},
+	}
+
+	if got := Stats(); got.Pools != nil {
+		t.Fatalf("expected no pool stats without a registered PoolStatsFn; got %v", got.Pools)
+	}
+
+	SetPoolStatsFn(func() []PoolStats { return pools })
+	TrackPageTableFrames(3)
+	TrackPageTableFrames(-1)
+	TrackKernelVirtualBytes(3 * PageSize)
+	UntrackKernelVirtualBytes(PageSize)
+	TrackGoHeapBytes(4 * PageSize)
+	TrackCoWFault()
+	TrackDemandFault()
+	TrackDemandFault()
+
+	exp := MemStats{
+		Pools:              pools,
+		PageTableFrames:    2,
+		KernelVirtualBytes: uint64(2 * PageSize),
+		GoHeapBytes:        uint64(4 * PageSize),
+		CoWFaults:          1,
+		DemandFaults:       2,
+	}
+
+	if got := Stats(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected stats to be:\n%+v\ngot:\n%+v", exp, got)
+	}
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	PrintStats()
+
+	for _, expLine := range []string{
+		"[mm] pool 1 (frames 0x40 - 0xbf): free: 100, reserved: 8, used: 20",
+		"[mm] frames: free: 103, reserved: 10, used: 23",
+		"[mm] page table frames: 2",
+		"[mm] kernel virtual address space: 8 KB",
+		"[mm] go heap: 16 KB",
+		"[mm] copy-on-write faults resolved: 1",
+		"[mm] demand-paging faults resolved: 2",
+	} {
+		if got := buf.String(); !strings.Contains(got, expLine) {
+			t.Errorf("expected output to contain %q; got:\n%s", expLine, got)
+		}
+	}
+}
@@ -3,18 +3,42 @@ package vmm
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/mm"
+	"sync/atomic"
+	"unsafe"
 )
 
 var (
+	// earlyReserveStart is the address where EarlyReserveRegion starts
+	// allocating regions from. It defaults to tempMappingAddr which
+	// coincides with the end of the kernel address space and is lowered
+	// by a random slide when RandomizeLayout is invoked.
+	earlyReserveStart = tempMappingAddr
+
 	// earlyReserveLastUsed tracks the last reserved page address and is
 	// decreased after each allocation request. Initially, it points to
-	// tempMappingAddr which coincides with the end of the kernel address
-	// space.
+	// earlyReserveStart.
 	earlyReserveLastUsed = tempMappingAddr
 
-	errEarlyReserveNoSpace = &kernel.Error{Module: "early_reserve", Message: "remaining virtual address space not large enough to satisfy reservation request"}
+	// releasedRegions contains the regions that were returned via
+	// releaseRegion. They are reused by subsequent reservation requests
+	// before any new address space is carved out.
+	releasedRegions     [maxReleasedRegions]releasedRegion
+	releasedRegionCount int
+
+	errEarlyReserveNoSpace    = &kernel.Error{Module: "early_reserve", Message: "remaining virtual address space not large enough to satisfy reservation request"}
+	errTooManyReleasedRegions = &kernel.Error{Module: "early_reserve", Message: "too many released virtual memory regions"}
 )
 
+// maxReleasedRegions is the maximum number of non-adjacent released regions
+// that can be tracked.
+const maxReleasedRegions = 32
+
+// releasedRegion describes a page-aligned region of the kernel address space
+// that can be reused.
+type releasedRegion struct {
+	start, size uintptr
+}
+
 // EarlyReserveRegion reserves a page-aligned contiguous virtual memory region
 // with the requested size in the kernel address space and returns its virtual
 // address. If size is not a multiple of mm.PageSize it will be automatically
@@ -23,8 +47,34 @@ var (
 // This function allocates regions starting at the end of the kernel address
 // space. It should only be used during the early stages of kernel initialization.
 func EarlyReserveRegion(size uintptr) (uintptr, *kernel.Error) {
+	regionAddr, err := EarlyReserveUntrackedRegion(size)
+	if err != nil {
+		return 0, err
+	}
+
+	mm.TrackKernelVirtualBytes((size + (mm.PageSize - 1)) & ^(mm.PageSize - 1))
+	return regionAddr, nil
+}
+
+// EarlyReserveUntrackedRegion behaves like EarlyReserveRegion but the reserved
+// region does not count towards the kernel virtual address space reported by
+// mm.Stats. It is used for regions that are not mapped in their entirety
+// (e.g. randomized gaps or alignment padding); callers are expected to track
+// the bytes that they actually map via mm.TrackKernelVirtualBytes.
+func EarlyReserveUntrackedRegion(size uintptr) (uintptr, *kernel.Error) {
 	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
 
+	for index := 0; index < releasedRegionCount; index++ {
+		if region := &releasedRegions[index]; region.size >= size {
+			region.size -= size
+			regionAddr := region.start + region.size
+			if region.size == 0 {
+				removeReleasedRegion(index)
+			}
+			return regionAddr, nil
+		}
+	}
+
 	// reserving a region of the requested size will cause an underflow
 	if size > earlyReserveLastUsed {
 		return 0, errEarlyReserveNoSpace
@@ -33,3 +83,444 @@ func EarlyReserveRegion(size uintptr) (uintptr, *kernel.Error) {
 	earlyReserveLastUsed -= size
 	return earlyReserveLastUsed, nil
 }
+
+// releaseRegion returns a page-aligned region of the kernel address space that
+// was reserved via EarlyReserveRegion or EarlyReserveUntrackedRegion so that it
+// can be reused by subsequent reservation requests. Adjacent released regions
+// are coalesced. The caller must remove any mappings for the region before
+// releasing it.
+func releaseRegion(start, size uintptr) *kernel.Error {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	if size == 0 {
+		return nil
+	}
+
+	end := start + size
+	for index := 0; index < releasedRegionCount; {
+		region := releasedRegions[index]
+		if region.start+region.size != start && end != region.start {
+			index++
+			continue
+		}
+
+		if region.start < start {
+			start = region.start
+		} else {
+			end = region.start + region.size
+		}
+		removeReleasedRegion(index)
+	}
+
+	// Regions that border the unreserved part of the address space are
+	// returned to it.
+	if start == earlyReserveLastUsed {
+		earlyReserveLastUsed = end
+		return nil
+	}
+
+	if releasedRegionCount == maxReleasedRegions {
+		return errTooManyReleasedRegions
+	}
+
+	releasedRegions[releasedRegionCount] = releasedRegion{start: start, size: end - start}
+	releasedRegionCount++
+	return nil
+}
+
+// removeReleasedRegion removes the entry at index from the released region
+// list.
+func removeReleasedRegion(index int) {
+	releasedRegionCount--
+	releasedRegions[index] = releasedRegions[releasedRegionCount]
+}
+
+var (
+	// kernelHalfPopulated is set to true once all P4 entries spanning the
+	// kernel half of the address space point to a page table.
+	kernelHalfPopulated bool
+
+	errDestroyActiveAddressSpace = &kernel.Error{Module: "vmm", Message: "the active address space cannot be destroyed"}
+)
+
+// AddressSpace describes a virtual address space with its own page directory
+// table. The P4 entries that span the kernel half of the address space are
+// shared with every other address space so kernel mappings are always
+// visible; the user half is private to each address space.
+//
+// An AddressSpace does not need to be active in order to modify its mappings.
+// When inactive, its page tables are accessed via the direct map.
+//
+// If the CPU supports process-context identifiers, each address space is
+// assigned its own PCID so that its TLB entries survive switches to other
+// address spaces.
+type AddressSpace struct {
+	pdt PageDirectoryTable
+
+	// pcid tags the TLB entries for this address space.
+	pcid uint16
+
+	// tlbGens records, for each CPU, the value of tlbGeneration when the
+	// TLB entries tagged with pcid were last flushed on that CPU.
+	tlbGens [MaxCPUs]uint64
+}
+
+// Init allocates the page directory table for this address space and copies
+// the kernel half P4 entries from the active page directory table.
+func (as *AddressSpace) Init() *kernel.Error {
+	if err := populateKernelHalf(); err != nil {
+		return err
+	}
+
+	pdtFrame, err := mm.AllocFrame()
+	if err != nil {
+		return err
+	}
+	mm.TrackPageTableFrames(1)
+
+	var pdtPage mm.Page
+	if err = as.pdt.Init(pdtFrame); err == nil {
+		pdtPage, err = accessFrame(pdtFrame)
+	}
+
+	if err != nil {
+		_ = mm.FreeFrame(pdtFrame)
+		mm.TrackPageTableFrames(-1)
+		return err
+	}
+
+	for index := kernelHalfFirstEntry; index < recursiveEntry; index++ {
+		*tableEntry(pdtPage, index) = *(*pageTableEntry)(ptePtrFn(pdtVirtualAddr + (index << mm.PointerShift)))
+	}
+
+	releaseFrame(pdtPage)
+
+	as.pcid = allocPCID()
+	as.invalidateTLB()
+	return nil
+}
+
+// Activate switches the CPU to this address space. The TLB entries tagged with
+// the PCID of the address space are preserved unless some of them may be
+// stale.
+func (as *AddressSpace) Activate() {
+	var (
+		cpuIndex = currentCPUFn()
+		gen      = atomic.LoadUint64(&tlbGeneration)
+		preserve = pcidEnabled && as.pcid != 0 && as.tlbGens[cpuIndex] == gen
+	)
+
+	as.tlbGens[cpuIndex] = gen
+	switchPDTFn(cr3Value(as.pdt.pdtFrame, as.pcid, preserve))
+
+	// A mapping may have been invalidated while switching
+	if preserve && atomic.LoadUint64(&tlbGeneration) != gen {
+		flushTLBFn()
+	}
+}
+
+// invalidateTLB ensures that the TLB entries tagged with the PCID of this
+// address space are flushed the next time it is activated on any CPU.
+func (as *AddressSpace) invalidateTLB() {
+	for index := range as.tlbGens {
+		as.tlbGens[index] = 0
+	}
+}
+
+// Map establishes a mapping between a virtual page and a physical memory frame
+// in this address space. Missing page tables are allocated on demand and are
+// flagged as user-accessible if flags include FlagUserAccessible.
+func (as *AddressSpace) Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	if as.active() {
+		return mapFn(page, frame, flags)
+	}
+
+	if protectReservedZeroedPage && frame == ReservedZeroedFrame && (flags&FlagRW) != 0 {
+		return errAttemptToRWMapReservedFrame
+	}
+
+	pte, tablePage, err := as.inactiveEntry(page, flags&FlagUserAccessible, true)
+	if err != nil {
+		return err
+	}
+
+	err = mapLeafEntry(page, pte, frame, flags)
+	as.invalidateTLB()
+
+	releaseFrame(tablePage)
+	return err
+}
+
+// Unmap removes a mapping previously installed by a call to Map on this
+// address space.
+func (as *AddressSpace) Unmap(page mm.Page) *kernel.Error {
+	if as.active() {
+		return unmapFn(page)
+	}
+
+	pte, tablePage, err := as.inactiveEntry(page, 0, false)
+	if err != nil {
+		return err
+	}
+
+	err = unmapLeafEntry(page, pte)
+	as.invalidateTLB()
+
+	releaseFrame(tablePage)
+	return err
+}
+
+// Clone initializes dst as a copy of this address space. Instead of copying
+// the contents of the user half pages, both address spaces map the same
+// frames. Writable pages are marked as read-only and copy-on-write in both
+// address spaces so that the page fault handler creates a private copy of a
+// page the first time it is written to.
+func (as *AddressSpace) Clone(dst *AddressSpace) *kernel.Error {
+	if err := dst.Init(); err != nil {
+		return err
+	}
+
+	if err := as.cloneTable(dst, as.pdt.pdtFrame, 0, 0, 0, kernelHalfFirstEntry); err != nil {
+		_ = dst.Destroy()
+		return err
+	}
+
+	return nil
+}
+
+// Destroy releases the page tables that span the user half of this address
+// space and the frame used by its page directory table. The reference counts
+// of the frames mapped by user pages are dropped so frames that are not shared
+// with other address spaces are returned to the physical frame allocator. The
+// kernel half page tables are shared by all address spaces and are left
+// untouched.
+//
+// The active address space cannot be destroyed.
+func (as *AddressSpace) Destroy() *kernel.Error {
+	if as.active() {
+		return errDestroyActiveAddressSpace
+	}
+
+	if err := freeTable(as.pdt.pdtFrame, 0, 0, kernelHalfFirstEntry); err != nil {
+		return err
+	}
+
+	if err := mm.FreeFrame(as.pdt.pdtFrame); err != nil {
+		return err
+	}
+
+	mm.TrackPageTableFrames(-1)
+	freePCID(as.pcid)
+	as.pcid = 0
+	return nil
+}
+
+// active returns true if this address space is the currently active one.
+func (as *AddressSpace) active() bool {
+	return as.pdt.pdtFrame.Address() == activePDTFn()
+}
+
+// inactiveEntry walks the page tables of an inactive address space using
+// accessFrame and returns a pointer to the last level page table entry for
+// page together with the page that maps the table containing it. Callers must
+// pass the returned page to releaseFrame once they are done with the entry.
+//
+// If alloc is true, missing page tables are allocated; otherwise
+// ErrInvalidMapping is returned. The supplied tableFlags are applied to the
+// entries that point to each page table.
+func (as *AddressSpace) inactiveEntry(page mm.Page, tableFlags PageTableEntryFlag, alloc bool) (*pageTableEntry, mm.Page, *kernel.Error) {
+	var (
+		tableFrame = as.pdt.pdtFrame
+		tablePage  mm.Page
+		clearTable bool
+		err        *kernel.Error
+	)
+
+	for level := uint8(0); ; level++ {
+		if tablePage, err = accessFrame(tableFrame); err != nil {
+			return nil, 0, err
+		}
+
+		if clearTable {
+			kernel.Memset(tablePage.Address(), 0, mm.PageSize)
+		}
+
+		pte := tableEntry(tablePage, (page.Address()>>pageLevelShifts[level])&((1<<pageLevelBits[level])-1))
+		if level == pageLevels-1 {
+			return pte, tablePage, nil
+		}
+
+		switch {
+		case pte.HasFlags(FlagPresent | FlagHugePage):
+			err = errNoHugePageSupport
+		case pte.HasFlags(FlagPresent):
+			pte.SetFlags(tableFlags)
+			clearTable = false
+		case !alloc:
+			err = ErrInvalidMapping
+		default:
+			var newTableFrame mm.Frame
+			if newTableFrame, err = mm.AllocFrame(); err == nil {
+				mm.TrackPageTableFrames(1)
+				*pte = 0
+				pte.SetFrame(newTableFrame)
+				pte.SetFlags(FlagPresent | FlagRW | tableFlags)
+				clearTable = true
+			}
+		}
+
+		if err != nil {
+			releaseFrame(tablePage)
+			return nil, 0, err
+		}
+
+		tableFrame = pte.Frame()
+	}
+}
+
+// cloneTable copies the mappings described by the entries in the
+// [firstIndex, lastIndex) range of the page table stored in tableFrame to dst.
+// The baseAddr argument contains the virtual address bits that correspond to
+// the page table entries traversed so far.
+func (as *AddressSpace) cloneTable(dst *AddressSpace, tableFrame mm.Frame, level uint8, baseAddr, firstIndex, lastIndex uintptr) *kernel.Error {
+	var (
+		tablePage mm.Page
+		mapped    bool
+		err       *kernel.Error
+	)
+
+	for index := firstIndex; index < lastIndex; index++ {
+		// Cloning mappings into dst may overwrite the temporary mapping
+		if !mapped {
+			if tablePage, err = accessFrame(tableFrame); err != nil {
+				return err
+			}
+			mapped = true
+		}
+
+		pte := tableEntry(tablePage, index)
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		entryAddr := baseAddr | (index << pageLevelShifts[level])
+
+		switch {
+		case level == pageLevels-1:
+			if pte.HasFlags(FlagRW) {
+				pte.ClearFlags(FlagRW)
+				pte.SetFlags(FlagCopyOnWrite)
+				if as.active() {
+					flushTLBEntry(entryAddr)
+				} else {
+					as.invalidateTLB()
+				}
+			}
+
+			entry := *pte
+			mapped = false
+			err = dst.Map(mm.PageFromAddress(entryAddr), entry.Frame(), PageTableEntryFlag(uintptr(entry)&^ptePhysPageMask))
+		case pte.HasFlags(FlagHugePage):
+			err = errNoHugePageSupport
+		default:
+			mapped = false
+			err = as.cloneTable(dst, pte.Frame(), level+1, entryAddr, 0, 1<<pageLevelBits[level+1])
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if mapped {
+		releaseFrame(tablePage)
+	}
+
+	return err
+}
+
+// freeTable releases the page tables and frames referenced by the entries in
+// the [firstIndex, lastIndex) range of the page table stored in tableFrame.
+func freeTable(tableFrame mm.Frame, level uint8, firstIndex, lastIndex uintptr) *kernel.Error {
+	var (
+		tablePage mm.Page
+		mapped    bool
+		err       *kernel.Error
+	)
+
+	for index := firstIndex; index < lastIndex; index++ {
+		// Freeing the next level tables may overwrite the temporary mapping
+		if !mapped {
+			if tablePage, err = accessFrame(tableFrame); err != nil {
+				return err
+			}
+			mapped = true
+		}
+
+		pte := *tableEntry(tablePage, index)
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		switch {
+		case level == pageLevels-1:
+			err = decFrameRefCount(pte.Frame())
+		case pte.HasFlags(FlagHugePage):
+			err = decFrameRangeRefCount(hugePageFrame(pte, level), (uintptr(1)<<pageLevelShifts[level])>>mm.PageShift)
+		default:
+			mapped = false
+			if err = freeTable(pte.Frame(), level+1, 0, 1<<pageLevelBits[level+1]); err == nil {
+				if err = mm.FreeFrame(pte.Frame()); err == nil {
+					mm.TrackPageTableFrames(-1)
+				}
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if mapped {
+		releaseFrame(tablePage)
+	}
+
+	return err
+}
+
+// populateKernelHalf ensures that every P4 entry spanning the kernel half of
+// the address space points to a page table. As each address space copies
+// these entries when it is initialized, kernel mappings established at a later
+// time become visible to all address spaces.
+//
+// The P3 tables are allocated eagerly the first time an address space is
+// created. Allocating them on demand would require keeping track of every
+// address space so that P4 entries installed after its creation could be
+// propagated to it. Eager allocation costs at most one frame per kernel half
+// P4 entry (~1M) which is paid once and shared by all address spaces; in
+// practice the entries spanning the kernel image and the direct map are
+// already present.
+func populateKernelHalf() *kernel.Error {
+	if kernelHalfPopulated {
+		return nil
+	}
+
+	for index := kernelHalfFirstEntry; index < recursiveEntry; index++ {
+		pte := (*pageTableEntry)(ptePtrFn(pdtVirtualAddr + (index << mm.PointerShift)))
+		if pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		if err := installPageTable(0, pte); err != nil {
+			return err
+		}
+	}
+
+	kernelHalfPopulated = true
+	return nil
+}
+
+// tableEntry returns a pointer to the page table entry at the given index of
+// the page table mapped at tablePage.
+func tableEntry(tablePage mm.Page, index uintptr) *pageTableEntry {
+	return (*pageTableEntry)(unsafe.Pointer(tablePage.Address() + (index << mm.PointerShift)))
+}
@@ -1,8 +1,13 @@
 package vmm
 
 import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+	"reflect"
 	"runtime"
 	"testing"
+	"unsafe"
 )
 
 func TestEarlyReserveAmd64(t *testing.T) {
@@ -26,4 +31,332 @@ func TestEarlyReserveAmd64(t *testing.T) {
 	if _, err = EarlyReserveRegion(1); err != errEarlyReserveNoSpace {
 		t.Fatalf("expected to get errEarlyReserveNoSpace; got %v", err)
 	}
+
+	t.Run("virtual address space tracking", func(t *testing.T) {
+		earlyReserveLastUsed = 16 * mm.PageSize
+		trackedBytes := mm.Stats().KernelVirtualBytes
+
+		if _, err := EarlyReserveUntrackedRegion(2 * mm.PageSize); err != nil {
+			t.Fatal(err)
+		}
+		if got := mm.Stats().KernelVirtualBytes - trackedBytes; got != 0 {
+			t.Fatalf("expected untracked reservation not to be tracked; got %d tracked bytes", got)
+		}
+
+		if _, err := EarlyReserveRegion(42); err != nil {
+			t.Fatal(err)
+		}
+		if got, exp := mm.Stats().KernelVirtualBytes-trackedBytes, uint64(mm.PageSize); got != exp {
+			t.Fatalf("expected %d tracked bytes; got %d", exp, got)
+		}
+
+		if exp := 13 * mm.PageSize; earlyReserveLastUsed != exp {
+			t.Fatalf("expected last reserved address to be 0x%x; got 0x%x", exp, earlyReserveLastUsed)
+		}
+
+		if _, err := EarlyReserveUntrackedRegion(14 * mm.PageSize); err != errEarlyReserveNoSpace {
+			t.Fatalf("expected to get errEarlyReserveNoSpace; got %v", err)
+		}
+	})
+
+	t.Run("release and reuse regions", func(t *testing.T) {
+		defer func() {
+			releasedRegionCount = 0
+		}()
+
+		earlyReserveLastUsed = 16 * mm.PageSize
+		var regions [4]uintptr
+		for index := range regions {
+			if regions[index], err = EarlyReserveUntrackedRegion(mm.PageSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Releasing the two regions in the middle should coalesce them
+		for _, index := range []int{1, 2} {
+			if err = releaseRegion(regions[index], 42); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if exp := (releasedRegion{regions[2], 2 * mm.PageSize}); releasedRegionCount != 1 || releasedRegions[0] != exp {
+			t.Fatalf("expected released regions to be [%v]; got %v", exp, releasedRegions[:releasedRegionCount])
+		}
+
+		// Released regions are reused before reserving new address space
+		addr, err := EarlyReserveUntrackedRegion(mm.PageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := regions[1]; addr != exp {
+			t.Fatalf("expected released region 0x%x to be reused; got 0x%x", exp, addr)
+		}
+
+		// Releasing a region that borders the unreserved address space
+		// returns it (and any released regions adjacent to it) to it.
+		for _, addr := range []uintptr{regions[1], regions[3]} {
+			if err = releaseRegion(addr, mm.PageSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if exp := regions[0]; releasedRegionCount != 0 || earlyReserveLastUsed != exp {
+			t.Fatalf("expected last reserved address to be 0x%x with no released regions; got 0x%x and %v", exp, earlyReserveLastUsed, releasedRegions[:releasedRegionCount])
+		}
+
+		// Releasing an empty region is a no-op
+		if err = releaseRegion(regions[0]-mm.PageSize, 0); err != nil || releasedRegionCount != 0 {
+			t.Fatalf("expected releasing an empty region to be a no-op; got %v, %d released regions", err, releasedRegionCount)
+		}
+
+		for index := range releasedRegions {
+			releasedRegions[index] = releasedRegion{uintptr(index+2) * 2 * mm.PageSize, mm.PageSize}
+		}
+		releasedRegionCount = maxReleasedRegions
+		if err = releaseRegion(0, mm.PageSize); err != errTooManyReleasedRegions {
+			t.Fatalf("expected to get errTooManyReleasedRegions; got %v", err)
+		}
+	})
+}
+
+func TestAddressSpaceAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origPopulated bool) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		kernelHalfPopulated = origPopulated
+		activePDTFn = cpu.ActivePDT
+		mapFn = Map
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		mm.SetFrameAllocator(nil)
+		mm.SetFrameFreer(nil)
+		frameRefCounts = nil
+	}(ptePtrFn, nextAddrFn, kernelHalfPopulated)
+
+	frameRefCounts = make([]uint16, 0x4000)
+
+	// Emulate physical memory using a page-aligned buffer. Frame 0 holds
+	// the active PDT.
+	var (
+		physMem       = make([]byte, 17*mm.PageSize)
+		physBase      = (uintptr(unsafe.Pointer(&physMem[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+		nextFrame     = mm.Frame(2)
+		freedFrames   []mm.Frame
+		activePDTAddr uintptr
+	)
+
+	frameAddr := func(frame mm.Frame) uintptr { return physBase + frame.Address() }
+	leafEntry := func(pdtFrame mm.Frame, virtAddr uintptr) *pageTableEntry {
+		tableFrame := pdtFrame
+		for level := uint8(0); ; level++ {
+			pte := (*pageTableEntry)(unsafe.Pointer(frameAddr(tableFrame) + (((virtAddr >> pageLevelShifts[level]) & ((1 << pageLevelBits[level]) - 1)) << mm.PointerShift)))
+			if level == pageLevels-1 || !pte.HasFlags(FlagPresent) {
+				return pte
+			}
+			tableFrame = pte.Frame()
+		}
+	}
+
+	activePDT := (*[512]pageTableEntry)(unsafe.Pointer(frameAddr(0)))
+	for index := kernelHalfFirstEntry; index < recursiveEntry; index++ {
+		activePDT[index] = pageTableEntry(mm.Frame(1).Address()) | pageTableEntry(FlagPresent|FlagRW)
+	}
+	activePDT[300] = 0
+
+	kernelHalfPopulated = false
+	activePDTFn = func() uintptr { return activePDTAddr }
+	ptePtrFn = func(entryAddr uintptr) unsafe.Pointer {
+		return unsafe.Pointer(frameAddr(0) + (entryAddr - pdtVirtualAddr))
+	}
+	nextAddrFn = func(_ uintptr) uintptr { return frameAddr(nextFrame - 1) }
+	mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) {
+		return mm.PageFromAddress(frameAddr(frame)), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	flushTLBEntryFn = func(_ uintptr) {}
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		nextFrame++
+		return nextFrame - 1, nil
+	})
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+
+	var src, dst AddressSpace
+
+	t.Run("init", func(t *testing.T) {
+		if err := src.Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !kernelHalfPopulated || activePDT[300].Frame() != mm.Frame(2) {
+			t.Fatal("expected missing kernel half P4 entry to be populated with a new table")
+		}
+
+		if exp := mm.Frame(3); src.pdt.pdtFrame != exp {
+			t.Fatalf("expected PDT to be stored in frame %d; got %d", exp, src.pdt.pdtFrame)
+		}
+
+		pdt := (*[512]pageTableEntry)(unsafe.Pointer(frameAddr(src.pdt.pdtFrame)))
+		for index := uintptr(0); index < recursiveEntry; index++ {
+			var exp pageTableEntry
+			if index >= kernelHalfFirstEntry {
+				exp = activePDT[index]
+			}
+
+			if pdt[index] != exp {
+				t.Errorf("expected PDT entry %d to be %x; got %x", index, exp, pdt[index])
+			}
+		}
+
+		if pdt[recursiveEntry].Frame() != src.pdt.pdtFrame {
+			t.Error("expected last PDT entry to be recursively mapped")
+		}
+	})
+
+	t.Run("init error", func(t *testing.T) {
+		defer func(origMapTemporary func(mm.Frame) (mm.Page, *kernel.Error)) {
+			mapTemporaryFn = origMapTemporary
+		}(mapTemporaryFn)
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) { return 0, expErr }
+
+		var (
+			as         AddressSpace
+			origFrame  = nextFrame
+			origTables = mm.Stats().PageTableFrames
+		)
+
+		if err := as.Init(); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if len(freedFrames) != 1 || freedFrames[0] != origFrame {
+			t.Fatalf("expected PDT frame %d to be freed; got %v", origFrame, freedFrames)
+		}
+
+		if got := mm.Stats().PageTableFrames; got != origTables {
+			t.Fatalf("expected page table frame count to remain %d; got %d", origTables, got)
+		}
+
+		// Hand out the freed frame again so the frame numbers expected
+		// by the following tests remain the same.
+		freedFrames, nextFrame = nil, origFrame
+	})
+
+	t.Run("map inactive", func(t *testing.T) {
+		if err := src.Map(mm.PageFromAddress(0x400000), mm.Frame(0x1234), FlagPresent|FlagRW|FlagUserAccessible); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := src.Map(mm.PageFromAddress(0x401000), mm.Frame(0x1235), FlagPresent|FlagUserAccessible); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := mm.Frame(7); nextFrame != exp {
+			t.Fatalf("expected 3 page tables to be allocated; next frame is %d", nextFrame)
+		}
+
+		pte := leafEntry(src.pdt.pdtFrame, 0x400000)
+		if pte.Frame() != mm.Frame(0x1234) || !pte.HasFlags(FlagPresent|FlagRW|FlagUserAccessible) {
+			t.Fatalf("unexpected page table entry for mapped page: %x", *pte)
+		}
+
+		for frame, index := range map[mm.Frame]uintptr{3: 0, 4: 0, 5: 2} {
+			if pte := (*pageTableEntry)(unsafe.Pointer(frameAddr(frame) + (index << mm.PointerShift))); !pte.HasFlags(FlagPresent | FlagUserAccessible) {
+				t.Errorf("expected table entry %d in frame %d to be present and user-accessible; got %x", index, frame, *pte)
+			}
+		}
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		if err := src.Clone(&dst); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, as := range []*AddressSpace{&src, &dst} {
+			pte := leafEntry(as.pdt.pdtFrame, 0x400000)
+			if pte.Frame() != mm.Frame(0x1234) || pte.HasFlags(FlagRW) || !pte.HasFlags(FlagPresent|FlagCopyOnWrite|FlagUserAccessible) {
+				t.Errorf("expected writable page to be marked as CoW; got %x", *pte)
+			}
+
+			pte = leafEntry(as.pdt.pdtFrame, 0x401000)
+			if pte.Frame() != mm.Frame(0x1235) || pte.HasAnyFlag(FlagRW|FlagCopyOnWrite) || !pte.HasFlags(FlagPresent) {
+				t.Errorf("expected read-only page to remain unchanged; got %x", *pte)
+			}
+		}
+
+		for _, frame := range []mm.Frame{0x1234, 0x1235} {
+			if got := frameRefCount(frame); got != 2 {
+				t.Errorf("expected reference count for frame %x to be 2; got %d", frame, got)
+			}
+		}
+	})
+
+	t.Run("unmap inactive", func(t *testing.T) {
+		if err := dst.Unmap(mm.PageFromAddress(0x401000)); err != nil {
+			t.Fatal(err)
+		}
+
+		if pte := leafEntry(dst.pdt.pdtFrame, 0x401000); pte.HasFlags(FlagPresent) {
+			t.Fatal("expected page to be unmapped")
+		}
+
+		if pte := leafEntry(src.pdt.pdtFrame, 0x401000); !pte.HasFlags(FlagPresent) {
+			t.Fatal("expected page in the source address space to remain mapped")
+		}
+
+		if err := dst.Unmap(mm.PageFromAddress(0x8000000000)); err != ErrInvalidMapping {
+			t.Fatalf("expected to get ErrInvalidMapping; got %v", err)
+		}
+	})
+
+	t.Run("active address space", func(t *testing.T) {
+		activePDTAddr = src.pdt.pdtFrame.Address()
+		defer func() { activePDTAddr = 0 }()
+
+		var mapCalled bool
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error {
+			mapCalled = true
+			return nil
+		}
+
+		if err := src.Map(mm.PageFromAddress(0x402000), mm.Frame(0x1236), FlagPresent); err != nil || !mapCalled {
+			t.Fatalf("expected Map to use the active PDT; got err %v", err)
+		}
+
+		if err := src.Destroy(); err != errDestroyActiveAddressSpace {
+			t.Fatalf("expected to get errDestroyActiveAddressSpace; got %v", err)
+		}
+	})
+
+	t.Run("destroy", func(t *testing.T) {
+		if err := dst.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the page tables should be freed as the mapped pages are
+		// still referenced by the source address space.
+		if exp := []mm.Frame{10, 9, 8, 7}; !reflect.DeepEqual(freedFrames, exp) {
+			t.Fatalf("expected freed frames to be %v; got %v", exp, freedFrames)
+		}
+
+		if err := src.Map(mm.PageFromAddress(0x600000), mm.Frame(0x2000), FlagPresent|FlagRW|FlagUserAccessible); err != nil {
+			t.Fatal(err)
+		}
+
+		freedFrames = nil
+		if err := src.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := []mm.Frame{0x1234, 0x1235, 6, 0x2000, 11, 5, 4, 3}; !reflect.DeepEqual(freedFrames, exp) {
+			t.Fatalf("expected freed frames to be %v; got %v", exp, freedFrames)
+		}
+	})
 }
@@ -0,0 +1,91 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+)
+
+// maxBootPageTables is the maximum number of page tables that can be
+// reported by VisitBootPageTables.
+const maxBootPageTables = 16
+
+var (
+	// bootPDTFrame points to the page directory table that was set up by
+	// the rt0 code and was active before setupPDTForKernel switched to the
+	// kernel PDT.
+	bootPDTFrame mm.Frame
+
+	// bootKernelPageOffset is the start of the kernel virtual address
+	// space; the boot page tables live inside the kernel image.
+	bootKernelPageOffset uintptr
+)
+
+// BootPageTableVisitor is invoked by VisitBootPageTables for each page table
+// that was set up by the rt0 code. The page argument is the page where the
+// table is mapped inside the kernel image.
+type BootPageTableVisitor func(page mm.Page, frame mm.Frame)
+
+// VisitBootPageTables invokes visitor for each page table that was set up by
+// the rt0 code to bootstrap the kernel. These tables are no longer used after
+// Init activates the kernel PDT and can be reclaimed. Only tables that are
+// part of the kernel image are reported and each table is only reported once
+// even if VisitBootPageTables is invoked multiple times.
+func VisitBootPageTables(visitor BootPageTableVisitor) *kernel.Error {
+	if bootPDTFrame == 0 {
+		return nil
+	}
+
+	var (
+		visited    [maxBootPageTables]mm.Frame
+		tableCount int
+		visitTable func(mm.Frame, uint8) *kernel.Error
+	)
+
+	visitTable = func(tableFrame mm.Frame, level uint8) *kernel.Error {
+		for index := 0; index < tableCount; index++ {
+			if visited[index] == tableFrame {
+				return nil
+			}
+		}
+
+		if tableCount == maxBootPageTables {
+			return nil
+		}
+		visited[tableCount] = tableFrame
+		tableCount++
+
+		if level < pageLevels-1 {
+			for index := uintptr(0); index < 1<<pageLevelBits[level]; index++ {
+				// Visiting the next level tables may overwrite the
+				// temporary mapping so the table is accessed for
+				// each entry.
+				tablePage, err := accessFrame(tableFrame)
+				if err != nil {
+					return err
+				}
+				pte := *tableEntry(tablePage, index)
+				releaseFrame(tablePage)
+
+				if !pte.HasFlags(FlagPresent) || pte.HasFlags(FlagHugePage) {
+					continue
+				}
+
+				if err = visitTable(pte.Frame(), level+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Ignore tables that are not part of the kernel image
+		page := mm.PageFromAddress(tableFrame.Address() + bootKernelPageOffset)
+		if physAddr, err := translateFn(page.Address()); err == nil && physAddr == tableFrame.Address() {
+			visitor(page, tableFrame)
+		}
+
+		return nil
+	}
+
+	err := visitTable(bootPDTFrame, 0)
+	bootPDTFrame = 0
+	return err
+}
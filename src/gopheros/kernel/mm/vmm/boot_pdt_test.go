@@ -0,0 +1,102 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"testing"
+	"unsafe"
+)
+
+func TestVisitBootPageTables(t *testing.T) {
+	defer func() {
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		translateFn = Translate
+		bootPDTFrame = 0
+		bootKernelPageOffset = 0
+	}()
+
+	// Emulate physical memory using a page-aligned buffer. Frame 1 holds
+	// the boot P4 table.
+	var (
+		physMem  = make([]byte, 8*mm.PageSize)
+		physBase = (uintptr(unsafe.Pointer(&physMem[0])) + mm.PageSize - 1) &^ (mm.PageSize - 1)
+	)
+
+	table := func(frame mm.Frame) *[512]pageTableEntry {
+		return (*[512]pageTableEntry)(unsafe.Pointer(physBase + frame.Address()))
+	}
+	tableRef := func(frame mm.Frame, flags PageTableEntryFlag) pageTableEntry {
+		return pageTableEntry(frame.Address()) | pageTableEntry(FlagPresent|FlagRW|flags)
+	}
+
+	// The rt0 code maps the same P3 table both at the identity-mapped and
+	// the higher-half regions. Frame 5 holds a P3 table that is not part
+	// of the kernel image and the P2 table contains a huge page entry
+	// that must not be treated as a table.
+	table(1)[0] = tableRef(2, 0)
+	table(1)[5] = tableRef(5, 0)
+	table(1)[511] = tableRef(2, 0)
+	table(2)[0] = tableRef(3, 0)
+	table(3)[0] = tableRef(6, FlagHugePage)
+	table(3)[1] = tableRef(4, 0)
+	table(4)[0] = tableRef(0, 0)
+
+	bootKernelPageOffset = 0xffff800000000000
+	mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) {
+		return mm.PageFromAddress(physBase + frame.Address()), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		physAddr := virtAddr - bootKernelPageOffset
+		if physAddr == mm.Frame(5).Address() {
+			return 0, ErrInvalidMapping
+		}
+		return physAddr, nil
+	}
+
+	t.Run("success", func(t *testing.T) {
+		bootPDTFrame = mm.Frame(1)
+
+		var visited []mm.Frame
+		err := VisitBootPageTables(func(page mm.Page, frame mm.Frame) {
+			if exp := mm.PageFromAddress(frame.Address() + bootKernelPageOffset); page != exp {
+				t.Errorf("expected table at frame %d to be reported at page 0x%x; got 0x%x", frame, exp, page)
+			}
+			visited = append(visited, frame)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expFrames := []mm.Frame{4, 3, 2, 1}
+		if len(visited) != len(expFrames) {
+			t.Fatalf("expected visitor to be called for frames %v; got %v", expFrames, visited)
+		}
+		for index, exp := range expFrames {
+			if visited[index] != exp {
+				t.Fatalf("expected visitor to be called for frames %v; got %v", expFrames, visited)
+			}
+		}
+
+		// Subsequent calls should not report any tables
+		if err = VisitBootPageTables(func(_ mm.Page, frame mm.Frame) {
+			t.Errorf("unexpected visitor call for frame %d", frame)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("access error", func(t *testing.T) {
+		bootPDTFrame = mm.Frame(1)
+
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if err := VisitBootPageTables(func(_ mm.Page, _ mm.Frame) {}); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+)
+
+// CacheMode describes the memory type that the CPU uses when accessing a
+// mapped physical memory region.
+type CacheMode uint8
+
+const (
+	// CacheModeWriteBack is the default memory type used for RAM.
+	CacheModeWriteBack CacheMode = iota
+
+	// CacheModeWriteThrough caches reads but forwards writes to memory.
+	CacheModeWriteThrough
+
+	// CacheModeWriteCombine buffers and combines writes before sending them
+	// to memory. It is best suited for framebuffers.
+	CacheModeWriteCombine
+
+	// CacheModeUncached disables caching and is required for MMIO regions
+	// with side-effects on access (e.g. APIC or HPET registers).
+	CacheModeUncached
+)
+
+const (
+	msrPAT = cpu.MSRPAT
+
+	// patValue contains the memory types for the 8 PAT entries that are
+	// selected by the PAT, PCD and PWT page table entry bits. Entries 0-3
+	// retain their power-on defaults (WB, WT, UC-, UC) so that existing
+	// mappings keep their memory type while entry 4 (selected by
+	// FlagWriteCombine) is set to WC.
+	patValue = uint64(0x0007050100070406)
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	writeMSRFn      = cpu.WriteMSR
+	mapRegionFn     = MapRegion
+	mapHugeRegionFn = MapHugeRegion
+
+	// patEnabled is set to true if the PAT has been programmed with a
+	// write-combining entry.
+	patEnabled bool
+)
+
+// flags returns the page table entry flags that select this cache mode. If
+// the PAT is not available, write-combining falls back to uncached.
+func (m CacheMode) flags() PageTableEntryFlag {
+	switch m {
+	case CacheModeWriteThrough:
+		return FlagWriteThroughCaching
+	case CacheModeWriteCombine:
+		if patEnabled {
+			return FlagWriteCombine
+		}
+		return FlagUncached
+	case CacheModeUncached:
+		return FlagUncached
+	default:
+		return 0
+	}
+}
+
+// setupPAT programs the IA32_PAT MSR so that pages mapped with the
+// FlagWriteCombine flag use the write-combining memory type. As none of the
+// existing mappings select the reprogrammed PAT entry, no TLB or cache flush
+// is required.
+func setupPAT() {
+	// CPUID.01H:EDX.PAT[bit 16]
+	if _, _, _, edx := cpuidFn(1); edx&(1<<16) == 0 {
+		return
+	}
+
+	writeMSRFn(msrPAT, patValue)
+	patEnabled = true
+}
+
+// MapMMIO establishes a RW, non-executable mapping for the physical memory
+// region [physAddr, physAddr+size) using the requested cache mode and returns
+// the virtual address that corresponds to physAddr. Drivers should use MapMMIO
+// for accessing memory-mapped device registers and framebuffers.
+//
+// Huge pages are only used if the region spans at least one huge page aligned
+// block; smaller regions are mapped using regular pages so that they do not
+// reserve the extra address space required for aligning huge page mappings.
+func MapMMIO(physAddr, size uintptr, mode CacheMode) (uintptr, *kernel.Error) {
+	var (
+		pageOffset   = PageOffset(physAddr)
+		hugePageMask = HugePage2M.Size() - 1
+		frame        = mm.FrameFromAddress(physAddr)
+		flags        = FlagPresent | FlagRW | FlagNoExecute | mode.flags()
+		page         mm.Page
+		err          *kernel.Error
+	)
+
+	if (physAddr+hugePageMask)&^hugePageMask+hugePageMask < physAddr+size {
+		page, err = mapHugeRegionFn(frame, size+pageOffset, flags)
+	} else {
+		page, err = mapRegionFn(frame, size+pageOffset, flags)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return page.Address() + pageOffset, nil
+}
+
+// UnmapMMIO removes a mapping for a region of size bytes that was established
+// via a call to MapMMIO which returned virtAddr and releases the virtual
+// address space reserved for it.
+func UnmapMMIO(virtAddr, size uintptr) *kernel.Error {
+	var (
+		pageOffset  = PageOffset(virtAddr)
+		regionStart = virtAddr - pageOffset
+		regionSize  = (size + pageOffset + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	)
+
+	if err := unmapRangeFn(mm.PageFromAddress(regionStart), regionSize>>mm.PageShift); err != nil {
+		return err
+	}
+
+	mm.UntrackKernelVirtualBytes(regionSize)
+	return releaseRegionFn(regionStart, regionSize)
+}
@@ -0,0 +1,204 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+	"testing"
+)
+
+func TestSetupPAT(t *testing.T) {
+	defer func() {
+		cpuidFn = cpu.ID
+		writeMSRFn = cpu.WriteMSR
+		patEnabled = false
+	}()
+
+	specs := []struct {
+		edx           uint32
+		expPATEnabled bool
+	}{
+		{0, false},
+		{1 << 16, true},
+	}
+
+	for specIndex, spec := range specs {
+		patEnabled = false
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, spec.edx }
+
+		writeMSRCallCount := 0
+		writeMSRFn = func(reg uint32, val uint64) {
+			writeMSRCallCount++
+			if reg != msrPAT {
+				t.Errorf("[spec %d] expected WriteMSR to be called with reg 0x%x; got 0x%x", specIndex, msrPAT, reg)
+			}
+
+			// Entry 4 must be write-combining (0x01) and entries 0-3 must use the power-on defaults
+			if exp := uint64(0x01); (val>>32)&0xff != exp {
+				t.Errorf("[spec %d] expected PAT entry 4 to be WC", specIndex)
+			}
+			if exp := uint64(0x00070406); val&0xffffffff != exp {
+				t.Errorf("[spec %d] expected PAT entries 0-3 to be set to 0x%x; got 0x%x", specIndex, exp, val&0xffffffff)
+			}
+		}
+
+		setupPAT()
+
+		if patEnabled != spec.expPATEnabled {
+			t.Errorf("[spec %d] expected patEnabled to be %t", specIndex, spec.expPATEnabled)
+		}
+
+		if exp := map[bool]int{false: 0, true: 1}[spec.expPATEnabled]; writeMSRCallCount != exp {
+			t.Errorf("[spec %d] expected WriteMSR to be called %d times; got %d", specIndex, exp, writeMSRCallCount)
+		}
+	}
+}
+
+func TestCacheModeFlags(t *testing.T) {
+	defer func() { patEnabled = false }()
+
+	specs := []struct {
+		mode       CacheMode
+		patEnabled bool
+		expFlags   PageTableEntryFlag
+	}{
+		{CacheModeWriteBack, true, 0},
+		{CacheModeWriteThrough, true, FlagWriteThroughCaching},
+		{CacheModeWriteCombine, true, FlagWriteCombine},
+		{CacheModeWriteCombine, false, FlagUncached},
+		{CacheModeUncached, true, FlagUncached},
+	}
+
+	for specIndex, spec := range specs {
+		patEnabled = spec.patEnabled
+		if got := spec.mode.flags(); got != spec.expFlags {
+			t.Errorf("[spec %d] expected flags to be 0x%x; got 0x%x", specIndex, spec.expFlags, got)
+		}
+	}
+}
+
+func TestMapMMIO(t *testing.T) {
+	defer func() {
+		mapRegionFn = MapRegion
+		mapHugeRegionFn = MapHugeRegion
+		patEnabled = false
+	}()
+
+	patEnabled = true
+
+	t.Run("small region", func(t *testing.T) {
+		mapHugeRegionFn = func(_ mm.Frame, _ uintptr, _ PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			t.Error("expected small region not to be mapped using huge pages")
+			return 0, nil
+		}
+		mapRegionFn = func(frame mm.Frame, size uintptr, flags PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			if exp := mm.Frame(0xfee00); frame != exp {
+				t.Errorf("expected MapRegion to be called with frame 0x%x; got 0x%x", exp, frame)
+			}
+
+			if exp := uintptr(0x420); size != exp {
+				t.Errorf("expected MapRegion to be called with size 0x%x; got 0x%x", exp, size)
+			}
+
+			if exp := FlagPresent | FlagRW | FlagNoExecute | FlagWriteCombine; flags != exp {
+				t.Errorf("expected MapRegion to be called with flags 0x%x; got 0x%x", exp, flags)
+			}
+
+			return mm.Page(0xbadf0), nil
+		}
+
+		addr, err := MapMMIO(0xfee00020, 0x400, CacheModeWriteCombine)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uintptr(0xbadf0020); addr != exp {
+			t.Fatalf("expected MapMMIO to return 0x%x; got 0x%x", exp, addr)
+		}
+	})
+
+	t.Run("large region", func(t *testing.T) {
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			t.Error("expected region spanning a 2M-aligned block to be mapped using huge pages")
+			return 0, nil
+		}
+		mapHugeRegionFn = func(frame mm.Frame, size uintptr, _ PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			if exp := uintptr(0x400010); size != exp {
+				t.Errorf("expected MapHugeRegion to be called with size 0x%x; got 0x%x", exp, size)
+			}
+			return mm.Page(0xbadf0), nil
+		}
+
+		if _, err := MapMMIO(0xe01ff010, 0x400000, CacheModeWriteCombine); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("map fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		mapRegionFn = func(_ mm.Frame, _ uintptr, _ PageTableEntryFlag) (mm.Page, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := MapMMIO(0xfee00000, 0x400, CacheModeUncached); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapMMIO(t *testing.T) {
+	defer func() {
+		unmapRangeFn = unmapRange
+		releaseRegionFn = releaseRegion
+	}()
+
+	var releasedStart, releasedSize uintptr
+	releaseRegionFn = func(start, size uintptr) *kernel.Error {
+		releasedStart, releasedSize = start, size
+		return nil
+	}
+
+	t.Run("success", func(t *testing.T) {
+		unmapRangeFn = func(page mm.Page, pageCount uintptr) *kernel.Error {
+			if exp := mm.Page(0xbadf0); page != exp {
+				t.Errorf("expected unmapRange to be called with page 0x%x; got 0x%x", exp, page)
+			}
+
+			if exp := uintptr(2); pageCount != exp {
+				t.Errorf("expected unmapRange to be called with %d pages; got %d", exp, pageCount)
+			}
+			return nil
+		}
+
+		trackedBytes := mm.Stats().KernelVirtualBytes
+		mm.TrackKernelVirtualBytes(2 * mm.PageSize)
+
+		if err := UnmapMMIO(0xbadf0ff0, 0x20); err != nil {
+			t.Fatal(err)
+		}
+
+		if releasedStart != 0xbadf0000 || releasedSize != 2*mm.PageSize {
+			t.Fatalf("expected region [0x%x, +0x%x) to be released; got [0x%x, +0x%x)", 0xbadf0000, 2*mm.PageSize, releasedStart, releasedSize)
+		}
+
+		if got := mm.Stats().KernelVirtualBytes; got != trackedBytes {
+			t.Fatalf("expected tracked kernel virtual bytes to be %d; got %d", trackedBytes, got)
+		}
+	})
+
+	t.Run("unmap fails", func(t *testing.T) {
+		releasedSize = 0
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+		unmapRangeFn = func(_ mm.Page, _ uintptr) *kernel.Error {
+			return expErr
+		}
+
+		if err := UnmapMMIO(0xbadf0000, 0x400); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+
+		if releasedSize != 0 {
+			t.Fatal("expected region not to be released when unmapping fails")
+		}
+	})
+}
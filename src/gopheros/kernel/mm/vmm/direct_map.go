@@ -0,0 +1,194 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/multiboot"
+)
+
+var (
+	// directMapOffset is the virtual address that corresponds to physical
+	// address 0 in the direct map. It is set to a non-zero value once the
+	// direct map is established by setupDirectMap.
+	directMapOffset uintptr
+
+	// kernelImageStartAddr and kernelImageEndAddr describe the page-aligned
+	// physical address range occupied by the kernel image. They are
+	// populated by setupPDTForKernel.
+	kernelImageStartAddr, kernelImageEndAddr uintptr
+
+	errDirectMapRange = &kernel.Error{Module: "vmm", Message: "physical address is beyond the direct map range"}
+)
+
+// setupDirectMap establishes a permanent mapping of all available and
+// ACPI-reclaimable physical memory regions at a (randomized) offset in the
+// kernel address space. Huge pages are used for the parts of each region that
+// are suitably aligned. The frames occupied by the kernel image are mapped
+// read-only so that the direct map cannot be used to bypass the W^X
+// protection of the kernel sections. If the bootloader does not provide a
+// memory map, the direct map is not established and physical frames are
+// accessed using temporary mappings.
+func setupDirectMap() *kernel.Error {
+	var (
+		offset = directMapBase + directMapSlide
+		mapped bool
+		err    *kernel.Error
+	)
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAvailable && region.Type != multiboot.MemAcpiReclaimable {
+			return true
+		}
+
+		var (
+			startAddr = uintptr(region.PhysAddress) & ^(mm.PageSize - 1)
+			endAddr   = (uintptr(region.PhysAddress+region.Length) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		)
+
+		if endAddr > directMapMaxPhysAddr {
+			endAddr = directMapMaxPhysAddr
+		}
+
+		if startAddr >= endAddr {
+			return true
+		}
+
+		err = mapDirectMapRange(offset, startAddr, endAddr)
+		mapped = err == nil
+		return mapped
+	})
+
+	if err != nil || !mapped {
+		return err
+	}
+
+	directMapOffset = offset
+	return nil
+}
+
+// mapDirectMapRange adds the page-aligned physical address range
+// [startAddr, endAddr) to the direct map at the supplied offset. The part of
+// the range that overlaps the kernel image is mapped read-only.
+func mapDirectMapRange(offset, startAddr, endAddr uintptr) *kernel.Error {
+	for startAddr < endAddr {
+		var (
+			segEndAddr = endAddr
+			flags      = FlagPresent | FlagRW | FlagNoExecute
+		)
+
+		switch {
+		case startAddr < kernelImageStartAddr:
+			if segEndAddr > kernelImageStartAddr {
+				segEndAddr = kernelImageStartAddr
+			}
+		case startAddr < kernelImageEndAddr:
+			if segEndAddr > kernelImageEndAddr {
+				segEndAddr = kernelImageEndAddr
+			}
+			flags &^= FlagRW
+		}
+
+		if err := mapRangeFn(
+			mm.PageFromAddress(offset+startAddr),
+			mm.FrameFromAddress(startAddr),
+			(segEndAddr-startAddr)>>mm.PageShift,
+			flags,
+		); err != nil {
+			return err
+		}
+
+		startAddr = segEndAddr
+	}
+
+	return nil
+}
+
+// ReleaseKernelImagePage removes the mapping for a page of the kernel image
+// that is no longer used by the kernel. As the kernel image is mapped
+// read-only in the direct map, the frame backing the page is remapped as
+// writable in the direct map so that it can be handed over to the frame
+// allocator.
+func ReleaseKernelImagePage(page mm.Page, frame mm.Frame) *kernel.Error {
+	if err := unmapFn(page); err != nil {
+		return err
+	}
+
+	// The frame was mapped before the reference count table was set up
+	// and is therefore pinned.
+	unpinFrame(frame)
+
+	if directMapOffset == 0 || frame.Address() < kernelImageStartAddr || frame.Address() >= kernelImageEndAddr {
+		return nil
+	}
+
+	return mapFn(mm.PageFromAddress(PhysToVirt(frame.Address())), frame, FlagPresent|FlagRW|FlagNoExecute)
+}
+
+// PhysToVirt returns the virtual address in the direct map that corresponds
+// to physAddr. Available and ACPI-reclaimable memory is always present in the
+// direct map; other physical memory regions must be added to the direct map
+// using DirectMapRegion before they can be accessed.
+//
+// Until the direct map is established by Init, PhysToVirt returns physAddr.
+func PhysToVirt(physAddr uintptr) uintptr {
+	return directMapOffset + physAddr
+}
+
+// VirtToPhys returns the physical address that corresponds to virtAddr.
+// Addresses inside the direct map are translated without walking the page
+// tables; all other addresses are translated using the active page directory
+// table.
+func VirtToPhys(virtAddr uintptr) (uintptr, *kernel.Error) {
+	if directMapOffset != 0 && virtAddr >= directMapOffset && virtAddr-directMapOffset < directMapMaxPhysAddr {
+		return virtAddr - directMapOffset, nil
+	}
+
+	return translateFn(virtAddr)
+}
+
+// DirectMapRegion ensures that the physical memory region which starts at the
+// given frame and ends at frame + pages(size) is accessible via the direct
+// map and returns back the Page that corresponds to the region start. Pages
+// of the region that are already present in the direct map are left intact;
+// missing pages are mapped using the supplied flags. The size argument is
+// always rounded up to the nearest page boundary.
+func DirectMapRegion(frame mm.Frame, size uintptr, flags PageTableEntryFlag) (mm.Page, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	if frame.Address() >= directMapMaxPhysAddr || size > directMapMaxPhysAddr-frame.Address() {
+		return 0, errDirectMapRange
+	}
+
+	startPage := mm.PageFromAddress(PhysToVirt(frame.Address()))
+	pageCount := size >> mm.PageShift
+	for page := startPage; pageCount > 0; pageCount, page, frame = pageCount-1, page+1, frame+1 {
+		if _, err := translateFn(page.Address()); err == nil {
+			continue
+		}
+
+		if err := mapFn(page, frame, flags); err != nil {
+			return 0, err
+		}
+	}
+
+	return startPage, nil
+}
+
+// accessFrame returns a page that can be used to access the contents of frame.
+// Once the direct map is established, the frame is accessed through it;
+// otherwise a temporary mapping is established. Callers must pass the
+// returned page to releaseFrame once they no longer need to access the frame.
+func accessFrame(frame mm.Frame) (mm.Page, *kernel.Error) {
+	if directMapOffset != 0 {
+		return mm.PageFromAddress(PhysToVirt(frame.Address())), nil
+	}
+
+	return mapTemporaryFn(frame)
+}
+
+// releaseFrame removes the temporary mapping (if any) established by a call
+// to accessFrame.
+func releaseFrame(page mm.Page) {
+	if directMapOffset == 0 {
+		_ = unmapFn(page)
+	}
+}
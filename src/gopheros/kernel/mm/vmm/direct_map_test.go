@@ -0,0 +1,362 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/multiboot"
+	"testing"
+)
+
+func TestSetupDirectMap(t *testing.T) {
+	defer func() {
+		visitMemRegionsFn = multiboot.VisitMemRegions
+		mapRangeFn = mapRange
+		directMapOffset = 0
+		directMapSlide = 0
+		kernelImageStartAddr, kernelImageEndAddr = 0, 0
+	}()
+
+	directMapSlide = 1 << 30
+	kernelImageStartAddr, kernelImageEndAddr = 0, 0
+	expOffset := directMapBase + directMapSlide
+
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for _, region := range []multiboot.MemoryMapEntry{
+			{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+			{PhysAddress: 0x9fc00, Length: 0x400, Type: multiboot.MemReserved},
+			{PhysAddress: 0x100000, Length: 0x7ee0000, Type: multiboot.MemAvailable},
+			{PhysAddress: 0x7fe0000, Length: 0x20000, Type: multiboot.MemAcpiReclaimable},
+			{PhysAddress: 0xfffc0000, Length: 0x40000, Type: multiboot.MemReserved},
+		} {
+			if !visitor(&region) {
+				return
+			}
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		directMapOffset = 0
+
+		type rangeCall struct {
+			page      mm.Page
+			frame     mm.Frame
+			pageCount uintptr
+		}
+
+		var calls []rangeCall
+		mapRangeFn = func(page mm.Page, frame mm.Frame, pageCount uintptr, flags PageTableEntryFlag) *kernel.Error {
+			if exp := FlagPresent | FlagRW | FlagNoExecute; flags != exp {
+				t.Errorf("expected map flags to be %d; got %d", exp, flags)
+			}
+			calls = append(calls, rangeCall{page, frame, pageCount})
+			return nil
+		}
+
+		if err := setupDirectMap(); err != nil {
+			t.Fatal(err)
+		}
+
+		expCalls := []rangeCall{
+			{mm.PageFromAddress(expOffset), 0, 0xa0},
+			{mm.PageFromAddress(expOffset + 0x100000), 0x100, 0x7ee0},
+			{mm.PageFromAddress(expOffset + 0x7fe0000), 0x7fe0, 0x20},
+		}
+
+		if len(calls) != len(expCalls) {
+			t.Fatalf("expected mapRange to be called %d times; got %d", len(expCalls), len(calls))
+		}
+
+		for index, exp := range expCalls {
+			if calls[index] != exp {
+				t.Errorf("[call %d] expected mapRange args %+v; got %+v", index, exp, calls[index])
+			}
+		}
+
+		if directMapOffset != expOffset {
+			t.Fatalf("expected direct map offset to be 0x%x; got 0x%x", expOffset, directMapOffset)
+		}
+	})
+
+	t.Run("read-only kernel image", func(t *testing.T) {
+		defer func() { kernelImageStartAddr, kernelImageEndAddr = 0, 0 }()
+		directMapOffset = 0
+		kernelImageStartAddr, kernelImageEndAddr = 0x100000, 0x50a000
+
+		type rangeCall struct {
+			page      mm.Page
+			frame     mm.Frame
+			pageCount uintptr
+			flags     PageTableEntryFlag
+		}
+
+		var calls []rangeCall
+		mapRangeFn = func(page mm.Page, frame mm.Frame, pageCount uintptr, flags PageTableEntryFlag) *kernel.Error {
+			calls = append(calls, rangeCall{page, frame, pageCount, flags})
+			return nil
+		}
+
+		if err := setupDirectMap(); err != nil {
+			t.Fatal(err)
+		}
+
+		rwFlags := FlagPresent | FlagRW | FlagNoExecute
+		expCalls := []rangeCall{
+			{mm.PageFromAddress(expOffset), 0, 0xa0, rwFlags},
+			{mm.PageFromAddress(expOffset + 0x100000), 0x100, 0x40a, FlagPresent | FlagNoExecute},
+			{mm.PageFromAddress(expOffset + 0x50a000), 0x50a, 0x7ad6, rwFlags},
+			{mm.PageFromAddress(expOffset + 0x7fe0000), 0x7fe0, 0x20, rwFlags},
+		}
+
+		if len(calls) != len(expCalls) {
+			t.Fatalf("expected mapRange to be called %d times; got %d", len(expCalls), len(calls))
+		}
+
+		for index, exp := range expCalls {
+			if calls[index] != exp {
+				t.Errorf("[call %d] expected mapRange args %+v; got %+v", index, exp, calls[index])
+			}
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		directMapOffset = 0
+
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		mapRangeFn = func(_ mm.Page, _ mm.Frame, _ uintptr, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if err := setupDirectMap(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+
+		if directMapOffset != 0 {
+			t.Fatal("expected direct map offset not to be set")
+		}
+	})
+
+	t.Run("missing memory map", func(t *testing.T) {
+		directMapOffset = 0
+		visitMemRegionsFn = func(_ multiboot.MemRegionVisitor) {}
+
+		if err := setupDirectMap(); err != nil {
+			t.Fatal(err)
+		}
+
+		if directMapOffset != 0 {
+			t.Fatal("expected direct map offset not to be set")
+		}
+	})
+}
+
+func TestReleaseKernelImagePage(t *testing.T) {
+	defer func() {
+		directMapOffset = 0
+		kernelImageStartAddr, kernelImageEndAddr = 0, 0
+		mapFn = Map
+		unmapFn = Unmap
+		frameRefCounts = nil
+	}()
+
+	directMapOffset = directMapBase
+	kernelImageStartAddr, kernelImageEndAddr = 0x100000, 0x200000
+	frameRefCounts = make([]uint16, 0x300)
+	pinFrameRange(0, uintptr(len(frameRefCounts)))
+
+	var (
+		unmapped, mapped mm.Page
+		mapFlags         PageTableEntryFlag
+	)
+	unmapFn = func(page mm.Page) *kernel.Error {
+		unmapped = page
+		return nil
+	}
+	mapFn = func(page mm.Page, _ mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		mapped, mapFlags = page, flags
+		return nil
+	}
+
+	if err := ReleaseKernelImagePage(mm.Page(0x123), mm.Frame(0x150)); err != nil {
+		t.Fatal(err)
+	}
+
+	if unmapped != mm.Page(0x123) {
+		t.Errorf("expected kernel image page to be unmapped; got page 0x%x", unmapped)
+	}
+
+	if exp := mm.PageFromAddress(directMapBase + 0x150000); mapped != exp {
+		t.Errorf("expected direct map page 0x%x to be remapped; got 0x%x", exp, mapped)
+	}
+
+	if exp := FlagPresent | FlagRW | FlagNoExecute; mapFlags != exp {
+		t.Errorf("expected direct map page to be remapped with flags %d; got %d", exp, mapFlags)
+	}
+
+	if got := frameRefCount(mm.Frame(0x150)); got != 0 {
+		t.Errorf("expected released frame to be unpinned; got reference count %d", got)
+	}
+
+	t.Run("frame outside kernel image", func(t *testing.T) {
+		mapped = 0
+		if err := ReleaseKernelImagePage(mm.Page(0x123), mm.Frame(0x250)); err != nil {
+			t.Fatal(err)
+		}
+
+		if mapped != 0 {
+			t.Fatal("expected direct map not to be modified")
+		}
+	})
+
+	t.Run("unmap error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+		unmapFn = func(_ mm.Page) *kernel.Error { return expErr }
+
+		if err := ReleaseKernelImagePage(mm.Page(0x123), mm.Frame(0x150)); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestPhysToVirtAndVirtToPhys(t *testing.T) {
+	defer func() {
+		directMapOffset = 0
+		translateFn = Translate
+	}()
+
+	translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+		return virtAddr + 1, nil
+	}
+
+	directMapOffset = 0
+	if got := PhysToVirt(0x1000); got != 0x1000 {
+		t.Fatalf("expected PhysToVirt to return the physical address when the direct map is not set up; got 0x%x", got)
+	}
+
+	directMapOffset = directMapBase
+	if got := PhysToVirt(0x1000); got != directMapBase+0x1000 {
+		t.Fatalf("expected PhysToVirt to return 0x%x; got 0x%x", directMapBase+0x1000, got)
+	}
+
+	specs := []struct {
+		virtAddr uintptr
+		exp      uintptr
+	}{
+		{directMapBase + 0x1234, 0x1234},
+		// addresses outside the direct map are translated via the page tables
+		{directMapBase - 0x1000, directMapBase - 0x1000 + 1},
+		{directMapBase + directMapMaxPhysAddr, directMapBase + directMapMaxPhysAddr + 1},
+	}
+
+	for specIndex, spec := range specs {
+		got, err := VirtToPhys(spec.virtAddr)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got != spec.exp {
+			t.Errorf("[spec %d] expected VirtToPhys to return 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestDirectMapRegion(t *testing.T) {
+	defer func() {
+		directMapOffset = 0
+		translateFn = Translate
+		mapFn = Map
+	}()
+
+	directMapOffset = directMapBase
+
+	t.Run("success", func(t *testing.T) {
+		var mappedPages []mm.Page
+		translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+			// The second page is already mapped
+			if virtAddr == directMapBase+0x11000 {
+				return 0x11000, nil
+			}
+			return 0, ErrInvalidMapping
+		}
+		mapFn = func(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			if exp := mm.PageFromAddress(PhysToVirt(frame.Address())); page != exp {
+				t.Errorf("expected frame 0x%x to be mapped to page 0x%x; got 0x%x", frame, exp, page)
+			}
+			if flags != FlagPresent {
+				t.Errorf("expected map flags to be %d; got %d", FlagPresent, flags)
+			}
+			mappedPages = append(mappedPages, page)
+			return nil
+		}
+
+		page, err := DirectMapRegion(mm.Frame(0x10), 2*mm.PageSize+1, FlagPresent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := mm.PageFromAddress(directMapBase + 0x10000); page != exp {
+			t.Fatalf("expected returned page to be 0x%x; got 0x%x", exp, page)
+		}
+
+		if len(mappedPages) != 2 {
+			t.Fatalf("expected 2 pages to be mapped; got %d", len(mappedPages))
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, ErrInvalidMapping }
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+
+		if _, err := DirectMapRegion(mm.Frame(0x10), mm.PageSize, FlagPresent); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("region beyond direct map range", func(t *testing.T) {
+		if _, err := DirectMapRegion(mm.FrameFromAddress(directMapMaxPhysAddr-mm.PageSize), 2*mm.PageSize, FlagPresent); err != errDirectMapRange {
+			t.Fatalf("expected error: %v; got %v", errDirectMapRange, err)
+		}
+	})
+}
+
+func TestAccessFrame(t *testing.T) {
+	defer func() {
+		directMapOffset = 0
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+	}()
+
+	var mapCount, unmapCount int
+	mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) {
+		mapCount++
+		return mm.PageFromAddress(tempMappingAddr), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error {
+		unmapCount++
+		return nil
+	}
+
+	// Without a direct map, frames are accessed via temporary mappings
+	directMapOffset = 0
+	page, err := accessFrame(mm.Frame(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseFrame(page)
+
+	if page != mm.PageFromAddress(tempMappingAddr) || mapCount != 1 || unmapCount != 1 {
+		t.Fatalf("expected frame to be accessed via a temporary mapping; got page 0x%x (map calls: %d, unmap calls: %d)", page, mapCount, unmapCount)
+	}
+
+	// With a direct map, no temporary mappings are established
+	directMapOffset = directMapBase
+	if page, err = accessFrame(mm.Frame(42)); err != nil {
+		t.Fatal(err)
+	}
+	releaseFrame(page)
+
+	if exp := mm.PageFromAddress(directMapBase + 42*mm.PageSize); page != exp || mapCount != 1 || unmapCount != 1 {
+		t.Fatalf("expected frame to be accessed via page 0x%x; got page 0x%x (map calls: %d, unmap calls: %d)", exp, page, mapCount, unmapCount)
+	}
+}
@@ -2,24 +2,61 @@ package vmm
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/debug"
 	"gopheros/kernel/gate"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
 )
 
+const (
+	// doubleFaultIST is the interrupt stack table entry used by the
+	// double fault handler.
+	doubleFaultIST = 1
+
+	// doubleFaultStackSize is the size of the dedicated double fault stack.
+	doubleFaultStackSize = 2 * mm.PageSize
+)
+
 var (
-	// handleInterruptFn is used by tests.
-	handleInterruptFn = gate.HandleInterrupt
+	// handleInterruptFn, setInterruptStackFn, dumpExceptionStateFn and
+	// skipPanicStackTraceFn are used by tests.
+	handleInterruptFn     = gate.HandleInterrupt
+	setInterruptStackFn   = gate.SetInterruptStack
+	dumpExceptionStateFn  = gate.DumpExceptionState
+	skipPanicStackTraceFn = debug.SkipPanicStackTrace
+
+	errKernelStackOverflow = &kernel.Error{Module: "vmm", Message: "kernel stack overflow"}
 )
 
+// setupDoubleFaultStack allocates a dedicated stack for the double fault
+// handler. A kernel stack overflow causes the CPU to fault while trying to
+// push the page fault exception frame to the stack; handling the resulting
+// double fault using a separate stack prevents a triple fault.
+func setupDoubleFaultStack() *kernel.Error {
+	stackTop, err := AllocKernelStack(doubleFaultStackSize)
+	if err != nil {
+		return err
+	}
+
+	setInterruptStackFn(doubleFaultIST, stackTop)
+	return nil
+}
+
 func installFaultHandlers() {
 	handleInterruptFn(gate.PageFaultException, 0, pageFaultHandler)
-	handleInterruptFn(gate.GPFException, 0, generalProtectionFaultHandler)
+	handleInterruptFn(gate.DoubleFault, doubleFaultIST, doubleFaultHandler)
 }
 
 // pageFaultHandler is invoked when a PDT or PDT-entry is not present or when a
 // RW protection check fails.
 func pageFaultHandler(regs *gate.Registers) {
+	// Faults triggered by the protection self-check are expected; resume
+	// execution so that the probe reports the fault to its caller.
+	if probeActive {
+		regs.RIP = uint64(probeFaultReturnAddr())
+		return
+	}
+
 	var (
 		faultAddress = uintptr(readCR2Fn())
 		faultPage    = mm.PageFromAddress(faultAddress)
@@ -34,6 +71,17 @@ func pageFaultHandler(regs *gate.Registers) {
 			pageEntry = pte
 		}
 
+		// CoW huge pages are split so that only the faulting page
+		// needs to be copied. Other faults inside huge pages cannot
+		// be recovered.
+		if nextIsPresent && pteLevel < pageLevels-1 && pte.HasFlags(FlagHugePage) {
+			if pte.HasFlags(FlagRW) || !pte.HasFlags(FlagCopyOnWrite) {
+				return false
+			}
+
+			return splitHugePage(faultAddress, pteLevel, pte) == nil
+		}
+
 		// Abort walk if the next page table entry is missing
 		return nextIsPresent
 	})
@@ -46,41 +94,87 @@ func pageFaultHandler(regs *gate.Registers) {
 			err     *kernel.Error
 		)
 
+		// If this is the only mapping of the frame there is no need
+		// to copy it; just make it writable.
+		if frameRefCount(pageEntry.Frame()) == 1 {
+			pageEntry.ClearFlags(FlagCopyOnWrite)
+			pageEntry.SetFlags(FlagRW)
+			flushTLBEntry(faultPage.Address())
+			mm.TrackCoWFault()
+			return
+		}
+
 		if copy, err = mm.AllocFrame(); err != nil {
 			nonRecoverablePageFault(faultAddress, regs, err)
-		} else if tmpPage, err = mapTemporaryFn(copy); err != nil {
+		} else if tmpPage, err = accessFrame(copy); err != nil {
 			nonRecoverablePageFault(faultAddress, regs, err)
 		} else {
 			// Copy page contents, mark as RW and remove CoW flag
 			kernel.Memcopy(faultPage.Address(), tmpPage.Address(), mm.PageSize)
-			_ = unmapFn(tmpPage)
+			releaseFrame(tmpPage)
 
 			// Update mapping to point to the new frame, flag it as RW and
 			// remove the CoW flag
+			origFrame := pageEntry.Frame()
 			pageEntry.ClearFlags(FlagCopyOnWrite)
 			pageEntry.SetFlags(FlagPresent | FlagRW)
 			pageEntry.SetFrame(copy)
-			flushTLBEntryFn(faultPage.Address())
+			flushTLBEntry(faultPage.Address())
+
+			incFrameRefCount(copy)
+			if err = decFrameRefCount(origFrame); err != nil {
+				nonRecoverablePageFault(faultAddress, regs, err)
+			}
+			mm.TrackCoWFault()
+
+			// Fault recovered; retry the instruction that caused the fault
+			return
+		}
+	}
+
+	// Non-present pages inside a pager region are populated on demand
+	if regs.Info&1 == 0 {
+		if region := findPagerRegion(faultAddress); region != nil {
+			if err := region.pageIn(faultPage); err != nil {
+				nonRecoverablePageFault(faultAddress, regs, err)
+			}
 
 			// Fault recovered; retry the instruction that caused the fault
 			return
 		}
 	}
 
+	if isGuardPage(faultAddress) {
+		nonRecoverablePageFault(faultAddress, regs, errKernelStackOverflow)
+	}
+
 	nonRecoverablePageFault(faultAddress, regs, errUnrecoverableFault)
 }
 
-// generalProtectionFaultHandler is invoked for various reasons:
-// - segment errors (privilege, type or limit violations)
-// - executing privileged instructions outside ring-0
-// - attempts to access reserved or unimplemented CPU registers
-func generalProtectionFaultHandler(regs *gate.Registers) {
-	kfmt.Printf("\nGeneral protection fault while accessing address: 0x%x\n", readCR2Fn())
-	kfmt.Printf("Registers:\n")
-	regs.DumpTo(kfmt.GetOutputSink())
+// doubleFaultHandler is invoked when the CPU fails to invoke the handler for
+// another exception. This typically happens when a kernel stack overflows
+// into its guard page as the CPU cannot push the page fault exception frame
+// to the stack. The handler runs on a dedicated stack.
+//
+// The RIP value saved by the CPU for a double fault is architecturally
+// undefined so the handler reports the stack pointer and the faulting address
+// instead.
+func doubleFaultHandler(regs *gate.Registers) {
+	faultAddress := uintptr(readCR2Fn())
+
+	err := errUnrecoverableFault
+	if isGuardPage(faultAddress) {
+		err = errKernelStackOverflow
+		kfmt.Printf("\nkernel stack overflow at RSP: 0x%16x (guard page address: 0x%16x)\n", regs.RSP, faultAddress)
+	} else {
+		kfmt.Printf("\nDouble fault at RSP: 0x%16x (CR2: 0x%16x)\n", regs.RSP, faultAddress)
+	}
+	kfmt.Printf("The saved RIP is undefined for double faults; the stack trace may be bogus\n")
 
-	// TODO: Revisit this when user-mode tasks are implemented
-	panic(errUnrecoverableFault)
+	dumpExceptionStateFn(kfmt.GetOutputSink(), gate.DoubleFault, regs)
+
+	skipPanicStackTraceFn()
+	panic(err)
 }
 
 func nonRecoverablePageFault(faultAddress uintptr, regs *gate.Registers, err *kernel.Error) {
@@ -104,9 +198,10 @@ func nonRecoverablePageFault(faultAddress uintptr, regs *gate.Registers, err *ke
 		kfmt.Printf("unknown")
 	}
 
-	kfmt.Printf("\n\nRegisters:\n")
-	regs.DumpTo(kfmt.GetOutputSink())
+	kfmt.Printf("\n")
+	dumpExceptionStateFn(kfmt.GetOutputSink(), gate.PageFaultException, regs)
 
 	// TODO: Revisit this when user-mode tasks are implemented
+	skipPanicStackTraceFn()
 	panic(err)
 }
@@ -8,11 +8,20 @@ import (
 	"gopheros/kernel/gate"
 	"gopheros/kernel/kfmt"
 	"gopheros/kernel/mm"
+	"io"
 	"strings"
 	"testing"
 	"unsafe"
 )
 
+func init() {
+	// Reading the control registers requires ring-0 access so tests only
+	// dump the general purpose registers.
+	dumpExceptionStateFn = func(w io.Writer, _ gate.InterruptNumber, regs *gate.Registers) {
+		regs.DumpTo(w)
+	}
+}
+
 func TestRecoverablePageFault(t *testing.T) {
 	var (
 		regs       gate.Registers
@@ -97,6 +106,162 @@ func TestRecoverablePageFault(t *testing.T) {
 
 }
 
+func TestCopyOnWriteFrameRefCounts(t *testing.T) {
+	var (
+		regs        gate.Registers
+		pageEntry   pageTableEntry
+		origPage    = make([]byte, mm.PageSize)
+		clonedPage  = make([]byte, mm.PageSize)
+		freedFrames []mm.Frame
+	)
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		mm.SetFrameAllocator(nil)
+		mm.SetFrameFreer(nil)
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		frameRefCounts = nil
+	}(ptePtrFn)
+
+	var clonedFrame mm.Frame
+	ptePtrFn = func(entry uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return uint64(uintptr(unsafe.Pointer(&origPage[0]))) }
+	mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	flushTLBEntryFn = func(_ uintptr) {}
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		clonedFrame = mm.Frame(uintptr(unsafe.Pointer(&clonedPage[0])) >> mm.PageShift)
+		return clonedFrame, nil
+	})
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+
+	// Only the original frame (1) is tracked
+	frameRefCounts = make([]uint16, 2)
+
+	t.Run("sole reference", func(t *testing.T) {
+		frameRefCounts[1] = 1
+		pageEntry = 0
+		pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+		pageEntry.SetFrame(mm.Frame(1))
+
+		regs.Info = 3
+		pageFaultHandler(&regs)
+
+		if !pageEntry.HasFlags(FlagRW) || pageEntry.HasFlags(FlagCopyOnWrite) || pageEntry.Frame() != mm.Frame(1) {
+			t.Fatalf("expected entry to be made writable in place; got %x", pageEntry)
+		}
+	})
+
+	t.Run("shared frame", func(t *testing.T) {
+		frameRefCounts[1] = 2
+		pageEntry = 0
+		pageEntry.SetFlags(FlagPresent | FlagCopyOnWrite)
+		pageEntry.SetFrame(mm.Frame(1))
+
+		regs.Info = 3
+		pageFaultHandler(&regs)
+
+		if !pageEntry.HasFlags(FlagRW) || pageEntry.Frame() != clonedFrame {
+			t.Fatalf("expected entry to point to a writable copy of the page; got %x", pageEntry)
+		}
+
+		if got := frameRefCount(1); got != 1 {
+			t.Fatalf("expected reference count for the original frame to be 1; got %d", got)
+		}
+
+		if len(freedFrames) != 0 {
+			t.Fatalf("expected no frames to be freed; got %v", freedFrames)
+		}
+	})
+}
+
+func TestRecoverableHugePageFault(t *testing.T) {
+	var (
+		regs       gate.Registers
+		physPages  [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		origPage   = make([]byte, mm.PageSize)
+		clonedPage = make([]byte, mm.PageSize)
+	)
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		readCR2Fn = cpu.ReadCR2
+		mm.SetFrameAllocator(nil)
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		flushTLBEntryFn = cpu.FlushTLBEntry
+	}(ptePtrFn, nextAddrFn)
+
+	faultAddr := uintptr(unsafe.Pointer(&origPage[0]))
+	p1Index := (faultAddr >> pageLevelShifts[pageLevels-1]) & ((1 << pageLevelBits[pageLevels-1]) - 1)
+
+	pteCallCount := 0
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mm.PageSize-1)) >> mm.PointerShift
+		if pteCallCount < pageLevels {
+			pteIndex = 0
+		}
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+	nextAddrFn = func(_ uintptr) uintptr { return uintptr(unsafe.Pointer(&physPages[3][0])) }
+	readCR2Fn = func() uint64 { return uint64(uintptr(unsafe.Pointer(&origPage[0]))) }
+	mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+	flushTLBEntryFn = func(_ uintptr) {}
+
+	allocCount := 0
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		defer func() { allocCount++ }()
+		if allocCount == 0 {
+			return mm.Frame(uintptr(unsafe.Pointer(&physPages[3][0])) >> mm.PageShift), nil
+		}
+		return mm.Frame(uintptr(unsafe.Pointer(&clonedPage[0])) >> mm.PageShift), nil
+	})
+
+	for i := 0; i < len(origPage); i++ {
+		origPage[i] = byte(i % 256)
+	}
+
+	physPages[0][0].SetFlags(FlagPresent | FlagRW)
+	physPages[1][0].SetFlags(FlagPresent | FlagRW)
+	physPages[2][0].SetFrame(mm.Frame(0x200))
+	physPages[2][0].SetFlags(FlagPresent | FlagCopyOnWrite | FlagHugePage)
+
+	regs.Info = 3
+	pageFaultHandler(&regs)
+
+	if physPages[2][0].HasFlags(FlagHugePage) {
+		t.Fatal("expected huge page to be split")
+	}
+
+	for index, pte := range physPages[3] {
+		if uintptr(index) == p1Index {
+			if !pte.HasFlags(FlagPresent|FlagRW) || pte.HasFlags(FlagCopyOnWrite) {
+				t.Errorf("expected faulting page entry to be RW and not CoW")
+			}
+			continue
+		}
+
+		if !pte.HasFlags(FlagPresent|FlagCopyOnWrite) || pte.HasFlags(FlagRW) {
+			t.Errorf("expected entry %d to remain a read-only CoW page", index)
+		}
+	}
+
+	for i := 0; i < len(origPage); i++ {
+		if origPage[i] != clonedPage[i] {
+			t.Fatalf("expected clone page to be a copy of the original page; mismatch at index %d", i)
+		}
+	}
+}
+
 func TestNonRecoverablePageFault(t *testing.T) {
 	defer func() {
 		kfmt.SetOutputSink(nil)
@@ -164,22 +329,95 @@ func TestNonRecoverablePageFault(t *testing.T) {
 	}
 }
 
-func TestGPFHandler(t *testing.T) {
-	defer func() {
+func TestDoubleFaultHandler(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
 		readCR2Fn = cpu.ReadCR2
-	}()
+		kfmt.SetOutputSink(nil)
+	}(ptePtrFn)
+
+	specs := []struct {
+		pteFlags  PageTableEntryFlag
+		expErr    *kernel.Error
+		expOutput string
+	}{
+		{FlagGuardPage, errKernelStackOverflow, "kernel stack overflow at RSP: 0x00000000deadb000 (guard page address: 0x000000badf00d000)"},
+		{0, errUnrecoverableFault, "Double fault at RSP: 0x00000000deadb000 (CR2: 0x000000badf00d000)"},
+	}
 
-	var regs gate.Registers
+	var (
+		regs      gate.Registers
+		buf       bytes.Buffer
+		pageEntry pageTableEntry
+	)
+
+	regs.RIP, regs.RSP = 0xc0ffee00, 0xdeadb000
+	readCR2Fn = func() uint64 { return 0xbadf00d000 }
+	kfmt.SetOutputSink(&buf)
 
-	readCR2Fn = func() uint64 {
-		return 0xbadf00d000
+	for specIndex, spec := range specs {
+		t.Run(fmt.Sprint(specIndex), func(t *testing.T) {
+			buf.Reset()
+
+			// Intermediate levels must be present; the final entry
+			// uses the spec flags.
+			pteCallCount := 0
+			ptePtrFn = func(_ uintptr) unsafe.Pointer {
+				pteCallCount++
+				if pteCallCount < pageLevels {
+					pageEntry = pageTableEntry(FlagPresent)
+				} else {
+					pageEntry = pageTableEntry(spec.pteFlags)
+				}
+				return unsafe.Pointer(&pageEntry)
+			}
+
+			defer func() {
+				if err := recover(); err != spec.expErr {
+					t.Errorf("expected a panic with %v; got %v", spec.expErr, err)
+				}
+
+				if got := buf.String(); !strings.Contains(got, spec.expOutput) {
+					t.Errorf("expected output to contain %q; got:\n%s", spec.expOutput, got)
+				}
+			}()
+
+			doubleFaultHandler(&regs)
+		})
 	}
+}
+
+func TestPageFaultOnGuardPage(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		kfmt.SetOutputSink(nil)
+	}(ptePtrFn)
+
+	var (
+		regs      gate.Registers
+		buf       bytes.Buffer
+		pageEntry pageTableEntry
+	)
+
+	pteCallCount := 0
+	ptePtrFn = func(_ uintptr) unsafe.Pointer {
+		pteCallCount++
+		if pteCallCount%pageLevels != 0 {
+			pageEntry = pageTableEntry(FlagPresent)
+		} else {
+			pageEntry = pageTableEntry(FlagGuardPage)
+		}
+		return unsafe.Pointer(&pageEntry)
+	}
+	readCR2Fn = func() uint64 { return 0xbadf00d000 }
+	kfmt.SetOutputSink(&buf)
 
 	defer func() {
-		if err := recover(); err != errUnrecoverableFault {
-			t.Errorf("expected a panic with errUnrecoverableFault; got %v", err)
+		if err := recover(); err != errKernelStackOverflow {
+			t.Errorf("expected a panic with errKernelStackOverflow; got %v", err)
 		}
 	}()
 
-	generalProtectionFaultHandler(&regs)
+	pageFaultHandler(&regs)
 }
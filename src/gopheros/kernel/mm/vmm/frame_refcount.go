@@ -0,0 +1,251 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"gopheros/multiboot"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+var (
+	// frameRefCounts tracks the number of page mappings that point to each
+	// physical frame and is indexed by mm.Frame. Frames beyond the end of
+	// the table and ReservedZeroedFrame are not tracked. Frames that are
+	// not managed by the frame allocator and frames that are already
+	// mapped when Init allocates the table are pinned: their count is
+	// saturated so they are never released. The temporary mapping and the
+	// direct map alias frames owned by other mappings and are therefore
+	// not counted.
+	frameRefCounts    []uint16
+	frameRefCountsHdr reflect.SliceHeader
+
+	// visitMemRegionsFn is used by tests and is automatically inlined by
+	// the compiler.
+	visitMemRegionsFn = multiboot.VisitMemRegions
+)
+
+// setupFrameRefCounts reserves and maps a region large enough to hold the
+// reference counts for all frames up to the highest available physical memory
+// address reported by the bootloader.
+func setupFrameRefCounts() *kernel.Error {
+	var frameCount uintptr
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAvailable {
+			return true
+		}
+
+		if regionEnd := uintptr(region.PhysAddress+region.Length) >> mm.PageShift; regionEnd > frameCount {
+			frameCount = regionEnd
+		}
+		return true
+	})
+
+	if frameCount == 0 {
+		return nil
+	}
+
+	requiredBytes := (frameCount*unsafe.Sizeof(frameRefCounts[0]) + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+	regionAddr, err := earlyReserveRegionFn(requiredBytes)
+	if err != nil {
+		return err
+	}
+
+	for page, lastPage := mm.PageFromAddress(regionAddr), mm.PageFromAddress(regionAddr+requiredBytes-1); page <= lastPage; page++ {
+		frame, err := mm.AllocFrame()
+		if err != nil {
+			return err
+		}
+
+		if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+			return err
+		}
+
+		kernel.Memset(page.Address(), 0, mm.PageSize)
+	}
+
+	frameRefCountsHdr.Data = regionAddr
+	frameRefCountsHdr.Len = int(frameCount)
+	frameRefCountsHdr.Cap = int(frameCount)
+	frameRefCounts = *(*[]uint16)(unsafe.Pointer(&frameRefCountsHdr))
+	return seedFrameRefCounts()
+}
+
+// seedFrameRefCounts pins the frames that must never be released when their
+// reference count drops to zero: frames that are not fully contained in an
+// available or ACPI-reclaimable memory region (and are therefore never managed
+// by the frame allocator) and frames that are mapped by the active page tables.
+func seedFrameRefCounts() *kernel.Error {
+	for frame := range frameRefCounts {
+		frameRefCounts[frame] = math.MaxUint16
+	}
+
+	visitMemRegionsFn(func(region *multiboot.MemoryMapEntry) bool {
+		if region.Type != multiboot.MemAvailable && region.Type != multiboot.MemAcpiReclaimable {
+			return true
+		}
+
+		var (
+			frame    = (uintptr(region.PhysAddress) + mm.PageSize - 1) >> mm.PageShift
+			endFrame = uintptr(region.PhysAddress+region.Length) >> mm.PageShift
+		)
+
+		for ; frame < endFrame && frame < uintptr(len(frameRefCounts)); frame++ {
+			frameRefCounts[frame] = 0
+		}
+		return true
+	})
+
+	return pinMappedFrames(mm.FrameFromAddress(activePDTFn()), 0, 0)
+}
+
+// pinMappedFrames pins the frames that are mapped by the entries of the page
+// table stored in tableFrame. The baseAddr argument contains the virtual
+// address bits that correspond to the page table entries traversed so far.
+// The recursive page table mapping as well as the mappings that are not
+// reference counted are skipped.
+func pinMappedFrames(tableFrame mm.Frame, level uint8, baseAddr uintptr) *kernel.Error {
+	var (
+		tablePage mm.Page
+		mapped    bool
+		err       *kernel.Error
+	)
+
+	for index := uintptr(0); index < 1<<pageLevelBits[level]; index++ {
+		if level == 0 && index == recursiveEntry {
+			continue
+		}
+
+		// Visiting the next level tables may overwrite the temporary
+		// mapping
+		if !mapped {
+			if tablePage, err = accessFrame(tableFrame); err != nil {
+				return err
+			}
+			mapped = true
+		}
+
+		pte := *tableEntry(tablePage, index)
+		if !pte.HasFlags(FlagPresent) {
+			continue
+		}
+
+		// Addresses in the upper half of the address space are
+		// sign-extended.
+		entryAddr := baseAddr | (index << pageLevelShifts[level])
+		if level == 0 && index >= kernelHalfFirstEntry {
+			entryAddr |= ^uintptr(0) << (pageLevelShifts[0] + pageLevelBits[0])
+		}
+
+		switch {
+		case level == pageLevels-1:
+			if refCountedAddr(entryAddr) {
+				pinFrameRange(pte.Frame(), 1)
+			}
+		case pte.HasFlags(FlagHugePage):
+			if refCountedAddr(entryAddr) {
+				pinFrameRange(hugePageFrame(pte, level), (uintptr(1)<<pageLevelShifts[level])>>mm.PageShift)
+			}
+		default:
+			mapped = false
+			if err = pinMappedFrames(pte.Frame(), level+1, entryAddr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mapped {
+		releaseFrame(tablePage)
+	}
+
+	return nil
+}
+
+// refCountedAddr returns true if the mapping for virtAddr is reference
+// counted.
+func refCountedAddr(virtAddr uintptr) bool {
+	return virtAddr != tempMappingAddr &&
+		(directMapOffset == 0 || virtAddr < directMapOffset || virtAddr-directMapOffset >= directMapMaxPhysAddr)
+}
+
+// frameRefCountTracked returns true if the reference count for frame is
+// tracked by the frameRefCounts table.
+func frameRefCountTracked(frame mm.Frame) bool {
+	return uintptr(frame) < uintptr(len(frameRefCounts)) && frame != ReservedZeroedFrame
+}
+
+// frameRefCount returns the number of mappings that point to frame. Untracked
+// frames always report a zero count.
+func frameRefCount(frame mm.Frame) uint16 {
+	if !frameRefCountTracked(frame) {
+		return 0
+	}
+
+	return frameRefCounts[frame]
+}
+
+// incFrameRefCount increments the reference count for frame. Counts that
+// reach the maximum value saturate and the frame is never released.
+func incFrameRefCount(frame mm.Frame) {
+	if frameRefCountTracked(frame) && frameRefCounts[frame] != math.MaxUint16 {
+		frameRefCounts[frame]++
+	}
+}
+
+// decFrameRefCount decrements the reference count for frame and returns the
+// frame to the physical frame allocator once its count drops to zero. It
+// returns any error reported by the frame allocator.
+func decFrameRefCount(frame mm.Frame) *kernel.Error {
+	if !frameRefCountTracked(frame) || frameRefCounts[frame] == 0 || frameRefCounts[frame] == math.MaxUint16 {
+		return nil
+	}
+
+	if frameRefCounts[frame]--; frameRefCounts[frame] == 0 {
+		return mm.FreeFrame(frame)
+	}
+
+	return nil
+}
+
+// pinFrameRange saturates the reference counts for the frameCount consecutive
+// frames starting at frame so that they are never released.
+func pinFrameRange(frame mm.Frame, frameCount uintptr) {
+	for ; frameCount > 0; frame, frameCount = frame+1, frameCount-1 {
+		if frameRefCountTracked(frame) {
+			frameRefCounts[frame] = math.MaxUint16
+		}
+	}
+}
+
+// unpinFrame clears the reference count of a pinned frame that is no longer
+// mapped and is handed over to the frame allocator.
+func unpinFrame(frame mm.Frame) {
+	if frameRefCountTracked(frame) {
+		frameRefCounts[frame] = 0
+	}
+}
+
+// incFrameRangeRefCount increments the reference counts for the frameCount
+// consecutive frames starting at frame. It is used for huge page mappings
+// which reference all frames in the physical memory region they span.
+func incFrameRangeRefCount(frame mm.Frame, frameCount uintptr) {
+	for ; frameCount > 0; frame, frameCount = frame+1, frameCount-1 {
+		incFrameRefCount(frame)
+	}
+}
+
+// decFrameRangeRefCount decrements the reference counts for the frameCount
+// consecutive frames starting at frame. All counts are decremented even if
+// releasing a frame fails; the first error is returned.
+func decFrameRangeRefCount(frame mm.Frame, frameCount uintptr) *kernel.Error {
+	var firstErr *kernel.Error
+	for ; frameCount > 0; frame, frameCount = frame+1, frameCount-1 {
+		if err := decFrameRefCount(frame); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,389 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/mm"
+	"gopheros/multiboot"
+	"math"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestSetupFrameRefCounts(t *testing.T) {
+	defer func() {
+		visitMemRegionsFn = multiboot.VisitMemRegions
+		earlyReserveRegionFn = EarlyReserveRegion
+		mapFn = Map
+		activePDTFn = cpu.ActivePDT
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		mm.SetFrameAllocator(nil)
+		frameRefCounts = nil
+	}()
+
+	var (
+		regionBuf = make([]byte, mm.PageSize)
+		expErr    = &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		// The active page tables are stored in frames 0x1f0-0x1f3.
+		tableBuf        = make([]byte, (pageLevels+1)*mm.PageSize)
+		tableBufAddr    = (uintptr(unsafe.Pointer(&tableBuf[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		firstTableFrame = mm.Frame(0x1f0)
+	)
+
+	tableEntryFor := func(level uint8, index uintptr) *pageTableEntry {
+		return tableEntry(mm.PageFromAddress(tableBufAddr+uintptr(level)*mm.PageSize), index)
+	}
+
+	// P4[0] -> P3[0] -> P2[0] -> P1 which maps frame 0x10 at index 5. The
+	// recursive P4 entry must be skipped.
+	for level := uint8(0); level < pageLevels-1; level++ {
+		tableEntryFor(level, 0).SetFrame(firstTableFrame + mm.Frame(level+1))
+		tableEntryFor(level, 0).SetFlags(FlagPresent | FlagRW)
+	}
+	tableEntryFor(pageLevels-1, 5).SetFrame(mm.Frame(0x10))
+	tableEntryFor(pageLevels-1, 5).SetFlags(FlagPresent)
+	tableEntryFor(0, recursiveEntry).SetFrame(firstTableFrame)
+	tableEntryFor(0, recursiveEntry).SetFlags(FlagPresent | FlagRW)
+
+	activePDTFn = func() uintptr { return firstTableFrame.Address() }
+	mapTemporaryFn = func(frame mm.Frame) (mm.Page, *kernel.Error) {
+		return mm.PageFromAddress(tableBufAddr + uintptr(frame-firstTableFrame)*mm.PageSize), nil
+	}
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+
+	visitMemRegionsFn = func(visitor multiboot.MemRegionVisitor) {
+		for _, region := range []multiboot.MemoryMapEntry{
+			{PhysAddress: 0, Length: 0x9fc00, Type: multiboot.MemAvailable},
+			{PhysAddress: 0x100000, Length: 0x100000, Type: multiboot.MemAvailable},
+			{PhysAddress: 0xfffc0000, Length: 0x40000, Type: multiboot.MemReserved},
+		} {
+			if !visitor(&region) {
+				return
+			}
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		for i := range regionBuf {
+			regionBuf[i] = 0xff
+		}
+
+		var mapCount int
+		earlyReserveRegionFn = func(size uintptr) (uintptr, *kernel.Error) {
+			if size != mm.PageSize {
+				t.Errorf("expected to reserve %d bytes; got %d", mm.PageSize, size)
+			}
+			return uintptr(unsafe.Pointer(&regionBuf[0])), nil
+		}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.Frame(42), nil })
+		mapFn = func(_ mm.Page, _ mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			mapCount++
+			if exp := FlagPresent | FlagRW | FlagNoExecute; flags != exp {
+				t.Errorf("expected map flags to be %d; got %d", exp, flags)
+			}
+			return nil
+		}
+
+		if err := setupFrameRefCounts(); err != nil {
+			t.Fatal(err)
+		}
+
+		if mapCount != 1 {
+			t.Fatalf("expected 1 page to be mapped; got %d", mapCount)
+		}
+
+		if exp := 0x200; len(frameRefCounts) != exp {
+			t.Fatalf("expected table to track %d frames; got %d", exp, len(frameRefCounts))
+		}
+
+		// Frames outside the available regions and mapped frames are
+		// pinned.
+		for frame, count := range frameRefCounts {
+			expCount := uint16(0)
+			if (frame >= 0x9f && frame < 0x100) || frame == 0x10 {
+				expCount = math.MaxUint16
+			}
+
+			if count != expCount {
+				t.Fatalf("expected reference count for frame 0x%x to be %d; got %d", frame, expCount, count)
+			}
+		}
+	})
+
+	t.Run("seed error", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&regionBuf[0])), nil
+		}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.Frame(42), nil })
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return nil }
+		origMapTemporary := mapTemporaryFn
+		defer func() { mapTemporaryFn = origMapTemporary }()
+		mapTemporaryFn = func(_ mm.Frame) (mm.Page, *kernel.Error) { return 0, expErr }
+
+		if err := setupFrameRefCounts(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("reserve error", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+
+		if err := setupFrameRefCounts(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("alloc error", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			return uintptr(unsafe.Pointer(&regionBuf[0])), nil
+		}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr })
+
+		if err := setupFrameRefCounts(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("map error", func(t *testing.T) {
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.Frame(42), nil })
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+
+		if err := setupFrameRefCounts(); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestFrameRefCounts(t *testing.T) {
+	defer func(origZeroedFrame mm.Frame) {
+		ReservedZeroedFrame = origZeroedFrame
+		mm.SetFrameFreer(nil)
+		frameRefCounts = nil
+	}(ReservedZeroedFrame)
+
+	var freedFrames []mm.Frame
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+
+	frameRefCounts = make([]uint16, 16)
+	ReservedZeroedFrame = mm.Frame(3)
+
+	incFrameRefCount(1)
+	incFrameRefCount(1)
+	if got := frameRefCount(1); got != 2 {
+		t.Fatalf("expected reference count to be 2; got %d", got)
+	}
+
+	decFrameRefCount(1)
+	if len(freedFrames) != 0 {
+		t.Fatal("expected frame not to be freed while it is still referenced")
+	}
+
+	decFrameRefCount(1)
+	decFrameRefCount(1)
+	if exp := []mm.Frame{1}; !reflect.DeepEqual(freedFrames, exp) {
+		t.Fatalf("expected freed frames to be %v; got %v", exp, freedFrames)
+	}
+
+	// Untracked frames
+	for _, frame := range []mm.Frame{ReservedZeroedFrame, 16} {
+		incFrameRefCount(frame)
+		if got := frameRefCount(frame); got != 0 {
+			t.Errorf("expected frame %d not to be tracked; got reference count %d", frame, got)
+		}
+		decFrameRefCount(frame)
+	}
+
+	// Saturated counts
+	frameRefCounts[2] = math.MaxUint16
+	incFrameRefCount(2)
+	decFrameRefCount(2)
+	if got := frameRefCount(2); got != math.MaxUint16 {
+		t.Fatalf("expected saturated reference count to remain unchanged; got %d", got)
+	}
+
+	if exp := []mm.Frame{1}; !reflect.DeepEqual(freedFrames, exp) {
+		t.Fatalf("expected freed frames to be %v; got %v", exp, freedFrames)
+	}
+
+	// Pinned frames are released once unpinned
+	pinFrameRange(4, 2)
+	decFrameRefCount(4)
+	if got := frameRefCount(4); got != math.MaxUint16 {
+		t.Fatalf("expected pinned reference count to remain unchanged; got %d", got)
+	}
+	unpinFrame(4)
+	if got := frameRefCount(4); got != 0 {
+		t.Fatalf("expected unpinned reference count to be 0; got %d", got)
+	}
+
+	// Frame release errors
+	expErr := &kernel.Error{Module: "test", Message: "free failed"}
+	mm.SetFrameFreer(func(_ mm.Frame) *kernel.Error { return expErr })
+	incFrameRefCount(6)
+	if err := decFrameRefCount(6); err != expErr {
+		t.Fatalf("expected error: %v; got %v", expErr, err)
+	}
+
+	incFrameRangeRefCount(7, 2)
+	if err := decFrameRangeRefCount(7, 2); err != expErr {
+		t.Fatalf("expected error: %v; got %v", expErr, err)
+	}
+	if got := frameRefCount(8); got != 0 {
+		t.Fatalf("expected all reference counts in the range to be decremented; got %d", got)
+	}
+}
+
+func TestRefCountedAddr(t *testing.T) {
+	defer func() {
+		directMapOffset = 0
+	}()
+
+	directMapOffset = directMapBase
+
+	specs := []struct {
+		addr uintptr
+		exp  bool
+	}{
+		{0x1000, true},
+		{tempMappingAddr, false},
+		{directMapBase, false},
+		{directMapBase + directMapMaxPhysAddr - mm.PageSize, false},
+		{directMapBase + directMapMaxPhysAddr, true},
+	}
+
+	for specIndex, spec := range specs {
+		if got := refCountedAddr(spec.addr); got != spec.exp {
+			t.Errorf("[spec %d] expected refCountedAddr(0x%x) to return %t; got %t", specIndex, spec.addr, spec.exp, got)
+		}
+	}
+}
+
+func TestMapUnmapFrameRefCounts(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		mm.SetFrameFreer(nil)
+		frameRefCounts = nil
+	}(ptePtrFn)
+
+	var (
+		pageEntry   pageTableEntry
+		freedFrames []mm.Frame
+	)
+
+	// Use the same entry for all page levels so intermediate tables
+	// always appear as present.
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	flushTLBEntryFn = func(_ uintptr) {}
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+	frameRefCounts = make([]uint16, 16)
+
+	pageEntry.SetFlags(FlagPresent)
+	if err := Map(mm.Page(1), mm.Frame(5), FlagPresent|FlagRW); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remapping the page drops the reference to the previous frame
+	if err := Map(mm.Page(1), mm.Frame(6), FlagPresent|FlagRW); err != nil {
+		t.Fatal(err)
+	}
+
+	if frameRefCount(5) != 0 || frameRefCount(6) != 1 {
+		t.Fatalf("expected reference counts 0 and 1 for frames 5 and 6; got %d and %d", frameRefCount(5), frameRefCount(6))
+	}
+
+	// Temporary mappings are not reference counted
+	if _, err := MapTemporary(mm.Frame(7)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Unmap(mm.PageFromAddress(tempMappingAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	if frameRefCount(6) != 1 || frameRefCount(7) != 0 {
+		t.Fatalf("expected temporary mapping not to affect reference counts; got %d and %d for frames 6 and 7", frameRefCount(6), frameRefCount(7))
+	}
+
+	pageEntry = 0
+	pageEntry.SetFlags(FlagPresent)
+	pageEntry.SetFrame(mm.Frame(6))
+	if err := Unmap(mm.Page(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := []mm.Frame{5, 6}; !reflect.DeepEqual(freedFrames, exp) {
+		t.Fatalf("expected freed frames to be %v; got %v", exp, freedFrames)
+	}
+}
+
+func TestHugePageFrameRefCounts(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		mm.SetFrameFreer(nil)
+		frameRefCounts = nil
+	}(ptePtrFn)
+
+	var (
+		physPages    [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		pteCallCount int
+		freedFrames  []mm.Frame
+	)
+
+	ptePtrFn = func(_ uintptr) unsafe.Pointer {
+		pteCallCount++
+		return unsafe.Pointer(&physPages[pteCallCount-1][0])
+	}
+	flushTLBEntryFn = func(_ uintptr) {}
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+	frameRefCounts = make([]uint16, 1024)
+
+	hugePageFrames := HugePage2M.Size() >> mm.PageShift
+	for _, flags := range []PageTableEntryFlag{FlagPresent | FlagRW, FlagPresent | FlagRW | FlagWriteCombine} {
+		freedFrames = nil
+		physPages[0][0] = pageTableEntry(FlagPresent)
+		physPages[1][0] = pageTableEntry(FlagPresent)
+
+		pteCallCount = 0
+		if err := MapHuge(mm.Page(0), mm.Frame(512), HugePage2M, flags); err != nil {
+			t.Fatal(err)
+		}
+
+		for frame := mm.Frame(512); frame < 1024; frame++ {
+			if got := frameRefCount(frame); got != 1 {
+				t.Fatalf("[flags %x] expected reference count for frame %d to be 1; got %d", flags, frame, got)
+			}
+		}
+
+		// Frame 600 is also referenced by another mapping
+		incFrameRefCount(600)
+
+		pteCallCount = 0
+		if err := UnmapHuge(mm.Page(0), HugePage2M); err != nil {
+			t.Fatal(err)
+		}
+
+		if physPages[2][0] != 0 {
+			t.Fatalf("[flags %x] expected huge page entry to be cleared; got %x", flags, physPages[2][0])
+		}
+
+		if exp := int(hugePageFrames) - 1; len(freedFrames) != exp || frameRefCount(600) != 1 {
+			t.Fatalf("[flags %x] expected %d frames to be freed and frame 600 to remain referenced; freed %d frames", flags, exp, len(freedFrames))
+		}
+
+		decFrameRefCount(600)
+	}
+}
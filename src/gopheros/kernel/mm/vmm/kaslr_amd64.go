@@ -0,0 +1,149 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+)
+
+const (
+	// kaslrSlideAlign is the alignment of the early reserve and heap
+	// slides. Using a 2M alignment allows the randomized regions to be
+	// mapped using huge pages.
+	kaslrSlideAlign = uintptr(2 << 20)
+
+	// kaslrDirectMapSlideAlign is the alignment of the direct-map slide
+	// which allows the direct map to be established using 1G pages.
+	kaslrDirectMapSlideAlign = uintptr(1 << 30)
+
+	// The following constants define the maximum slide for each
+	// randomized region.
+	kaslrEarlyReserveMaxSlide = uintptr(512 << 30)
+	kaslrHeapMaxSlide         = uintptr(4 << 40)
+	kaslrDirectMapMaxSlide    = uintptr(16 << 40)
+
+	// kaslrRandomRetries is the number of attempts made to obtain a value
+	// from the on-chip random number generator before falling back to the
+	// next entropy source.
+	kaslrRandomRetries = 10
+
+	// kaslrJitterRounds is the number of time-stamp counter samples mixed
+	// together when no hardware random number generator is available.
+	kaslrJitterRounds = 64
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	readRandomFn     = cpu.ReadRandom
+	readRandomSeedFn = cpu.ReadRandomSeed
+	readTSCFn        = cpu.ReadTSC
+
+	// The per-boot slides selected by RandomizeLayout.
+	earlyReserveSlide uintptr
+	heapSlide         uintptr
+	directMapSlide    uintptr
+)
+
+// RandomizeLayout selects random slides for the early reserve region, the Go
+// heap and the direct physical memory map. The kernel image itself is not
+// relocated so the rt0 code and the redirect table remain valid.
+//
+// The entropy is obtained via the RDSEED or RDRAND instructions if supported
+// by the CPU; otherwise, it is extracted from the jitter of the time-stamp
+// counter. The selected slides are reported when the kernel panics.
+//
+// RandomizeLayout must be invoked before any call to EarlyReserveRegion.
+func RandomizeLayout() {
+	seed := kaslrEntropy()
+
+	earlyReserveSlide = kaslrSlide(&seed, kaslrEarlyReserveMaxSlide, kaslrSlideAlign)
+	heapSlide = kaslrSlide(&seed, kaslrHeapMaxSlide, kaslrSlideAlign)
+	directMapSlide = kaslrSlide(&seed, kaslrDirectMapMaxSlide, kaslrDirectMapSlideAlign)
+
+	earlyReserveStart = tempMappingAddr - earlyReserveSlide
+	earlyReserveLastUsed = earlyReserveStart
+
+	kfmt.RegisterPanicInfoFn(printLayoutSlides)
+}
+
+// HeapSlide returns the size of the randomized gap that should be left before
+// the region reserved for the Go heap.
+func HeapSlide() uintptr {
+	return heapSlide
+}
+
+// DirectMapSlide returns the randomized offset that should be added to the
+// base address of the direct physical memory map.
+func DirectMapSlide() uintptr {
+	return directMapSlide
+}
+
+// printLayoutSlides outputs the slides selected by RandomizeLayout.
+func printLayoutSlides() {
+	kfmt.Printf("[vmm] kaslr slides: early reserve: 0x%x, heap: 0x%x, direct map: 0x%x\n",
+		earlyReserveSlide, heapSlide, directMapSlide,
+	)
+}
+
+// kaslrSlide returns a random slide that is a multiple of align and less than
+// maxSlide. The seed is advanced by each call.
+func kaslrSlide(seed *uint64, maxSlide, align uintptr) uintptr {
+	return (uintptr(splitMix64(seed)) % (maxSlide / align)) * align
+}
+
+// kaslrEntropy returns a random 64-bit value using the best entropy source
+// available to the CPU.
+func kaslrEntropy() uint64 {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf >= 7 {
+		if _, ebx, _, _ := cpuidFn(7); ebx&(1<<18) != 0 {
+			for retry := 0; retry < kaslrRandomRetries; retry++ {
+				if val, ok := readRandomSeedFn(); ok {
+					return val
+				}
+			}
+		}
+	}
+
+	if _, _, ecx, _ := cpuidFn(1); ecx&(1<<30) != 0 {
+		for retry := 0; retry < kaslrRandomRetries; retry++ {
+			if val, ok := readRandomFn(); ok {
+				return val
+			}
+		}
+	}
+
+	return tscJitterEntropy()
+}
+
+// tscJitterEntropy extracts entropy from the variation in the number of
+// cycles required to execute a fixed workload. The samples are mixed into
+// the initial time-stamp counter value.
+func tscJitterEntropy() uint64 {
+	var (
+		seed = readTSCFn()
+		work uint64
+	)
+
+	for round := 0; round < kaslrJitterRounds; round++ {
+		start := readTSCFn()
+		for i := uint64(0); i < 64; i++ {
+			work = (work*31 + i) ^ (work >> 7)
+		}
+		delta := readTSCFn() - start
+
+		seed ^= delta + work
+		seed = splitMix64(&seed)
+	}
+
+	return splitMix64(&seed)
+}
+
+// splitMix64 advances seed and returns the next value of the SplitMix64
+// pseudo-random sequence.
+func splitMix64(seed *uint64) uint64 {
+	*seed += 0x9e3779b97f4a7c15
+	z := *seed
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
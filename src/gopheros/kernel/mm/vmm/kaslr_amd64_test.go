@@ -0,0 +1,130 @@
+package vmm
+
+import (
+	"bytes"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"strings"
+	"testing"
+)
+
+func TestKASLREntropy(t *testing.T) {
+	defer func() {
+		cpuidFn = cpu.ID
+		readRandomFn = cpu.ReadRandom
+		readRandomSeedFn = cpu.ReadRandomSeed
+		readTSCFn = cpu.ReadTSC
+	}()
+
+	specs := []struct {
+		maxLeaf, leaf1ECX, leaf7EBX uint32
+		seedOK, randOK              bool
+		exp                         uint64
+	}{
+		// RDSEED is preferred when available
+		{7, 1 << 30, 1 << 18, true, true, 0x5eed},
+		// RDSEED fails; fall back to RDRAND
+		{7, 1 << 30, 1 << 18, false, true, 0xbadf00d},
+		// leaf 7 is not supported
+		{6, 1 << 30, 1 << 18, true, true, 0xbadf00d},
+		// no hardware RNG; use TSC jitter
+		{7, 0, 0, true, true, 0},
+		// RDRAND fails; use TSC jitter
+		{1, 1 << 30, 0, true, false, 0},
+	}
+
+	for specIndex, spec := range specs {
+		var seedCalls, randCalls int
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0:
+				return spec.maxLeaf, 0, 0, 0
+			case 1:
+				return 0, 0, spec.leaf1ECX, 0
+			case 7:
+				return 0, spec.leaf7EBX, 0, 0
+			}
+			return 0, 0, 0, 0
+		}
+		readRandomSeedFn = func() (uint64, bool) {
+			seedCalls++
+			return 0x5eed, spec.seedOK
+		}
+		readRandomFn = func() (uint64, bool) {
+			randCalls++
+			return 0xbadf00d, spec.randOK
+		}
+		var tsc uint64
+		readTSCFn = func() uint64 {
+			tsc += 100 + tsc%7
+			return tsc
+		}
+
+		got := kaslrEntropy()
+		switch {
+		case spec.exp == 0:
+			if got == 0x5eed || got == 0xbadf00d {
+				t.Errorf("[spec %d] expected TSC jitter entropy to be used; got 0x%x", specIndex, got)
+			}
+		case got != spec.exp:
+			t.Errorf("[spec %d] expected entropy 0x%x; got 0x%x", specIndex, spec.exp, got)
+		}
+
+		if !spec.seedOK && seedCalls != kaslrRandomRetries {
+			t.Errorf("[spec %d] expected RDSEED to be retried %d times; got %d", specIndex, kaslrRandomRetries, seedCalls)
+		}
+		if !spec.randOK && randCalls != kaslrRandomRetries {
+			t.Errorf("[spec %d] expected RDRAND to be retried %d times; got %d", specIndex, kaslrRandomRetries, randCalls)
+		}
+	}
+}
+
+func TestRandomizeLayout(t *testing.T) {
+	defer func(origStart, origLastUsed uintptr) {
+		cpuidFn = cpu.ID
+		readRandomFn = cpu.ReadRandom
+		earlyReserveStart = origStart
+		earlyReserveLastUsed = origLastUsed
+		earlyReserveSlide, heapSlide, directMapSlide = 0, 0, 0
+		kfmt.SetOutputSink(nil)
+	}(earlyReserveStart, earlyReserveLastUsed)
+
+	cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		return 1, 0, 1 << 30, 0
+	}
+
+	seen := make(map[uintptr]bool)
+	for rnd := uint64(0); rnd < 32; rnd++ {
+		randVal := rnd
+		readRandomFn = func() (uint64, bool) { return randVal, true }
+
+		RandomizeLayout()
+
+		if earlyReserveSlide%kaslrSlideAlign != 0 || earlyReserveSlide >= kaslrEarlyReserveMaxSlide {
+			t.Errorf("[rnd %d] invalid early reserve slide 0x%x", rnd, earlyReserveSlide)
+		}
+		if HeapSlide()%kaslrSlideAlign != 0 || HeapSlide() >= kaslrHeapMaxSlide {
+			t.Errorf("[rnd %d] invalid heap slide 0x%x", rnd, HeapSlide())
+		}
+		if DirectMapSlide()%kaslrDirectMapSlideAlign != 0 || DirectMapSlide() >= kaslrDirectMapMaxSlide {
+			t.Errorf("[rnd %d] invalid direct map slide 0x%x", rnd, DirectMapSlide())
+		}
+
+		if exp := tempMappingAddr - earlyReserveSlide; earlyReserveStart != exp || earlyReserveLastUsed != exp {
+			t.Errorf("[rnd %d] expected early reserve region to start at 0x%x; got 0x%x (last used: 0x%x)", rnd, exp, earlyReserveStart, earlyReserveLastUsed)
+		}
+
+		seen[earlyReserveSlide] = true
+	}
+
+	if len(seen) < 2 {
+		t.Fatal("expected RandomizeLayout to select different slides for different entropy values")
+	}
+
+	var buf bytes.Buffer
+	kfmt.SetOutputSink(&buf)
+	printLayoutSlides()
+	if got := buf.String(); !strings.Contains(got, "kaslr slides") {
+		t.Fatalf("expected slide report; got %q", got)
+	}
+}
@@ -46,9 +46,21 @@ var (
 	// which will cause a fault if called in user-mode.
 	flushTLBEntryFn = cpu.FlushTLBEntry
 
-	earlyReserveRegionFn = EarlyReserveRegion
+	earlyReserveRegionFn          = EarlyReserveRegion
+	earlyReserveUntrackedRegionFn = EarlyReserveUntrackedRegion
+	releaseRegionFn               = releaseRegion
+
+	// the following functions are used by tests and are automatically
+	// inlined by the compiler.
+	mapHugeFn            = MapHuge
+	mapRangeFn           = mapRange
+	unmapHugeFn          = UnmapHuge
+	unmapRangeFn         = unmapRange
+	mappedHugePageSizeFn = mappedHugePageSize
 
 	errNoHugePageSupport           = &kernel.Error{Module: "vmm", Message: "huge pages are not supported"}
+	errMisalignedHugePage          = &kernel.Error{Module: "vmm", Message: "huge page and frame must be aligned to the huge page size"}
+	errHugePageOverlapsTable       = &kernel.Error{Module: "vmm", Message: "huge page mapping would replace an existing page table"}
 	errAttemptToRWMapReservedFrame = &kernel.Error{Module: "vmm", Message: "reserved blank frame cannot be mapped with a RW flag"}
 )
 
@@ -69,13 +81,25 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 		// If we reached the last level all we need to do is to map the
 		// frame in place and flag it as present and flush its TLB entry
 		if pteLevel == pageLevels-1 {
-			*pte = 0
-			pte.SetFrame(frame)
-			pte.SetFlags(flags)
-			flushTLBEntryFn(page.Address())
+			// Replacing a present mapping requires stale TLB entries
+			// to be invalidated on all CPUs
+			wasPresent := pte.HasFlags(FlagPresent)
+			err = mapLeafEntry(page, pte, frame, flags)
+			if wasPresent {
+				flushTLBEntry(page.Address())
+			} else {
+				flushTLBEntryFn(page.Address())
+			}
 			return true
 		}
 
+		// The page falls inside an existing huge page mapping; split it
+		// so the rest of the huge page remains mapped.
+		if pte.HasFlags(FlagPresent | FlagHugePage) {
+			err = splitHugePage(page.Address(), pteLevel, pte)
+			return err == nil
+		}
+
 		if pte.HasFlags(FlagHugePage) {
 			err = errNoHugePageSupport
 			return false
@@ -84,28 +108,240 @@ func Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
 		// Next table does not yet exist; we need to allocate a
 		// physical frame for it map it and clear its contents.
 		if !pte.HasFlags(FlagPresent) {
-			var newTableFrame mm.Frame
-			newTableFrame, err = mm.AllocFrame()
-			if err != nil {
+			err = installPageTable(pteLevel, pte)
+		}
+
+		// User-accessible pages also require all the tables that
+		// lead to them to be user-accessible.
+		if err == nil {
+			pte.SetFlags(flags & FlagUserAccessible)
+		}
+
+		return err == nil
+	})
+
+	return err
+}
+
+// MapHuge establishes a mapping between a virtual page and a physical memory
+// frame using a single page table entry that spans a huge page of the
+// requested size. Both page and frame must be aligned to the huge page size.
+//
+// If the huge page overlaps an existing huge page mapping of a larger size,
+// the larger mapping is split first. Attempts to install a huge page on top of
+// an already present page table will result in an error as this would orphan
+// the page table and any mappings it contains.
+func MapHuge(page mm.Page, frame mm.Frame, size HugePageSize, flags PageTableEntryFlag) *kernel.Error {
+	if size == HugePage1G && !supportsHugePage1G() {
+		return errNoHugePageSupport
+	}
+
+	pageCount := size.Size() >> mm.PageShift
+	if uintptr(page)&(pageCount-1) != 0 || uintptr(frame)&(pageCount-1) != 0 {
+		return errMisalignedHugePage
+	}
+
+	if protectReservedZeroedPage && (flags&FlagRW) != 0 &&
+		ReservedZeroedFrame >= frame && uintptr(ReservedZeroedFrame-frame) < pageCount {
+		return errAttemptToRWMapReservedFrame
+	}
+
+	var (
+		err       *kernel.Error
+		hugeLevel = size.level()
+	)
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if pteLevel == hugeLevel {
+			if pte.HasFlags(FlagPresent) && !pte.HasFlags(FlagHugePage) {
+				err = errHugePageOverlapsTable
 				return false
 			}
 
+			// Bit 7 selects the page size for huge page entries
+			// so the PAT bit is relocated to bit 12.
+			if (flags & FlagWriteCombine) != 0 {
+				flags = (flags &^ FlagWriteCombine) | flagHugePagePAT
+			}
+
+			prevEntry := *pte
 			*pte = 0
-			pte.SetFrame(newTableFrame)
-			pte.SetFlags(FlagPresent | FlagRW)
+			pte.SetFrame(frame)
+			pte.SetFlags(flags | FlagHugePage)
+			flushTLBEntryFn(page.Address())
 
-			// The next pte entry becomes available but we need to
-			// make sure that the new page is properly cleared
-			nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
-			kernel.Memset(nextAddrFn(nextTableAddr), 0, mm.PageSize)
+			// A huge page references every frame in the region it
+			// spans.
+			if !refCountedAddr(page.Address()) {
+				return false
+			}
+			if (flags & FlagPresent) != 0 {
+				incFrameRangeRefCount(frame, pageCount)
+			}
+			if prevEntry.HasFlags(FlagPresent) {
+				err = decFrameRangeRefCount(hugePageFrame(prevEntry, pteLevel), pageCount)
+			}
+			return false
 		}
 
-		return true
+		if pte.HasFlags(FlagPresent | FlagHugePage) {
+			err = splitHugePage(page.Address(), pteLevel, pte)
+			return err == nil
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			err = errNoHugePageSupport
+			return false
+		}
+
+		if !pte.HasFlags(FlagPresent) {
+			err = installPageTable(pteLevel, pte)
+		}
+
+		return err == nil
 	})
 
 	return err
 }
 
+// mapLeafEntry points the last level page table entry pte for page to frame
+// and updates the reference counts of frame and of the frame that pte
+// previously pointed to. Temporary and direct map mappings are not reference
+// counted. It returns any error that occurred while releasing the previously
+// mapped frame.
+func mapLeafEntry(page mm.Page, pte *pageTableEntry, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+	prevEntry := *pte
+
+	*pte = 0
+	pte.SetFrame(frame)
+	pte.SetFlags(flags)
+
+	if !refCountedAddr(page.Address()) {
+		return nil
+	}
+
+	if (flags & FlagPresent) != 0 {
+		incFrameRefCount(frame)
+	}
+	if prevEntry.HasFlags(FlagPresent) {
+		return decFrameRefCount(prevEntry.Frame())
+	}
+
+	return nil
+}
+
+// unmapLeafEntry marks the last level page table entry pte for page as not
+// present and drops the reference count of the frame it points to. It returns
+// any error that occurred while releasing the frame.
+func unmapLeafEntry(page mm.Page, pte *pageTableEntry) *kernel.Error {
+	if !pte.HasFlags(FlagPresent) {
+		return nil
+	}
+
+	pte.ClearFlags(FlagPresent)
+
+	if !refCountedAddr(page.Address()) {
+		return nil
+	}
+
+	return decFrameRefCount(pte.Frame())
+}
+
+// installPageTable allocates and clears a physical frame for the page table
+// pointed to by pte and marks pte as present.
+func installPageTable(pteLevel uint8, pte *pageTableEntry) *kernel.Error {
+	newTableFrame, err := mm.AllocFrame()
+	if err != nil {
+		return err
+	}
+	mm.TrackPageTableFrames(1)
+
+	*pte = 0
+	pte.SetFrame(newTableFrame)
+	pte.SetFlags(FlagPresent | FlagRW)
+
+	// The next pte entry becomes available but we need to
+	// make sure that the new page is properly cleared
+	nextTableAddr := (uintptr(unsafe.Pointer(pte)) << pageLevelBits[pteLevel+1])
+	kernel.Memset(nextAddrFn(nextTableAddr), 0, mm.PageSize)
+	return nil
+}
+
+// splitHugePage replaces the huge page mapping described by pte with a newly
+// allocated page table whose entries map the same physical memory region with
+// the same flags using the page size of the next page level. Splitting a 1G
+// page yields 512 2M pages whereas splitting a 2M page yields 512 regular
+// pages. The virtAddr argument may point to any address inside the huge page.
+// The new entries take over the frame references held by the huge page so
+// the frame reference counts remain unchanged.
+func splitHugePage(virtAddr uintptr, pteLevel uint8, pte *pageTableEntry) *kernel.Error {
+	if pteLevel == 0 || pteLevel >= pageLevels-1 {
+		return errNoHugePageSupport
+	}
+
+	tableFrame, err := mm.AllocFrame()
+	if err != nil {
+		return err
+	}
+	mm.TrackPageTableFrames(1)
+
+	var (
+		childLevel = pteLevel + 1
+		childSize  = uintptr(1) << pageLevelShifts[childLevel]
+		hugeMask   = (uintptr(1) << pageLevelShifts[pteLevel]) - 1
+		physAddr   = uintptr(*pte) & ptePhysPageMask &^ hugeMask
+		childFlags = PageTableEntryFlag(uintptr(*pte) &^ ptePhysPageMask)
+		hasPAT     = pte.HasFlags(flagHugePagePAT)
+	)
+
+	// Regular pages use bit 7 as the PAT bit instead of bit 12
+	switch {
+	case childLevel == pageLevels-1:
+		childFlags &^= FlagHugePage
+		if hasPAT {
+			childFlags |= FlagWriteCombine
+		}
+	case hasPAT:
+		childFlags |= flagHugePagePAT
+	}
+
+	// The user-accessible bit must be set at every page level for the
+	// split pages to remain accessible from user-mode.
+	*pte = 0
+	pte.SetFrame(tableFrame)
+	pte.SetFlags(FlagPresent | FlagRW | (childFlags & FlagUserAccessible))
+
+	// The recursive virtual address for the new table previously fell
+	// inside the huge page so we need to flush it before populating the
+	// table entries.
+	tableAddr := nextAddrFn(uintptr(unsafe.Pointer(pte)) << pageLevelBits[childLevel])
+	flushTLBEntryFn(tableAddr)
+	for index := uintptr(0); index < 1<<pageLevelBits[childLevel]; index++ {
+		entry := (*pageTableEntry)(unsafe.Pointer(tableAddr + (index << mm.PointerShift)))
+		*entry = pageTableEntry(physAddr + index*childSize)
+		entry.SetFlags(childFlags)
+	}
+
+	// Invalidate the TLB entry for the huge page itself
+	flushTLBEntryFn(virtAddr &^ hugeMask)
+	return nil
+}
+
+// hugePageFrame returns the first physical frame of the huge page mapped by a
+// page table entry at the specified page level. Bit 12 of huge page entries
+// contains the PAT bit and is masked out.
+func hugePageFrame(pte pageTableEntry, pteLevel uint8) mm.Frame {
+	hugeMask := (uintptr(1) << pageLevelShifts[pteLevel]) - 1
+	return mm.FrameFromAddress(uintptr(pte) & ptePhysPageMask &^ hugeMask)
+}
+
+// supportsHugePage1G returns true if the CPU can map 1G pages using P3
+// entries.
+func supportsHugePage1G() bool {
+	_, _, _, edx := cpuidFn(0x80000001)
+	return edx&(1<<26) != 0
+}
+
 // MapRegion establishes a mapping to the physical mmory region which starts
 // at the given frame and ends at frame + pages(size). The size argument is
 // always rounded up to the nearest page boundary. MapRegion reserves the next
@@ -129,6 +365,138 @@ func MapRegion(frame mm.Frame, size uintptr, flags PageTableEntryFlag) (mm.Page,
 	return mm.PageFromAddress(startPage), nil
 }
 
+// MapHugeRegion behaves like MapRegion but uses huge page mappings for the
+// parts of the physical memory region that are suitably aligned. To maximize
+// the number of huge pages that can be used, the reserved virtual region is
+// shifted so that its offset from a huge page boundary matches the offset of
+// the physical region start. The region is aligned to a 1G boundary if the CPU
+// supports 1G pages and the physical region spans at least one 1G-aligned
+// block; otherwise it is aligned to a 2M boundary.
+func MapHugeRegion(frame mm.Frame, size uintptr, flags PageTableEntryFlag) (mm.Page, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+
+	hugePageMask := HugePage2M.Size() - 1
+	if mask1G := HugePage1G.Size() - 1; supportsHugePage1G() && (frame.Address()+mask1G)&^mask1G+mask1G < frame.Address()+size {
+		hugePageMask = mask1G
+	}
+	physOffset := frame.Address() & hugePageMask
+
+	// Reserve enough address space to align the region start. Only the
+	// mapped part of the region is tracked; the padding around it is
+	// released so it can be used by other reservations. Failing to release
+	// the padding only wastes address space.
+	regionSize := size + hugePageMask + 1 - mm.PageSize
+	regionAddr, err := earlyReserveUntrackedRegionFn(regionSize)
+	if err != nil {
+		return 0, err
+	}
+
+	startPage := mm.PageFromAddress(regionAddr + ((physOffset - regionAddr) & hugePageMask))
+	_ = releaseRegionFn(regionAddr, startPage.Address()-regionAddr)
+	_ = releaseRegionFn(startPage.Address()+size, regionAddr+regionSize-startPage.Address()-size)
+
+	if err = mapRangeFn(startPage, frame, size>>mm.PageShift, flags); err != nil {
+		return 0, err
+	}
+
+	mm.TrackKernelVirtualBytes(size)
+	return startPage, nil
+}
+
+// mapRange maps pageCount consecutive pages starting at page to the physical
+// frames starting at frame. Whenever both the current page and frame are
+// aligned to a huge page boundary and enough pages remain, mapRange installs
+// a huge page mapping instead of individual page mappings.
+func mapRange(page mm.Page, frame mm.Frame, pageCount uintptr, flags PageTableEntryFlag) *kernel.Error {
+	var (
+		err        *kernel.Error
+		mapped     uintptr
+		have1GHuge = supportsHugePage1G()
+	)
+
+	for ; pageCount > 0; page, frame, pageCount = page+mm.Page(mapped), frame+mm.Frame(mapped), pageCount-mapped {
+		switch {
+		case have1GHuge && canMapHuge(page, frame, pageCount, HugePage1G):
+			mapped = HugePage1G.Size() >> mm.PageShift
+			err = mapHugeFn(page, frame, HugePage1G, flags)
+		case canMapHuge(page, frame, pageCount, HugePage2M):
+			mapped = HugePage2M.Size() >> mm.PageShift
+			err = mapHugeFn(page, frame, HugePage2M, flags)
+		default:
+			mapped = 1
+			err = mapFn(page, frame, flags)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmapRange removes the mappings for pageCount consecutive pages starting at
+// page. Huge page mappings that are fully contained in the range are removed
+// in one step; huge pages that are only partially contained in it are split.
+func unmapRange(page mm.Page, pageCount uintptr) *kernel.Error {
+	var (
+		err      *kernel.Error
+		unmapped uintptr
+	)
+
+	for ; pageCount > 0; page, pageCount = page+mm.Page(unmapped), pageCount-unmapped {
+		size, huge := mappedHugePageSizeFn(page)
+		if hugePageCount := size.Size() >> mm.PageShift; huge && pageCount >= hugePageCount && uintptr(page)&(hugePageCount-1) == 0 {
+			unmapped = hugePageCount
+			err = unmapHugeFn(page, size)
+		} else {
+			unmapped = 1
+			err = unmapFn(page)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mappedHugePageSize returns the size of the huge page that maps page. It
+// returns false if page is not mapped by a huge page.
+func mappedHugePageSize(page mm.Page) (HugePageSize, bool) {
+	var (
+		size HugePageSize
+		huge bool
+	)
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if pteLevel == pageLevels-1 || !pte.HasFlags(FlagPresent) {
+			return false
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			if huge, size = true, HugePage2M; pteLevel == HugePage1G.level() {
+				size = HugePage1G
+			}
+			return false
+		}
+
+		return true
+	})
+
+	return size, huge
+}
+
+// canMapHuge returns true if page and frame are both aligned to the supplied
+// huge page size and at least one huge page worth of pages remains.
+func canMapHuge(page mm.Page, frame mm.Frame, pageCount uintptr, size HugePageSize) bool {
+	hugePageCount := size.Size() >> mm.PageShift
+	return pageCount >= hugePageCount &&
+		uintptr(page)&(hugePageCount-1) == 0 &&
+		uintptr(frame)&(hugePageCount-1) == 0
+}
+
 // IdentityMapRegion establishes an identity mapping to the physical mmory
 // region which starts at the given frame and ends at frame + pages(size). The
 // size argument is always rounded up to the nearest page boundary.
@@ -173,8 +541,8 @@ func Unmap(page mm.Page) *kernel.Error {
 		// If we reached the last level all we need to do is to set the
 		// page as non-present and flush its TLB entry
 		if pteLevel == pageLevels-1 {
-			pte.ClearFlags(FlagPresent)
-			flushTLBEntryFn(page.Address())
+			err = unmapLeafEntry(page, pte)
+			flushTLBEntry(page.Address())
 			return true
 		}
 
@@ -184,11 +552,62 @@ func Unmap(page mm.Page) *kernel.Error {
 			return false
 		}
 
+		// The page is part of a huge page; split the huge page so we
+		// can unmap a single page and leave the rest of it intact.
 		if pte.HasFlags(FlagHugePage) {
-			err = errNoHugePageSupport
+			err = splitHugePage(page.Address(), pteLevel, pte)
+			return err == nil
+		}
+
+		return true
+	})
+
+	return err
+}
+
+// UnmapHuge removes a huge page mapping previously installed via a call to
+// MapHuge. If the huge page is part of a larger huge page mapping, the larger
+// mapping is split first.
+func UnmapHuge(page mm.Page, size HugePageSize) *kernel.Error {
+	pageCount := size.Size() >> mm.PageShift
+	if uintptr(page)&(pageCount-1) != 0 {
+		return errMisalignedHugePage
+	}
+
+	var (
+		err       *kernel.Error
+		hugeLevel = size.level()
+	)
+
+	walk(page.Address(), func(pteLevel uint8, pte *pageTableEntry) bool {
+		if !pte.HasFlags(FlagPresent) {
+			err = ErrInvalidMapping
 			return false
 		}
 
+		if pteLevel == hugeLevel {
+			if !pte.HasFlags(FlagHugePage) {
+				err = ErrInvalidMapping
+				return false
+			}
+
+			// Clear the entire entry so that the stale huge page
+			// flag does not prevent the range from being mapped
+			// again.
+			frame := hugePageFrame(*pte, pteLevel)
+			*pte = 0
+			flushTLBEntry(page.Address())
+			if refCountedAddr(page.Address()) {
+				err = decFrameRangeRefCount(frame, pageCount)
+			}
+			return false
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			err = splitHugePage(page.Address(), pteLevel, pte)
+			return err == nil
+		}
+
 		return true
 	})
 
@@ -199,14 +618,16 @@ func Unmap(page mm.Page) *kernel.Error {
 // virtual address or ErrInvalidMapping if the virtual address does not
 // correspond to a mapped physical address.
 func Translate(virtAddr uintptr) (uintptr, *kernel.Error) {
-	pte, err := pteForAddress(virtAddr)
+	pte, pteLevel, err := pteForAddress(virtAddr)
 	if err != nil {
 		return 0, err
 	}
 
 	// Calculate the physical address by taking the physical frame address and
-	// appending the offset from the virtual address
-	physAddr := pte.Frame().Address() + PageOffset(virtAddr)
+	// appending the offset from the virtual address. For huge pages, the
+	// offset spans all virtual address bits below the entry's page level.
+	offsetMask := (uintptr(1) << pageLevelShifts[pteLevel]) - 1
+	physAddr := (uintptr(*pte) & ptePhysPageMask &^ offsetMask) + (virtAddr & offsetMask)
 	return physAddr, nil
 }
 
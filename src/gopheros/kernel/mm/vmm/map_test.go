@@ -2,6 +2,7 @@ package vmm
 
 import (
 	"gopheros/kernel"
+	"gopheros/kernel/cpu"
 	"gopheros/kernel/mm"
 	"runtime"
 	"testing"
@@ -423,3 +424,712 @@ func TestTranslateAmd64(t *testing.T) {
 		}
 	}
 }
+
+func TestMapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		cpuidFn = cpu.ID
+		mm.SetFrameAllocator(nil)
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		nextPhysPage int
+		pteCallCount int
+	)
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		nextPhysPage++
+		pageAddr := unsafe.Pointer(&physPages[nextPhysPage][0])
+		return mm.Frame(uintptr(pageAddr) >> mm.PageShift), nil
+	})
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mm.PageSize-1)) >> mm.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[nextPhysPage][0]))
+	}
+
+	flushTLBEntryFn = func(uintptr) {}
+
+	reset := func() {
+		physPages = [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry{}
+		nextPhysPage, pteCallCount = 0, 0
+	}
+
+	t.Run("2M page", func(t *testing.T) {
+		reset()
+
+		// This address breaks down to p4: 0, p3: 0, p2: 1
+		page := mm.PageFromAddress(2 * oneMb)
+		frame := mm.Frame(0x200)
+		if err := MapHuge(page, frame, HugePage2M, FlagPresent|FlagRW); err != nil {
+			t.Fatal(err)
+		}
+
+		pte := physPages[2][1]
+		if !pte.HasFlags(FlagPresent | FlagRW | FlagHugePage) {
+			t.Fatal("expected P2 entry to have FlagPresent, FlagRW and FlagHugePage set")
+		}
+
+		if got := pte.Frame(); got != frame {
+			t.Fatalf("expected P2 entry frame to be %d; got %d", frame, got)
+		}
+
+		if exp := 3; pteCallCount != exp {
+			t.Fatalf("expected walk to stop after visiting %d levels; visited %d", exp, pteCallCount)
+		}
+	})
+
+	t.Run("2M write-combining page", func(t *testing.T) {
+		reset()
+
+		if err := MapHuge(mm.PageFromAddress(2*oneMb), mm.Frame(0x200), HugePage2M, FlagPresent|FlagWriteCombine); err != nil {
+			t.Fatal(err)
+		}
+
+		pte := physPages[2][1]
+		if !pte.HasFlags(FlagPresent | FlagHugePage | flagHugePagePAT) {
+			t.Fatal("expected P2 entry to have FlagPresent, FlagHugePage and the huge page PAT bit set")
+		}
+
+		if exp, got := uintptr(2*oneMb), uintptr(pte)&ptePhysPageMask&^flagHugePagePAT; got != exp {
+			t.Fatalf("expected P2 entry to point to physical address 0x%x; got 0x%x", exp, got)
+		}
+	})
+
+	t.Run("1G page", func(t *testing.T) {
+		reset()
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 1 << 26 }
+
+		page := mm.PageFromAddress(1024 * oneMb)
+		frame := mm.Frame(0x40000)
+		if err := MapHuge(page, frame, HugePage1G, FlagPresent); err != nil {
+			t.Fatal(err)
+		}
+
+		pte := physPages[1][1]
+		if !pte.HasFlags(FlagPresent | FlagHugePage) {
+			t.Fatal("expected P3 entry to have FlagPresent and FlagHugePage set")
+		}
+
+		if got := pte.Frame(); got != frame {
+			t.Fatalf("expected P3 entry frame to be %d; got %d", frame, got)
+		}
+	})
+
+	t.Run("1G pages not supported", func(t *testing.T) {
+		reset()
+		cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 0 }
+
+		if err := MapHuge(mm.PageFromAddress(1024*oneMb), mm.Frame(0x40000), HugePage1G, FlagPresent); err != errNoHugePageSupport {
+			t.Fatalf("expected to get errNoHugePageSupport; got %v", err)
+		}
+	})
+
+	t.Run("misaligned page or frame", func(t *testing.T) {
+		reset()
+
+		if err := MapHuge(mm.Page(1), mm.Frame(0x200), HugePage2M, FlagPresent); err != errMisalignedHugePage {
+			t.Fatalf("expected to get errMisalignedHugePage; got %v", err)
+		}
+
+		if err := MapHuge(mm.Page(0x200), mm.Frame(0x201), HugePage2M, FlagPresent); err != errMisalignedHugePage {
+			t.Fatalf("expected to get errMisalignedHugePage; got %v", err)
+		}
+	})
+
+	t.Run("overlaps existing page table", func(t *testing.T) {
+		reset()
+		for level := 0; level < pageLevels-1; level++ {
+			physPages[level][0].SetFlags(FlagPresent | FlagRW)
+		}
+
+		if err := MapHuge(mm.Page(0), mm.Frame(0x200), HugePage2M, FlagPresent); err != errHugePageOverlapsTable {
+			t.Fatalf("expected to get errHugePageOverlapsTable; got %v", err)
+		}
+	})
+
+	t.Run("RW mapping of ReservedZeroedFrame", func(t *testing.T) {
+		defer func(origFrame mm.Frame) {
+			protectReservedZeroedPage = false
+			ReservedZeroedFrame = origFrame
+		}(ReservedZeroedFrame)
+
+		reset()
+		protectReservedZeroedPage = true
+		ReservedZeroedFrame = mm.Frame(0x2ff)
+		if err := MapHuge(mm.Page(0x200), mm.Frame(0x200), HugePage2M, FlagPresent|FlagRW); err != errAttemptToRWMapReservedFrame {
+			t.Fatalf("expected to get errAttemptToRWMapReservedFrame; got %v", err)
+		}
+	})
+}
+
+func TestUnmapSplitsHugePageAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origNextAddrFn func(uintptr) uintptr, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		nextAddrFn = origNextAddrFn
+		flushTLBEntryFn = origFlushTLBEntryFn
+		mm.SetFrameAllocator(nil)
+	}(ptePtrFn, nextAddrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		hugePhysAddr = uintptr(1024 * oneMb)
+		pteCallCount int
+	)
+
+	// Emulate a 2M RW page mapped at virtual address 0
+	physPages[0][0].SetFlags(FlagPresent | FlagRW)
+	physPages[1][0].SetFlags(FlagPresent | FlagRW)
+	physPages[2][0].SetFrame(mm.FrameFromAddress(hugePhysAddr))
+	physPages[2][0].SetFlags(FlagPresent | FlagRW | FlagNoExecute | FlagHugePage)
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		return mm.Frame(uintptr(unsafe.Pointer(&physPages[3][0])) >> mm.PageShift), nil
+	})
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		pteIndex := (entry & uintptr(mm.PageSize-1)) >> mm.PointerShift
+		return unsafe.Pointer(&physPages[pteCallCount-1][pteIndex])
+	}
+
+	nextAddrFn = func(entry uintptr) uintptr {
+		return uintptr(unsafe.Pointer(&physPages[3][0]))
+	}
+
+	var flushedAddrs []uintptr
+	flushTLBEntryFn = func(addr uintptr) {
+		flushedAddrs = append(flushedAddrs, addr)
+	}
+
+	unmapIndex := 3
+	if err := Unmap(mm.Page(unmapIndex)); err != nil {
+		t.Fatal(err)
+	}
+
+	if physPages[2][0].HasFlags(FlagHugePage) {
+		t.Fatal("expected P2 entry to no longer be a huge page")
+	}
+
+	if exp, got := mm.Frame(uintptr(unsafe.Pointer(&physPages[3][0]))>>mm.PageShift), physPages[2][0].Frame(); got != exp {
+		t.Fatalf("expected P2 entry to point to the new page table at frame %d; got %d", exp, got)
+	}
+
+	for index, pte := range physPages[3] {
+		if index == unmapIndex {
+			if pte.HasFlags(FlagPresent) {
+				t.Errorf("expected unmapped entry %d not to have FlagPresent set", index)
+			}
+			continue
+		}
+
+		if !pte.HasFlags(FlagPresent | FlagRW | FlagNoExecute) {
+			t.Errorf("expected entry %d to retain the flags of the huge page", index)
+		}
+
+		if pte.HasFlags(FlagHugePage) {
+			t.Errorf("expected entry %d not to have FlagHugePage set", index)
+		}
+
+		if exp, got := mm.FrameFromAddress(hugePhysAddr)+mm.Frame(index), pte.Frame(); got != exp {
+			t.Errorf("expected entry %d to point to frame %d; got %d", index, exp, got)
+		}
+	}
+
+	// Expect flushes for the new table, the huge page and the unmapped page
+	if exp := 3; len(flushedAddrs) != exp {
+		t.Fatalf("expected flushTLBEntry to be called %d times; got %d", exp, len(flushedAddrs))
+	}
+
+	t.Run("split write-combining huge page", func(t *testing.T) {
+		physPages[3] = [mm.PageSize >> mm.PointerShift]pageTableEntry{}
+		physPages[2][0] = pageTableEntry(hugePhysAddr)
+		physPages[2][0].SetFlags(FlagPresent | FlagRW | FlagHugePage | flagHugePagePAT)
+		pteCallCount = 0
+
+		if err := Unmap(mm.Page(unmapIndex)); err != nil {
+			t.Fatal(err)
+		}
+
+		if pte := physPages[3][0]; !pte.HasFlags(FlagPresent|FlagWriteCombine) || pte.Frame() != mm.FrameFromAddress(hugePhysAddr) {
+			t.Fatal("expected split entries to be mapped with FlagWriteCombine")
+		}
+	})
+
+	t.Run("allocating page table fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+			return mm.InvalidFrame, expErr
+		})
+
+		physPages[2][0] = 0
+		physPages[2][0].SetFlags(FlagPresent | FlagHugePage)
+		pteCallCount = 0
+
+		if err := Unmap(mm.Page(0)); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer, origFlushTLBEntryFn func(uintptr)) {
+		ptePtrFn = origPtePtr
+		flushTLBEntryFn = origFlushTLBEntryFn
+	}(ptePtrFn, flushTLBEntryFn)
+
+	var (
+		physPages    [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		pteCallCount int
+	)
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		return unsafe.Pointer(&physPages[pteCallCount-1][0])
+	}
+	flushTLBEntryFn = func(uintptr) {}
+
+	specs := []struct {
+		p2Flags PageTableEntryFlag
+		page    mm.Page
+		expErr  *kernel.Error
+	}{
+		{FlagPresent | FlagHugePage, 0, nil},
+		{FlagPresent, 0, ErrInvalidMapping},
+		{0, 0, ErrInvalidMapping},
+		{FlagPresent | FlagHugePage, 1, errMisalignedHugePage},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount = 0
+		physPages[0][0] = pageTableEntry(FlagPresent)
+		physPages[1][0] = pageTableEntry(FlagPresent)
+		physPages[2][0] = pageTableEntry(spec.p2Flags)
+
+		if err := UnmapHuge(spec.page, HugePage2M); err != spec.expErr {
+			t.Errorf("[spec %d] expected to get error %v; got %v", specIndex, spec.expErr, err)
+			continue
+		}
+
+		if spec.expErr == nil && physPages[2][0] != 0 {
+			t.Errorf("[spec %d] expected P2 entry to be cleared; got %x", specIndex, physPages[2][0])
+		}
+	}
+}
+
+func TestTranslateHugePageAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	specs := []struct {
+		hugeLevel   int
+		virtAddr    uintptr
+		expPhysAddr uintptr
+	}{
+		{2, 0x123456, 0x40123456},
+		{1, 0x12345678, 0x52345678},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount := 0
+		ptePtrFn = func(entry uintptr) unsafe.Pointer {
+			var pte pageTableEntry
+			pte.SetFlags(FlagPresent)
+			if pteCallCount == spec.hugeLevel {
+				pte.SetFrame(mm.FrameFromAddress(0x40000000))
+				pte.SetFlags(FlagHugePage)
+			}
+			pteCallCount++
+
+			return unsafe.Pointer(&pte)
+		}
+
+		physAddr, err := Translate(spec.virtAddr)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error %v", specIndex, err)
+			continue
+		}
+
+		if physAddr != spec.expPhysAddr {
+			t.Errorf("[spec %d] expected phys addr to be 0x%x; got 0x%x", specIndex, spec.expPhysAddr, physAddr)
+		}
+
+		if exp := spec.hugeLevel + 1; pteCallCount != exp {
+			t.Errorf("[spec %d] expected walk to stop after visiting %d levels; visited %d", specIndex, exp, pteCallCount)
+		}
+	}
+}
+
+func TestMapHugeRegion(t *testing.T) {
+	defer func() {
+		mapRangeFn = mapRange
+		earlyReserveUntrackedRegionFn = EarlyReserveUntrackedRegion
+		releaseRegionFn = releaseRegion
+		cpuidFn = cpu.ID
+	}()
+
+	var releasedBytes uintptr
+	releaseRegionFn = func(_, size uintptr) *kernel.Error {
+		releasedBytes += size
+		return nil
+	}
+
+	specs := []struct {
+		frame       mm.Frame
+		reservedAt  uintptr
+		expStartAdr uintptr
+	}{
+		{mm.Frame(0x201), 0x10000000, 0x10001000},
+		{mm.Frame(0x201), 0x10005000, 0x10201000},
+		{mm.Frame(0x200), 0x10005000, 0x10200000},
+	}
+
+	for specIndex, spec := range specs {
+		var reservedSize uintptr
+		releasedBytes = 0
+		earlyReserveUntrackedRegionFn = func(size uintptr) (uintptr, *kernel.Error) {
+			reservedSize = size
+			return spec.reservedAt, nil
+		}
+
+		mapRangeFn = func(page mm.Page, frame mm.Frame, pageCount uintptr, _ PageTableEntryFlag) *kernel.Error {
+			if frame != spec.frame {
+				t.Errorf("[spec %d] expected mapRange to be called with frame %d; got %d", specIndex, spec.frame, frame)
+			}
+
+			if exp := uintptr(2); pageCount != exp {
+				t.Errorf("[spec %d] expected mapRange to be called with %d pages; got %d", specIndex, exp, pageCount)
+			}
+			return nil
+		}
+
+		page, err := MapHugeRegion(spec.frame, 4097, FlagPresent)
+		if err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if got := page.Address(); got != spec.expStartAdr {
+			t.Errorf("[spec %d] expected region to start at 0x%x; got 0x%x", specIndex, spec.expStartAdr, got)
+		}
+
+		if exp := 2*mm.PageSize + HugePage2M.Size() - mm.PageSize; reservedSize != exp {
+			t.Errorf("[spec %d] expected to reserve %d bytes; reserved %d", specIndex, exp, reservedSize)
+		}
+
+		if exp := reservedSize - 2*mm.PageSize; releasedBytes != exp {
+			t.Errorf("[spec %d] expected the %d bytes of alignment padding to be released; released %d", specIndex, exp, releasedBytes)
+		}
+	}
+
+	t.Run("1G alignment", func(t *testing.T) {
+		var (
+			frame        = mm.FrameFromAddress(HugePage1G.Size() + 0x1000)
+			size         = 2 * HugePage1G.Size()
+			reservedSize uintptr
+		)
+
+		earlyReserveUntrackedRegionFn = func(size uintptr) (uintptr, *kernel.Error) {
+			reservedSize = size
+			return 0x8000000000, nil
+		}
+		mapRangeFn = func(_ mm.Page, _ mm.Frame, _ uintptr, _ PageTableEntryFlag) *kernel.Error {
+			return nil
+		}
+
+		specs := []struct {
+			have1GHuge  bool
+			size        uintptr
+			expStartAdr uintptr
+			expReserved uintptr
+		}{
+			// The region spans the 1G-aligned block at 2G
+			{true, size, 0x8000001000, size + HugePage1G.Size() - mm.PageSize},
+			// No 1G pages available
+			{false, size, 0x8000001000, size + HugePage2M.Size() - mm.PageSize},
+			// The region does not span a 1G-aligned block
+			{true, HugePage1G.Size(), 0x8000001000, HugePage1G.Size() + HugePage2M.Size() - mm.PageSize},
+		}
+
+		for specIndex, spec := range specs {
+			have1GHuge := spec.have1GHuge
+			cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) {
+				if have1GHuge {
+					return 0, 0, 0, 1 << 26
+				}
+				return 0, 0, 0, 0
+			}
+
+			page, err := MapHugeRegion(frame, spec.size, FlagPresent)
+			if err != nil {
+				t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+				continue
+			}
+
+			if got := page.Address(); got != spec.expStartAdr {
+				t.Errorf("[spec %d] expected region to start at 0x%x; got 0x%x", specIndex, spec.expStartAdr, got)
+			}
+
+			if reservedSize != spec.expReserved {
+				t.Errorf("[spec %d] expected to reserve %d bytes; reserved %d", specIndex, spec.expReserved, reservedSize)
+			}
+		}
+	})
+
+	t.Run("EarlyReserveUntrackedRegion fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "out of address space"}
+		earlyReserveUntrackedRegionFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			return 0, expErr
+		}
+
+		if _, err := MapHugeRegion(mm.Frame(0), 4096, FlagPresent); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("mapRange fails", func(t *testing.T) {
+		expErr := &kernel.Error{Module: "test", Message: "map failed"}
+		earlyReserveUntrackedRegionFn = func(_ uintptr) (uintptr, *kernel.Error) {
+			return 0x10000000, nil
+		}
+		mapRangeFn = func(_ mm.Page, _ mm.Frame, _ uintptr, _ PageTableEntryFlag) *kernel.Error {
+			return expErr
+		}
+
+		if _, err := MapHugeRegion(mm.Frame(0), 4096, FlagPresent); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestUnmapRange(t *testing.T) {
+	defer func() {
+		unmapFn = Unmap
+		unmapHugeFn = UnmapHuge
+		mappedHugePageSizeFn = mappedHugePageSize
+	}()
+
+	var (
+		unmapCalls  int
+		hugeCalls   [2]int
+		expUnmapErr *kernel.Error
+		expHugeErr  *kernel.Error
+	)
+
+	unmapFn = func(_ mm.Page) *kernel.Error {
+		unmapCalls++
+		return expUnmapErr
+	}
+	unmapHugeFn = func(page mm.Page, size HugePageSize) *kernel.Error {
+		if mask := (size.Size() >> mm.PageShift) - 1; uintptr(page)&mask != 0 {
+			t.Errorf("UnmapHuge called with misaligned page %d", page)
+		}
+		hugeCalls[size]++
+		return expHugeErr
+	}
+	// Pages [0x200, 0x400) are mapped by a 2M page and pages [0x40000,
+	// 0x80000) are mapped by a 1G page.
+	mappedHugePageSizeFn = func(page mm.Page) (HugePageSize, bool) {
+		switch {
+		case page >= 0x200 && page < 0x400:
+			return HugePage2M, true
+		case page >= 0x40000 && page < 0x80000:
+			return HugePage1G, true
+		}
+		return 0, false
+	}
+
+	specs := []struct {
+		page          mm.Page
+		pageCount     uintptr
+		expUnmapCalls int
+		expHugeCalls  [2]int
+	}{
+		// regular pages
+		{0x1, 16, 16, [2]int{0, 0}},
+		// 1 page, 1 2M page and 1 page
+		{0x1ff, 514, 2, [2]int{1, 0}},
+		// part of a 2M page
+		{0x200, 16, 16, [2]int{0, 0}},
+		// a 1G page
+		{0x40000, 0x40000, 0, [2]int{0, 1}},
+	}
+
+	for specIndex, spec := range specs {
+		unmapCalls, hugeCalls = 0, [2]int{}
+
+		if err := unmapRange(spec.page, spec.pageCount); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if unmapCalls != spec.expUnmapCalls {
+			t.Errorf("[spec %d] expected Unmap to be called %d times; got %d", specIndex, spec.expUnmapCalls, unmapCalls)
+		}
+
+		if hugeCalls != spec.expHugeCalls {
+			t.Errorf("[spec %d] expected UnmapHuge call counts to be %v; got %v", specIndex, spec.expHugeCalls, hugeCalls)
+		}
+	}
+
+	t.Run("unmap errors", func(t *testing.T) {
+		expUnmapErr = &kernel.Error{Module: "test", Message: "unmap failed"}
+		if err := unmapRange(0x1, 1); err != expUnmapErr {
+			t.Errorf("expected error: %v; got %v", expUnmapErr, err)
+		}
+
+		expHugeErr = &kernel.Error{Module: "test", Message: "huge unmap failed"}
+		if err := unmapRange(0x200, 512); err != expHugeErr {
+			t.Errorf("expected error: %v; got %v", expHugeErr, err)
+		}
+	})
+}
+
+func TestMappedHugePageSizeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+	}(ptePtrFn)
+
+	var (
+		physPages    [pageLevels][mm.PageSize >> mm.PointerShift]pageTableEntry
+		pteCallCount int
+	)
+
+	ptePtrFn = func(entry uintptr) unsafe.Pointer {
+		pteCallCount++
+		return unsafe.Pointer(&physPages[pteCallCount-1][0])
+	}
+
+	specs := []struct {
+		p1Flags, p2Flags PageTableEntryFlag
+		expSize          HugePageSize
+		expHuge          bool
+	}{
+		{FlagPresent | FlagHugePage, 0, HugePage1G, true},
+		{FlagPresent, FlagPresent | FlagHugePage, HugePage2M, true},
+		{FlagPresent, FlagPresent, 0, false},
+		{FlagPresent, 0, 0, false},
+		{0, 0, 0, false},
+	}
+
+	for specIndex, spec := range specs {
+		pteCallCount = 0
+		physPages[0][0] = pageTableEntry(FlagPresent)
+		physPages[1][0] = pageTableEntry(spec.p1Flags)
+		physPages[2][0] = pageTableEntry(spec.p2Flags)
+		physPages[3][0] = pageTableEntry(FlagPresent)
+
+		size, huge := mappedHugePageSize(0)
+		if huge != spec.expHuge || size != spec.expSize {
+			t.Errorf("[spec %d] expected to get (%d, %t); got (%d, %t)", specIndex, spec.expSize, spec.expHuge, size, huge)
+		}
+	}
+}
+
+func TestMapRange(t *testing.T) {
+	defer func() {
+		mapFn = Map
+		mapHugeFn = MapHuge
+		cpuidFn = cpu.ID
+	}()
+
+	var (
+		mapCalls    int
+		hugeCalls   [2]int
+		expMapErr   *kernel.Error
+		expHugeErr  *kernel.Error
+		huge1GFlags uint32
+	)
+
+	mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error {
+		mapCalls++
+		return expMapErr
+	}
+	mapHugeFn = func(page mm.Page, frame mm.Frame, size HugePageSize, _ PageTableEntryFlag) *kernel.Error {
+		if mask := (size.Size() >> mm.PageShift) - 1; uintptr(page)&mask != 0 || uintptr(frame)&mask != 0 {
+			t.Errorf("MapHuge called with misaligned page %d or frame %d", page, frame)
+		}
+		hugeCalls[size]++
+		return expHugeErr
+	}
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, huge1GFlags }
+
+	specs := []struct {
+		page         mm.Page
+		frame        mm.Frame
+		pageCount    uintptr
+		have1G       bool
+		expMapCalls  int
+		expHugeCalls [2]int
+	}{
+		// page and frame never become aligned at the same time
+		{0x1, 0x2, 1024, true, 1024, [2]int{0, 0}},
+		// 1 page, 1 2M page and 1 page
+		{0x1ff, 0x1ff, 514, false, 2, [2]int{1, 0}},
+		// 1G region with and without 1G page support
+		{0x40000, 0x40000, 0x40000, true, 0, [2]int{0, 1}},
+		{0x40000, 0x40000, 0x40000, false, 0, [2]int{512, 0}},
+	}
+
+	for specIndex, spec := range specs {
+		mapCalls, hugeCalls = 0, [2]int{}
+		huge1GFlags = 0
+		if spec.have1G {
+			huge1GFlags = 1 << 26
+		}
+
+		if err := mapRange(spec.page, spec.frame, spec.pageCount, FlagPresent); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		if mapCalls != spec.expMapCalls {
+			t.Errorf("[spec %d] expected Map to be called %d times; got %d", specIndex, spec.expMapCalls, mapCalls)
+		}
+
+		if hugeCalls != spec.expHugeCalls {
+			t.Errorf("[spec %d] expected MapHuge call counts to be %v; got %v", specIndex, spec.expHugeCalls, hugeCalls)
+		}
+	}
+
+	t.Run("map errors", func(t *testing.T) {
+		expMapErr = &kernel.Error{Module: "test", Message: "map failed"}
+		if err := mapRange(0x1, 0x1, 1, FlagPresent); err != expMapErr {
+			t.Errorf("expected error: %v; got %v", expMapErr, err)
+		}
+
+		expHugeErr = &kernel.Error{Module: "test", Message: "huge map failed"}
+		if err := mapRange(0x200, 0x200, 512, FlagPresent); err != expHugeErr {
+			t.Errorf("expected error: %v; got %v", expHugeErr, err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"unsafe"
+)
+
+// maxPagerRegions is the maximum number of regions that can be registered
+// via RegisterPagerRegion.
+const maxPagerRegions = 32
+
+var (
+	errPagerRegionAlignment = &kernel.Error{Module: "vmm", Message: "pager region start and size must be page-aligned"}
+	errPagerRegionOverlap   = &kernel.Error{Module: "vmm", Message: "pager region overlaps an existing pager region"}
+	errPagerRegionLimit     = &kernel.Error{Module: "vmm", Message: "maximum number of pager regions reached"}
+	errPagerRegionNotFound  = &kernel.Error{Module: "vmm", Message: "no pager region starts at the requested address"}
+
+	// pagerRegions holds the regions registered via RegisterPagerRegion.
+	// A fixed-size array is used so that the page fault handler does not
+	// need to allocate memory.
+	pagerRegions     [maxPagerRegions]pagerRegion
+	pagerRegionCount int
+)
+
+// Pager populates the contents of a page that belongs to a pager region. It is
+// invoked by the page fault handler when a non-present page inside the region
+// is accessed. The offset argument is the offset of the faulting page from the
+// start of the region and dst is a writable page that is mapped to the frame
+// which will back the faulting page once the pager returns.
+//
+// As pagers run in the context of the page fault handler they must not
+// trigger any page faults for addresses inside pager regions.
+type Pager func(offset uintptr, dst mm.Page) *kernel.Error
+
+// pagerRegion describes a virtual memory region whose pages are populated on
+// demand by a pager.
+type pagerRegion struct {
+	// start and end describe the [start, end) virtual address range
+	// covered by the region.
+	start, end uintptr
+
+	// flags are the page table entry flags used for mapping pages
+	// populated by the pager.
+	flags PageTableEntryFlag
+
+	pager Pager
+}
+
+// RegisterPagerRegion registers a virtual memory region of the given size
+// whose pages are populated on demand by pager. When a non-present page
+// inside the region is accessed, the page fault handler allocates a frame,
+// asks the pager to fill it and maps it using the supplied flags. Both start
+// and size must be page-aligned and the region must not overlap any other
+// pager region.
+func RegisterPagerRegion(start, size uintptr, flags PageTableEntryFlag, pager Pager) *kernel.Error {
+	if size == 0 || start&(mm.PageSize-1) != 0 || size&(mm.PageSize-1) != 0 {
+		return errPagerRegionAlignment
+	}
+
+	end := start + size
+	for index := 0; index < pagerRegionCount; index++ {
+		if start < pagerRegions[index].end && pagerRegions[index].start < end {
+			return errPagerRegionOverlap
+		}
+	}
+
+	if pagerRegionCount == maxPagerRegions {
+		return errPagerRegionLimit
+	}
+
+	pagerRegions[pagerRegionCount] = pagerRegion{
+		start: start,
+		end:   end,
+		flags: flags | FlagPresent,
+		pager: pager,
+	}
+	pagerRegionCount++
+	return nil
+}
+
+// UnregisterPagerRegion removes the pager region that starts at the given
+// address and unmaps any pages that were populated by its pager. The frames
+// backing the populated pages are released once they are no longer mapped
+// anywhere else. If a page cannot be unmapped, the region remains registered
+// so that the call can be retried.
+func UnregisterPagerRegion(start uintptr) *kernel.Error {
+	for index := 0; index < pagerRegionCount; index++ {
+		if pagerRegions[index].start != start {
+			continue
+		}
+
+		region := pagerRegions[index]
+		for page, lastPage := mm.PageFromAddress(region.start), mm.PageFromAddress(region.end-1); page <= lastPage; page++ {
+			if _, err := translateFn(page.Address()); err != nil {
+				continue
+			}
+
+			if err := unmapFn(page); err != nil {
+				return err
+			}
+		}
+
+		pagerRegionCount--
+		pagerRegions[index] = pagerRegions[pagerRegionCount]
+		pagerRegions[pagerRegionCount] = pagerRegion{}
+		return nil
+	}
+
+	return errPagerRegionNotFound
+}
+
+// findPagerRegion returns the pager region that contains virtAddr or nil if
+// virtAddr does not belong to any pager region.
+func findPagerRegion(virtAddr uintptr) *pagerRegion {
+	for index := 0; index < pagerRegionCount; index++ {
+		if virtAddr >= pagerRegions[index].start && virtAddr < pagerRegions[index].end {
+			return &pagerRegions[index]
+		}
+	}
+
+	return nil
+}
+
+// pageIn allocates a frame for page, invokes the region pager to populate it
+// and maps it to page.
+func (region *pagerRegion) pageIn(page mm.Page) *kernel.Error {
+	frame, err := mm.AllocFrame()
+	if err != nil {
+		return err
+	}
+
+	tmpPage, err := accessFrame(frame)
+	if err != nil {
+		_ = mm.FreeFrame(frame)
+		return err
+	}
+
+	err = region.pager(page.Address()-region.start, tmpPage)
+	releaseFrame(tmpPage)
+
+	if err == nil {
+		err = mapFn(page, frame, region.flags)
+	}
+
+	if err != nil {
+		_ = mm.FreeFrame(frame)
+		return err
+	}
+
+	mm.TrackDemandFault()
+	return nil
+}
+
+// ZeroFillPager is a Pager that populates pages with zeroes.
+func ZeroFillPager(_ uintptr, dst mm.Page) *kernel.Error {
+	kernel.Memset(dst.Address(), 0, mm.PageSize)
+	return nil
+}
+
+// BufferPager returns a Pager that populates pages with the contents of buf.
+// Pages (or parts of pages) beyond the end of buf are filled with zeroes.
+func BufferPager(buf []byte) Pager {
+	return func(offset uintptr, dst mm.Page) *kernel.Error {
+		kernel.Memset(dst.Address(), 0, mm.PageSize)
+
+		if offset < uintptr(len(buf)) {
+			copySize := uintptr(len(buf)) - offset
+			if copySize > mm.PageSize {
+				copySize = mm.PageSize
+			}
+
+			kernel.Memcopy(uintptr(unsafe.Pointer(&buf[offset])), dst.Address(), copySize)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,319 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"io/ioutil"
+	"testing"
+	"unsafe"
+)
+
+func TestRegisterPagerRegion(t *testing.T) {
+	defer func() {
+		pagerRegions = [maxPagerRegions]pagerRegion{}
+		pagerRegionCount = 0
+		translateFn = Translate
+		unmapFn = Unmap
+	}()
+
+	regionStart := uintptr(0xffffa00000000000)
+
+	specs := []struct {
+		start, size uintptr
+		expErr      *kernel.Error
+	}{
+		{regionStart, 4 * mm.PageSize, nil},
+		{regionStart + 4*mm.PageSize, mm.PageSize, nil},
+		{regionStart + 1, mm.PageSize, errPagerRegionAlignment},
+		{regionStart + 8*mm.PageSize, mm.PageSize + 1, errPagerRegionAlignment},
+		{regionStart + 8*mm.PageSize, 0, errPagerRegionAlignment},
+		{regionStart - mm.PageSize, 2 * mm.PageSize, errPagerRegionOverlap},
+		{regionStart + 3*mm.PageSize, 4 * mm.PageSize, errPagerRegionOverlap},
+	}
+
+	for specIndex, spec := range specs {
+		if err := RegisterPagerRegion(spec.start, spec.size, FlagRW, ZeroFillPager); err != spec.expErr {
+			t.Errorf("[spec %d] expected error: %v; got %v", specIndex, spec.expErr, err)
+		}
+	}
+
+	if pagerRegionCount != 2 {
+		t.Fatalf("expected 2 pager regions to be registered; got %d", pagerRegionCount)
+	}
+
+	if exp := FlagPresent | FlagRW; pagerRegions[0].flags != exp {
+		t.Fatalf("expected region flags to be %d; got %d", exp, pagerRegions[0].flags)
+	}
+
+	for addr, expIndex := range map[uintptr]int{
+		regionStart - 1:                   -1,
+		regionStart:                       0,
+		regionStart + 4*mm.PageSize - 1:   0,
+		regionStart + 4*mm.PageSize:       1,
+		regionStart + 5*mm.PageSize - 1:   1,
+		regionStart + 5*mm.PageSize:       -1,
+		regionStart + 128*mm.PageSize + 1: -1,
+	} {
+		region := findPagerRegion(addr)
+		switch {
+		case expIndex == -1 && region != nil:
+			t.Errorf("expected address 0x%x not to belong to a pager region", addr)
+		case expIndex != -1 && region != &pagerRegions[expIndex]:
+			t.Errorf("expected address 0x%x to belong to pager region %d", addr, expIndex)
+		}
+	}
+
+	t.Run("unregister", func(t *testing.T) {
+		var unmapped []mm.Page
+
+		// Only the second page of the region has been populated
+		translateFn = func(virtAddr uintptr) (uintptr, *kernel.Error) {
+			if virtAddr == regionStart+mm.PageSize {
+				return 0x1000, nil
+			}
+			return 0, ErrInvalidMapping
+		}
+		unmapFn = func(page mm.Page) *kernel.Error {
+			unmapped = append(unmapped, page)
+			return nil
+		}
+
+		if err := UnregisterPagerRegion(regionStart + mm.PageSize); err != errPagerRegionNotFound {
+			t.Fatalf("expected error: %v; got %v", errPagerRegionNotFound, err)
+		}
+
+		if err := UnregisterPagerRegion(regionStart); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(unmapped) != 1 || unmapped[0] != mm.PageFromAddress(regionStart+mm.PageSize) {
+			t.Fatalf("expected only the populated page to be unmapped; got %v", unmapped)
+		}
+
+		if pagerRegionCount != 1 || findPagerRegion(regionStart) != nil || findPagerRegion(regionStart+4*mm.PageSize) == nil {
+			t.Fatal("expected only the unregistered region to be removed")
+		}
+
+		expErr := &kernel.Error{Module: "test", Message: "unmap failed"}
+		translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, nil }
+		unmapFn = func(_ mm.Page) *kernel.Error { return expErr }
+		if err := UnregisterPagerRegion(regionStart + 4*mm.PageSize); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+
+		if pagerRegionCount != 1 || findPagerRegion(regionStart+4*mm.PageSize) == nil {
+			t.Fatal("expected region to remain registered when unmapping fails")
+		}
+
+		unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+		if err := UnregisterPagerRegion(regionStart + 4*mm.PageSize); err != nil {
+			t.Fatal(err)
+		}
+
+		if pagerRegionCount != 0 {
+			t.Fatal("expected region to be removed after a successful retry")
+		}
+	})
+
+	t.Run("region limit", func(t *testing.T) {
+		pagerRegionCount = 0
+		for index := 0; index < maxPagerRegions; index++ {
+			if err := RegisterPagerRegion(regionStart+uintptr(index)*mm.PageSize, mm.PageSize, FlagRW, ZeroFillPager); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := RegisterPagerRegion(regionStart+maxPagerRegions*mm.PageSize, mm.PageSize, FlagRW, ZeroFillPager); err != errPagerRegionLimit {
+			t.Fatalf("expected error: %v; got %v", errPagerRegionLimit, err)
+		}
+	})
+}
+
+func TestBufferPager(t *testing.T) {
+	var (
+		buf     = make([]byte, mm.PageSize+16)
+		dstBuf  = make([]byte, 2*mm.PageSize)
+		dstPage = mm.PageFromAddress((uintptr(unsafe.Pointer(&dstBuf[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1))
+		dst     = (*[mm.PageSize]byte)(unsafe.Pointer(dstPage.Address()))
+	)
+
+	for i := 0; i < len(buf); i++ {
+		buf[i] = byte(i%255) + 1
+	}
+
+	pager := BufferPager(buf)
+
+	specs := []struct {
+		offset  uintptr
+		expData []byte
+	}{
+		{0, buf[:mm.PageSize]},
+		{mm.PageSize, buf[mm.PageSize:]},
+		{2 * mm.PageSize, nil},
+	}
+
+	for specIndex, spec := range specs {
+		for i := 0; i < len(dst); i++ {
+			dst[i] = 0xff
+		}
+
+		if err := pager(spec.offset, dstPage); err != nil {
+			t.Errorf("[spec %d] unexpected error: %v", specIndex, err)
+			continue
+		}
+
+		for i := 0; i < len(dst); i++ {
+			var exp byte
+			if i < len(spec.expData) {
+				exp = spec.expData[i]
+			}
+
+			if dst[i] != exp {
+				t.Errorf("[spec %d] expected byte %d to be 0x%x; got 0x%x", specIndex, i, exp, dst[i])
+				break
+			}
+		}
+	}
+}
+
+func TestDemandPageFault(t *testing.T) {
+	var (
+		regs      gate.Registers
+		pageEntry pageTableEntry
+		frameBuf  = make([]byte, 2*mm.PageSize)
+		frameAddr = (uintptr(unsafe.Pointer(&frameBuf[0])) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		pageData  = (*[mm.PageSize]byte)(unsafe.Pointer(frameAddr))
+		expErr    = &kernel.Error{Module: "test", Message: "something went wrong"}
+
+		regionStart = uintptr(0xffffa00000000000)
+		faultAddr   = regionStart + mm.PageSize + 42
+	)
+
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		readCR2Fn = cpu.ReadCR2
+		mapFn = Map
+		mapTemporaryFn = MapTemporary
+		unmapFn = Unmap
+		mm.SetFrameAllocator(nil)
+		mm.SetFrameFreer(nil)
+		pagerRegions = [maxPagerRegions]pagerRegion{}
+		pagerRegionCount = 0
+		kfmt.SetOutputSink(nil)
+	}(ptePtrFn)
+
+	kfmt.SetOutputSink(ioutil.Discard)
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+	readCR2Fn = func() uint64 { return uint64(faultAddr) }
+	mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+	unmapFn = func(_ mm.Page) *kernel.Error { return nil }
+
+	var (
+		pagerErr, allocErr, mapErr *kernel.Error
+		mappedPage                 mm.Page
+		mappedFlags                PageTableEntryFlag
+		freedFrames                []mm.Frame
+	)
+
+	mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+		return mm.FrameFromAddress(frameAddr), allocErr
+	})
+	mm.SetFrameFreer(func(frame mm.Frame) *kernel.Error {
+		freedFrames = append(freedFrames, frame)
+		return nil
+	})
+	mapFn = func(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+		if frame != mm.FrameFromAddress(frameAddr) {
+			t.Errorf("expected frame 0x%x to be mapped; got 0x%x", mm.FrameFromAddress(frameAddr), frame)
+		}
+		mappedPage, mappedFlags = page, flags
+		return mapErr
+	}
+
+	var pagerOffset uintptr
+	pager := func(offset uintptr, dst mm.Page) *kernel.Error {
+		pagerOffset = offset
+		kernel.Memset(dst.Address(), 0xaa, mm.PageSize)
+		return pagerErr
+	}
+
+	if err := RegisterPagerRegion(regionStart, 4*mm.PageSize, FlagRW|FlagNoExecute, pager); err != nil {
+		t.Fatal(err)
+	}
+
+	specs := []struct {
+		faultInfo                  uint64
+		pagerErr, allocErr, mapErr *kernel.Error
+		expPanic                   bool
+		expFreed                   bool
+	}{
+		// Read from non-present page inside the region
+		{0, nil, nil, nil, false, false},
+		// Write to non-present page inside the region
+		{2, nil, nil, nil, false, false},
+		// Protection violation inside the region
+		{3, nil, nil, nil, true, false},
+		// Frame allocation fails
+		{2, nil, expErr, nil, true, false},
+		// Pager fails
+		{2, expErr, nil, nil, true, true},
+		// Mapping the populated frame fails
+		{2, nil, nil, expErr, true, true},
+	}
+
+	for specIndex, spec := range specs {
+		func() {
+			defer func() {
+				if err := recover(); spec.expPanic && err == nil {
+					t.Errorf("[spec %d] expected a panic", specIndex)
+				} else if !spec.expPanic && err != nil {
+					t.Errorf("[spec %d] unexpected panic: %v", specIndex, err)
+				}
+
+				if exp := spec.expFreed; exp != (len(freedFrames) == 1) {
+					t.Errorf("[spec %d] expected frame to be freed: %t; freed frames: %v", specIndex, exp, freedFrames)
+				}
+			}()
+
+			pagerErr, allocErr, mapErr = spec.pagerErr, spec.allocErr, spec.mapErr
+			mappedPage, mappedFlags, freedFrames, pagerOffset = 0, 0, nil, 0
+			pageEntry = 0
+			pageData[0] = 0
+
+			regs.Info = spec.faultInfo
+			pageFaultHandler(&regs)
+
+			if pagerOffset != mm.PageSize {
+				t.Errorf("[spec %d] expected pager to be invoked with offset 0x%x; got 0x%x", specIndex, mm.PageSize, pagerOffset)
+			}
+
+			if pageData[0] != 0xaa {
+				t.Errorf("[spec %d] expected frame to be populated by the pager", specIndex)
+			}
+
+			if exp := mm.PageFromAddress(faultAddr); mappedPage != exp {
+				t.Errorf("[spec %d] expected page 0x%x to be mapped; got 0x%x", specIndex, exp, mappedPage)
+			}
+
+			if exp := FlagPresent | FlagRW | FlagNoExecute; mappedFlags != exp {
+				t.Errorf("[spec %d] expected map flags to be %d; got %d", specIndex, exp, mappedFlags)
+			}
+		}()
+	}
+
+	// Faults outside pager regions are not recoverable
+	t.Run("fault outside pager regions", func(t *testing.T) {
+		defer func() {
+			if err := recover(); err != errUnrecoverableFault {
+				t.Fatalf("expected a panic with error %v; got %v", errUnrecoverableFault, err)
+			}
+		}()
+
+		readCR2Fn = func() uint64 { return uint64(regionStart - 1) }
+		regs.Info = 2
+		pageFaultHandler(&regs)
+	})
+}
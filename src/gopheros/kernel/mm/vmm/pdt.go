@@ -44,8 +44,8 @@ type PageDirectoryTable struct {
 // Init sets up the page table directory starting at the supplied physical
 // address. If the supplied frame does not match the currently active PDT, then
 // Init assumes that this is a new page table directory that needs
-// bootstapping. In such a case, a temporary mapping is established so that
-// Init can:
+// bootstapping. In such a case, the frame is accessed via the direct map (or a
+// temporary mapping if the direct map is not yet available) so that Init can:
 //  - call kernel.Memset to clear the frame contents
 //  - setup a recursive mapping for the last table entry to the page itself.
 func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
@@ -58,8 +58,8 @@ func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 		return nil
 	}
 
-	// Create a temporary mapping for the pdt frame so we can work on it
-	pdtPage, err := mapTemporaryFn(pdtFrame)
+	// Access the pdt frame so we can work on it
+	pdtPage, err := accessFrame(pdtFrame)
 	if err != nil {
 		return err
 	}
@@ -71,8 +71,8 @@ func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 	lastPdtEntry.SetFlags(FlagPresent | FlagRW)
 	lastPdtEntry.SetFrame(pdtFrame)
 
-	// Remove temporary mapping
-	_ = unmapFn(pdtPage)
+	// Remove temporary mapping (if any)
+	releaseFrame(pdtPage)
 
 	return nil
 }
@@ -83,29 +83,19 @@ func (pdt *PageDirectoryTable) Init(pdtFrame mm.Frame) *kernel.Error {
 // establishing a temporary mapping so that Map() can access the inactive PDT
 // entries.
 func (pdt PageDirectoryTable) Map(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
-	var (
-		activePdtFrame   = mm.Frame(activePDTFn() >> mm.PageShift)
-		lastPdtEntryAddr uintptr
-		lastPdtEntry     *pageTableEntry
-	)
-	// If this table is not active we need to temporarily map it to the
-	// last entry in the active PDT so we can access it using the recursive
-	// virtual address scheme.
-	if activePdtFrame != pdt.pdtFrame {
-		lastPdtEntryAddr = activePdtFrame.Address() + (((1 << pageLevelBits[0]) - 1) << mm.PointerShift)
-		lastPdtEntry = (*pageTableEntry)(unsafe.Pointer(lastPdtEntryAddr))
-		lastPdtEntry.SetFrame(pdt.pdtFrame)
-		flushTLBEntryFn(lastPdtEntryAddr)
-	}
-
-	err := mapFn(page, frame, flags)
-
-	if activePdtFrame != pdt.pdtFrame {
-		lastPdtEntry.SetFrame(activePdtFrame)
-		flushTLBEntryFn(lastPdtEntryAddr)
-	}
+	return pdt.exec(func() *kernel.Error {
+		return mapFn(page, frame, flags)
+	})
+}
 
-	return err
+// MapHuge establishes a huge page mapping between a virtual page and a
+// physical memory frame using this PDT. This method behaves in a similar
+// fashion to the global MapHuge() function with the difference that it also
+// supports inactive page PDTs.
+func (pdt PageDirectoryTable) MapHuge(page mm.Page, frame mm.Frame, size HugePageSize, flags PageTableEntryFlag) *kernel.Error {
+	return pdt.exec(func() *kernel.Error {
+		return mapHugeFn(page, frame, size, flags)
+	})
 }
 
 // Unmap removes a mapping previousle installed by a call to Map() on this PDT.
@@ -113,14 +103,20 @@ func (pdt PageDirectoryTable) Map(page mm.Page, frame mm.Frame, flags PageTableE
 // the difference that it also supports inactive page PDTs by establishing a
 // temporary mapping so that Unmap() can access the inactive PDT entries.
 func (pdt PageDirectoryTable) Unmap(page mm.Page) *kernel.Error {
+	return pdt.exec(func() *kernel.Error {
+		return unmapFn(page)
+	})
+}
+
+// exec invokes fn while this PDT is accessible via the recursive virtual
+// address scheme. If this table is not active we need to temporarily map it to
+// the last entry in the active PDT so that fn can access its entries.
+func (pdt PageDirectoryTable) exec(fn func() *kernel.Error) *kernel.Error {
 	var (
 		activePdtFrame   = mm.Frame(activePDTFn() >> mm.PageShift)
 		lastPdtEntryAddr uintptr
 		lastPdtEntry     *pageTableEntry
 	)
-	// If this table is not active we need to temporarily map it to the
-	// last entry in the active PDT so we can access it using the recursive
-	// virtual address scheme.
 	if activePdtFrame != pdt.pdtFrame {
 		lastPdtEntryAddr = activePdtFrame.Address() + (((1 << pageLevelBits[0]) - 1) << mm.PointerShift)
 		lastPdtEntry = (*pageTableEntry)(unsafe.Pointer(lastPdtEntryAddr))
@@ -128,7 +124,7 @@ func (pdt PageDirectoryTable) Unmap(page mm.Page) *kernel.Error {
 		flushTLBEntryFn(lastPdtEntryAddr)
 	}
 
-	err := unmapFn(page)
+	err := fn()
 
 	if activePdtFrame != pdt.pdtFrame {
 		lastPdtEntry.SetFrame(activePdtFrame)
@@ -153,6 +149,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 	if err != nil {
 		return err
 	}
+	mm.TrackPageTableFrames(1)
 
 	if err = kernelPDT.Init(kernelPDTFrame); err != nil {
 		return err
@@ -160,6 +157,11 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 
 	// Query the ELF sections of the kernel image and establish mappings
 	// for each one using the appropriate flags
+	var (
+		prevLastPage mm.Page
+		prevFlags    PageTableEntryFlag
+	)
+	kernelImageStartAddr, kernelImageEndAddr = 0, 0
 	var visitor = func(_ string, secFlags multiboot.ElfSectionFlag, secAddress uintptr, secSize uint64) {
 		// Bail out if we have encountered an error; also ignore sections
 		// not using the kernel's VMA
@@ -167,16 +169,19 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 			return
 		}
 
-		flags := FlagPresent
-
-		if (secFlags & multiboot.ElfSectionExecutable) == 0 {
-			flags |= FlagNoExecute
+		// Keep track of the physical address range occupied by the
+		// kernel image so the direct map can protect it.
+		secStartAddr := (secAddress - kernelPageOffset) & ^(mm.PageSize - 1)
+		secEndAddr := (secAddress - kernelPageOffset + uintptr(secSize) + mm.PageSize - 1) & ^(mm.PageSize - 1)
+		if kernelImageEndAddr == 0 || secStartAddr < kernelImageStartAddr {
+			kernelImageStartAddr = secStartAddr
 		}
-
-		if (secFlags & multiboot.ElfSectionWritable) != 0 {
-			flags |= FlagRW
+		if secEndAddr > kernelImageEndAddr {
+			kernelImageEndAddr = secEndAddr
 		}
 
+		flags := kernelSectionFlags(secFlags)
+
 		// Map the start and end VMA addresses for the section contents
 		// into a start and end (inclusive) page number. To figure out
 		// the physical start frame we just need to subtract the
@@ -185,8 +190,24 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 		curPage := mm.PageFromAddress(secAddress)
 		lastPage := mm.PageFromAddress(secAddress + uintptr(secSize-1))
 		curFrame := mm.Frame((secAddress - kernelPageOffset) >> mm.PageShift)
-		for ; curPage <= lastPage; curFrame, curPage = curFrame+1, curPage+1 {
-			if err = kernelPDT.Map(curPage, curFrame, flags); err != nil {
+
+		// If the first page is shared with the previous section it
+		// must remain accessible using the flags of both sections. A
+		// page cannot be shared by an executable and a non-executable
+		// section as the non-executable section would either become
+		// executable or, if writable, turn the page into a RW+X page.
+		pageFlags := flags
+		if curPage == prevLastPage {
+			if (flags^prevFlags)&FlagNoExecute != 0 {
+				err = errKernelSectionOverlap
+				return
+			}
+			pageFlags |= prevFlags
+		}
+		prevLastPage, prevFlags = lastPage, flags
+
+		for ; curPage <= lastPage; curFrame, curPage, pageFlags = curFrame+1, curPage+1, flags {
+			if err = kernelPDT.Map(curPage, curFrame, pageFlags); err != nil {
 				return
 			}
 		}
@@ -205,7 +226,7 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 
 	// Ensure that any pages mapped by the mmory allocator using
 	// EarlyReserveRegion are copied to the new page directory.
-	for rsvAddr := earlyReserveLastUsed; rsvAddr < tempMappingAddr; rsvAddr += mm.PageSize {
+	for rsvAddr := earlyReserveLastUsed; rsvAddr < earlyReserveStart; rsvAddr += mm.PageSize {
 		page := mm.PageFromAddress(rsvAddr)
 
 		frameAddr, err := translateFn(rsvAddr)
@@ -218,6 +239,11 @@ func setupPDTForKernel(kernelPageOffset uintptr) *kernel.Error {
 		}
 	}
 
+	// Keep track of the page tables set up by the rt0 code so they can be
+	// reclaimed once the kernel has booted.
+	bootPDTFrame = mm.FrameFromAddress(activePDTFn())
+	bootKernelPageOffset = kernelPageOffset
+
 	// Activate the new PDT. After this point, the identify mapping for the
 	// physical mmory addresses where the kernel is loaded becomes invalid.
 	kernelPDT.Activate()
@@ -277,13 +303,14 @@ func (pte *pageTableEntry) SetFrame(frame mm.Frame) {
 }
 
 // pteForAddress returns the final page table entry that correspond to a
-// particular virtual address. The function performs a page table walk till it
-// reaches the final page table entry returning ErrInvalidMapping if the page
-// is not present.
-func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
+// particular virtual address together with its page level. The function
+// performs a page table walk till it reaches the final page table entry or a
+// huge page entry returning ErrInvalidMapping if the page is not present.
+func pteForAddress(virtAddr uintptr) (*pageTableEntry, uint8, *kernel.Error) {
 	var (
-		err   *kernel.Error
-		entry *pageTableEntry
+		err        *kernel.Error
+		entry      *pageTableEntry
+		entryLevel uint8
 	)
 
 	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
@@ -293,11 +320,13 @@ func pteForAddress(virtAddr uintptr) (*pageTableEntry, *kernel.Error) {
 			return false
 		}
 
-		entry = pte
-		return true
+		entry, entryLevel = pte, pteLevel
+
+		// Huge page entries terminate the walk
+		return pteLevel == 0 || !pte.HasFlags(FlagHugePage)
 	})
 
-	return entry, err
+	return entry, entryLevel, err
 }
 
 var (
@@ -319,6 +348,9 @@ type pageTableWalker func(pteLevel uint8, pte *pageTableEntry) bool
 // suppplied walkFn with the page table entry that corresponds to each page
 // table level. If walkFn returns an error then the walk is aborted and the
 // error is returned to the caller.
+//
+// As walk does not inspect the entries it visits, walkFn is responsible for
+// aborting the walk when it encounters a huge page entry.
 func walk(virtAddr uintptr, walkFn pageTableWalker) {
 	var (
 		level                            uint8
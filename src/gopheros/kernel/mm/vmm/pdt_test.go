@@ -219,6 +219,69 @@ func TestPageDirectoryTableMapAmd64(t *testing.T) {
 	})
 }
 
+func TestPageDirectoryTableMapHugeAmd64(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("test requires amd64 runtime; skipping")
+	}
+
+	defer func(origFlushTLBEntry func(uintptr), origActivePDT func() uintptr, origMapHuge func(mm.Page, mm.Frame, HugePageSize, PageTableEntryFlag) *kernel.Error) {
+		flushTLBEntryFn = origFlushTLBEntry
+		activePDTFn = origActivePDT
+		mapHugeFn = origMapHuge
+	}(flushTLBEntryFn, activePDTFn, mapHugeFn)
+
+	var (
+		pdtFrame       = mm.Frame(123)
+		pdt            = PageDirectoryTable{pdtFrame: pdtFrame}
+		page           = mm.PageFromAddress(uintptr(100 * oneMb))
+		activePhysPage [mm.PageSize >> mm.PointerShift]pageTableEntry
+		activePdtFrame = mm.Frame(uintptr(unsafe.Pointer(&activePhysPage[0])) >> mm.PageShift)
+	)
+
+	activePhysPage[len(activePhysPage)-1].SetFlags(FlagPresent | FlagRW)
+	activePhysPage[len(activePhysPage)-1].SetFrame(activePdtFrame)
+
+	activePDTFn = func() uintptr {
+		return activePdtFrame.Address()
+	}
+
+	mapHugeCallCount := 0
+	mapHugeFn = func(_ mm.Page, _ mm.Frame, size HugePageSize, _ PageTableEntryFlag) *kernel.Error {
+		mapHugeCallCount++
+		if size != HugePage2M {
+			t.Errorf("expected MapHuge to be called with HugePage2M; got %d", size)
+		}
+
+		// While MapHuge runs, the last entry of the active pdt should
+		// be pointing to pdtFrame
+		if got := activePhysPage[len(activePhysPage)-1].Frame(); got != pdtFrame {
+			t.Errorf("expected last PDT entry of active PDT to be re-mapped to frame %x; got %x", pdtFrame, got)
+		}
+		return nil
+	}
+
+	flushCallCount := 0
+	flushTLBEntryFn = func(_ uintptr) {
+		flushCallCount++
+	}
+
+	if err := pdt.MapHuge(page, mm.Frame(0x200), HugePage2M, FlagRW); err != nil {
+		t.Fatal(err)
+	}
+
+	if exp := 1; mapHugeCallCount != exp {
+		t.Fatalf("expected MapHuge to be called %d times; called %d", exp, mapHugeCallCount)
+	}
+
+	if exp := 2; flushCallCount != exp {
+		t.Fatalf("expected flushTLBEntry to be called %d times; called %d", exp, flushCallCount)
+	}
+
+	if got := activePhysPage[len(activePhysPage)-1].Frame(); got != activePdtFrame {
+		t.Fatalf("expected last PDT entry of active PDT to be mapped back frame %x; got %x", activePdtFrame, got)
+	}
+}
+
 func TestPageDirectoryTableUnmapAmd64(t *testing.T) {
 	if runtime.GOARCH != "amd64" {
 		t.Skip("test requires amd64 runtime; skipping")
@@ -405,6 +468,86 @@ func TestSetupPDTForKernel(t *testing.T) {
 		}
 	})
 
+	t.Run("kernel sections sharing a page", func(t *testing.T) {
+		defer func() {
+			visitElfSectionsFn = multiboot.VisitElfSections
+			kernelImageStartAddr, kernelImageEndAddr = 0, 0
+		}()
+
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return mm.Frame(addr >> mm.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		translateFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0xbadf00d000, nil }
+		mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+		visitElfSectionsFn = func(v multiboot.ElfSectionVisitor) {
+			v(".rodata", 0, 0x3000, uint64(mm.PageSize>>1))
+			// shares its first page with .rodata
+			v(".data", multiboot.ElfSectionWritable, 0x3800, uint64(mm.PageSize))
+		}
+
+		expFlags := []PageTableEntryFlag{
+			FlagPresent | FlagNoExecute,
+			FlagPresent | FlagNoExecute | FlagRW,
+			FlagPresent | FlagNoExecute | FlagRW,
+		}
+		mapCount := 0
+		mapFn = func(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			defer func() { mapCount++ }()
+
+			if mapCount < len(expFlags) && flags != expFlags[mapCount] {
+				t.Errorf("[map call %d] expected flags to be %d; got %d", mapCount, expFlags[mapCount], flags)
+			}
+
+			return nil
+		}
+
+		if err := setupPDTForKernel(0x123); err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := len(expFlags); mapCount != exp {
+			t.Errorf("expected Map to be called %d times; got %d", exp, mapCount)
+		}
+
+		if kernelImageStartAddr != 0x2000 || kernelImageEndAddr != 0x5000 {
+			t.Errorf("expected kernel image range to be [0x2000, 0x5000); got [0x%x, 0x%x)", kernelImageStartAddr, kernelImageEndAddr)
+		}
+	})
+
+	t.Run("executable and non-executable kernel sections sharing a page", func(t *testing.T) {
+		defer func() { visitElfSectionsFn = multiboot.VisitElfSections }()
+
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return mm.Frame(addr >> mm.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+		visitElfSectionsFn = func(v multiboot.ElfSectionVisitor) {
+			v(".text", multiboot.ElfSectionExecutable, 0x3000, uint64(mm.PageSize>>1))
+			// shares its first page with .text
+			v(".data", multiboot.ElfSectionWritable, 0x3800, uint64(mm.PageSize))
+		}
+		mapFn = func(page mm.Page, frame mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			if flags&(FlagRW|FlagNoExecute) == FlagRW {
+				t.Errorf("unexpected RW+X mapping for page 0x%x", page.Address())
+			}
+			return nil
+		}
+
+		if err := setupPDTForKernel(0x123); err != errKernelSectionOverlap {
+			t.Fatalf("expected error: %v; got %v", errKernelSectionOverlap, err)
+		}
+	})
+
 	t.Run("map of kernel sections fials", func(t *testing.T) {
 		defer func() { visitElfSectionsFn = multiboot.VisitElfSections }()
 		expErr := &kernel.Error{Module: "test", Message: "map failed"}
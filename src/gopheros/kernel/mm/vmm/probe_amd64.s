@@ -0,0 +1,23 @@
+#include "textflag.h"
+
+TEXT ·probeWrite(SB),NOSPLIT,$0
+	MOVB $1, ret+8(FP)
+	MOVQ addr+0(FP), AX
+	MOVB (AX), BX
+	MOVB BX, (AX)
+	RET
+
+TEXT ·probeExec(SB),NOSPLIT,$0
+	MOVB $1, ret+8(FP)
+	MOVQ addr+0(FP), AX
+	// the code at addr returns directly to our caller
+	JMP AX
+
+TEXT ·probeFaultReturn(SB),NOSPLIT,$0
+	MOVB $0, ret+8(FP)
+	RET
+
+TEXT ·probeFaultReturnAddr(SB),NOSPLIT,$0
+	MOVQ $·probeFaultReturn(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
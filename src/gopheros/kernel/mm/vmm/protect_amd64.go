@@ -0,0 +1,173 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/mm"
+	"gopheros/multiboot"
+	"unsafe"
+)
+
+const (
+	// cr0WriteProtect prevents ring-0 code from writing to read-only pages.
+	cr0WriteProtect = uint64(1 << 16)
+
+	// cr4SMEP prevents ring-0 code from executing user-accessible pages.
+	cr4SMEP = uint64(1 << 20)
+
+	// cr4SMAP prevents ring-0 code from accessing user-accessible pages.
+	cr4SMAP = uint64(1 << 21)
+
+	// eferNXE enables support for FlagNoExecute.
+	msrEFER = cpu.MSREFER
+	eferNXE = cpu.EFERNoExecuteEnable
+)
+
+var (
+	// the following functions are mocked by tests and are automatically
+	// inlined by the compiler.
+	readCR0Fn    = cpu.ReadCR0
+	writeCR0Fn   = cpu.WriteCR0
+	readCR4Fn    = cpu.ReadCR4
+	writeCR4Fn   = cpu.WriteCR4
+	readMSRFn    = cpu.ReadMSR
+	probeWriteFn = probeWrite
+	probeExecFn  = probeExec
+
+	// probeActive is set to true while the protection self-check runs.
+	// It instructs the page fault handler to resume execution at
+	// probeFaultReturn instead of treating the fault as fatal.
+	probeActive bool
+
+	// probeExecData contains a RET instruction and lives in the kernel
+	// data section. The protection self-check attempts to execute it.
+	probeExecData = [1]byte{0xc3}
+
+	errKernelSectionProtection = &kernel.Error{Module: "vmm", Message: "kernel section mapped with wrong page protection flags"}
+	errKernelSectionOverlap    = &kernel.Error{Module: "vmm", Message: "executable and non-executable kernel sections share a page"}
+	errKernelProtectionCheck   = &kernel.Error{Module: "vmm", Message: "W^X self-check failed"}
+)
+
+// probeWrite reads a byte from addr and writes it back. It returns false if
+// the write triggers a page fault while probeActive is set.
+func probeWrite(addr uintptr) bool
+
+// probeExec jumps to the code at addr which must consist of a RET
+// instruction. It returns false if the jump triggers a page fault while
+// probeActive is set.
+func probeExec(addr uintptr) bool
+
+// probeFaultReturn is never called directly. The page fault handler resumes
+// execution at its entry point when a probe faults so that the probe returns
+// false to its caller.
+func probeFaultReturn(addr uintptr) bool
+
+// probeFaultReturnAddr returns the address of the probeFaultReturn code.
+func probeFaultReturnAddr() uintptr
+
+// enableProtectionFeatures enables write-protection for ring-0 code and, when
+// supported by the CPU, no-execute pages and the SMEP and SMAP features which
+// prevent the kernel from executing or accessing user pages.
+func enableProtectionFeatures() {
+	writeCR0Fn(readCR0Fn() | cr0WriteProtect)
+
+	if _, _, _, edx := cpuidFn(0x80000001); edx&(1<<20) != 0 {
+		writeMSRFn(msrEFER, readMSRFn(msrEFER)|eferNXE)
+	}
+
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < 7 {
+		return
+	}
+
+	_, ebx, _, _ := cpuidFn(7)
+	cr4 := readCR4Fn()
+	if ebx&(1<<7) != 0 {
+		cr4 |= cr4SMEP
+	}
+	if ebx&(1<<20) != 0 {
+		cr4 |= cr4SMAP
+	}
+	writeCR4Fn(cr4)
+}
+
+// kernelSectionFlags returns the page table entry flags for mapping a kernel
+// section with the given ELF flags. Executable sections are mapped RX and all
+// other sections are mapped NX. Writable sections are always mapped NX.
+func kernelSectionFlags(secFlags multiboot.ElfSectionFlag) PageTableEntryFlag {
+	flags := FlagPresent
+
+	if (secFlags & multiboot.ElfSectionExecutable) == 0 {
+		flags |= FlagNoExecute
+	}
+
+	if (secFlags & multiboot.ElfSectionWritable) != 0 {
+		flags |= FlagRW | FlagNoExecute
+	}
+
+	return flags
+}
+
+// verifyKernelSections walks the page tables for the kernel sections that use
+// the kernel's VMA and ensures that no page is both writable and executable,
+// that pages of writable sections are writable and that only the pages of
+// executable sections are executable.
+func verifyKernelSections(kernelPageOffset uintptr) *kernel.Error {
+	var err *kernel.Error
+
+	var visitor = func(_ string, secFlags multiboot.ElfSectionFlag, secAddress uintptr, secSize uint64) {
+		if err != nil || secAddress < kernelPageOffset || secSize == 0 {
+			return
+		}
+
+		var (
+			pte      *pageTableEntry
+			expRW    = (secFlags & multiboot.ElfSectionWritable) != 0
+			expNX    = (secFlags&multiboot.ElfSectionExecutable) == 0 || expRW
+			curPage  = mm.PageFromAddress(secAddress)
+			lastPage = mm.PageFromAddress(secAddress + uintptr(secSize-1))
+		)
+
+		for ; curPage <= lastPage; curPage++ {
+			if pte, _, err = pteForAddress(curPage.Address()); err != nil {
+				return
+			}
+
+			isRW, isNX := pte.HasFlags(FlagRW), pte.HasFlags(FlagNoExecute)
+			if (isRW && !isNX) || (expRW && !isRW) || isNX != expNX {
+				kfmt.Printf("[vmm] kernel page 0x%x has wrong protection flags\n", curPage.Address())
+				err = errKernelSectionProtection
+				return
+			}
+		}
+	}
+
+	visitElfSectionsFn(
+		*(*multiboot.ElfSectionVisitor)(noEscape(unsafe.Pointer(&visitor))),
+	)
+
+	return err
+}
+
+// checkKernelProtections attempts to write to the kernel code and to execute
+// code stored in the kernel data section and returns an error unless both
+// attempts were blocked by the MMU.
+func checkKernelProtections() *kernel.Error {
+	probeActive = true
+	textWritable := probeWriteFn(probeFaultReturnAddr())
+	dataExecutable := probeExecFn(uintptr(unsafe.Pointer(&probeExecData[0])))
+	probeActive = false
+
+	if textWritable {
+		kfmt.Printf("[vmm] W^X self-check failed: kernel code is writable\n")
+	}
+	if dataExecutable {
+		kfmt.Printf("[vmm] W^X self-check failed: kernel data is executable\n")
+	}
+	if textWritable || dataExecutable {
+		return errKernelProtectionCheck
+	}
+
+	kfmt.Printf("[vmm] W^X self-check passed\n")
+	return nil
+}
@@ -0,0 +1,187 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/gate"
+	"gopheros/multiboot"
+	"testing"
+	"unsafe"
+)
+
+func TestEnableProtectionFeatures(t *testing.T) {
+	defer func() {
+		cpuidFn = cpu.ID
+		readCR0Fn = cpu.ReadCR0
+		writeCR0Fn = cpu.WriteCR0
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		readMSRFn = cpu.ReadMSR
+		writeMSRFn = cpu.WriteMSR
+	}()
+
+	specs := []struct {
+		maxLeaf, leaf7EBX, extEDX uint32
+		expEFER, expCR4           uint64
+	}{
+		{0, 0, 0, 0, 0},
+		{7, 0, 1 << 20, eferNXE, 0},
+		{7, 1 << 7, 0, 0, cr4SMEP},
+		{7, (1 << 7) | (1 << 20), 1 << 20, eferNXE, cr4SMEP | cr4SMAP},
+		// leaf 7 is not supported
+		{6, (1 << 7) | (1 << 20), 0, 0, 0},
+	}
+
+	for specIndex, spec := range specs {
+		var cr0, cr4, efer uint64
+
+		cpuidFn = func(leaf uint32) (uint32, uint32, uint32, uint32) {
+			switch leaf {
+			case 0:
+				return spec.maxLeaf, 0, 0, 0
+			case 7:
+				return 0, spec.leaf7EBX, 0, 0
+			case 0x80000001:
+				return 0, 0, 0, spec.extEDX
+			}
+			return 0, 0, 0, 0
+		}
+		readCR0Fn = func() uint64 { return cr0 }
+		writeCR0Fn = func(val uint64) { cr0 = val }
+		readCR4Fn = func() uint64 { return cr4 }
+		writeCR4Fn = func(val uint64) { cr4 = val }
+		readMSRFn = func(_ uint32) uint64 { return efer }
+		writeMSRFn = func(reg uint32, val uint64) {
+			if reg != msrEFER {
+				t.Errorf("[spec %d] expected WriteMSR to be called with reg 0x%x; got 0x%x", specIndex, msrEFER, reg)
+			}
+			efer = val
+		}
+
+		enableProtectionFeatures()
+
+		if cr0 != cr0WriteProtect {
+			t.Errorf("[spec %d] expected CR0.WP to be set", specIndex)
+		}
+
+		if efer != spec.expEFER {
+			t.Errorf("[spec %d] expected EFER to be 0x%x; got 0x%x", specIndex, spec.expEFER, efer)
+		}
+
+		if cr4 != spec.expCR4 {
+			t.Errorf("[spec %d] expected CR4 to be 0x%x; got 0x%x", specIndex, spec.expCR4, cr4)
+		}
+	}
+}
+
+func TestKernelSectionFlags(t *testing.T) {
+	specs := []struct {
+		secFlags multiboot.ElfSectionFlag
+		expFlags PageTableEntryFlag
+	}{
+		{multiboot.ElfSectionExecutable, FlagPresent},
+		{0, FlagPresent | FlagNoExecute},
+		{multiboot.ElfSectionWritable, FlagPresent | FlagRW | FlagNoExecute},
+		{multiboot.ElfSectionWritable | multiboot.ElfSectionExecutable, FlagPresent | FlagRW | FlagNoExecute},
+	}
+
+	for specIndex, spec := range specs {
+		if got := kernelSectionFlags(spec.secFlags); got != spec.expFlags {
+			t.Errorf("[spec %d] expected flags to be 0x%x; got 0x%x", specIndex, spec.expFlags, got)
+		}
+	}
+}
+
+func TestVerifyKernelSections(t *testing.T) {
+	defer func(origPtePtr func(uintptr) unsafe.Pointer) {
+		ptePtrFn = origPtePtr
+		visitElfSectionsFn = multiboot.VisitElfSections
+	}(ptePtrFn)
+
+	specs := []struct {
+		secFlags multiboot.ElfSectionFlag
+		pteFlags PageTableEntryFlag
+		expErr   bool
+	}{
+		{multiboot.ElfSectionExecutable, FlagPresent, false},
+		{0, FlagPresent | FlagNoExecute, false},
+		{multiboot.ElfSectionWritable, FlagPresent | FlagRW | FlagNoExecute, false},
+		// executable section mapped NX
+		{multiboot.ElfSectionExecutable, FlagPresent | FlagNoExecute, true},
+		// read-only data section mapped executable
+		{0, FlagPresent, true},
+		// writable section mapped read-only
+		{multiboot.ElfSectionWritable, FlagPresent | FlagNoExecute, true},
+		// writable and executable page
+		{multiboot.ElfSectionWritable | multiboot.ElfSectionExecutable, FlagPresent | FlagRW, true},
+		// page not mapped
+		{0, 0, true},
+	}
+
+	var pageEntry pageTableEntry
+	ptePtrFn = func(_ uintptr) unsafe.Pointer { return unsafe.Pointer(&pageEntry) }
+
+	for specIndex, spec := range specs {
+		pageEntry = pageTableEntry(spec.pteFlags)
+		visitElfSectionsFn = func(v multiboot.ElfSectionVisitor) {
+			// address < VMA; should be ignored
+			v(".debug", 0, 0, 1)
+			v(".section", spec.secFlags, 0x10000, 0x2000)
+		}
+
+		if err := verifyKernelSections(0x1000); (err != nil) != spec.expErr {
+			t.Errorf("[spec %d] expected error to be %t; got %v", specIndex, spec.expErr, err)
+		}
+	}
+}
+
+func TestCheckKernelProtections(t *testing.T) {
+	defer func() {
+		probeWriteFn = probeWrite
+		probeExecFn = probeExec
+	}()
+
+	specs := []struct {
+		textWritable, dataExecutable bool
+		expErr                       *kernel.Error
+	}{
+		{false, false, nil},
+		{true, false, errKernelProtectionCheck},
+		{false, true, errKernelProtectionCheck},
+	}
+
+	for specIndex, spec := range specs {
+		probeWriteFn = func(_ uintptr) bool {
+			if !probeActive {
+				t.Errorf("[spec %d] expected probeActive to be set while probing", specIndex)
+			}
+			return spec.textWritable
+		}
+		probeExecFn = func(addr uintptr) bool {
+			if addr != uintptr(unsafe.Pointer(&probeExecData[0])) {
+				t.Errorf("[spec %d] expected probeExec to be called with the address of probeExecData", specIndex)
+			}
+			return spec.dataExecutable
+		}
+
+		if err := checkKernelProtections(); err != spec.expErr {
+			t.Errorf("[spec %d] expected error to be %v; got %v", specIndex, spec.expErr, err)
+		}
+
+		if probeActive {
+			t.Errorf("[spec %d] expected probeActive to be cleared after probing", specIndex)
+		}
+	}
+}
+
+func TestPageFaultHandlerProbe(t *testing.T) {
+	defer func() { probeActive = false }()
+
+	var regs gate.Registers
+	probeActive = true
+	pageFaultHandler(&regs)
+
+	if exp := uint64(probeFaultReturnAddr()); regs.RIP != exp {
+		t.Fatalf("expected RIP to be set to probeFaultReturn (0x%x); got 0x%x", exp, regs.RIP)
+	}
+}
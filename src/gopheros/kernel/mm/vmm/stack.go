@@ -0,0 +1,62 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+)
+
+// AllocKernelStack reserves a region of the kernel address space for a stack
+// of the requested size (rounded up to a multiple of mm.PageSize), backs it
+// with physical frames and installs a guard page right below it so that a
+// stack overflow triggers a fault instead of silently corrupting adjacent
+// memory. AllocKernelStack returns the address of the top of the stack.
+func AllocKernelStack(size uintptr) (uintptr, *kernel.Error) {
+	size = (size + (mm.PageSize - 1)) & ^(mm.PageSize - 1)
+
+	regionStart, err := earlyReserveRegionFn(size + mm.PageSize)
+	if err != nil {
+		return 0, err
+	}
+
+	guardPage := mm.PageFromAddress(regionStart)
+	if err = MapGuardPage(guardPage); err != nil {
+		return 0, err
+	}
+
+	for page, lastPage := guardPage+1, mm.PageFromAddress(regionStart+size); page <= lastPage; page++ {
+		frame, err := mm.AllocFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		if err = mapFn(page, frame, FlagPresent|FlagRW|FlagNoExecute); err != nil {
+			return 0, err
+		}
+	}
+
+	return regionStart + mm.PageSize + size, nil
+}
+
+// MapGuardPage replaces any existing mapping for page with a non-present
+// entry flagged as a guard page. Faults caused by accessing the page are
+// reported as kernel stack overflows.
+func MapGuardPage(page mm.Page) *kernel.Error {
+	return mapFn(page, mm.Frame(0), FlagGuardPage)
+}
+
+// isGuardPage returns true if virtAddr belongs to a guard page installed via
+// a call to MapGuardPage.
+func isGuardPage(virtAddr uintptr) bool {
+	var guard bool
+
+	walk(virtAddr, func(pteLevel uint8, pte *pageTableEntry) bool {
+		if pteLevel == pageLevels-1 {
+			guard = !pte.HasFlags(FlagPresent) && pte.HasFlags(FlagGuardPage)
+			return false
+		}
+
+		return pte.HasFlags(FlagPresent) && !pte.HasFlags(FlagHugePage)
+	})
+
+	return guard
+}
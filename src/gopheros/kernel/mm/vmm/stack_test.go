@@ -0,0 +1,95 @@
+package vmm
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/mm"
+	"testing"
+)
+
+func TestAllocKernelStack(t *testing.T) {
+	defer func() {
+		earlyReserveRegionFn = EarlyReserveRegion
+		mapFn = Map
+		mm.SetFrameAllocator(nil)
+	}()
+
+	expErr := &kernel.Error{Module: "test", Message: "something went wrong"}
+
+	t.Run("success", func(t *testing.T) {
+		earlyReserveRegionFn = func(size uintptr) (uintptr, *kernel.Error) {
+			if exp := 3 * mm.PageSize; size != exp {
+				t.Errorf("expected to reserve %d bytes; got %d", exp, size)
+			}
+			return 0x10000, nil
+		}
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.Frame(42), nil })
+
+		var mappedPages []mm.Page
+		mapFn = func(page mm.Page, _ mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			expFlags := FlagPresent | FlagRW | FlagNoExecute
+			if len(mappedPages) == 0 {
+				expFlags = FlagGuardPage
+			}
+
+			if flags != expFlags {
+				t.Errorf("[page %x] expected map flags to be %x; got %x", page, expFlags, flags)
+			}
+
+			mappedPages = append(mappedPages, page)
+			return nil
+		}
+
+		stackTop, err := AllocKernelStack(mm.PageSize + 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp := uintptr(0x13000); stackTop != exp {
+			t.Errorf("expected stack top to be 0x%x; got 0x%x", exp, stackTop)
+		}
+
+		if exp := 3; len(mappedPages) != exp || mappedPages[0] != mm.PageFromAddress(0x10000) {
+			t.Errorf("expected guard page and %d stack pages to be mapped; got %v", exp-1, mappedPages)
+		}
+	})
+
+	t.Run("reserve error", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0, expErr }
+
+		if _, err := AllocKernelStack(mm.PageSize); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("guard page map error", func(t *testing.T) {
+		earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0x10000, nil }
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return expErr }
+
+		if _, err := AllocKernelStack(mm.PageSize); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("alloc error", func(t *testing.T) {
+		mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return nil }
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.InvalidFrame, expErr })
+
+		if _, err := AllocKernelStack(mm.PageSize); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("stack page map error", func(t *testing.T) {
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) { return mm.Frame(42), nil })
+		mapFn = func(_ mm.Page, _ mm.Frame, flags PageTableEntryFlag) *kernel.Error {
+			if flags == FlagGuardPage {
+				return nil
+			}
+			return expErr
+		}
+
+		if _, err := AllocKernelStack(mm.PageSize); err != expErr {
+			t.Fatalf("expected error: %v; got %v", expErr, err)
+		}
+	})
+}
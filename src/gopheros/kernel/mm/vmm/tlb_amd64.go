@@ -0,0 +1,271 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/mm"
+	"gopheros/kernel/sync"
+	"sync/atomic"
+)
+
+const (
+	// cr4PCIDE enables support for process-context identifiers.
+	cr4PCIDE = uint64(1 << 17)
+
+	// cr3NoFlush instructs the CPU to preserve the TLB entries tagged
+	// with the PCID that is loaded into the CR3 register.
+	cr3NoFlush = uintptr(1 << 63)
+
+	// maxPCIDs is the number of process-context identifiers supported by
+	// the CPU. PCID 0 is used by the kernel PDT and by address spaces that
+	// could not be assigned a PCID of their own.
+	maxPCIDs = 4096
+
+	// MaxCPUs is the maximum number of CPUs that can take part in TLB
+	// shootdowns.
+	MaxCPUs = 64
+
+	// tlbShootdownQueueSize is the number of pending invalidation requests
+	// that can be queued for each CPU. If a queue overflows, the target
+	// CPU flushes its entire TLB instead.
+	tlbShootdownQueueSize = 16
+)
+
+var (
+	// flushTLBFn is used by tests and is automatically inlined by the
+	// compiler.
+	flushTLBFn = cpu.FlushTLB
+
+	// pcidEnabled is set to true if the CPU supports process-context
+	// identifiers and enablePCID has enabled them.
+	pcidEnabled bool
+
+	// pcidBitmap tracks the allocated PCIDs.
+	pcidBitmap [maxPCIDs / 64]uint64
+	pcidLock   sync.Spinlock
+
+	// tlbGeneration is incremented each time a present mapping is
+	// invalidated. An address space that is activated on a CPU where its
+	// PCID-tagged TLB entries were last flushed at an older generation
+	// may have stale entries and needs a TLB flush.
+	tlbGeneration uint64 = 1
+
+	// The following variables track the CPUs that receive TLB shootdown
+	// requests. Shootdowns are only performed when more than one CPU is
+	// online and a function for sending IPIs has been registered.
+	tlbShootdownQueues    [MaxCPUs]tlbShootdownQueue
+	onlineCPUMask         uint64 = 1
+	currentCPUFn                 = func() uint32 { return 0 }
+	sendTLBShootdownIPIFn func(cpuIndex uint32)
+)
+
+// tlbShootdownQueue holds the TLB invalidation requests for a single CPU.
+type tlbShootdownQueue struct {
+	lock sync.Spinlock
+
+	addrs    [tlbShootdownQueueSize]uintptr
+	count    int
+	flushAll bool
+
+	// pending is set to 1 while the queue contains requests that have not
+	// been processed by the target CPU.
+	pending uint32
+}
+
+// enqueue adds a request for invalidating the TLB entry for virtAddr.
+func (q *tlbShootdownQueue) enqueue(virtAddr uintptr) {
+	q.lock.Acquire()
+
+	if q.count == tlbShootdownQueueSize {
+		q.flushAll = true
+	} else {
+		q.addrs[q.count] = virtAddr
+		q.count++
+	}
+	atomic.StoreUint32(&q.pending, 1)
+
+	q.lock.Release()
+}
+
+// enablePCID enables process-context identifiers if supported by the CPU.
+// It must be invoked while the kernel PDT is active so that the PCID bits in
+// the CR3 register are cleared.
+func enablePCID() {
+	if !hasFeatureFn(features.PCID) {
+		return
+	}
+
+	writeCR4Fn(readCR4Fn() | cr4PCIDE)
+
+	// PCID 0 is reserved for the kernel PDT
+	pcidBitmap[0] |= 1
+	pcidEnabled = true
+}
+
+// allocPCID reserves a PCID for an address space. If PCIDs are not enabled or
+// all PCIDs are in use, allocPCID returns the shared PCID 0.
+func allocPCID() uint16 {
+	if !pcidEnabled {
+		return 0
+	}
+
+	pcidLock.Acquire()
+
+	for blockIndex, block := range pcidBitmap {
+		if block == ^uint64(0) {
+			continue
+		}
+
+		for bit := uint16(0); bit < 64; bit++ {
+			if block&(1<<bit) == 0 {
+				pcidBitmap[blockIndex] |= 1 << bit
+				pcidLock.Release()
+				return uint16(blockIndex<<6) + bit
+			}
+		}
+	}
+
+	pcidLock.Release()
+	return 0
+}
+
+// freePCID releases a PCID reserved via a call to allocPCID.
+func freePCID(pcid uint16) {
+	if pcid == 0 {
+		return
+	}
+
+	pcidLock.Acquire()
+	pcidBitmap[pcid>>6] &^= 1 << (pcid & 63)
+	pcidLock.Release()
+}
+
+// cr3Value returns the value that must be loaded into the CR3 register for
+// activating the PDT stored at pdtFrame with the given PCID.
+func cr3Value(pdtFrame mm.Frame, pcid uint16, preserveTLB bool) uintptr {
+	if !pcidEnabled {
+		return pdtFrame.Address()
+	}
+
+	val := pdtFrame.Address() | uintptr(pcid)
+	if preserveTLB {
+		val |= cr3NoFlush
+	}
+
+	return val
+}
+
+// flushTLBEntry invalidates the TLB entries for virtAddr after a present
+// mapping has been removed or modified. Besides flushing the local TLB
+// entry, it ensures that stale entries tagged with other PCIDs are flushed
+// before their address spaces are activated again and asks all other online
+// CPUs to invalidate their TLB entries for virtAddr.
+func flushTLBEntry(virtAddr uintptr) {
+	flushTLBEntryFn(virtAddr)
+
+	if pcidEnabled {
+		atomic.AddUint64(&tlbGeneration, 1)
+	}
+
+	shootdownTLBEntry(virtAddr)
+}
+
+// shootdownTLBEntry queues a request for invalidating the TLB entries for
+// virtAddr to all other online CPUs, sends them a TLB shootdown IPI and waits
+// until all of them have processed the request. Waiting is required as the
+// caller may release the frame that virtAddr used to be mapped to.
+func shootdownTLBEntry(virtAddr uintptr) {
+	if sendTLBShootdownIPIFn == nil {
+		return
+	}
+
+	targetMask := atomic.LoadUint64(&onlineCPUMask) &^ (1 << currentCPUFn())
+	if targetMask == 0 {
+		return
+	}
+
+	for cpuIndex := uint32(0); cpuIndex < MaxCPUs; cpuIndex++ {
+		if targetMask&(1<<cpuIndex) != 0 {
+			tlbShootdownQueues[cpuIndex].enqueue(virtAddr)
+			sendTLBShootdownIPIFn(cpuIndex)
+		}
+	}
+
+	// While waiting, keep processing the requests queued for the current
+	// CPU. Otherwise, two CPUs that concurrently shoot down TLB entries
+	// with interrupts disabled would wait for each other forever.
+	localQueue := &tlbShootdownQueues[currentCPUFn()]
+	for cpuIndex := uint32(0); cpuIndex < MaxCPUs; cpuIndex++ {
+		if targetMask&(1<<cpuIndex) == 0 {
+			continue
+		}
+
+		for atomic.LoadUint32(&tlbShootdownQueues[cpuIndex].pending) != 0 {
+			if atomic.LoadUint32(&localQueue.pending) != 0 {
+				localQueue.drain()
+			}
+		}
+	}
+}
+
+// HandleTLBShootdown processes the TLB shootdown requests that are queued for
+// the current CPU. It must be invoked by the handler for the IPI that is sent
+// by the function registered via SetTLBShootdownHandlers.
+func HandleTLBShootdown() {
+	tlbShootdownQueues[currentCPUFn()].drain()
+}
+
+// drain flushes the TLB entries for all requests in the queue. If the queue
+// is locked, drain returns immediately: the lock is either held by another
+// CPU that is enqueueing a request and will send a new IPI once it is done or
+// by the interrupted code on the current CPU which is already draining the
+// queue.
+func (q *tlbShootdownQueue) drain() {
+	if !q.lock.TryToAcquire() {
+		return
+	}
+
+	if q.flushAll {
+		flushTLBFn()
+	} else {
+		for index := 0; index < q.count; index++ {
+			flushTLBEntryFn(q.addrs[index])
+		}
+	}
+
+	q.count, q.flushAll = 0, false
+	atomic.StoreUint32(&q.pending, 0)
+
+	q.lock.Release()
+}
+
+// SetTLBShootdownHandlers registers the functions that are used for
+// performing cross-CPU TLB shootdowns. The currentCPU function returns the
+// index of the CPU that executes it and the sendIPI function sends the TLB
+// shootdown IPI to the CPU with the specified index. The IPI handler must call
+// HandleTLBShootdown.
+func SetTLBShootdownHandlers(currentCPU func() uint32, sendIPI func(cpuIndex uint32)) {
+	currentCPUFn = currentCPU
+	sendTLBShootdownIPIFn = sendIPI
+}
+
+// SetCPUOnline marks the CPU with the specified index as online or offline.
+// Online CPUs receive TLB shootdown requests. The bootstrap CPU (index 0) is
+// always considered to be online.
+func SetCPUOnline(cpuIndex uint32, online bool) {
+	if cpuIndex == 0 || cpuIndex >= MaxCPUs {
+		return
+	}
+
+	for {
+		oldMask := atomic.LoadUint64(&onlineCPUMask)
+		newMask := oldMask &^ (1 << cpuIndex)
+		if online {
+			newMask = oldMask | (1 << cpuIndex)
+		}
+
+		if atomic.CompareAndSwapUint64(&onlineCPUMask, oldMask, newMask) {
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package vmm
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/mm"
+	"testing"
+)
+
+func TestEnablePCID(t *testing.T) {
+	defer func() {
+		hasFeatureFn = features.Has
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		pcidEnabled = false
+		pcidBitmap = [maxPCIDs / 64]uint64{}
+	}()
+
+	var cr4 uint64
+	readCR4Fn = func() uint64 { return cr4 }
+	writeCR4Fn = func(val uint64) { cr4 = val }
+
+	specs := []struct {
+		pcid     bool
+		expPCIDE bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for specIndex, spec := range specs {
+		cr4, pcidEnabled = 0, false
+		hasFeatureFn = func(f features.Feature) bool { return f == features.PCID && spec.pcid }
+
+		enablePCID()
+
+		if pcidEnabled != spec.expPCIDE || (cr4&cr4PCIDE != 0) != spec.expPCIDE {
+			t.Errorf("[spec %d] expected PCIDs to be enabled: %t; got %t (CR4: 0x%x)", specIndex, spec.expPCIDE, pcidEnabled, cr4)
+		}
+	}
+}
+
+func TestPCIDAllocation(t *testing.T) {
+	defer func() {
+		pcidEnabled = false
+		pcidBitmap = [maxPCIDs / 64]uint64{}
+	}()
+
+	pcidEnabled = false
+	if got := allocPCID(); got != 0 {
+		t.Fatalf("expected allocPCID to return PCID 0 when PCIDs are disabled; got %d", got)
+	}
+
+	if got := cr3Value(mm.Frame(0x123), 42, true); got != 0x123000 {
+		t.Fatalf("expected CR3 value to only contain the PDT address when PCIDs are disabled; got 0x%x", got)
+	}
+
+	pcidEnabled = true
+	pcidBitmap[0] = 1
+
+	for exp := uint16(1); exp < maxPCIDs; exp++ {
+		if got := allocPCID(); got != exp {
+			t.Fatalf("expected allocPCID to return PCID %d; got %d", exp, got)
+		}
+	}
+
+	if got := allocPCID(); got != 0 {
+		t.Fatalf("expected allocPCID to return the shared PCID 0 when all PCIDs are in use; got %d", got)
+	}
+
+	freePCID(0)
+	freePCID(100)
+	if got := allocPCID(); got != 100 {
+		t.Fatalf("expected allocPCID to reuse the released PCID 100; got %d", got)
+	}
+
+	if got := cr3Value(mm.Frame(0x123), 42, false); got != 0x12302a {
+		t.Fatalf("expected CR3 value to be 0x12302a; got 0x%x", got)
+	}
+
+	if got := cr3Value(mm.Frame(0x123), 42, true); got != 0x12302a|cr3NoFlush {
+		t.Fatalf("expected CR3 value to be 0x%x; got 0x%x", 0x12302a|cr3NoFlush, got)
+	}
+}
+
+func TestAddressSpaceActivateWithPCID(t *testing.T) {
+	defer func() {
+		switchPDTFn = cpu.SwitchPDT
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		flushTLBFn = cpu.FlushTLB
+		pcidEnabled = false
+		tlbGeneration = 1
+	}()
+
+	var (
+		loadedCR3  uintptr
+		flushCount int
+		as         = AddressSpace{pdt: PageDirectoryTable{pdtFrame: mm.Frame(0x123)}, pcid: 7}
+	)
+
+	switchPDTFn = func(val uintptr) { loadedCR3 = val }
+	flushTLBEntryFn = func(_ uintptr) {}
+	flushTLBFn = func() { flushCount++ }
+	pcidEnabled = true
+
+	specs := []struct {
+		setup       func()
+		expPreserve bool
+	}{
+		// The first activation flushes any stale entries tagged with the PCID
+		{func() { as.invalidateTLB() }, false},
+		// No mappings were invalidated since the last activation
+		{func() {}, true},
+		// A present mapping was invalidated
+		{func() { flushTLBEntry(0x1000) }, false},
+		{func() {}, true},
+		// The address space was modified while inactive
+		{func() { as.invalidateTLB() }, false},
+	}
+
+	for specIndex, spec := range specs {
+		spec.setup()
+		as.Activate()
+
+		if exp := cr3Value(as.pdt.pdtFrame, as.pcid, spec.expPreserve); loadedCR3 != exp {
+			t.Errorf("[spec %d] expected CR3 to be loaded with 0x%x; got 0x%x", specIndex, exp, loadedCR3)
+		}
+	}
+
+	if flushCount != 0 {
+		t.Fatalf("expected no full TLB flushes; got %d", flushCount)
+	}
+
+	// Address spaces using the shared PCID never preserve TLB entries
+	as.pcid = 0
+	as.Activate()
+	as.Activate()
+	if exp := cr3Value(as.pdt.pdtFrame, 0, false); loadedCR3 != exp {
+		t.Fatalf("expected CR3 to be loaded with 0x%x; got 0x%x", exp, loadedCR3)
+	}
+}
+
+func TestTLBShootdown(t *testing.T) {
+	defer func() {
+		flushTLBEntryFn = cpu.FlushTLBEntry
+		flushTLBFn = cpu.FlushTLB
+		currentCPUFn = func() uint32 { return 0 }
+		sendTLBShootdownIPIFn = nil
+		onlineCPUMask = 1
+		tlbShootdownQueues = [MaxCPUs]tlbShootdownQueue{}
+	}()
+
+	var (
+		activeCPU    uint32
+		flushedAddrs = make(map[uint32][]uintptr)
+		fullFlushes  = make(map[uint32]int)
+		ipis         []uint32
+	)
+
+	flushTLBEntryFn = func(virtAddr uintptr) {
+		flushedAddrs[activeCPU] = append(flushedAddrs[activeCPU], virtAddr)
+	}
+	flushTLBFn = func() { fullFlushes[activeCPU]++ }
+
+	// Simulate the delivery of the IPI by running the handler on behalf
+	// of the target CPU.
+	SetTLBShootdownHandlers(
+		func() uint32 { return activeCPU },
+		func(cpuIndex uint32) {
+			ipis = append(ipis, cpuIndex)
+			origCPU := activeCPU
+			activeCPU = cpuIndex
+			HandleTLBShootdown()
+			activeCPU = origCPU
+		},
+	)
+
+	t.Run("single CPU online", func(t *testing.T) {
+		flushTLBEntry(0x1000)
+
+		if len(ipis) != 0 {
+			t.Fatalf("expected no IPIs to be sent while a single CPU is online; got %v", ipis)
+		}
+		if got := flushedAddrs[0]; len(got) != 1 || got[0] != 0x1000 {
+			t.Fatalf("expected local TLB entry to be flushed; got %v", got)
+		}
+	})
+
+	t.Run("multiple CPUs online", func(t *testing.T) {
+		flushedAddrs = make(map[uint32][]uintptr)
+		SetCPUOnline(2, true)
+		SetCPUOnline(5, true)
+		SetCPUOnline(MaxCPUs, true)
+		SetCPUOnline(0, false)
+
+		if exp := uint64(1 | 1<<2 | 1<<5); onlineCPUMask != exp {
+			t.Fatalf("expected online CPU mask to be 0x%x; got 0x%x", exp, onlineCPUMask)
+		}
+
+		activeCPU = 2
+		flushTLBEntry(0x2000)
+
+		if len(ipis) != 2 || ipis[0] != 0 || ipis[1] != 5 {
+			t.Fatalf("expected IPIs to be sent to CPUs 0 and 5; got %v", ipis)
+		}
+
+		for _, cpuIndex := range []uint32{0, 2, 5} {
+			if got := flushedAddrs[cpuIndex]; len(got) != 1 || got[0] != 0x2000 {
+				t.Errorf("expected CPU %d to flush its TLB entry for 0x2000; got %v", cpuIndex, got)
+			}
+
+			if tlbShootdownQueues[cpuIndex].pending != 0 || tlbShootdownQueues[cpuIndex].count != 0 {
+				t.Errorf("expected shootdown queue for CPU %d to be empty", cpuIndex)
+			}
+		}
+
+		SetCPUOnline(5, false)
+		activeCPU = 0
+	})
+
+	t.Run("concurrent shootdowns", func(t *testing.T) {
+		flushedAddrs = make(map[uint32][]uintptr)
+		defer func() {
+			flushTLBEntryFn = func(virtAddr uintptr) {
+				flushedAddrs[activeCPU] = append(flushedAddrs[activeCPU], virtAddr)
+			}
+			SetTLBShootdownHandlers(
+				func() uint32 { return activeCPU },
+				func(cpuIndex uint32) {
+					ipis = append(ipis, cpuIndex)
+					origCPU := activeCPU
+					activeCPU = cpuIndex
+					HandleTLBShootdown()
+					activeCPU = origCPU
+				},
+			)
+		}()
+
+		// CPU 0 runs with interrupts disabled while shooting down its
+		// own TLB entry and only processes the request sent by CPU 2
+		// once CPU 2 has processed the request from CPU 0.
+		SetTLBShootdownHandlers(
+			func() uint32 { return activeCPU },
+			func(cpuIndex uint32) {
+				tlbShootdownQueues[activeCPU].enqueue(0x4000)
+			},
+		)
+		flushTLBEntryFn = func(virtAddr uintptr) {
+			flushedAddrs[activeCPU] = append(flushedAddrs[activeCPU], virtAddr)
+
+			if activeCPU == 2 && virtAddr == 0x4000 {
+				activeCPU = 0
+				HandleTLBShootdown()
+				activeCPU = 2
+			}
+		}
+
+		activeCPU = 2
+		flushTLBEntry(0x3000)
+		activeCPU = 0
+
+		if got := flushedAddrs[2]; len(got) != 2 || got[0] != 0x3000 || got[1] != 0x4000 {
+			t.Fatalf("expected CPU 2 to process the concurrent shootdown request while waiting; got %v", got)
+		}
+		if got := flushedAddrs[0]; len(got) != 1 || got[0] != 0x3000 {
+			t.Fatalf("expected CPU 0 to flush its TLB entry for 0x3000; got %v", got)
+		}
+	})
+
+	t.Run("queue overflow", func(t *testing.T) {
+		flushedAddrs = make(map[uint32][]uintptr)
+		for index := 0; index <= tlbShootdownQueueSize; index++ {
+			tlbShootdownQueues[2].enqueue(uintptr(index) << mm.PageShift)
+		}
+
+		activeCPU = 2
+		HandleTLBShootdown()
+		activeCPU = 0
+
+		if fullFlushes[2] != 1 || len(flushedAddrs[2]) != 0 {
+			t.Fatalf("expected CPU 2 to flush its entire TLB; got %d full flushes and %d entry flushes", fullFlushes[2], len(flushedAddrs[2]))
+		}
+	})
+}
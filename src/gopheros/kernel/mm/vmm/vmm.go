@@ -3,27 +3,57 @@ package vmm
 import (
 	"gopheros/kernel"
 	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
 	"gopheros/kernel/mm"
 )
 
 var (
 	// the following functions are mocked by tests and are automatically
 	// inlined by the compiler.
-	readCR2Fn   = cpu.ReadCR2
-	translateFn = Translate
+	readCR2Fn    = cpu.ReadCR2
+	translateFn  = Translate
+	cpuidFn      = cpu.ID
+	hasFeatureFn = features.Has
 
 	errUnrecoverableFault = &kernel.Error{Module: "vmm", Message: "page/gpf fault"}
 )
 
-// Init initializes the vmm system, creates a granular PDT for the kernel and
-// installs paging-related exception handlers.
+// Init initializes the vmm system, programs the page attribute table, enables
+// the CPU page protection features, creates and verifies a granular W^X PDT
+// for the kernel, enables process-context identifiers, establishes the direct
+// physical memory map, allocates the frame reference count table and installs
+// paging-related exception handlers including a double fault handler that
+// runs on a dedicated stack.
 func Init(kernelPageOffset uintptr) *kernel.Error {
+	setupPAT()
+	enableProtectionFeatures()
+
 	if err := setupPDTForKernel(kernelPageOffset); err != nil {
 		return err
 	}
+	enablePCID()
+
+	if err := verifyKernelSections(kernelPageOffset); err != nil {
+		return err
+	}
+
+	if err := setupDirectMap(); err != nil {
+		return err
+	}
+
+	if err := setupFrameRefCounts(); err != nil {
+		return err
+	}
+
+	if err := setupDoubleFaultStack(); err != nil {
+		return err
+	}
 
 	// Install arch-specific handlers for vmm-related faults.
 	installFaultHandlers()
+	if err := checkKernelProtections(); err != nil {
+		return err
+	}
 
 	return reserveZeroedFrame()
 }
@@ -38,11 +68,18 @@ func reserveZeroedFrame() *kernel.Error {
 
 	if ReservedZeroedFrame, err = mm.AllocFrame(); err != nil {
 		return err
-	} else if tempPage, err = mapTemporaryFn(ReservedZeroedFrame); err != nil {
+	} else if tempPage, err = accessFrame(ReservedZeroedFrame); err != nil {
 		return err
 	}
 	kernel.Memset(tempPage.Address(), 0, mm.PageSize)
-	_ = unmapFn(tempPage)
+	releaseFrame(tempPage)
+
+	// Prevent writes to the frame via the direct map
+	if directMapOffset != 0 {
+		if err = mapFn(tempPage, ReservedZeroedFrame, FlagPresent|FlagNoExecute); err != nil {
+			return err
+		}
+	}
 
 	// From this point on, ReservedZeroedFrame cannot be mapped with a RW flag
 	protectReservedZeroedPage = true
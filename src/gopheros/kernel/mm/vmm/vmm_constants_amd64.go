@@ -16,8 +16,55 @@ const (
 	// pages). For amd64 this address uses the following table indices:
 	// 510, 511, 511, 511.
 	tempMappingAddr = uintptr(0Xffffff7ffffff000)
+
+	// directMapBase is the virtual address where the direct map of the
+	// physical memory starts before applying the randomized slide. For
+	// amd64 this address corresponds to P4 entry 272.
+	directMapBase = uintptr(0xffff880000000000)
+
+	// directMapMaxPhysAddr is the (exclusive) upper bound for physical
+	// addresses that can be accessed via the direct map.
+	directMapMaxPhysAddr = uintptr(64 << 40)
+
+	// kernelHalfFirstEntry is the index of the first P4 entry that spans
+	// the higher-half kernel address space. P4 entries starting at this
+	// index (excluding the recursive entry) are shared by all address
+	// spaces.
+	kernelHalfFirstEntry = uintptr(256)
+
+	// recursiveEntry is the index of the P4 entry that points back to the
+	// P4 table itself.
+	recursiveEntry = uintptr(511)
+)
+
+// HugePageSize describes a page size larger than mm.PageSize that can be
+// mapped using a single page table entry with the FlagHugePage bit set.
+type HugePageSize uint8
+
+const (
+	// HugePage2M selects a 2 MiB page which is mapped by a P2 entry.
+	HugePage2M HugePageSize = iota
+
+	// HugePage1G selects a 1 GiB page which is mapped by a P3 entry. Not
+	// all CPUs support 1 GiB pages; MapHuge returns an error if this
+	// size is requested on a CPU that lacks support for it.
+	HugePage1G
 )
 
+// Size returns the number of bytes spanned by a huge page of this size.
+func (s HugePageSize) Size() uintptr {
+	return uintptr(1) << pageLevelShifts[s.level()]
+}
+
+// level returns the page table level whose entries map huge pages of this
+// size.
+func (s HugePageSize) level() uint8 {
+	if s == HugePage1G {
+		return 1
+	}
+	return 2
+}
+
 var (
 	// pdtVirtualAddr is a special virtual address that exploits the
 	// recursive mapping used in the last PDT entry for each page directory
@@ -82,6 +129,24 @@ const (
 	// flag and FlagRW are mutually exclusive.
 	FlagCopyOnWrite = 1 << 9
 
+	// FlagGuardPage marks a non-present page as a guard page. Accesses to
+	// guard pages are reported as kernel stack overflows.
+	FlagGuardPage = 1 << 10
+
+	// FlagWriteCombine selects the write-combining memory type for a page.
+	// For regular pages it occupies the same bit as FlagHugePage (the PAT
+	// bit); MapHuge automatically relocates it to the PAT bit used by huge
+	// page entries. This flag requires the PAT MSR to be programmed by
+	// Init.
+	FlagWriteCombine = 1 << 7
+
+	// FlagUncached selects the strong uncacheable memory type for a page.
+	// It should be used when mapping MMIO regions.
+	FlagUncached = FlagWriteThroughCaching | FlagDoNotCache
+
 	// FlagNoExecute if set, indicates that a page contains non-executable code.
 	FlagNoExecute = 1 << 63
+
+	// flagHugePagePAT is the location of the PAT bit for huge page entries.
+	flagHugePagePAT = 1 << 12
 )
@@ -19,8 +19,32 @@ func TestInit(t *testing.T) {
 		mapTemporaryFn = MapTemporary
 		unmapFn = Unmap
 		handleInterruptFn = gate.HandleInterrupt
+		cpuidFn = cpu.ID
+		writeMSRFn = cpu.WriteMSR
+		patEnabled = false
+		readCR0Fn = cpu.ReadCR0
+		writeCR0Fn = cpu.WriteCR0
+		readCR4Fn = cpu.ReadCR4
+		writeCR4Fn = cpu.WriteCR4
+		probeWriteFn = probeWrite
+		probeExecFn = probeExec
+		mapFn = Map
+		setInterruptStackFn = gate.SetInterruptStack
+		earlyReserveRegionFn = EarlyReserveRegion
 	}()
 
+	// PAT is not supported unless a test overrides cpuidFn
+	cpuidFn = func(_ uint32) (uint32, uint32, uint32, uint32) { return 0, 0, 0, 0 }
+	readCR0Fn = func() uint64 { return 0 }
+	writeCR0Fn = func(_ uint64) {}
+	readCR4Fn = func() uint64 { return 0 }
+	writeCR4Fn = func(_ uint64) {}
+	probeWriteFn = func(_ uintptr) bool { return false }
+	probeExecFn = func(_ uintptr) bool { return false }
+	mapFn = func(_ mm.Page, _ mm.Frame, _ PageTableEntryFlag) *kernel.Error { return nil }
+	setInterruptStackFn = func(_ uint8, _ uintptr) {}
+	earlyReserveRegionFn = func(_ uintptr) (uintptr, *kernel.Error) { return 0xf00000, nil }
+
 	// reserve space for an allocated page
 	reservedPage := make([]byte, mm.PageSize)
 
@@ -56,6 +80,27 @@ func TestInit(t *testing.T) {
 		}
 	})
 
+	t.Run("W^X self-check fails", func(t *testing.T) {
+		defer func() { probeWriteFn = func(_ uintptr) bool { return false } }()
+
+		mm.SetFrameAllocator(func() (mm.Frame, *kernel.Error) {
+			addr := uintptr(unsafe.Pointer(&reservedPage[0]))
+			return mm.Frame(addr >> mm.PageShift), nil
+		})
+		activePDTFn = func() uintptr {
+			return uintptr(unsafe.Pointer(&reservedPage[0]))
+		}
+		switchPDTFn = func(_ uintptr) {}
+		unmapFn = func(p mm.Page) *kernel.Error { return nil }
+		mapTemporaryFn = func(f mm.Frame) (mm.Page, *kernel.Error) { return mm.Page(f), nil }
+		handleInterruptFn = func(_ gate.InterruptNumber, _ uint8, _ func(*gate.Registers)) {}
+		probeWriteFn = func(_ uintptr) bool { return true }
+
+		if err := Init(0); err != errKernelProtectionCheck {
+			t.Fatalf("expected error: %v; got %v", errKernelProtectionCheck, err)
+		}
+	})
+
 	t.Run("setupPDT fails", func(t *testing.T) {
 		expErr := &kernel.Error{Module: "test", Message: "out of memory"}
 
@@ -0,0 +1,297 @@
+// Package time implements a monotonic clock which is driven by the best
+// available hardware clock source. Clock sources are registered by their
+// drivers and the highest-rated one is selected once hardware detection
+// completes.
+package time
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu/features"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sync"
+)
+
+const (
+	// NanosecondsPerSecond is the number of nanoseconds in a second.
+	NanosecondsPerSecond = uint64(1000000000)
+
+	// maxClockSources is the maximum number of clock sources that can be
+	// registered.
+	maxClockSources = 8
+
+	// calibrationPeriodMillis is the duration of the interval used for
+	// calibrating the frequency of a clock source.
+	calibrationPeriodMillis = 20
+)
+
+var (
+	errTooManyClockSources = &kernel.Error{Module: "time", Message: "maximum number of clock sources reached"}
+	errNoClockSource       = &kernel.Error{Module: "time", Message: "no clock source available"}
+	errNoWrapTracking      = &kernel.Error{Module: "time", Message: "clock sources that wrap around require an event device"}
+	errNoReference         = &kernel.Error{Module: "time", Message: "no reference clock source available for calibration"}
+	errCalibrationFailed   = &kernel.Error{Module: "time", Message: "clock source calibration failed"}
+
+	clockSources     [maxClockSources]ClockSource
+	clockSourceCount int
+
+	// clock holds the state of the monotonic clock.
+	clock monotonicClock
+
+	// registerPlatformClockSourcesFn is used by tests and is automatically
+	// inlined by the compiler.
+	registerPlatformClockSourcesFn = registerPlatformClockSources
+)
+
+// ClockSource is implemented by hardware counters that can drive the
+// monotonic clock.
+type ClockSource interface {
+	// Name returns the name of the clock source.
+	Name() string
+
+	// Rating returns a value that describes the quality of the clock
+	// source. When selecting a clock source, higher rated sources are
+	// preferred.
+	Rating() int
+
+	// Read returns the current counter value.
+	Read() uint64
+
+	// Mask returns a bitmask with the counter bits that are valid. The
+	// counter wraps around once it reaches the mask value.
+	Mask() uint64
+
+	// Frequency returns the counter frequency in Hz or 0 if the frequency
+	// is not known and the clock source must be calibrated.
+	Frequency() uint64
+}
+
+// monotonicClock converts the counter values of a clock source into the
+// number of nanoseconds elapsed since the clock was started. Counter deltas
+// are accumulated on each read so narrow counters can be used as long as the
+// clock is read at least once per counter period. Init guarantees this by
+// scheduling a timer that periodically reads the clock.
+type monotonicClock struct {
+	lock sync.Spinlock
+
+	source    ClockSource
+	frequency uint64
+	mask      uint64
+
+	// lastCycles is the counter value observed by the last read and
+	// cycles is the number of counter cycles elapsed since the source was
+	// selected.
+	lastCycles uint64
+	cycles     uint64
+
+	// offset is the clock value when the source was selected.
+	offset uint64
+}
+
+// now returns the clock value in nanoseconds.
+func (c *monotonicClock) now() uint64 {
+	// If the lock is held by the code interrupted by the caller, reading
+	// the clock without updating its state avoids a deadlock.
+	if !c.lock.TryToAcquire() {
+		return c.offset + cyclesToNanoseconds(c.cycles+(c.source.Read()-c.lastCycles)&c.mask, c.frequency)
+	}
+
+	cur := c.source.Read()
+	c.cycles += (cur - c.lastCycles) & c.mask
+	c.lastCycles = cur
+	ns := c.offset + cyclesToNanoseconds(c.cycles, c.frequency)
+
+	c.lock.Release()
+	return ns
+}
+
+// switchTo makes the clock use the specified source while ensuring that the
+// clock value does not go backwards.
+func (c *monotonicClock) switchTo(source ClockSource, frequency uint64) {
+	var offset uint64
+	if c.source != nil {
+		offset = c.now()
+	}
+
+	c.lock.Acquire()
+	c.source, c.frequency, c.mask = source, frequency, source.Mask()
+	c.offset, c.cycles, c.lastCycles = offset, 0, source.Read()
+	c.lock.Release()
+}
+
+// wrapPeriod returns the number of nanoseconds after which the counter of the
+// clock source wraps around or 0 if the counter never wraps.
+func (c *monotonicClock) wrapPeriod() uint64 {
+	if c.mask == ^uint64(0) {
+		return 0
+	}
+
+	return cyclesToNanoseconds(c.mask, c.frequency)
+}
+
+// cyclesToNanoseconds converts a number of counter cycles to nanoseconds. The
+// conversion is split into a whole-second and a sub-second part to prevent
+// overflows.
+func cyclesToNanoseconds(cycles, frequency uint64) uint64 {
+	return (cycles/frequency)*NanosecondsPerSecond + (cycles%frequency)*NanosecondsPerSecond/frequency
+}
+
+// RegisterClockSource adds a clock source to the list of sources that are
+// considered by Init.
+func RegisterClockSource(source ClockSource) *kernel.Error {
+	if clockSourceCount == maxClockSources {
+		return errTooManyClockSources
+	}
+
+	clockSources[clockSourceCount] = source
+	clockSourceCount++
+	return nil
+}
+
+// Init registers the clock sources that are available on all platforms and
+// starts the monotonic clock using the highest rated clock source. Sources
+// with an unknown frequency are calibrated against the highest rated source
+// whose frequency is known. Once the clock is running, the registered timer
+// event device (if any) is initialized. Init must be invoked after all device
+// drivers have registered their clock sources and event devices.
+//
+// Clock sources whose counters wrap around are only used if an event device
+// is available; Init then schedules a timer that reads the clock at least
+// twice per counter period so that no wraps are missed.
+func Init() *kernel.Error {
+	if err := registerPlatformClockSourcesFn(); err != nil {
+		return err
+	}
+
+	var (
+		best    ClockSource
+		skipped bool
+	)
+	for index := 0; index < clockSourceCount; index++ {
+		candidate := clockSources[index]
+		if eventDevice == nil && candidate.Mask() != ^uint64(0) {
+			skipped = true
+			continue
+		}
+
+		if best == nil || candidate.Rating() > best.Rating() {
+			best = candidate
+		}
+	}
+
+	switch {
+	case best == nil && skipped:
+		return errNoWrapTracking
+	case best == nil:
+		return errNoClockSource
+	}
+
+	frequency := best.Frequency()
+	if frequency == 0 {
+		var err *kernel.Error
+		if frequency, err = calibrate(best); err != nil {
+			return err
+		}
+	}
+
+	clock.switchTo(best, frequency)
+	kfmt.Printf("[time] using clock source: %s (%d Hz)\n", best.Name(), frequency)
+
+	if eventDevice == nil {
+		return nil
+	}
+
+	if err := initEventDevice(); err != nil {
+		return err
+	}
+
+	kfmt.Printf("[time] using event device: %s\n", eventDevice.Name())
+	return scheduleClockTick()
+}
+
+// scheduleClockTick arms a timer that invokes clockTick once half of the
+// counter wrap period of the active clock source elapses. No timer is armed
+// for clock sources whose counters never wrap.
+func scheduleClockTick() *kernel.Error {
+	period := clock.wrapPeriod()
+	if period == 0 {
+		return nil
+	}
+
+	_, err := AfterFunc(period/2, clockTick)
+	return err
+}
+
+// clockTick reads the monotonic clock so that any counter wraps are accounted
+// for and re-arms the tick timer.
+func clockTick() {
+	clock.now()
+	if err := scheduleClockTick(); err != nil {
+		kfmt.Printf("[time] unable to schedule clock tick: %s\n", err.Message)
+	}
+}
+
+// registerPlatformClockSources registers the PIT and, if available, the
+// invariant TSC as clock sources.
+func registerPlatformClockSources() *kernel.Error {
+	pit := &pitClockSource{}
+	pit.init()
+	if err := RegisterClockSource(pit); err != nil {
+		return err
+	}
+
+	if !hasFeatureFn(features.InvariantTSC) {
+		return nil
+	}
+
+	return RegisterClockSource(&tscClockSource{frequency: tscFrequency()})
+}
+
+// calibrate measures the frequency of a clock source against the highest
+// rated clock source with a known frequency.
+func calibrate(source ClockSource) (uint64, *kernel.Error) {
+	var ref ClockSource
+	for index := 0; index < clockSourceCount; index++ {
+		candidate := clockSources[index]
+		if candidate != source && candidate.Frequency() != 0 && (ref == nil || candidate.Rating() > ref.Rating()) {
+			ref = candidate
+		}
+	}
+
+	if ref == nil {
+		return 0, errNoReference
+	}
+
+	var (
+		refFrequency = ref.Frequency()
+		refMask      = ref.Mask()
+		target       = refFrequency * calibrationPeriodMillis / 1000
+		refElapsed   uint64
+		refLast      = ref.Read()
+		start        = source.Read()
+	)
+
+	// The reference counter may wrap during the calibration period so its
+	// deltas need to be accumulated.
+	for refElapsed < target {
+		cur := ref.Read()
+		refElapsed += (cur - refLast) & refMask
+		refLast = cur
+	}
+
+	elapsed := (source.Read() - start) & source.Mask()
+	if elapsed == 0 {
+		return 0, errCalibrationFailed
+	}
+
+	return elapsed * refFrequency / refElapsed, nil
+}
+
+// Nanotime returns the number of nanoseconds elapsed since the monotonic clock
+// was started or 0 if Init has not been invoked yet.
+func Nanotime() uint64 {
+	if clock.source == nil {
+		return 0
+	}
+
+	return clock.now()
+}
@@ -0,0 +1,368 @@
+package time
+
+import (
+	"gopheros/kernel"
+	"gopheros/kernel/cpu/features"
+	"testing"
+)
+
+type mockClockSource struct {
+	name      string
+	rating    int
+	counter   uint64
+	step      uint64
+	mask      uint64
+	frequency uint64
+}
+
+func (s *mockClockSource) Name() string      { return s.name }
+func (s *mockClockSource) Rating() int       { return s.rating }
+func (s *mockClockSource) Mask() uint64      { return s.mask }
+func (s *mockClockSource) Frequency() uint64 { return s.frequency }
+func (s *mockClockSource) Read() uint64 {
+	s.counter = (s.counter + s.step) & s.mask
+	return s.counter
+}
+
+// scaledClockSource ticks ratio times faster than the source it follows.
+type scaledClockSource struct {
+	mockClockSource
+	follow *mockClockSource
+	ratio  uint64
+}
+
+func (s *scaledClockSource) Read() uint64 {
+	return s.follow.counter * s.ratio
+}
+
+func resetClock() {
+	clockSources = [maxClockSources]ClockSource{}
+	clockSourceCount = 0
+	clock = monotonicClock{}
+	registerPlatformClockSourcesFn = registerPlatformClockSources
+}
+
+func TestRegisterClockSource(t *testing.T) {
+	defer resetClock()
+	resetClock()
+
+	for i := 0; i < maxClockSources; i++ {
+		if err := RegisterClockSource(&mockClockSource{}); err != nil {
+			t.Fatalf("[source %d] unexpected error: %v", i, err)
+		}
+	}
+
+	if err := RegisterClockSource(&mockClockSource{}); err != errTooManyClockSources {
+		t.Fatalf("expected to get errTooManyClockSources; got %v", err)
+	}
+}
+
+func TestInit(t *testing.T) {
+	defer func() {
+		resetClock()
+		resetTimers()
+	}()
+
+	t.Run("selects highest rated source", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		var (
+			low  = &mockClockSource{name: "low", rating: 100, step: 1, mask: 0xffff, frequency: 1000}
+			high = &mockClockSource{name: "high", rating: 200, step: 1, mask: 0xffff, frequency: 1000}
+		)
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			RegisterClockSource(low)
+			return RegisterClockSource(high)
+		}
+		RegisterEventDevice(&mockEventDevice{})
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if clock.source != high {
+			t.Fatalf("expected the clock to use source %q; got %q", high.name, clock.source.Name())
+		}
+
+		// Init reads the clock twice while arming the clock tick timer
+		if got, exp := Nanotime(), uint64(3000000); got != exp {
+			t.Fatalf("expected Nanotime() to return %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("clock tick", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		var (
+			source = &mockClockSource{step: 1, mask: 0xffff, frequency: 1000}
+			dev    = &mockEventDevice{}
+		)
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			return RegisterClockSource(source)
+		}
+		RegisterEventDevice(dev)
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The tick must fire before half of the 65.535s wrap period
+		// elapses.
+		if exp := clock.wrapPeriod() / 2; !dev.armed || dev.delay > exp {
+			t.Fatalf("expected event device to be armed with a delay of at most %d; got %d", exp, dev.delay)
+		}
+
+		// Advance the counter by 3/4 of its period and fire the tick;
+		// the clock should account for the elapsed cycles and re-arm
+		// the tick.
+		source.counter += 0xc000
+		before := clock.cycles
+		dev.armed = false
+		dev.fn()
+
+		if clock.cycles-before < 0xc000 {
+			t.Fatalf("expected clock tick to accumulate at least 0x%x cycles; got 0x%x", 0xc000, clock.cycles-before)
+		}
+
+		if !dev.armed || timerQueue.count != 1 {
+			t.Fatal("expected clock tick to be re-armed")
+		}
+	})
+
+	t.Run("wrapping sources without event device", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		var (
+			narrow = &mockClockSource{name: "narrow", rating: 200, step: 1, mask: 0xffff, frequency: 1000}
+			wide   = &mockClockSource{name: "wide", rating: 100, step: 1, mask: ^uint64(0), frequency: 1000}
+		)
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			RegisterClockSource(narrow)
+			return RegisterClockSource(wide)
+		}
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if clock.source != wide {
+			t.Fatalf("expected the clock to use source %q; got %q", wide.name, clock.source.Name())
+		}
+
+		resetClock()
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			return RegisterClockSource(narrow)
+		}
+
+		if err := Init(); err != errNoWrapTracking {
+			t.Fatalf("expected to get errNoWrapTracking; got %v", err)
+		}
+	})
+
+	t.Run("calibrates source with unknown frequency", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		var (
+			ref   = &mockClockSource{name: "ref", rating: 100, step: 100, mask: ^uint64(0), frequency: 100000}
+			uncal = &scaledClockSource{
+				mockClockSource: mockClockSource{name: "uncal", rating: 300, mask: ^uint64(0)},
+				follow:          ref,
+				ratio:           4,
+			}
+			expFrq = uint64(400000)
+		)
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			RegisterClockSource(ref)
+			return RegisterClockSource(uncal)
+		}
+
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if clock.source != uncal {
+			t.Fatalf("expected the clock to use source %q; got %q", uncal.name, clock.source.Name())
+		}
+
+		if clock.frequency != expFrq {
+			t.Fatalf("expected calibrated frequency to be %d; got %d", expFrq, clock.frequency)
+		}
+	})
+
+	t.Run("platform registration error", func(t *testing.T) {
+		resetClock()
+		expErr := &kernel.Error{Module: "test", Message: "registration failed"}
+		registerPlatformClockSourcesFn = func() *kernel.Error { return expErr }
+
+		if err := Init(); err != expErr {
+			t.Fatalf("expected to get error: %v; got %v", expErr, err)
+		}
+	})
+
+	t.Run("no clock sources", func(t *testing.T) {
+		resetClock()
+		registerPlatformClockSourcesFn = func() *kernel.Error { return nil }
+
+		if err := Init(); err != errNoClockSource {
+			t.Fatalf("expected to get errNoClockSource; got %v", err)
+		}
+	})
+
+	t.Run("no calibration reference", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		RegisterEventDevice(&mockEventDevice{})
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			return RegisterClockSource(&mockClockSource{step: 1, mask: 0xff})
+		}
+
+		if err := Init(); err != errNoReference {
+			t.Fatalf("expected to get errNoReference; got %v", err)
+		}
+	})
+
+	t.Run("calibration failure", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+		RegisterEventDevice(&mockEventDevice{})
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			RegisterClockSource(&mockClockSource{rating: 100, step: 1000, mask: 0xffff, frequency: 100000})
+			return RegisterClockSource(&mockClockSource{rating: 200, mask: 0xff})
+		}
+
+		if err := Init(); err != errCalibrationFailed {
+			t.Fatalf("expected to get errCalibrationFailed; got %v", err)
+		}
+	})
+}
+
+func TestMonotonicClock(t *testing.T) {
+	defer resetClock()
+
+	t.Run("counter wraparound", func(t *testing.T) {
+		var (
+			c      monotonicClock
+			source = &mockClockSource{step: 0x80, mask: 0xff, counter: 0x7f}
+		)
+
+		c.switchTo(source, 1000)
+		for i := 1; i <= 8; i++ {
+			if got, exp := c.now(), uint64(i)*0x80*1000000; got != exp {
+				t.Fatalf("[read %d] expected now() to return %d; got %d", i, exp, got)
+			}
+		}
+	})
+
+	t.Run("locked read", func(t *testing.T) {
+		var (
+			c      monotonicClock
+			source = &mockClockSource{step: 10, mask: 0xffff}
+		)
+
+		c.switchTo(source, 1000)
+		c.lock.Acquire()
+		if got, exp := c.now(), uint64(10000000); got != exp {
+			t.Fatalf("expected now() to return %d; got %d", exp, got)
+		}
+
+		// The locked read should not update the clock state.
+		if c.cycles != 0 {
+			t.Fatalf("expected the clock state not to be updated by a locked read")
+		}
+		c.lock.Release()
+	})
+
+	t.Run("switching sources", func(t *testing.T) {
+		var (
+			c    monotonicClock
+			slow = &mockClockSource{step: 1, mask: 0xffff}
+			fast = &mockClockSource{step: 1000, mask: 0xffff}
+		)
+
+		c.switchTo(slow, 1000)
+		before := c.now()
+		c.switchTo(fast, 1000000)
+		if after := c.now(); after <= before {
+			t.Fatalf("expected clock to advance after switching sources; before: %d, after: %d", before, after)
+		}
+	})
+}
+
+func TestCyclesToNanoseconds(t *testing.T) {
+	specs := []struct {
+		cycles    uint64
+		frequency uint64
+		exp       uint64
+	}{
+		{0, 1000, 0},
+		{1, 1000, 1000000},
+		{1193182, 1193182, NanosecondsPerSecond},
+		// cycles*NanosecondsPerSecond would overflow a uint64
+		{1 << 62, 1 << 32, (1 << 30) * NanosecondsPerSecond},
+	}
+
+	for specIndex, spec := range specs {
+		if got := cyclesToNanoseconds(spec.cycles, spec.frequency); got != spec.exp {
+			t.Errorf("[spec %d] expected cyclesToNanoseconds(%d, %d) to return %d; got %d", specIndex, spec.cycles, spec.frequency, spec.exp, got)
+		}
+	}
+}
+
+func TestNanotimeBeforeInit(t *testing.T) {
+	defer resetClock()
+	resetClock()
+
+	if got := Nanotime(); got != 0 {
+		t.Fatalf("expected Nanotime() to return 0 before Init; got %d", got)
+	}
+}
+
+func TestRegisterPlatformClockSources(t *testing.T) {
+	defer func() {
+		resetClock()
+		mockPorts(nil, nil)
+		cpuidFn = cpuIDFnOrig
+		hasFeatureFn = features.Has
+	}()
+
+	mockPorts(func(_ uint16) uint8 { return 0 }, func(_ uint16, _ uint8) {})
+
+	t.Run("without invariant TSC", func(t *testing.T) {
+		resetClock()
+		hasFeatureFn = func(_ features.Feature) bool { return false }
+
+		if err := registerPlatformClockSources(); err != nil {
+			t.Fatal(err)
+		}
+
+		if clockSourceCount != 1 || clockSources[0].Name() != "pit" {
+			t.Fatal("expected only the PIT to be registered")
+		}
+	})
+
+	t.Run("with invariant TSC", func(t *testing.T) {
+		resetClock()
+		hasFeatureFn = func(f features.Feature) bool { return f == features.InvariantTSC }
+		cpuidFn = mockCPUID(0x15, 2, 100, 1000000)
+
+		if err := registerPlatformClockSources(); err != nil {
+			t.Fatal(err)
+		}
+
+		if clockSourceCount != 2 || clockSources[1].Name() != "tsc" {
+			t.Fatal("expected the PIT and the TSC to be registered")
+		}
+
+		if got, exp := clockSources[1].Frequency(), uint64(50000000); got != exp {
+			t.Fatalf("expected TSC frequency to be %d; got %d", exp, got)
+		}
+	})
+
+	t.Run("registration errors", func(t *testing.T) {
+		resetClock()
+		clockSourceCount = maxClockSources
+		if err := registerPlatformClockSources(); err != errTooManyClockSources {
+			t.Fatalf("expected to get errTooManyClockSources; got %v", err)
+		}
+	})
+}
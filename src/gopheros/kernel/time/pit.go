@@ -0,0 +1,71 @@
+package time
+
+import "gopheros/kernel/cpu"
+
+const (
+	// PITFrequency is the frequency of the input clock of the 8254
+	// programmable interval timer (PIT).
+	PITFrequency = uint64(1193182)
+
+	pitChannel2Port = uint16(0x42)
+	pitCommandPort  = uint16(0x43)
+
+	// pitGatePort controls the gate input of PIT channel 2 (bit 0) and
+	// whether its output drives the PC speaker (bit 1).
+	pitGatePort = uint16(0x61)
+
+	// pitCmdChannel2Periodic selects channel 2, lobyte/hibyte access and
+	// mode 2 (rate generator).
+	pitCmdChannel2Periodic = uint8(0xb4)
+
+	// pitCmdLatchChannel2 latches the current count of channel 2.
+	pitCmdLatchChannel2 = uint8(0x80)
+
+	pitRating = 100
+)
+
+var (
+	// The following functions are used by tests to mock port I/O and are
+	// automatically inlined by the compiler.
+	portReadByteFn  = cpu.PortReadByte
+	portWriteByteFn = cpu.PortWriteByte
+)
+
+// pitClockSource uses channel 2 of the PIT as a 16-bit free-running counter.
+// Channel 2 does not raise interrupts and is always available which makes it
+// suitable as a calibration reference for other clock sources. As its counter
+// wraps every ~55ms, it is the least preferred clock source.
+type pitClockSource struct{}
+
+// init programs channel 2 of the PIT to count continuously.
+func (*pitClockSource) init() {
+	// Enable the channel 2 gate and disconnect the PC speaker
+	portWriteByteFn(pitGatePort, (portReadByteFn(pitGatePort)&^0x02)|0x01)
+
+	// A reload value of 0 selects the maximum counter period (65536)
+	portWriteByteFn(pitCommandPort, pitCmdChannel2Periodic)
+	portWriteByteFn(pitChannel2Port, 0)
+	portWriteByteFn(pitChannel2Port, 0)
+}
+
+// Name returns the name of the clock source.
+func (*pitClockSource) Name() string { return "pit" }
+
+// Rating returns the rating of the clock source.
+func (*pitClockSource) Rating() int { return pitRating }
+
+// Read returns the current counter value. As the PIT counts down, the
+// returned value is the complement of the latched count.
+func (*pitClockSource) Read() uint64 {
+	portWriteByteFn(pitCommandPort, pitCmdLatchChannel2)
+	lo := uint64(portReadByteFn(pitChannel2Port))
+	hi := uint64(portReadByteFn(pitChannel2Port))
+
+	return ^(hi<<8 | lo) & 0xffff
+}
+
+// Mask returns the bitmask for the valid counter bits.
+func (*pitClockSource) Mask() uint64 { return 0xffff }
+
+// Frequency returns the counter frequency.
+func (*pitClockSource) Frequency() uint64 { return PITFrequency }
@@ -0,0 +1,100 @@
+package time
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+// mockPorts replaces the port I/O functions used by the PIT clock source. If
+// nil functions are passed, the original implementations are restored.
+func mockPorts(readFn func(uint16) uint8, writeFn func(uint16, uint8)) {
+	if readFn == nil || writeFn == nil {
+		portReadByteFn = cpu.PortReadByte
+		portWriteByteFn = cpu.PortWriteByte
+		return
+	}
+
+	portReadByteFn = readFn
+	portWriteByteFn = writeFn
+}
+
+type portWrite struct {
+	port uint16
+	val  uint8
+}
+
+func TestPITClockSource(t *testing.T) {
+	defer mockPorts(nil, nil)
+
+	var (
+		writes    []portWrite
+		readQueue []uint8
+	)
+
+	mockPorts(
+		func(port uint16) uint8 {
+			if port == pitGatePort {
+				return 0xfe
+			}
+			val := readQueue[0]
+			readQueue = readQueue[1:]
+			return val
+		},
+		func(port uint16, val uint8) {
+			writes = append(writes, portWrite{port, val})
+		},
+	)
+
+	pit := &pitClockSource{}
+
+	t.Run("init", func(t *testing.T) {
+		writes = nil
+		pit.init()
+
+		exp := []portWrite{
+			{pitGatePort, 0xfd},
+			{pitCommandPort, pitCmdChannel2Periodic},
+			{pitChannel2Port, 0},
+			{pitChannel2Port, 0},
+		}
+
+		if len(writes) != len(exp) {
+			t.Fatalf("expected %d port writes; got %d", len(exp), len(writes))
+		}
+
+		for i := range exp {
+			if writes[i] != exp[i] {
+				t.Errorf("[write %d] expected %v; got %v", i, exp[i], writes[i])
+			}
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		writes = nil
+		readQueue = []uint8{0x34, 0x12}
+
+		if got, exp := pit.Read(), uint64(0xedcb); got != exp {
+			t.Fatalf("expected Read() to return 0x%x; got 0x%x", exp, got)
+		}
+
+		if len(writes) != 1 || writes[0] != (portWrite{pitCommandPort, pitCmdLatchChannel2}) {
+			t.Fatal("expected Read() to latch the channel 2 counter")
+		}
+	})
+
+	if got, exp := pit.Name(), "pit"; got != exp {
+		t.Errorf("expected Name() to return %q; got %q", exp, got)
+	}
+
+	if got, exp := pit.Rating(), pitRating; got != exp {
+		t.Errorf("expected Rating() to return %d; got %d", exp, got)
+	}
+
+	if got, exp := pit.Mask(), uint64(0xffff); got != exp {
+		t.Errorf("expected Mask() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := pit.Frequency(), PITFrequency; got != exp {
+		t.Errorf("expected Frequency() to return %d; got %d", exp, got)
+	}
+}
@@ -0,0 +1,269 @@
+package time
+
+import (
+	"container/heap"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"gopheros/kernel/sync"
+)
+
+const (
+	// retryDelay is the delay (in nanoseconds) before the timer queue is
+	// processed again if the timer interrupt fires while the queue is
+	// locked by the interrupted code.
+	retryDelay = uint64(10000)
+
+	// maxTimers is the maximum number of timers that can be pending at
+	// any time.
+	maxTimers = 64
+)
+
+var (
+	// eventDevice is the device used for scheduling timer events.
+	eventDevice EventDevice
+
+	timerLock  sync.Spinlock
+	timerQueue timerHeap
+
+	// timerPool provides the storage for the timers created by AfterFunc.
+	// Timers are allocated from a fixed pool so that callbacks running in
+	// interrupt context can create new timers without invoking the Go
+	// allocator.
+	timerPool [maxTimers]timer
+
+	errTimerPoolExhausted = &kernel.Error{Module: "time", Message: "timer pool exhausted"}
+)
+
+// EventDevice is implemented by timers that can raise an interrupt after a
+// programmed delay. The highest rated registered device is used for running
+// the callbacks of timers created via AfterFunc.
+type EventDevice interface {
+	// Name returns the name of the device.
+	Name() string
+
+	// Rating returns a value that describes the quality of the device.
+	// When selecting an event device, higher rated devices are preferred.
+	Rating() int
+
+	// Init is invoked once the monotonic clock has been started and
+	// allows the device to calibrate its frequency against Nanotime.
+	Init() *kernel.Error
+
+	// OneShot arms the device so that fn is invoked once after the
+	// specified delay in nanoseconds. Devices may clamp the delay to the
+	// maximum delay they support.
+	OneShot(delay uint64, fn func()) *kernel.Error
+
+	// Periodic arms the device so that fn is invoked every period
+	// nanoseconds.
+	Periodic(period uint64, fn func()) *kernel.Error
+
+	// Stop disarms the device.
+	Stop()
+}
+
+// timer describes a callback that is invoked once its deadline expires.
+type timer struct {
+	// deadline is the value of the monotonic clock when the timer
+	// expires.
+	deadline uint64
+	fn       func()
+
+	// index is the position of the timer in the timer queue or -1 if the
+	// timer is not queued.
+	index int
+
+	// inUse is set while the timer is allocated from the timer pool.
+	inUse bool
+
+	// gen is incremented each time the timer is returned to the timer
+	// pool so that stale Timer handles can be detected.
+	gen uint64
+}
+
+// Timer is a handle to a timer created via AfterFunc. The storage of a timer
+// is reused once the timer fires or is stopped; the handle records the
+// generation of the timer it refers to so that operations on stale handles
+// do not affect newer timers that reuse the same storage.
+type Timer struct {
+	t   *timer
+	gen uint64
+}
+
+// RegisterEventDevice registers a device for scheduling timer events. If a
+// device is already registered, the device with the highest rating is kept.
+func RegisterEventDevice(dev EventDevice) {
+	if eventDevice == nil || dev.Rating() > eventDevice.Rating() {
+		eventDevice = dev
+	}
+}
+
+// initEventDevice initializes the registered event device and arms it for any
+// timers that were created before the monotonic clock was started.
+func initEventDevice() *kernel.Error {
+	if err := eventDevice.Init(); err != nil {
+		return err
+	}
+
+	timerLock.Acquire()
+	err := programEventDevice()
+	timerLock.Release()
+	return err
+}
+
+// AfterFunc creates a timer that invokes fn after the specified delay in
+// nanoseconds has elapsed. The callback runs in interrupt context and must
+// not block. The returned handle can be used to cancel the call. AfterFunc
+// returns an error if maxTimers timers are already pending or if the event
+// device cannot be armed.
+func AfterFunc(delay uint64, fn func()) (Timer, *kernel.Error) {
+	deadline := Nanotime() + delay
+
+	timerLock.Acquire()
+	defer timerLock.Release()
+
+	t := allocTimer()
+	if t == nil {
+		return Timer{}, errTimerPoolExhausted
+	}
+
+	t.deadline, t.fn = deadline, fn
+	heap.Push(&timerQueue, t)
+	if t.index == 0 {
+		if err := programEventDevice(); err != nil {
+			heap.Remove(&timerQueue, t.index)
+			freeTimer(t)
+			return Timer{}, err
+		}
+	}
+
+	return Timer{t: t, gen: t.gen}, nil
+}
+
+// Stop prevents the timer from firing. It returns true if the call stopped
+// the timer or false if the timer already expired or has been stopped.
+func (h Timer) Stop() bool {
+	timerLock.Acquire()
+	defer timerLock.Release()
+
+	if h.t == nil || h.t.gen != h.gen || h.t.index < 0 {
+		return false
+	}
+
+	heap.Remove(&timerQueue, h.t.index)
+	freeTimer(h.t)
+	return true
+}
+
+// allocTimer returns an unused timer from the timer pool or nil if all timers
+// are in use. It must be invoked while holding timerLock.
+func allocTimer() *timer {
+	for i := 0; i < maxTimers; i++ {
+		if t := &timerPool[i]; !t.inUse {
+			t.inUse, t.index = true, -1
+			return t
+		}
+	}
+
+	return nil
+}
+
+// freeTimer returns a timer to the timer pool and invalidates any handles
+// that refer to it. It must be invoked while holding timerLock.
+func freeTimer(t *timer) {
+	t.fn = nil
+	t.inUse = false
+	t.gen++
+}
+
+// programEventDevice arms the event device for the earliest timer deadline.
+// The device is not armed before the monotonic clock is started. It must be
+// invoked while holding timerLock.
+func programEventDevice() *kernel.Error {
+	if eventDevice == nil || clock.source == nil || timerQueue.count == 0 {
+		return nil
+	}
+
+	var delay uint64
+	if now := Nanotime(); timerQueue.timers[0].deadline > now {
+		delay = timerQueue.timers[0].deadline - now
+	}
+
+	return eventDevice.OneShot(delay, handleTimerEvent)
+}
+
+// handleTimerEvent is invoked by the event device and runs the callbacks of
+// all expired timers. Expired timers are processed one at a time so that no
+// memory needs to be allocated while running in interrupt context.
+func handleTimerEvent() {
+	// Timers created by the callbacks are processed by the next event even
+	// if they already expired.
+	now := Nanotime()
+
+	for {
+		// If the interrupted code holds the lock, try again later
+		// instead of deadlocking.
+		if !timerLock.TryToAcquire() {
+			reportEventDeviceError(eventDevice.OneShot(retryDelay, handleTimerEvent))
+			return
+		}
+
+		if timerQueue.count == 0 || timerQueue.timers[0].deadline > now {
+			err := programEventDevice()
+			timerLock.Release()
+			reportEventDeviceError(err)
+			return
+		}
+
+		t := heap.Pop(&timerQueue).(*timer)
+		fn := t.fn
+		freeTimer(t)
+		timerLock.Release()
+
+		// Callbacks are invoked without holding the lock so they can
+		// create new timers.
+		fn()
+	}
+}
+
+// reportEventDeviceError outputs a warning if the event device could not be
+// armed while processing a timer event. As the pending timers will not fire
+// until the device gets armed again, the error cannot be silently ignored.
+func reportEventDeviceError(err *kernel.Error) {
+	if err != nil {
+		kfmt.Printf("[time] unable to arm event device %s: %s\n", eventDevice.Name(), err.Message)
+	}
+}
+
+// timerHeap implements heap.Interface for a fixed-size list of timers ordered
+// by their deadline.
+type timerHeap struct {
+	timers [maxTimers]*timer
+	count  int
+}
+
+func (h *timerHeap) Len() int           { return h.count }
+func (h *timerHeap) Less(i, j int) bool { return h.timers[i].deadline < h.timers[j].deadline }
+
+func (h *timerHeap) Swap(i, j int) {
+	h.timers[i], h.timers[j] = h.timers[j], h.timers[i]
+	h.timers[i].index, h.timers[j].index = i, j
+}
+
+// Push appends a timer to the heap. Callers must ensure that the heap has
+// room for the timer; this is guaranteed as long as the pushed timers are
+// allocated from the timer pool.
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = h.count
+	h.timers[h.count] = t
+	h.count++
+}
+
+func (h *timerHeap) Pop() interface{} {
+	h.count--
+	t := h.timers[h.count]
+	h.timers[h.count] = nil
+	t.index = -1
+	return t
+}
@@ -0,0 +1,322 @@
+package time
+
+import (
+	"bytes"
+	"gopheros/kernel"
+	"gopheros/kernel/kfmt"
+	"strings"
+	"testing"
+)
+
+type mockEventDevice struct {
+	name    string
+	rating  int
+	initErr *kernel.Error
+	armErr  *kernel.Error
+
+	armed  bool
+	delay  uint64
+	fn     func()
+	period uint64
+}
+
+func (d *mockEventDevice) Name() string        { return d.name }
+func (d *mockEventDevice) Rating() int         { return d.rating }
+func (d *mockEventDevice) Init() *kernel.Error { return d.initErr }
+func (d *mockEventDevice) Stop()               { d.armed = false }
+
+func (d *mockEventDevice) OneShot(delay uint64, fn func()) *kernel.Error {
+	if d.armErr != nil {
+		return d.armErr
+	}
+	d.armed, d.delay, d.fn = true, delay, fn
+	return nil
+}
+
+func (d *mockEventDevice) Periodic(period uint64, fn func()) *kernel.Error {
+	d.armed, d.period, d.fn = true, period, fn
+	return nil
+}
+
+func resetTimers() {
+	eventDevice = nil
+	timerQueue = timerHeap{}
+	timerPool = [maxTimers]timer{}
+	timerLock.Release()
+}
+
+// startTestClock starts the monotonic clock using a source that advances by
+// the specified number of nanoseconds each time it is read.
+func startTestClock(step uint64) {
+	clock.switchTo(&mockClockSource{step: step, mask: ^uint64(0)}, NanosecondsPerSecond)
+}
+
+func TestRegisterEventDevice(t *testing.T) {
+	defer resetTimers()
+	resetTimers()
+
+	var (
+		low  = &mockEventDevice{name: "low", rating: 100}
+		high = &mockEventDevice{name: "high", rating: 300}
+	)
+
+	RegisterEventDevice(low)
+	RegisterEventDevice(high)
+	RegisterEventDevice(low)
+
+	if eventDevice != high {
+		t.Fatalf("expected the highest rated event device to be selected; got %q", eventDevice.Name())
+	}
+}
+
+func TestInitEventDevice(t *testing.T) {
+	defer func() {
+		resetClock()
+		resetTimers()
+	}()
+
+	t.Run("success", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+
+		dev := &mockEventDevice{name: "dev"}
+		RegisterEventDevice(dev)
+
+		// A timer created before the clock is started arms the device
+		// once it gets initialized.
+		if _, err := AfterFunc(1000, func() {}); err != nil {
+			t.Fatal(err)
+		}
+		if dev.armed {
+			t.Fatal("expected event device not to be armed before Init")
+		}
+
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			return RegisterClockSource(&mockClockSource{step: 1, mask: ^uint64(0), frequency: NanosecondsPerSecond})
+		}
+		if err := Init(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !dev.armed || dev.delay >= 1000 {
+			t.Fatalf("expected event device to be armed for the pending timer; delay: %d", dev.delay)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		resetClock()
+		resetTimers()
+
+		expErr := &kernel.Error{Module: "test", Message: "calibration failed"}
+		RegisterEventDevice(&mockEventDevice{initErr: expErr})
+
+		registerPlatformClockSourcesFn = func() *kernel.Error {
+			return RegisterClockSource(&mockClockSource{step: 1, mask: ^uint64(0), frequency: NanosecondsPerSecond})
+		}
+		if err := Init(); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+	})
+}
+
+func TestAfterFunc(t *testing.T) {
+	defer func() {
+		resetClock()
+		resetTimers()
+	}()
+	resetClock()
+	resetTimers()
+
+	dev := &mockEventDevice{}
+	RegisterEventDevice(dev)
+	startTestClock(10)
+
+	var fired []int
+	afterFunc := func(delay uint64, fn func()) Timer {
+		timer, err := AfterFunc(delay, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return timer
+	}
+
+	t300 := afterFunc(300, func() { fired = append(fired, 300) })
+	if !dev.armed || dev.delay != 290 {
+		t.Fatalf("expected event device to be armed with a delay of 290; got %d", dev.delay)
+	}
+
+	// Only timers that become the queue head re-arm the device
+	dev.armed = false
+	afterFunc(500, func() { fired = append(fired, 500) })
+	if dev.armed {
+		t.Fatal("expected event device not to be re-armed")
+	}
+
+	t100 := afterFunc(100, func() { fired = append(fired, 100) })
+	if !dev.armed {
+		t.Fatal("expected event device to be re-armed")
+	}
+
+	stopped := afterFunc(200, func() { fired = append(fired, 200) })
+	if !stopped.Stop() {
+		t.Fatal("expected Stop to return true for a pending timer")
+	}
+	if stopped.Stop() {
+		t.Fatal("expected Stop to return false for a stopped timer")
+	}
+
+	// Timers created by callbacks are queued
+	t100.t.fn = func() {
+		fired = append(fired, 100)
+		afterFunc(0, func() { fired = append(fired, 0) })
+	}
+
+	// Advance the clock past the first two deadlines
+	clock.cycles += 340
+	dev.fn()
+
+	if len(fired) != 2 || fired[0] != 100 || fired[1] != 300 {
+		t.Fatalf("expected the timers with deadlines 100 and 300 to fire; got %v", fired)
+	}
+
+	if t300.Stop() {
+		t.Fatal("expected Stop to return false for an expired timer")
+	}
+
+	// The device is re-armed for the timer created by the callback
+	if dev.delay != 0 {
+		t.Fatalf("expected event device to be armed with a delay of 0; got %d", dev.delay)
+	}
+
+	dev.fn()
+	if len(fired) != 3 || fired[2] != 0 {
+		t.Fatalf("expected the timer created by the callback to fire; got %v", fired)
+	}
+
+	t.Run("locked queue", func(t *testing.T) {
+		timerLock.Acquire()
+		dev.delay = 0
+		handleTimerEvent()
+		timerLock.Release()
+
+		if dev.delay != retryDelay {
+			t.Fatalf("expected event device to be re-armed with a delay of %d; got %d", retryDelay, dev.delay)
+		}
+	})
+
+	// The queue is empty and all timers are returned to the pool once
+	// they fire
+	clock.cycles += 1000
+	dev.fn()
+	if timerQueue.count != 0 || len(fired) != 4 || fired[3] != 500 {
+		t.Fatalf("expected all timers to fire; got %v", fired)
+	}
+
+	for i := 0; i < maxTimers; i++ {
+		if timerPool[i].inUse {
+			t.Fatalf("expected timer %d to be returned to the pool", i)
+		}
+	}
+}
+
+func TestAfterFuncPoolExhausted(t *testing.T) {
+	defer resetTimers()
+	resetTimers()
+
+	for i := 0; i < maxTimers; i++ {
+		if _, err := AfterFunc(uint64(i), func() {}); err != nil {
+			t.Fatalf("[timer %d] unexpected error: %v", i, err)
+		}
+	}
+
+	if _, err := AfterFunc(0, func() {}); err != errTimerPoolExhausted {
+		t.Fatalf("expected to get error %v; got %v", errTimerPoolExhausted, err)
+	}
+
+	// Stopping a timer returns it to the pool
+	h := Timer{t: timerQueue.timers[0], gen: timerQueue.timers[0].gen}
+	if !h.Stop() {
+		t.Fatal("expected Stop to return true for a pending timer")
+	}
+	if _, err := AfterFunc(0, func() {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleTimerHandle(t *testing.T) {
+	defer resetTimers()
+	resetTimers()
+
+	stale, err := AfterFunc(100, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stale.Stop() {
+		t.Fatal("expected Stop to return true for a pending timer")
+	}
+
+	// The new timer reuses the storage of the stopped timer
+	cur, err := AfterFunc(100, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.t != stale.t {
+		t.Fatal("expected the new timer to reuse the pool slot of the stopped timer")
+	}
+
+	if stale.Stop() {
+		t.Fatal("expected Stop to return false for a stale handle")
+	}
+	if timerQueue.count != 1 {
+		t.Fatal("expected Stop on a stale handle not to cancel the new timer")
+	}
+	if !cur.Stop() {
+		t.Fatal("expected Stop to return true for a pending timer")
+	}
+
+	if (Timer{}).Stop() {
+		t.Fatal("expected Stop to return false for a zero Timer value")
+	}
+}
+
+func TestEventDeviceArmError(t *testing.T) {
+	defer func() {
+		resetClock()
+		resetTimers()
+		kfmt.SetOutputSink(nil)
+	}()
+	resetClock()
+	resetTimers()
+
+	expErr := &kernel.Error{Module: "test", Message: "device busy"}
+	dev := &mockEventDevice{name: "dev", armErr: expErr}
+	RegisterEventDevice(dev)
+	startTestClock(10)
+
+	t.Run("AfterFunc", func(t *testing.T) {
+		if _, err := AfterFunc(100, func() {}); err != expErr {
+			t.Fatalf("expected to get error %v; got %v", expErr, err)
+		}
+
+		if timerQueue.count != 0 || timerPool[0].inUse {
+			t.Fatal("expected the timer to be returned to the pool")
+		}
+	})
+
+	t.Run("timer event", func(t *testing.T) {
+		var buf bytes.Buffer
+		kfmt.SetOutputSink(&buf)
+
+		dev.armErr = nil
+		if _, err := AfterFunc(100, func() {}); err != nil {
+			t.Fatal(err)
+		}
+
+		dev.armErr = expErr
+		handleTimerEvent()
+
+		if exp := "[time] unable to arm event device dev: device busy"; !strings.Contains(buf.String(), exp) {
+			t.Fatalf("expected output to contain %q; got %q", exp, buf.String())
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package time
+
+import (
+	"gopheros/kernel/cpu"
+	"gopheros/kernel/cpu/features"
+)
+
+const tscRating = 300
+
+var (
+	// The following functions are used by tests to mock calls to the cpu
+	// packages and are automatically inlined by the compiler.
+	cpuidFn      = cpu.ID
+	readTSCFn    = cpu.ReadTSC
+	hasFeatureFn = features.Has
+)
+
+// tscClockSource uses the CPU time-stamp counter. It is only registered if
+// the CPU provides an invariant TSC which ticks at a constant rate regardless
+// of power-management state changes.
+type tscClockSource struct {
+	frequency uint64
+}
+
+// Name returns the name of the clock source.
+func (*tscClockSource) Name() string { return "tsc" }
+
+// Rating returns the rating of the clock source.
+func (*tscClockSource) Rating() int { return tscRating }
+
+// Read returns the current counter value.
+func (*tscClockSource) Read() uint64 { return readTSCFn() }
+
+// Mask returns the bitmask for the valid counter bits.
+func (*tscClockSource) Mask() uint64 { return ^uint64(0) }
+
+// Frequency returns the TSC frequency if it is reported by the CPU or 0 if the
+// TSC must be calibrated.
+func (tsc *tscClockSource) Frequency() uint64 { return tsc.frequency }
+
+// tscFrequency returns the TSC frequency as reported by CPUID leaf 0x15 or 0 if
+// the CPU does not enumerate it.
+func tscFrequency() uint64 {
+	if maxLeaf, _, _, _ := cpuidFn(0); maxLeaf < 0x15 {
+		return 0
+	}
+
+	// EAX and EBX contain the ratio of the TSC frequency to the core
+	// crystal clock frequency which is reported in ECX.
+	denominator, numerator, crystalHz, _ := cpuidFn(0x15)
+	if denominator == 0 || numerator == 0 || crystalHz == 0 {
+		return 0
+	}
+
+	return uint64(crystalHz) * uint64(numerator) / uint64(denominator)
+}
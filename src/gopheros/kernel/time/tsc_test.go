@@ -0,0 +1,71 @@
+package time
+
+import (
+	"gopheros/kernel/cpu"
+	"testing"
+)
+
+var cpuIDFnOrig = cpu.ID
+
+// mockCPUID returns a CPUID implementation which reports the specified values
+// for leaf 0x15.
+func mockCPUID(maxLeaf, denominator, numerator, crystalHz uint32) func(uint32) (uint32, uint32, uint32, uint32) {
+	return func(leaf uint32) (uint32, uint32, uint32, uint32) {
+		switch leaf {
+		case 0:
+			return maxLeaf, 0, 0, 0
+		case 0x15:
+			return denominator, numerator, crystalHz, 0
+		}
+		return 0, 0, 0, 0
+	}
+}
+
+func TestTSCFrequency(t *testing.T) {
+	defer func() { cpuidFn = cpuIDFnOrig }()
+
+	specs := []struct {
+		maxLeaf, denominator, numerator, crystalHz uint32
+		exp                                        uint64
+	}{
+		{0x14, 2, 100, 24000000, 0},
+		{0x15, 0, 100, 24000000, 0},
+		{0x15, 2, 0, 24000000, 0},
+		{0x15, 2, 100, 0, 0},
+		{0x16, 2, 176, 24000000, 2112000000},
+	}
+
+	for specIndex, spec := range specs {
+		cpuidFn = mockCPUID(spec.maxLeaf, spec.denominator, spec.numerator, spec.crystalHz)
+		if got := tscFrequency(); got != spec.exp {
+			t.Errorf("[spec %d] expected tscFrequency() to return %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestTSCClockSource(t *testing.T) {
+	defer func() { readTSCFn = cpu.ReadTSC }()
+
+	readTSCFn = func() uint64 { return 0xdeadbeef }
+
+	tsc := &tscClockSource{frequency: 1000}
+	if got, exp := tsc.Name(), "tsc"; got != exp {
+		t.Errorf("expected Name() to return %q; got %q", exp, got)
+	}
+
+	if got, exp := tsc.Rating(), tscRating; got != exp {
+		t.Errorf("expected Rating() to return %d; got %d", exp, got)
+	}
+
+	if got, exp := tsc.Read(), uint64(0xdeadbeef); got != exp {
+		t.Errorf("expected Read() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := tsc.Mask(), ^uint64(0); got != exp {
+		t.Errorf("expected Mask() to return 0x%x; got 0x%x", exp, got)
+	}
+
+	if got, exp := tsc.Frequency(), uint64(1000); got != exp {
+		t.Errorf("expected Frequency() to return %d; got %d", exp, got)
+	}
+}
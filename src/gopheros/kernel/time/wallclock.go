@@ -0,0 +1,44 @@
+package time
+
+import "sync/atomic"
+
+const secondsPerDay = 24 * 60 * 60
+
+var (
+	// bootWallClock is the wall-clock time (in nanoseconds since the Unix
+	// epoch) when the monotonic clock was started.
+	bootWallClock int64
+)
+
+// SetWallClock sets the current wall-clock time to the specified number of
+// seconds and nanoseconds since the Unix epoch. The wall clock is advanced
+// using the monotonic clock.
+func SetWallClock(sec int64, nsec int32) {
+	atomic.StoreInt64(&bootWallClock, sec*int64(NanosecondsPerSecond)+int64(nsec)-int64(Nanotime()))
+}
+
+// Now returns the current wall-clock time as the number of seconds and
+// nanoseconds elapsed since the Unix epoch. If SetWallClock has not been
+// invoked, Now returns the time elapsed since the monotonic clock was started.
+func Now() (int64, int32) {
+	now := atomic.LoadInt64(&bootWallClock) + int64(Nanotime())
+	return now / int64(NanosecondsPerSecond), int32(now % int64(NanosecondsPerSecond))
+}
+
+// UnixSeconds converts a UTC date and time to the number of seconds elapsed
+// since the Unix epoch. Months and days are 1-based.
+func UnixSeconds(year, month, day, hour, minute, second int) int64 {
+	// Count the days since 0000-03-01 so that the leap day is the last
+	// day of each (shifted) year.
+	if month <= 2 {
+		year--
+		month += 12
+	}
+
+	days := int64(365*year + year/4 - year/100 + year/400 + (153*(month-3)+2)/5 + day - 1)
+
+	// 719468 is the number of days from 0000-03-01 to 1970-01-01.
+	days -= 719468
+
+	return days*secondsPerDay + int64(hour*3600+minute*60+second)
+}
@@ -0,0 +1,50 @@
+package time
+
+import "testing"
+
+func TestUnixSeconds(t *testing.T) {
+	specs := []struct {
+		year, month, day, hour, minute, second int
+		exp                                    int64
+	}{
+		{1970, 1, 1, 0, 0, 0, 0},
+		{1970, 1, 2, 0, 0, 1, 86401},
+		{2000, 2, 29, 12, 0, 0, 951825600},
+		{2000, 3, 1, 0, 0, 0, 951868800},
+		{2038, 1, 19, 3, 14, 8, 2147483648},
+		{2100, 12, 31, 23, 59, 59, 4133980799},
+	}
+
+	for specIndex, spec := range specs {
+		if got := UnixSeconds(spec.year, spec.month, spec.day, spec.hour, spec.minute, spec.second); got != spec.exp {
+			t.Errorf("[spec %d] expected UnixSeconds to return %d; got %d", specIndex, spec.exp, got)
+		}
+	}
+}
+
+func TestWallClock(t *testing.T) {
+	defer func() {
+		resetClock()
+		bootWallClock = 0
+	}()
+	resetClock()
+
+	// Before the monotonic clock is started, Now returns the seeded value
+	SetWallClock(1500000000, 250)
+	if sec, nsec := Now(); sec != 1500000000 || nsec != 250 {
+		t.Fatalf("expected Now() to return (1500000000, 250); got (%d, %d)", sec, nsec)
+	}
+
+	// Advance the monotonic clock by 1.5 seconds
+	source := &mockClockSource{step: 1500, mask: ^uint64(0)}
+	clock.switchTo(source, 1000)
+	if sec, nsec := Now(); sec != 1500000001 || nsec != 500000250 {
+		t.Fatalf("expected Now() to return (1500000001, 500000250); got (%d, %d)", sec, nsec)
+	}
+
+	// Re-seeding the wall clock takes the monotonic clock into account
+	SetWallClock(1600000000, 0)
+	if sec, nsec := Now(); sec != 1600000001 || nsec != 500000000 {
+		t.Fatalf("expected Now() to return (1600000001, 500000000); got (%d, %d)", sec, nsec)
+	}
+}
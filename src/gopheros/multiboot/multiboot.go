@@ -9,6 +9,10 @@ import (
 var (
 	infoData  uintptr
 	cmdLineKV map[string]string
+
+	// relocatedInfo holds the copy of the multiboot info data created by
+	// RelocateInfo.
+	relocatedInfo []byte
 )
 
 type tagType uint32
@@ -276,6 +280,26 @@ func SetInfoPtr(ptr uintptr) {
 	infoData = ptr
 }
 
+// RelocateInfo copies the multiboot info data to a buffer allocated by the Go
+// allocator and updates the internal multiboot information pointer to point to
+// the copy. This allows the kernel to reuse the memory that holds the original
+// data. RelocateInfo returns the address and size of the original data. This
+// function must only be invoked after bootstrapping the memory allocator.
+func RelocateInfo() (uintptr, uintptr) {
+	origData := infoData
+	size := uintptr((*info)(unsafe.Pointer(infoData)).totalSize)
+
+	relocatedInfo = make([]byte, size)
+	copy(relocatedInfo, *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{
+		Len:  int(size),
+		Cap:  int(size),
+		Data: origData,
+	})))
+
+	infoData = uintptr(unsafe.Pointer(&relocatedInfo[0]))
+	return origData, size
+}
+
 // VisitMemRegions will invoke the supplied visitor for each memory region that
 // is defined by the multiboot info data that we received from the bootloader.
 func VisitMemRegions(visitor MemRegionVisitor) {
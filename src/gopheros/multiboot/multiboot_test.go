@@ -251,6 +251,36 @@ func TestGetElfSections(t *testing.T) {
 	}
 }
 
+func TestRelocateInfo(t *testing.T) {
+	defer func() {
+		relocatedInfo = nil
+	}()
+
+	origPtr := uintptr(unsafe.Pointer(&multibootInfoTestData[0]))
+	SetInfoPtr(origPtr)
+
+	addr, size := RelocateInfo()
+	if addr != origPtr {
+		t.Fatalf("expected RelocateInfo to return the original data address 0x%x; got 0x%x", origPtr, addr)
+	}
+
+	if exp := uintptr(binary.LittleEndian.Uint32(multibootInfoTestData)); size != exp {
+		t.Fatalf("expected RelocateInfo to return size %d; got %d", exp, size)
+	}
+
+	if infoData == origPtr {
+		t.Fatal("expected info pointer to be updated")
+	}
+
+	if !bytes.Equal(relocatedInfo, multibootInfoTestData[:size]) {
+		t.Fatal("expected relocated data to match the original data")
+	}
+
+	if _, tagSize := findTagByType(tagMemoryMap); tagSize != 152 {
+		t.Fatalf("expected to locate memory map tag in the relocated data")
+	}
+}
+
 var (
 	emptyInfoData = []byte{
 		0, 0, 0, 0, // size
@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
 	"io"
@@ -31,13 +32,24 @@ func exit(err error) {
 }
 
 func collectGoFiles(root string) ([]string, error) {
+	// Skip files excluded by build constraints (e.g. implementations that
+	// target different go versions) when building the kernel.
+	buildCtx := build.Default
+	buildCtx.GOOS, buildCtx.GOARCH = "linux", "amd64"
+
 	var goFiles []string
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return err
 		}
 
-		if filepath.Ext(path) == ".go" && !strings.Contains(path, "_test") {
+		if filepath.Ext(path) != ".go" || strings.Contains(path, "_test") {
+			return err
+		}
+
+		if match, matchErr := buildCtx.MatchFile(filepath.Dir(path), info.Name()); matchErr != nil {
+			return matchErr
+		} else if match {
 			goFiles = append(goFiles, path)
 		}
 